@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// newAPIServer serves the API as main does, under /api/v1 and the
+// deprecated /api aliases.
+func newAPIServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	r := mux.NewRouter()
+	registerAPI(r.PathPrefix("/api/v1").Subrouter())
+	legacy := r.PathPrefix("/api").Subrouter()
+	legacy.Use(deprecatedAPI)
+	registerAPI(legacy)
+	srv := httptest.NewServer(withRequestID(r))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// TestLegacyStatusShape checks that the deprecated paths keep keying
+// downloads by URL with progress always present, over HTTP and the
+// websocket, while /api/v1 keys them by ID.
+func TestLegacyStatusShape(t *testing.T) {
+	const id, url = "legacyshape", "https://example.com/legacy-shape.iso"
+	trackDownload(t, id, url, t.TempDir())
+	srv := newAPIServer(t)
+
+	get := func(path string) map[string]map[string]interface{} {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var status map[string]map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		return status
+	}
+	ws := func(path string) map[string]map[string]interface{} {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		var status map[string]map[string]interface{}
+		if err := conn.ReadJSON(&status); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		return status
+	}
+
+	for name, status := range map[string]map[string]map[string]interface{}{
+		"/api/status": get("/api/status"),
+		"/api/ws":     ws("/api/ws"),
+	} {
+		download, ok := status[url]
+		if !ok {
+			t.Errorf("%s: no entry keyed by %s", name, url)
+			continue
+		}
+		if progress, ok := download["progress"].(float64); !ok || progress != 0 {
+			t.Errorf("%s: progress = %v; want 0", name, download["progress"])
+		}
+	}
+	for name, status := range map[string]map[string]map[string]interface{}{
+		"/api/v1/status": get("/api/v1/status"),
+		"/api/v1/ws":     ws("/api/v1/ws"),
+	} {
+		download, ok := status[id]
+		if !ok {
+			t.Errorf("%s: no entry keyed by %s", name, id)
+			continue
+		}
+		if _, ok := download["progress"]; ok {
+			t.Errorf("%s: progress = %v; want it omitted while the size is unknown", name, download["progress"])
+		}
+	}
+}
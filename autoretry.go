@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+var (
+	maxAttempts  = flag.Int("max-attempts", 3, "times a download is tried before it fails, retrying network errors and 5xx responses (1 = no retries)")
+	retryBackoff = flag.Duration("retry-backoff", 2*time.Second, "wait before the first automatic retry, doubled for each one after")
+)
+
+// maxRetryBackoff caps the wait between automatic retries.
+const maxRetryBackoff = 5 * time.Minute
+
+// attemptLimit is how many times the download may be tried. A request's
+// own maxAttempts replaces -max-attempts.
+func (o downloadOptions) attemptLimit() int {
+	if o.maxAttempts > 0 {
+		return o.maxAttempts
+	}
+	return max(*maxAttempts, 1)
+}
+
+// retryableError reports whether err is worth trying again: a network
+// error, a body cut short, a 5xx, 408 or 429 response or a 4xx FTP
+// reply. Errors yad raised itself, such as a checksum mismatch or the
+// circuit breaker, aren't, except a stall. A download whose mirrors all failed is tried
+// again if any of them might work next time.
+func retryableError(err error) bool {
+	var mirrors *mirrorError
+	if errors.As(err, &mirrors) {
+		return slices.ContainsFunc(mirrors.errs, retryableError)
+	}
+	var derr *downloadError
+	if errors.As(err, &derr) {
+		return derr.code == "stalled"
+	}
+	var status *httpStatusError
+	if errors.As(err, &status) {
+		return status.code >= 500 || status.code == http.StatusRequestTimeout || status.code == http.StatusTooManyRequests
+	}
+	var reply *ftpReplyError
+	if errors.As(err, &reply) {
+		return reply.code >= 400 && reply.code < 500
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+	// url.Error is a net.Error itself; what it wraps decides, so a bad
+	// certificate or an unsupported scheme isn't retried.
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// retryDelay is the wait before retry number n (from 1): -retry-backoff
+// doubled n-1 times, capped, with up to half of it taken off at random
+// so downloads that failed together don't retry together.
+func retryDelay(n int) time.Duration {
+	d := *retryBackoff << min(n-1, 20)
+	if d <= 0 || d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// setAttempt records which try of how many download id is on.
+func setAttempt(id string, attempt, limit int) {
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[id]; exists {
+		download.Attempt = attempt
+		download.MaxAttempts = limit
+		download.RetryAt = nil
+	}
+	downloadsMutex.Unlock()
+}
+
+// awaitRetry shows download id as retrying after err until the backoff
+// for retry n has passed, returning false if ctx ends first.
+func awaitRetry(ctx context.Context, id string, n, limit int, err error) bool {
+	wait := retryDelay(n)
+	at := time.Now().Add(wait).Round(time.Second)
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[id]; exists {
+		download.Status = "retrying"
+		download.Error = err.Error()
+		download.RetryAt = &at
+		clearSpeed(download)
+	}
+	downloadsMutex.Unlock()
+	addDownloadEvent(id, "retrying", fmt.Sprintf("attempt %d of %d failed: %v; retrying in %s", n, limit, err, wait.Round(time.Second)))
+	broadcastStatus()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
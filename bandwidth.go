@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	classForeground = "foreground"
+	classBackground = "background"
+
+	// shaperBurst is how many seconds of its rate a class can save up
+	// while idle.
+	shaperBurst = 0.5
+	// shaperMinRead keeps reads from shrinking to a few bytes when a
+	// class's rate is tiny.
+	shaperMinRead = 1 << 10
+)
+
+var (
+	maxBandwidth    = flag.Int64("max-bandwidth", envBandwidth(), "bytes/sec shared by all HTTP downloads, also YAD_MAX_BANDWIDTH (0 = unlimited)")
+	backgroundShare = flag.Int("background-share", 20, "percent of -max-bandwidth reserved for background downloads; foreground downloads get the rest")
+)
+
+// checkClass normalizes a bandwidth class, defaulting to foreground.
+// envBandwidth is the default of -max-bandwidth.
+func envBandwidth() int64 {
+	value := os.Getenv("YAD_MAX_BANDWIDTH")
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		log.Fatalf("Invalid YAD_MAX_BANDWIDTH %q: want bytes/sec", value)
+	}
+	return n
+}
+
+func checkClass(class string) (string, error) {
+	switch class {
+	case "", classForeground:
+		return classForeground, nil
+	case classBackground:
+		return classBackground, nil
+	}
+	return "", fmt.Errorf("unknown class %q (want foreground or background)", class)
+}
+
+// classShaper splits the global bandwidth limit between foreground and
+// background downloads. Each class has a token bucket refilled at its
+// share of the limit; whatever a class can't use because it is idle or
+// its bucket is full goes to the other class.
+type classShaper struct {
+	mu sync.Mutex
+	// The limit in bytes/sec (0 = unlimited) and the background
+	// class's percentage of it, changeable at runtime.
+	limit   int64
+	bgShare int
+
+	last    time.Time
+	tokens  map[string]float64
+	active  map[string]int       // running transfers per class
+	classes map[string]string    // class of each running download
+	caps    map[string]*speedCap // running downloads with a maxSpeed
+
+	// Bytes per class since windowStart, and the rate measured over
+	// the previous window.
+	window      map[string]int64
+	windowStart time.Time
+	rates       map[string]int64
+}
+
+var shaper = &classShaper{
+	tokens:  make(map[string]float64),
+	active:  make(map[string]int),
+	classes: make(map[string]string),
+	caps:    make(map[string]*speedCap),
+	window:  make(map[string]int64),
+	rates:   make(map[string]int64),
+}
+
+// shares returns each class's current part of the limit: the configured
+// split while both classes are transferring, everything for the only
+// busy one otherwise. The caller must hold s.mu.
+func (s *classShaper) shares() map[string]float64 {
+	bg := float64(s.bgShare) / 100
+	switch {
+	case s.active[classBackground] == 0 && s.active[classForeground] > 0:
+		bg = 0
+	case s.active[classForeground] == 0 && s.active[classBackground] > 0:
+		bg = 1
+	}
+	return map[string]float64{classForeground: 1 - bg, classBackground: bg}
+}
+
+// refill adds the tokens earned since the last call. The caller must
+// hold s.mu.
+func (s *classShaper) refill(now time.Time, limit int64) {
+	elapsed := min(max(now.Sub(s.last).Seconds(), 0), 1)
+	s.last = now
+	shares := s.shares()
+	var spill float64
+	for _, class := range []string{classForeground, classBackground} {
+		capacity := float64(limit) * shares[class] * shaperBurst
+		if shares[class] > 0 {
+			capacity = max(capacity, shaperMinRead)
+		}
+		s.tokens[class] += float64(limit) * shares[class] * elapsed
+		if s.tokens[class] > capacity {
+			spill += s.tokens[class] - capacity
+			s.tokens[class] = capacity
+		}
+	}
+	// Lend what overflowed to whichever class has room.
+	for _, class := range []string{classForeground, classBackground} {
+		if spill <= 0 {
+			break
+		}
+		room := float64(limit)*shaperBurst - s.tokens[class]
+		if s.active[class] == 0 || room <= 0 {
+			continue
+		}
+		lent := min(room, spill)
+		s.tokens[class] += lent
+		spill -= lent
+	}
+}
+
+// configure sets the limit and background share, taking effect on
+// transfers already running.
+func (s *classShaper) configure(limit int64, bgShare int) {
+	s.mu.Lock()
+	s.limit, s.bgShare = limit, bgShare
+	s.mu.Unlock()
+}
+
+// take waits until download id may read some bytes and returns how
+// many, at most n.
+func (s *classShaper) take(ctx context.Context, id string, n int) (int, error) {
+	for {
+		s.mu.Lock()
+		limit := s.limit
+		class, ok := s.classes[id]
+		if !ok {
+			s.mu.Unlock()
+			return n, nil
+		}
+		now := time.Now()
+		wait := 10 * time.Millisecond
+		// The download's own cap comes first; what it reads is charged
+		// to it by count.
+		if c := s.caps[id]; c != nil {
+			c.refill(now)
+			if c.tokens < min(float64(n), shaperMinRead) {
+				s.mu.Unlock()
+				wait = max(wait, time.Duration(float64(shaperMinRead)/float64(c.rate)*float64(time.Second)))
+				select {
+				case <-time.After(min(wait, time.Second)):
+				case <-ctx.Done():
+					return 0, ctx.Err()
+				}
+				continue
+			}
+			n = min(n, int(c.tokens))
+		}
+		if limit <= 0 {
+			s.mu.Unlock()
+			return n, nil
+		}
+		s.refill(now, limit)
+		if avail := s.tokens[class]; avail >= min(float64(n), shaperMinRead) {
+			allowed := min(n, int(avail))
+			s.tokens[class] -= float64(allowed)
+			s.mu.Unlock()
+			return allowed, nil
+		}
+		rate := float64(limit) * s.shares()[class]
+		s.mu.Unlock()
+
+		if rate > 0 {
+			wait = max(wait, time.Duration(float64(shaperMinRead)/rate*float64(time.Second)))
+		}
+		select {
+		case <-time.After(min(wait, time.Second)):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// count records n bytes read by download id, out of the granted bytes
+// it took, for the throughput report. The rest are handed back.
+func (s *classShaper) count(id string, n, granted int) {
+	s.mu.Lock()
+	class := s.classes[id]
+	if c := s.caps[id]; c != nil {
+		c.tokens -= float64(n)
+	}
+	if s.limit > 0 && granted > n {
+		s.tokens[class] += float64(granted - n)
+	}
+	s.window[class] += int64(n)
+	s.roll(time.Now())
+	s.mu.Unlock()
+}
+
+// roll closes the measuring window once it is a second old. The caller
+// must hold s.mu.
+func (s *classShaper) roll(now time.Time) {
+	elapsed := now.Sub(s.windowStart)
+	if elapsed < time.Second {
+		return
+	}
+	for _, class := range []string{classForeground, classBackground} {
+		rate := int64(0)
+		if elapsed < 2*time.Second {
+			rate = int64(float64(s.window[class]) / elapsed.Seconds())
+		}
+		s.rates[class] = rate
+		s.window[class] = 0
+	}
+	s.windowStart = now
+}
+
+// start registers a running transfer for download id in class, capped
+// at maxSpeed bytes/sec unless that is 0; reads are only shaped for
+// registered downloads. It returns a function that unregisters it.
+func (s *classShaper) start(id, class string, maxSpeed int64) func() {
+	s.mu.Lock()
+	s.classes[id] = class
+	s.active[class]++
+	if maxSpeed > 0 {
+		s.caps[id] = &speedCap{rate: maxSpeed, last: time.Now()}
+	}
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		s.active[s.classes[id]]--
+		delete(s.classes, id)
+		delete(s.caps, id)
+		s.mu.Unlock()
+	}
+}
+
+// speedCap is the token bucket of a download with its own maxSpeed. It
+// may run into debt when concurrent reads overshoot, which later reads
+// wait off.
+type speedCap struct {
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func (c *speedCap) refill(now time.Time) {
+	elapsed := min(max(now.Sub(c.last).Seconds(), 0), 1)
+	c.last = now
+	c.tokens = min(c.tokens+float64(c.rate)*elapsed, max(float64(c.rate)*shaperBurst, shaperMinRead))
+}
+
+// setClass moves a running download to class.
+func (s *classShaper) setClass(id, class string) {
+	s.mu.Lock()
+	if old, ok := s.classes[id]; ok {
+		s.active[old]--
+		s.active[class]++
+		s.classes[id] = class
+	}
+	s.mu.Unlock()
+}
+
+type classStats struct {
+	Active      int     `json:"active"`
+	BytesPerSec int64   `json:"bytesPerSec"`
+	Share       float64 `json:"share"`
+}
+
+type bandwidthStats struct {
+	Limit           int64                 `json:"limit"`
+	BackgroundShare int                   `json:"backgroundShare"`
+	Classes         map[string]classStats `json:"classes"`
+}
+
+func (s *classShaper) stats() bandwidthStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roll(time.Now())
+	shares := s.shares()
+	stats := bandwidthStats{Limit: s.limit, BackgroundShare: s.bgShare, Classes: make(map[string]classStats)}
+	for _, class := range []string{classForeground, classBackground} {
+		stats.Classes[class] = classStats{Active: s.active[class], BytesPerSec: s.rates[class], Share: shares[class]}
+	}
+	return stats
+}
+
+// shapedReader reads at the pace the shaper allows the download's class.
+type shapedReader struct {
+	ctx context.Context
+	id  string
+	r   io.Reader
+}
+
+// shapeReader wraps r for the download whose key is on ctx.
+func shapeReader(ctx context.Context, r io.Reader) io.Reader {
+	return &shapedReader{ctx: ctx, id: downloadKeyFrom(ctx), r: r}
+}
+
+func (sr *shapedReader) Read(p []byte) (int, error) {
+	granted, err := shaper.take(sr.ctx, sr.id, len(p))
+	if err != nil {
+		return 0, err
+	}
+	n, err := sr.r.Read(p[:granted])
+	shaper.count(sr.id, n, granted)
+	return n, err
+}
+
+// downloadClass returns the class recorded for download id.
+func downloadClass(id string) string {
+	downloadsMutex.Lock()
+	defer downloadsMutex.Unlock()
+	if download, exists := activeDownloads[id]; exists && download.Class != "" {
+		return download.Class
+	}
+	return classForeground
+}
+
+// handlePatchClass moves a download to another bandwidth class, taking
+// effect immediately if it is running.
+func handlePatchClass(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID    string `json:"id"`
+		Class string `json:"class"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	class, err := checkClass(req.Class)
+	if err != nil || req.Class == "" {
+		httpError(w, r, "class must be foreground or background", http.StatusBadRequest)
+		return
+	}
+
+	downloadsMutex.Lock()
+	download, exists := activeDownloads[req.ID]
+	if exists {
+		download.Class = class
+	}
+	downloadsMutex.Unlock()
+	if !exists {
+		httpError(w, r, "Download not found", http.StatusNotFound)
+		return
+	}
+	shaper.setClass(req.ID, class)
+	broadcastStatus()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": req.ID, "class": class})
+}
+
+// handlePatchSettings changes the bandwidth limit and background share
+// at runtime; in-flight transfers speed up or slow down on their next
+// read. Fields left out keep their current value.
+func handlePatchSettings(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MaxBandwidth    *int64 `json:"maxBandwidth"`
+		BackgroundShare *int   `json:"backgroundShare"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.MaxBandwidth == nil && req.BackgroundShare == nil {
+		httpError(w, r, "Nothing to change: set maxBandwidth or backgroundShare", http.StatusBadRequest)
+		return
+	}
+	if req.MaxBandwidth != nil && *req.MaxBandwidth < 0 {
+		httpError(w, r, "maxBandwidth must not be negative (0 = unlimited)", http.StatusBadRequest)
+		return
+	}
+	if req.BackgroundShare != nil && (*req.BackgroundShare < 0 || *req.BackgroundShare > 100) {
+		httpError(w, r, "backgroundShare must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+
+	shaper.mu.Lock()
+	if req.MaxBandwidth != nil {
+		shaper.limit = *req.MaxBandwidth
+	}
+	if req.BackgroundShare != nil {
+		shaper.bgShare = *req.BackgroundShare
+	}
+	limit, share := shaper.limit, shaper.bgShare
+	shaper.mu.Unlock()
+	log.Printf("Bandwidth limit set to %d bytes/sec, background share %d%%", limit, share)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"maxBandwidth": limit, "backgroundShare": share})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// BasicAuth is a username and password sent as HTTP Basic
+// authentication, or in answer to a Digest challenge.
+type BasicAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (a BasicAuth) userinfo() *url.Userinfo {
+	return url.UserPassword(a.Username, a.Password)
+}
+
+// takeUserinfo removes the user:pass@ part from an HTTP, FTP or SFTP URL,
+// returning the URL without it and the credentials, if there were any.
+func takeUserinfo(rawURL string) (string, *BasicAuth) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "ftp" && u.Scheme != "sftp") {
+		return rawURL, nil
+	}
+	password, _ := u.User.Password()
+	auth := &BasicAuth{Username: u.User.Username(), Password: password}
+	u.User = nil
+	return u.String(), auth
+}
+
+// checkBasicAuth validates a request's credentials and returns those of
+// each URL that gets any: its own from basicAuth, or else the
+// request-wide username and password. Magnet links are left out.
+func checkBasicAuth(req DownloadRequest) (map[string]BasicAuth, error) {
+	urls := append([]string(nil), req.URLs...)
+	for _, entry := range req.Entries {
+		if entry.HTTPFallback != "" {
+			urls = append(urls, entry.HTTPFallback)
+		}
+	}
+	urls = append(urls, mirrorURLs(req)...)
+	if req.Password != "" && req.Username == "" {
+		return nil, fmt.Errorf("password given without a username")
+	}
+	if strings.Contains(req.Username, ":") {
+		return nil, fmt.Errorf("username must not contain a colon")
+	}
+	for url, auth := range req.BasicAuth {
+		if !slices.Contains(urls, url) {
+			return nil, fmt.Errorf("basicAuth given for %s, which is not in urls", url)
+		}
+		if strings.HasPrefix(url, "magnet:") {
+			return nil, fmt.Errorf("credentials can't be used with magnet links: %s", url)
+		}
+		if auth.Username == "" || strings.Contains(auth.Username, ":") {
+			return nil, fmt.Errorf("basicAuth for %s needs a username without a colon", url)
+		}
+	}
+
+	byURL := make(map[string]BasicAuth)
+	for _, url := range urls {
+		if auth, ok := req.BasicAuth[url]; ok {
+			byURL[url] = auth
+		} else if req.Username != "" && !strings.HasPrefix(url, "magnet:") {
+			byURL[url] = BasicAuth{Username: req.Username, Password: req.Password}
+		}
+	}
+	return byURL, nil
+}
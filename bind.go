@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+var (
+	bindSpec        = flag.String("bind", "", "network interface (e.g. wg0) or source IP for all outgoing download traffic")
+	httpBindSpec    = flag.String("http-bind", "", "interface or source IP for HTTP downloads, overriding -bind")
+	torrentBindSpec = flag.String("torrent-bind", "", "interface or source IP for the torrent client, overriding -bind")
+	bindRequired    = flag.Bool("bind-required", false, "pause all transfers while a bound interface has no address instead of falling back to the default route")
+)
+
+const bindCheckInterval = 5 * time.Second
+
+// bindState is the current state of one protocol's outgoing binding.
+type bindState struct {
+	Spec      string    `json:"spec"`
+	Interface string    `json:"interface,omitempty"`
+	Address   string    `json:"address,omitempty"`
+	Up        bool      `json:"up"`
+	Error     string    `json:"error,omitempty"`
+	Since     time.Time `json:"since"`
+
+	ip net.IP
+}
+
+var (
+	bindings   = make(map[string]*bindState) // by protocol: "http", "torrent"
+	bindingsMu sync.Mutex
+
+	// boundTorrents are the running torrents, paused while a required
+	// binding is down.
+	boundTorrents = make(map[*torrent.Torrent]string)
+)
+
+// initBind resolves the configured bindings and keeps them current. It
+// must run after flag.Parse.
+func initBind() {
+	for proto, spec := range map[string]string{"http": *httpBindSpec, "torrent": *torrentBindSpec} {
+		if spec == "" {
+			spec = *bindSpec
+		}
+		if spec != "" {
+			bindings[proto] = &bindState{Spec: spec}
+		}
+	}
+	if len(bindings) == 0 {
+		return
+	}
+	refreshBind()
+	go func() {
+		for range time.Tick(bindCheckInterval) {
+			refreshBind()
+		}
+	}()
+}
+
+func refreshBind() {
+	bindingsMu.Lock()
+	changed := false
+	for proto, b := range bindings {
+		iface, ip, err := resolveBind(b.Spec)
+		up := err == nil
+		if up != b.Up || !ip.Equal(b.ip) || b.Since.IsZero() {
+			changed = true
+			b.Since = time.Now()
+			switch {
+			case up:
+				log.Printf("Binding %s traffic to %s (%s)", proto, ip, iface)
+			case *bindRequired:
+				log.Printf("Bound interface for %s traffic is unavailable, pausing transfers: %v", proto, err)
+			default:
+				log.Printf("Bound interface for %s traffic is unavailable, using the default route: %v", proto, err)
+			}
+		}
+		b.Interface, b.ip, b.Up = iface, ip, up
+		b.Address, b.Error = "", ""
+		if up {
+			b.Address = ip.String()
+		} else {
+			b.Error = err.Error()
+		}
+	}
+	if changed && *bindRequired {
+		down := bindBlockedLocked()
+		for t, key := range boundTorrents {
+			pauseTorrent(t, key, down)
+		}
+	}
+	bindingsMu.Unlock()
+}
+
+// resolveBind finds the interface and source address for spec, an
+// interface name or an IP address. IPv4 addresses are preferred.
+func resolveBind(spec string) (string, net.IP, error) {
+	if ip := net.ParseIP(spec); ip != nil {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			return "", nil, err
+		}
+		for _, ifi := range ifaces {
+			addrs, _ := ifi.Addrs()
+			for _, addr := range addrs {
+				if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+					if ifi.Flags&net.FlagUp == 0 {
+						return ifi.Name, nil, fmt.Errorf("interface %s is down", ifi.Name)
+					}
+					return ifi.Name, ip, nil
+				}
+			}
+		}
+		return "", nil, fmt.Errorf("no interface has address %s", ip)
+	}
+
+	ifi, err := net.InterfaceByName(spec)
+	if err != nil {
+		return spec, nil, err
+	}
+	if ifi.Flags&net.FlagUp == 0 {
+		return spec, nil, fmt.Errorf("interface %s is down", spec)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return spec, nil, err
+	}
+	var v6 net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return spec, ipnet.IP, nil
+		}
+		if v6 == nil {
+			v6 = ipnet.IP
+		}
+	}
+	if v6 != nil {
+		return spec, v6, nil
+	}
+	return spec, nil, fmt.Errorf("interface %s has no address", spec)
+}
+
+// boundDialer returns the dialer for proto's outgoing connections.
+func boundDialer(proto string) (*net.Dialer, error) {
+	bindingsMu.Lock()
+	b, ok := bindings[proto]
+	var ip net.IP
+	var up bool
+	if ok {
+		ip, up = b.ip, b.Up
+	}
+	bindingsMu.Unlock()
+
+	switch {
+	case !ok:
+		return baseDialer, nil
+	case up:
+		d := *baseDialer
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+		return &d, nil
+	case *bindRequired:
+		return nil, &downloadError{code: "bind_down", err: fmt.Errorf("bound interface %s is unavailable", b.Spec)}
+	}
+	return baseDialer, nil
+}
+
+// bindBlocked reports whether transfers are paused because a required
+// binding is down.
+func bindBlocked() bool {
+	bindingsMu.Lock()
+	defer bindingsMu.Unlock()
+	return bindBlockedLocked()
+}
+
+func bindBlockedLocked() bool {
+	if !*bindRequired {
+		return false
+	}
+	for _, b := range bindings {
+		if !b.Up {
+			return true
+		}
+	}
+	return false
+}
+
+// applyTorrentBind makes the torrent client listen on, and dial peers,
+// trackers and web seeds from, the bound address.
+func applyTorrentBind(cfg *torrent.ClientConfig) error {
+	bindingsMu.Lock()
+	b, ok := bindings["torrent"]
+	bindingsMu.Unlock()
+	if !ok {
+		return nil
+	}
+	dialer, err := boundDialer("torrent")
+	if err != nil {
+		return err
+	}
+	if dialer.LocalAddr != nil {
+		host := dialer.LocalAddr.(*net.TCPAddr).IP.String()
+		cfg.ListenHost = func(string) string { return host }
+	} else {
+		log.Printf("Starting torrent client on the default route; %s is unavailable", b.Spec)
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		d, err := boundDialer("torrent")
+		if err != nil {
+			return nil, err
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+	cfg.TrackerDialContext = dial
+	cfg.HTTPDialContext = dial
+	return nil
+}
+
+// trackBoundTorrent registers a running torrent so it can be paused when
+// a required binding goes down. The returned func unregisters it.
+func trackBoundTorrent(t *torrent.Torrent, key string) func() {
+	bindingsMu.Lock()
+	defer bindingsMu.Unlock()
+	if _, ok := bindings["torrent"]; !ok {
+		return func() {}
+	}
+	boundTorrents[t] = key
+	if bindBlockedLocked() {
+		pauseTorrent(t, key, true)
+	}
+	return func() {
+		bindingsMu.Lock()
+		delete(boundTorrents, t)
+		bindingsMu.Unlock()
+	}
+}
+
+func pauseTorrent(t *torrent.Torrent, key string, pause bool) {
+	if pause {
+		t.DisallowDataDownload()
+		t.DisallowDataUpload()
+		addDownloadEvent(key, "paused", "bound interface is unavailable; transfer paused")
+	} else {
+		t.AllowDataDownload()
+		t.AllowDataUpload()
+		addDownloadEvent(key, "resumed", "bound interface is back; transfer resumed")
+	}
+}
+
+// bindStats lists the configured bindings for diagnostics.
+func bindStats() map[string]interface{} {
+	bindingsMu.Lock()
+	defer bindingsMu.Unlock()
+	list := make(map[string]bindState, len(bindings))
+	for proto, b := range bindings {
+		list[proto] = *b
+	}
+	return map[string]interface{}{
+		"required": *bindRequired,
+		"paused":   bindBlockedLocked(),
+		"bindings": list,
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	breakerFailures = flag.Int("breaker-failures", 5, "consecutive connection failures to a host within -breaker-window that trip its circuit breaker (0 disables)")
+	breakerWindow   = flag.Duration("breaker-window", time.Minute, "window in which -breaker-failures must occur")
+	breakerCooldown = flag.Duration("breaker-cooldown", 2*time.Minute, "how long a tripped host fast-fails downloads before it is probed again")
+)
+
+// Circuit breaker states.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "tripped"
+	breakerHalfOpen = "probing"
+)
+
+// hostBreaker tracks connection-level failures to one host.
+type hostBreaker struct {
+	Host         string     `json:"host"`
+	State        string     `json:"state"`
+	Failures     int        `json:"consecutiveFailures"`
+	LastError    string     `json:"lastError,omitempty"`
+	TrippedUntil *time.Time `json:"trippedUntil,omitempty"`
+
+	firstFailure time.Time
+}
+
+var (
+	breakers   = make(map[string]*hostBreaker)
+	breakersMu sync.Mutex
+)
+
+// breakerAllow decides whether a download to host may start. probe is
+// true when the host's cooldown has passed and this download has to
+// check the host with a lightweight request first.
+func breakerAllow(host string) (probe bool, err error) {
+	if *breakerFailures <= 0 {
+		return false, nil
+	}
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	b, ok := breakers[host]
+	if !ok {
+		return false, nil
+	}
+	switch b.State {
+	case breakerOpen:
+		if time.Now().Before(*b.TrippedUntil) {
+			return false, &downloadError{code: "host_down", err: fmt.Errorf("%s is marked down until %s after %d connection failures: %s",
+				host, b.TrippedUntil.Format(time.RFC3339), b.Failures, b.LastError)}
+		}
+		b.State = breakerHalfOpen
+		return true, nil
+	case breakerHalfOpen:
+		return false, &downloadError{code: "host_down", err: fmt.Errorf("%s is marked down and being probed: %s", host, b.LastError)}
+	}
+	return false, nil
+}
+
+// breakerResult records the outcome of a connection attempt to host. A
+// nil err means the host answered, whatever the HTTP status.
+func breakerResult(host string, err error) {
+	if *breakerFailures <= 0 {
+		return
+	}
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	b, ok := breakers[host]
+	if err == nil {
+		if ok {
+			delete(breakers, host)
+		}
+		return
+	}
+	now := time.Now()
+	if !ok {
+		b = &hostBreaker{Host: host, State: breakerClosed}
+		breakers[host] = b
+	}
+	if b.Failures == 0 || now.Sub(b.firstFailure) > *breakerWindow {
+		b.Failures = 0
+		b.firstFailure = now
+	}
+	b.Failures++
+	b.LastError = err.Error()
+	if b.State == breakerHalfOpen || b.Failures >= *breakerFailures {
+		until := now.Add(*breakerCooldown)
+		b.State = breakerOpen
+		b.TrippedUntil = &until
+	}
+}
+
+// probeHost sends a HEAD for url to see whether its host is back. Any
+// HTTP response counts as success.
+func probeHost(ctx context.Context, client *http.Client, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// breakerStats lists every host with recent failures, ordered by host.
+func breakerStats() []hostBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	list := make([]hostBreaker, 0, len(breakers))
+	for _, b := range breakers {
+		list = append(list, *b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+	return list
+}
+
+// handleResetBreakers closes the circuit breaker for ?host=, or for every
+// host if none is given.
+func handleResetBreakers(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Query().Get("host")
+
+	breakersMu.Lock()
+	reset := 0
+	if host == "" {
+		reset = len(breakers)
+		breakers = make(map[string]*hostBreaker)
+	} else if _, ok := breakers[host]; ok {
+		delete(breakers, host)
+		reset = 1
+	}
+	breakersMu.Unlock()
+	logf(r.Context(), "Reset %d circuit breakers", reset)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"reset": reset})
+}
+
+// breakerDown reports whether host is currently tripped or being probed,
+// without changing its state.
+func breakerDown(host string) (string, bool) {
+	if *breakerFailures <= 0 {
+		return "", false
+	}
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	b, ok := breakers[host]
+	if !ok || b.State == breakerClosed {
+		return "", false
+	}
+	if b.State == breakerOpen && !time.Now().Before(*b.TrippedUntil) {
+		return "", false // the next download probes it
+	}
+	return fmt.Sprintf("%s is marked down: %s", host, b.LastError), true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// cancelRequest is the cause a running download's context is cancelled
+// with, so the worker knows what the caller asked for.
+type cancelRequest struct {
+	removePartial bool
+}
+
+func (c *cancelRequest) Error() string { return "download cancelled" }
+
+var (
+	// partialPaths is where each running download is writing, so a
+	// cancelled one can be cleaned up.
+	partialPaths   = make(map[string]string)
+	partialPathsMu sync.Mutex
+)
+
+func setPartialPath(key, path string) {
+	partialPathsMu.Lock()
+	partialPaths[key] = path
+	partialPathsMu.Unlock()
+}
+
+func partialPath(key string) string {
+	partialPathsMu.Lock()
+	defer partialPathsMu.Unlock()
+	return partialPaths[key]
+}
+
+func takePartialPath(key string) string {
+	partialPathsMu.Lock()
+	defer partialPathsMu.Unlock()
+	path := partialPaths[key]
+	delete(partialPaths, key)
+	return path
+}
+
+// finishCancelled records that the worker stopped download id because it
+// was cancelled, removing what it had written if the caller asked for
+// that.
+func finishCancelled(id string, req *cancelRequest) {
+	path := takePartialPath(id)
+	if req != nil && req.removePartial && path != "" {
+		if err := os.RemoveAll(path); err != nil {
+			addDownloadEvent(id, "cleanup_failed", fmt.Sprintf("failed to remove %s: %v", path, err))
+		} else {
+			addDownloadEvent(id, "cleanup", fmt.Sprintf("removed partial download %s", path))
+		}
+		removeResumeMeta(strings.TrimSuffix(path, partSuffix))
+	}
+	markCancelled(id)
+}
+
+func markCancelled(id string) {
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[id]; exists {
+		download.Status = "cancelled"
+		download.Completed = true
+		clearSpeed(download)
+		download.QueuePosition = 0
+		download.EstimatedStart = nil
+	}
+	downloadsMutex.Unlock()
+	recordHistory(id)
+	addDownloadEvent(id, "cancelled", "download cancelled")
+	broadcastStatus()
+}
+
+// handleCancelDownload cancels the scheduled, queued, running or paused download
+// {id}, or every unfinished download matching ?url= or ?tag=.
+// ?removePartial=true also deletes whatever had been written.
+func handleCancelDownload(w http.ResponseWriter, r *http.Request) {
+	req := &cancelRequest{removePartial: r.URL.Query().Get("removePartial") == "true"}
+	targets, ok := downloadTargets(w, r, func(d *DownloadStatus) bool {
+		return !d.Completed
+	})
+	if !ok {
+		return
+	}
+
+	cancelled := make([]string, 0, len(targets))
+	for _, target := range targets {
+		if j, ok := takePausedJob(target); ok {
+			rememberStopped(j)
+			finishCancelled(target, req)
+			cancelled = append(cancelled, target)
+			continue
+		}
+		if j, ok := takeScheduledJob(target); ok {
+			rememberStopped(j)
+			markCancelled(target)
+			cancelled = append(cancelled, target)
+			continue
+		}
+		switch j, state := pool.cancel(target, req); state {
+		case "queued":
+			rememberStopped(j)
+			markCancelled(target)
+			cancelled = append(cancelled, target)
+		case "running":
+			// The worker marks it cancelled once the transfer stops.
+			cancelled = append(cancelled, target)
+		}
+	}
+	logf(r.Context(), "Cancelled %d downloads", len(cancelled))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"cancelled": cancelled})
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var casDir = flag.String("cas-dir", "", "store payloads once under a content-hash path in this directory and hardlink downloads to them (must share a file system with the output roots; empty disables)")
+
+// casIndex remembers which blob each URL produced and which visible files
+// link to each blob. It is saved as index.json in the store. Blobs are
+// keyed "<algorithm>:<digest>" so content stored under different
+// algorithms never collides.
+type casIndex struct {
+	URLs  map[string]string   `json:"urls"`
+	Blobs map[string]*casBlob `json:"blobs"`
+}
+
+type casBlob struct {
+	Size  int64    `json:"size"`
+	Links []string `json:"links"`
+}
+
+var (
+	casStore   *casIndex
+	casStoreMu sync.Mutex
+)
+
+// initCAS loads the content-addressed store's index if -cas-dir is set.
+// It must run after flag.Parse.
+func initCAS() error {
+	if *casDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Join(*casDir, "blobs"), os.ModePerm); err != nil {
+		return err
+	}
+	casStore = &casIndex{URLs: make(map[string]string), Blobs: make(map[string]*casBlob)}
+	data, err := os.ReadFile(filepath.Join(*casDir, "index.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, casStore); err != nil {
+		return err
+	}
+
+	// Indexes written before blobs were keyed by algorithm hold bare
+	// SHA-256 digests.
+	for key, blob := range casStore.Blobs {
+		if !strings.Contains(key, ":") {
+			delete(casStore.Blobs, key)
+			casStore.Blobs["sha256:"+key] = blob
+		}
+	}
+	for url, key := range casStore.URLs {
+		if !strings.Contains(key, ":") {
+			casStore.URLs[url] = "sha256:" + key
+		}
+	}
+	return nil
+}
+
+// saveCASIndex writes the index. The caller must hold casStoreMu.
+func saveCASIndex() {
+	data, _ := json.MarshalIndent(casStore, "", "  ")
+	tmp := filepath.Join(*casDir, "index.json.tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		log.Printf("Failed to save blob index: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, filepath.Join(*casDir, "index.json")); err != nil {
+		log.Printf("Failed to save blob index: %v", err)
+	}
+}
+
+// casBlobPath returns where the blob with key "<algorithm>:<digest>"
+// lives.
+func casBlobPath(key string) string {
+	alg, sum, _ := strings.Cut(key, ":")
+	return filepath.Join(*casDir, "blobs", alg, sum[:2], sum[2:4], sum)
+}
+
+// casLookup returns the blob a previous download of url produced, if it
+// is still in the store and has the size the server now reports.
+func casLookup(url string, size int64) (string, bool) {
+	if casStore == nil || size <= 0 {
+		return "", false
+	}
+	casStoreMu.Lock()
+	key, ok := casStore.URLs[url]
+	blob := casStore.Blobs[key]
+	casStoreMu.Unlock()
+	if !ok || blob == nil || blob.Size != size {
+		return "", false
+	}
+	if info, err := os.Stat(casBlobPath(key)); err != nil || info.Size() != size {
+		return "", false
+	}
+	return key, true
+}
+
+// casLinkOut makes path a hardlink to the blob, replacing whatever is
+// there, and records url as having produced it.
+func casLinkOut(url, key, path string) error {
+	os.Remove(path)
+	if err := os.Link(casBlobPath(key), path); err != nil {
+		return fmt.Errorf("failed to link blob: %v", err)
+	}
+	casRecord(url, key, path, -1)
+	return nil
+}
+
+// casIngest adds a completed file to the store, keyed by its alg digest.
+// If an identical blob is already stored the file is replaced with a link
+// to it and dedup is true; otherwise the file itself becomes the blob.
+// Blobs of the same size stored under other algorithms are checked too,
+// hashing the file with each of those algorithms in the same pass.
+func casIngest(url, path, alg string) (key string, dedup bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", false, err
+	}
+
+	algs := []string{alg}
+	casStoreMu.Lock()
+	for other, blob := range casStore.Blobs {
+		otherAlg, _, _ := strings.Cut(other, ":")
+		if blob.Size == info.Size() && !containsFold(algs, otherAlg) {
+			if _, ok := hashAlgorithms[otherAlg]; ok {
+				algs = append(algs, otherAlg)
+			}
+		}
+	}
+	casStoreMu.Unlock()
+
+	hashers := make([]hash.Hash, len(algs))
+	writers := make([]io.Writer, len(algs))
+	for i, a := range algs {
+		hashers[i] = newHash(a)
+		writers[i] = hashers[i]
+	}
+	size, err := copyWithPool(io.MultiWriter(writers...), f)
+	f.Close()
+	if err != nil {
+		return "", false, fmt.Errorf("failed to hash %s: %v", path, err)
+	}
+
+	keys := make([]string, len(algs))
+	for i, a := range algs {
+		keys[i] = a + ":" + hex.EncodeToString(hashers[i].Sum(nil))
+	}
+	for _, k := range keys {
+		if info, err := os.Stat(casBlobPath(k)); err == nil && info.Size() == size {
+			return k, true, casLinkOut(url, k, path)
+		}
+	}
+
+	key = keys[0]
+	blob := casBlobPath(key)
+	if err := os.MkdirAll(filepath.Dir(blob), os.ModePerm); err != nil {
+		return "", false, err
+	}
+	os.Remove(blob) // a truncated leftover
+	if err := os.Link(path, blob); err != nil {
+		return "", false, fmt.Errorf("failed to store blob: %v", err)
+	}
+	casRecord(url, key, path, size)
+	return key, false, nil
+}
+
+// casRecord notes that url produced blob key and path links to it. size
+// is only needed for new blobs.
+func casRecord(url, key, path string, size int64) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	casStoreMu.Lock()
+	defer casStoreMu.Unlock()
+	casStore.URLs[url] = key
+	blob, ok := casStore.Blobs[key]
+	if !ok {
+		blob = &casBlob{Size: size}
+		casStore.Blobs[key] = blob
+	}
+	for _, link := range blob.Links {
+		if link == path {
+			saveCASIndex()
+			return
+		}
+	}
+	blob.Links = append(blob.Links, path)
+	saveCASIndex()
+}
+
+// storeInCAS moves a finished download into the store. Directories
+// (multi-file torrents) are left as they are. Failures are recorded as
+// events and never fail the download.
+func storeInCAS(id, url, savedPath, alg string) {
+	if casStore == nil {
+		return
+	}
+	downloadsMutex.Lock()
+	done := false
+	if download, exists := activeDownloads[id]; exists {
+		done = download.BlobDigest != ""
+	}
+	downloadsMutex.Unlock()
+	if info, err := os.Stat(savedPath); done || err != nil || !info.Mode().IsRegular() {
+		return
+	}
+
+	key, dedup, err := casIngest(url, savedPath, alg)
+	if err != nil {
+		addDownloadEvent(id, "cas_failed", err.Error())
+		return
+	}
+	markBlob(id, key, dedup)
+}
+
+func markBlob(id, key string, dedup bool) {
+	alg, sum, _ := strings.Cut(key, ":")
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[id]; exists {
+		download.BlobDigest = sum
+		download.BlobAlgorithm = alg
+		download.Deduplicated = dedup
+	}
+	downloadsMutex.Unlock()
+	if dedup {
+		addDownloadEvent(id, "deduplicated", "linked to stored blob "+key)
+	}
+}
+
+// casGC removes blobs no visible file links to any more, including blobs
+// missing from the index.
+func casGC() (removed int, freed int64, err error) {
+	casStoreMu.Lock()
+	defer casStoreMu.Unlock()
+
+	for key, blob := range casStore.Blobs {
+		blobInfo, err := os.Stat(casBlobPath(key))
+		if err != nil {
+			delete(casStore.Blobs, key)
+			continue
+		}
+		links := blob.Links[:0]
+		for _, link := range blob.Links {
+			if info, err := os.Stat(link); err == nil && os.SameFile(info, blobInfo) {
+				links = append(links, link)
+			}
+		}
+		blob.Links = links
+		if len(links) > 0 {
+			continue
+		}
+		if err := os.Remove(casBlobPath(key)); err != nil {
+			return removed, freed, err
+		}
+		delete(casStore.Blobs, key)
+		removed++
+		freed += blobInfo.Size()
+	}
+	for url, key := range casStore.URLs {
+		if _, ok := casStore.Blobs[key]; !ok {
+			delete(casStore.URLs, url)
+		}
+	}
+
+	err = filepath.WalkDir(filepath.Join(*casDir, "blobs"), func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(filepath.Join(*casDir, "blobs"), path)
+		if err != nil {
+			return err
+		}
+		alg, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+		if _, ok := casStore.Blobs[alg+":"+d.Name()]; ok {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	saveCASIndex()
+	return removed, freed, err
+}
+
+func handleCASGC(w http.ResponseWriter, r *http.Request) {
+	if casStore == nil {
+		httpError(w, r, "Content-addressed storage is not enabled", http.StatusNotFound)
+		return
+	}
+	removed, freed, err := casGC()
+	if err != nil {
+		httpError(w, r, fmt.Sprintf("Garbage collection failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	logf(r.Context(), "Blob garbage collection removed %d blobs (%d bytes)", removed, freed)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"removed":    removed,
+		"freedBytes": freed,
+	})
+}
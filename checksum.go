@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	skipTorrentHash = flag.Bool("skip-torrent-hash", false, "don't compute digests of torrent payload files after completion")
+	torrentHashRate = flag.Int64("torrent-hash-rate", 0, "maximum bytes/sec read while hashing torrent payload files (0 = unlimited)")
+)
+
+// torrentHashMu makes payload hashing run one file at a time across all
+// downloads so it stays in the background on slow disks.
+var torrentHashMu sync.Mutex
+
+// hashTorrentPayload computes the alg digest of every file under a
+// completed torrent's content path and stores the digests, keyed by path
+// relative to the content root (or the file name for single-file
+// torrents).
+func hashTorrentPayload(id, contentPath, alg string) error {
+	info, err := os.Stat(contentPath)
+	if err != nil {
+		return err
+	}
+
+	digests := make(map[string]string)
+	if !info.IsDir() {
+		sum, err := hashFileThrottled(contentPath, alg)
+		if err != nil {
+			return err
+		}
+		digests[filepath.Base(contentPath)] = sum
+	} else {
+		err = filepath.WalkDir(contentPath, func(path string, d os.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(contentPath, path)
+			if err != nil {
+				return err
+			}
+			sum, err := hashFileThrottled(path, alg)
+			if err != nil {
+				return err
+			}
+			digests[filepath.ToSlash(rel)] = sum
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[id]; exists {
+		download.FileChecksums = digests
+		download.ChecksumAlgorithm = alg
+	}
+	downloadsMutex.Unlock()
+	return nil
+}
+
+func hashFileThrottled(path, alg string) (string, error) {
+	torrentHashMu.Lock()
+	defer torrentHashMu.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if *torrentHashRate > 0 {
+		r = &throttledReader{r: f, rate: *torrentHashRate, start: time.Now()}
+	}
+	h := newHash(alg)
+	if _, err := copyWithPool(h, r); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// throttledReader sleeps as needed to keep its average read rate at or
+// below rate bytes/sec.
+type throttledReader struct {
+	r     io.Reader
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > t.rate {
+		p = p[:t.rate]
+	}
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+	expected := time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second))
+	if wait := expected - time.Since(t.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// What to do when a download's file name is already taken, by a file on
+// disk or by another download writing it.
+const (
+	conflictRename    = "rename"
+	conflictOverwrite = "overwrite"
+	conflictSkip      = "skip"
+)
+
+// maxNameVariants bounds the search for a free "name (n).ext".
+const maxNameVariants = 10000
+
+var (
+	// claimedPaths are the local files downloads are writing right now,
+	// by path, so two downloads never write the same one.
+	claimedPaths   = make(map[string]string)
+	claimedPathsMu sync.Mutex
+)
+
+func checkOnConflict(onConflict string) (string, error) {
+	switch onConflict {
+	case "":
+		return conflictRename, nil
+	case conflictRename, conflictOverwrite, conflictSkip:
+		return onConflict, nil
+	}
+	return "", fmt.Errorf("onConflict must be rename, overwrite or skip")
+}
+
+// skippedError means the download wasn't made because its file already
+// exists and the request asked to skip it.
+type skippedError struct {
+	path string
+}
+
+func (e *skippedError) Error() string {
+	return fmt.Sprintf("%s already exists", displayPath(e.path))
+}
+
+// claimFileName reserves name in dir for download key of url, or
+// another name if it is taken, following onConflict: rename picks the
+// first free "name (n).ext", overwrite takes it over if only a file is in
+// the way, and skip gives up with a skippedError. A file key itself left
+// behind is never in the way. The claim lasts until releaseClaims.
+func claimFileName(key, url, dir, name, onConflict string) (string, error) {
+	claimedPathsMu.Lock()
+	defer claimedPathsMu.Unlock()
+
+	path := filepath.Join(dir, name)
+	taken := pathTaken(key, url, path)
+	switch {
+	case taken == "":
+		claimedPaths[path] = key
+		return name, nil
+	case onConflict == conflictSkip:
+		return "", &skippedError{path: path}
+	case onConflict == conflictOverwrite && taken == "file":
+		claimedPaths[path] = key
+		return name, nil
+	case onConflict == conflictOverwrite:
+		return "", &downloadError{code: "path_in_use", err: fmt.Errorf("another download is writing %s", displayPath(path))}
+	}
+
+	base, ext := splitExt(name)
+	for n := 1; n <= maxNameVariants; n++ {
+		variant := fmt.Sprintf("%s (%d)%s", base, n, ext)
+		if path := filepath.Join(dir, variant); pathTaken(key, url, path) == "" {
+			claimedPaths[path] = key
+			return variant, nil
+		}
+	}
+	return "", fmt.Errorf("no free name like %s in %s", name, displayPath(dir))
+}
+
+// pathTaken returns "download" if another download is writing path or
+// has its partial file there, "file" if something else key didn't leave
+// is there, or "" if key may write it. claimedPathsMu must be held.
+func pathTaken(key, url, path string) string {
+	if owner, ok := claimedPaths[path]; ok {
+		if owner == key {
+			return ""
+		}
+		return "download"
+	}
+	if ownsPartial(path, key, url) {
+		return ""
+	}
+	if _, err := os.Lstat(partPath(path)); err == nil {
+		return "download"
+	}
+	if _, err := os.Lstat(path); err == nil {
+		return "file"
+	}
+	return ""
+}
+
+// releaseClaims lets other downloads write the paths key claimed.
+func releaseClaims(key string) {
+	claimedPathsMu.Lock()
+	defer claimedPathsMu.Unlock()
+	for path, owner := range claimedPaths {
+		if owner == key {
+			delete(claimedPaths, path)
+		}
+	}
+}
+
+// releasePath gives up key's claim on one path.
+func releasePath(key, path string) {
+	claimedPathsMu.Lock()
+	defer claimedPathsMu.Unlock()
+	if claimedPaths[path] == key {
+		delete(claimedPaths, path)
+	}
+}
+
+// splitExt splits name before its extension, keeping compound ones such
+// as ".tar.gz" together.
+func splitExt(name string) (string, string) {
+	ext := filepath.Ext(name)
+	if ext == name {
+		// A dotfile such as ".bashrc" has no extension.
+		return name, ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	if inner := filepath.Ext(base); strings.EqualFold(inner, ".tar") {
+		return strings.TrimSuffix(base, inner), inner + ext
+	}
+	return base, ext
+}
+
+// markSkipped ends download id without downloading anything because its
+// file already exists.
+func markSkipped(id string, skipped *skippedError) {
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[id]; exists {
+		download.Status = "skipped"
+		download.Completed = true
+		clearSpeed(download)
+		download.QueuePosition = 0
+		download.EstimatedStart = nil
+	}
+	downloadsMutex.Unlock()
+	addDownloadEvent(id, "skipped", skipped.Error()+"; skipped as the request asked")
+	recordHistory(id)
+	broadcastStatus()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentSameNameDownloads runs two downloads of different
+// files both named setup.exe into one directory at once, and checks that
+// each ends up in a file of its own.
+func TestConcurrentSameNameDownloads(t *testing.T) {
+	// Both responses are held back until both requests arrived, so the
+	// downloads overlap.
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		arrived.Wait()
+		body := r.URL.Query().Get("mirror") + " build"
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	urls := map[string]string{
+		"same-name-a": srv.URL + "/setup.exe?mirror=a",
+		"same-name-b": srv.URL + "/setup.exe?mirror=b",
+	}
+	paths := make(map[string]string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for id, url := range urls {
+		trackDownload(t, id, url, dir)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path, err := downloadFile(context.Background(), id, url, dir, downloadOptions{onConflict: conflictRename})
+			if err != nil {
+				t.Errorf("%s: %v", id, err)
+				return
+			}
+			mu.Lock()
+			paths[id] = path
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	if paths["same-name-a"] == paths["same-name-b"] {
+		t.Fatalf("both downloads saved to %s", paths["same-name-a"])
+	}
+	for id, want := range map[string]string{"same-name-a": "a build", "same-name-b": "b build"} {
+		data, err := os.ReadFile(paths[id])
+		if err != nil || string(data) != want {
+			t.Errorf("%s saved %q, %v to %s; want %q", id, data, err, paths[id], want)
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[setup (1).exe setup.exe]" {
+		t.Errorf("directory holds %v; want setup.exe and setup (1).exe", names)
+	}
+	for id, path := range paths {
+		downloadsMutex.Lock()
+		recorded := activeDownloads[id].FileName
+		downloadsMutex.Unlock()
+		if recorded != filepath.Base(path) {
+			t.Errorf("%s is recorded as %s but saved as %s", id, recorded, filepath.Base(path))
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxCookieFileSize = 1 << 20
+
+var cookiesFile = flag.String("cookies-file", os.Getenv("YAD_COOKIES_FILE"), "Netscape cookies.txt loaded at startup into a cookie jar shared by HTTP downloads without cookies of their own, also YAD_COOKIES_FILE")
+
+// sharedCookieJar holds the -cookies-file cookies and whatever the
+// servers set while downloading, for every download that doesn't bring
+// its own cookie credential or file. Nil without -cookies-file.
+var sharedCookieJar http.CookieJar
+
+// netscapeCookie is one line of a Netscape-format cookies.txt file.
+type netscapeCookie struct {
+	domain            string
+	includeSubdomains bool
+	path              string
+	secure            bool
+	httpOnly          bool
+	expires           time.Time // zero for session cookies
+	name              string
+	value             string
+}
+
+// cookieCredential is a named set of imported cookies. Its values are
+// never returned by the API.
+type cookieCredential struct {
+	name     string
+	cookies  []netscapeCookie
+	imported time.Time
+}
+
+var (
+	cookieCredentials   = make(map[string]*cookieCredential)
+	cookieCredentialsMu sync.Mutex
+)
+
+// cookieLineError is a line of a cookies.txt that doesn't parse.
+type cookieLineError struct {
+	line int
+	err  error
+}
+
+func (e *cookieLineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.line, e.err)
+}
+
+// parseCookiesTxt parses a Netscape-format cookies.txt file as exported by
+// browsers and curl. Comment lines are skipped except for the common
+// "#HttpOnly_" prefix, which marks an HttpOnly cookie.
+func parseCookiesTxt(r io.Reader) ([]netscapeCookie, error) {
+	var cookies []netscapeCookie
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := false
+		if strings.HasPrefix(line, "#HttpOnly_") {
+			line = strings.TrimPrefix(line, "#HttpOnly_")
+			httpOnly = true
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) == 6 {
+			// Some exporters drop the value column for empty values
+			fields = append(fields, "")
+		}
+		if len(fields) != 7 {
+			return nil, &cookieLineError{lineNo, fmt.Errorf("expected 7 tab-separated fields, got %d", len(fields))}
+		}
+
+		expiresUnix, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, &cookieLineError{lineNo, fmt.Errorf("invalid expiry %q", fields[4])}
+		}
+		c := netscapeCookie{
+			domain:            fields[0],
+			includeSubdomains: strings.EqualFold(fields[1], "TRUE"),
+			path:              fields[2],
+			secure:            strings.EqualFold(fields[3], "TRUE"),
+			httpOnly:          httpOnly,
+			name:              fields[5],
+			value:             fields[6],
+		}
+		if expiresUnix > 0 {
+			c.expires = time.Unix(expiresUnix, 0)
+		}
+		if c.path == "" {
+			c.path = "/"
+		}
+		cookies = append(cookies, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cookies, nil
+}
+
+// newCookieJar builds a fresh jar holding the credential's unexpired
+// cookies. The jar applies the usual domain, path and Secure matching.
+func newCookieJar(cred *cookieCredential) (http.CookieJar, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, c := range cred.cookies {
+		if !c.expires.IsZero() && c.expires.Before(now) {
+			continue
+		}
+		host := strings.TrimPrefix(c.domain, ".")
+		scheme := "http"
+		if c.secure {
+			scheme = "https"
+		}
+		cookie := &http.Cookie{
+			Name:     c.name,
+			Value:    c.value,
+			Path:     c.path,
+			Secure:   c.secure,
+			HttpOnly: c.httpOnly,
+			Expires:  c.expires,
+		}
+		if c.includeSubdomains {
+			cookie.Domain = host
+		}
+		jar.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: c.path}, []*http.Cookie{cookie})
+	}
+	return jar, nil
+}
+
+// initCookies loads -cookies-file into the shared jar.
+func initCookies() error {
+	if *cookiesFile == "" {
+		return nil
+	}
+	cred, err := readCookiesFile(*cookiesFile)
+	if err != nil {
+		return err
+	}
+	jar, err := newCookieJar(cred)
+	if err != nil {
+		return err
+	}
+	sharedCookieJar = jar
+	httpClient.Jar = jar
+	log.Printf("Loaded %d cookies from %s", len(cred.cookies), *cookiesFile)
+	return nil
+}
+
+// readCookiesFile reads a cookies.txt on the server's disk. A line that
+// doesn't parse is reported by number only, so the error can't echo
+// what some other file holds.
+func readCookiesFile(path string) (*cookieCredential, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() || info.Size() > maxCookieFileSize {
+		return nil, fmt.Errorf("%s is not a cookies.txt file of at most %d bytes", path, maxCookieFileSize)
+	}
+	cookies, err := parseCookiesTxt(f)
+	var lineErr *cookieLineError
+	if errors.As(err, &lineErr) {
+		return nil, fmt.Errorf("%s is not a Netscape cookies.txt file (line %d)", path, lineErr.line)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cookieCredential{name: path, cookies: cookies, imported: info.ModTime()}, nil
+}
+
+func lookupCookieCredential(name string) (*cookieCredential, bool) {
+	cookieCredentialsMu.Lock()
+	defer cookieCredentialsMu.Unlock()
+	cred, ok := cookieCredentials[name]
+	return cred, ok
+}
+
+// handleImportCookies stores an uploaded cookies.txt as a named
+// credential. It accepts either a multipart form with "name" and "file"
+// fields or a raw request body with ?name=.
+func handleImportCookies(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxCookieFileSize)
+
+	var name string
+	var body io.Reader
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			httpError(w, r, fmt.Sprintf("Missing cookies file: %v", err), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		name = r.FormValue("name")
+		body = file
+	} else {
+		name = r.URL.Query().Get("name")
+		body = r.Body
+	}
+	if name == "" {
+		httpError(w, r, "A credential name is required", http.StatusBadRequest)
+		return
+	}
+
+	cookies, err := parseCookiesTxt(body)
+	if err != nil {
+		httpError(w, r, fmt.Sprintf("Invalid cookies file: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	cred := &cookieCredential{name: name, cookies: cookies, imported: time.Now()}
+	cookieCredentialsMu.Lock()
+	cookieCredentials[name] = cred
+	cookieCredentialsMu.Unlock()
+	logf(r.Context(), "Imported %d cookies as credential %q", len(cookies), name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(cred.summary())
+}
+
+// handleListCredentials lists stored credentials by name. Cookie values
+// are never included.
+func handleListCredentials(w http.ResponseWriter, r *http.Request) {
+	cookieCredentialsMu.Lock()
+	list := make([]map[string]interface{}, 0, len(cookieCredentials))
+	for _, cred := range cookieCredentials {
+		list = append(list, cred.summary())
+	}
+	cookieCredentialsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i]["name"].(string) < list[j]["name"].(string) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (cred *cookieCredential) summary() map[string]interface{} {
+	domains := make(map[string]bool)
+	for _, c := range cred.cookies {
+		domains[strings.TrimPrefix(c.domain, ".")] = true
+	}
+	domainList := make([]string, 0, len(domains))
+	for d := range domains {
+		domainList = append(domainList, d)
+	}
+	sort.Strings(domainList)
+
+	return map[string]interface{}{
+		"name":     cred.name,
+		"type":     "cookies",
+		"cookies":  len(cred.cookies),
+		"domains":  domainList,
+		"imported": cred.imported,
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCookiesTxt(t *testing.T) {
+	const file = "# Netscape HTTP Cookie File\r\n" +
+		"# https://curl.se/docs/http-cookies.html\n" +
+		"\n" +
+		"   \n" +
+		".example.com\tTRUE\t/\tTRUE\t2000000000\tsession\tabc123\n" +
+		"#HttpOnly_.example.com\tTRUE\t/account\tFALSE\t0\tsid\txyz\r\n" +
+		"files.example.com\tFALSE\t\tFALSE\t1500000000\tempty\n" +
+		"# .example.com\tTRUE\t/\tFALSE\t0\tcommented\tout\n"
+	cookies, err := parseCookiesTxt(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netscapeCookie{
+		{domain: ".example.com", includeSubdomains: true, path: "/", secure: true, expires: time.Unix(2000000000, 0), name: "session", value: "abc123"},
+		{domain: ".example.com", includeSubdomains: true, path: "/account", httpOnly: true, name: "sid", value: "xyz"},
+		{domain: "files.example.com", path: "/", expires: time.Unix(1500000000, 0), name: "empty"},
+	}
+	if !reflect.DeepEqual(cookies, want) {
+		t.Errorf("parseCookiesTxt =\n%+v\nwant\n%+v", cookies, want)
+	}
+}
+
+func TestParseCookiesTxtMalformed(t *testing.T) {
+	tests := []struct {
+		name, file string
+		line       int
+	}{
+		{"too few fields", "# comment\n.example.com\tTRUE\t/\tFALSE\t0\n", 2},
+		{"too many fields", ".example.com\tTRUE\t/\tFALSE\t0\ta\tb\tc\n", 1},
+		{"spaces for tabs", ".example.com TRUE / FALSE 0 name value\n", 1},
+		{"bad expiry", "\n.example.com\tTRUE\t/\tFALSE\tnever\tname\tvalue\n", 2},
+		{"bad HttpOnly line", "#HttpOnly_.example.com\tTRUE\n", 1},
+	}
+	for _, tt := range tests {
+		_, err := parseCookiesTxt(strings.NewReader(tt.file))
+		var lineErr *cookieLineError
+		if !errors.As(err, &lineErr) || lineErr.line != tt.line {
+			t.Errorf("%s: error %v; want one on line %d", tt.name, err, tt.line)
+		}
+	}
+}
+
+func TestNewCookieJar(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	jar, err := newCookieJar(&cookieCredential{cookies: []netscapeCookie{
+		{domain: ".example.com", includeSubdomains: true, path: "/", expires: future, name: "live", value: "1"},
+		{domain: ".example.com", includeSubdomains: true, path: "/", expires: past, name: "expired", value: "1"},
+		{domain: ".example.com", includeSubdomains: true, path: "/", name: "session", value: "1"},
+		{domain: "example.com", path: "/", name: "hostonly", value: "1"},
+		{domain: ".example.com", includeSubdomains: true, path: "/private", name: "private", value: "1"},
+		{domain: ".example.com", includeSubdomains: true, path: "/", secure: true, name: "secure", value: "1"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := func(rawURL string) string {
+		u, _ := url.Parse(rawURL)
+		var names []string
+		for _, c := range jar.Cookies(u) {
+			names = append(names, c.Name)
+		}
+		return strings.Join(names, ",")
+	}
+	for rawURL, want := range map[string]string{
+		"http://example.com/file":         "live,session,hostonly",
+		"http://files.example.com/file":   "live,session",
+		"http://example.com/private/file": "private,live,session,hostonly",
+		"https://files.example.com/file":  "live,session,secure",
+		"http://other.example.org/file":   "",
+	} {
+		if got := sent(rawURL); got != want {
+			t.Errorf("cookies for %s = %q, want %q", rawURL, got, want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSpec is a parsed five-field cron expression: minute, hour, day of
+// month, month and day of week, each as a bit set of the values it
+// matches.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	// With both day fields restricted, a day matching either one is
+	// taken, as in cron.
+	domAny, dowAny bool
+}
+
+// cronMacros are the shorthands accepted in place of the five fields.
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronDays   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseCron parses a cron expression such as "30 2 * * 1-5" or
+// "@daily". Fields take *, numbers, ranges such as 1-5, steps such as
+// */15 and comma-separated lists of those; months and days of the week
+// also take their three-letter English names, and Sunday is 0 or 7.
+func parseCron(expr string) (cronSpec, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSpec{}, fmt.Errorf("cron expression %q: want 5 fields (minute hour day-of-month month day-of-week) or a macro such as @daily", expr)
+	}
+	var spec cronSpec
+	var err error
+	if spec.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return cronSpec{}, fmt.Errorf("cron minute: %v", err)
+	}
+	if spec.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return cronSpec{}, fmt.Errorf("cron hour: %v", err)
+	}
+	if spec.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return cronSpec{}, fmt.Errorf("cron day of month: %v", err)
+	}
+	if spec.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return cronSpec{}, fmt.Errorf("cron month: %v", err)
+	}
+	if spec.dow, err = parseCronField(fields[4], 0, 7, cronDays); err != nil {
+		return cronSpec{}, fmt.Errorf("cron day of week: %v", err)
+	}
+	// 7 is Sunday as well as 0.
+	spec.dow = (spec.dow | spec.dow>>7) &^ (1 << 7)
+	spec.domAny = fields[2] == "*" || strings.HasPrefix(fields[2], "*/")
+	spec.dowAny = fields[4] == "*" || strings.HasPrefix(fields[4], "*/")
+	return spec, nil
+}
+
+// parseCronField returns the values between min and max that field
+// matches. names, if given, are accepted for min, min+1 and so on.
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(s, name) {
+				return min + i, nil
+			}
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("%q is not between %d and %d", s, min, max)
+		}
+		return n, nil
+	}
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+			step = n
+		}
+		lo, hi := min, max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			first, last, _ := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = value(first); err != nil {
+				return 0, err
+			}
+			if hi, err = value(last); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("range %q runs backwards", rangePart)
+			}
+		default:
+			n, err := value(rangePart)
+			if err != nil {
+				return 0, err
+			}
+			lo = n
+			if !hasStep {
+				hi = n
+			}
+		}
+		for n := lo; n <= hi; n += step {
+			bits |= 1 << n
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first minute after t the spec matches, in t's
+// location, or the zero time if there is none within five years, as for
+// "0 0 30 2 *". Matching goes by the wall clock: a time the clock skips
+// when it goes forward runs as soon as it has, and an hour the clock
+// repeats when it goes back runs once.
+func (s cronSpec) next(t time.Time) time.Time {
+	// Walk the wall clock in UTC, where every day has 24 hours, and only
+	// place a match in t's location at the end.
+	w := wallClock(t).Add(time.Minute)
+	limit := w.AddDate(5, 0, 0)
+	for w.Before(limit) {
+		switch {
+		case s.month&(1<<uint(w.Month())) == 0:
+			w = time.Date(w.Year(), w.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.dayMatches(w):
+			w = time.Date(w.Year(), w.Month(), w.Day()+1, 0, 0, 0, 0, time.UTC)
+		case s.hour&(1<<uint(w.Hour())) == 0:
+			w = w.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<uint(w.Minute())) == 0:
+			w = w.Add(time.Minute)
+		default:
+			at := time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), 0, 0, t.Location())
+			if !wallClock(at).Equal(w) {
+				// w doesn't exist that day; time.Date gave a time before
+				// the jump, whose zone ends where the clock resumes.
+				_, at = at.ZoneBounds()
+			}
+			if at.After(t) {
+				return at
+			}
+			w = w.Add(time.Minute)
+		}
+	}
+	return time.Time{}
+}
+
+// wallClock returns t's date and time to the minute as read in its
+// location, as a UTC time.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+func (s cronSpec) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	// Each expression parses to the same spec as the plain one beside it.
+	tests := []struct {
+		expr, same string
+	}{
+		{"@yearly", "0 0 1 1 *"},
+		{"@annually", "0 0 1 1 *"},
+		{"@monthly", "0 0 1 * *"},
+		{"@weekly", "0 0 * * 0"},
+		{" @DAILY ", "0 0 * * *"},
+		{"@midnight", "0 0 * * *"},
+		{"@hourly", "0 * * * *"},
+		{"0 0 1 jan-mar *", "0 0 1 1-3 *"},
+		{"0 0 1 Dec,FEB *", "0 0 1 2,12 *"},
+		{"0 9 * * mon-fri", "0 9 * * 1-5"},
+		{"0 9 * * sat,sun", "0 9 * * 0,6"},
+		{"0 9 * * 7", "0 9 * * 0"},
+		{"0 9 * * 5-7", "0 9 * * 0,5,6"},
+		{"*/15 * * * *", "0,15,30,45 * * * *"},
+		{"5/15 * * * *", "5,20,35,50 * * * *"},
+		{"0 10-16/3 * * *", "0 10,13,16 * * *"},
+		{"0 0 */10 * *", "0 0 1,11,21,31 * *"},
+		{"0 0 1 */5 *", "0 0 1 1,6,11 *"},
+		{"0 0 1,15 * *", "0 0 1,15 * *"},
+	}
+	for _, tt := range tests {
+		got, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		want, err := parseCron(tt.same)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.same, err)
+		}
+		// The day fields count as restricted by how they are written,
+		// which */10 isn't but the list it expands to is.
+		got.domAny, want.domAny = false, false
+		if got != want {
+			t.Errorf("parseCron(%q) = %+v; want %+v as for %q", tt.expr, got, want, tt.same)
+		}
+	}
+
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@reboot",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"* * * dec-jan *",
+		"* * * * sat-mon",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"1-x * * * *",
+		"* * * foo *",
+		"1,,2 * * * *",
+	} {
+		if spec, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) = %+v; want an error", expr, spec)
+		}
+	}
+}
+
+func TestCronDayMatches(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, time.October, d, 12, 0, 0, 0, time.UTC) }
+	// October 2026: the 13th is a Tuesday, the 16th and 23rd Fridays.
+	tests := []struct {
+		expr string
+		date time.Time
+		want bool
+	}{
+		{"0 0 * * *", day(14), true},
+		{"0 0 13 * *", day(13), true},
+		{"0 0 13 * *", day(16), false},
+		{"0 0 * * fri", day(16), true},
+		{"0 0 * * fri", day(13), false},
+
+		// With both restricted, either one will do.
+		{"0 0 13 * fri", day(13), true},
+		{"0 0 13 * fri", day(16), true},
+		{"0 0 13 * fri", day(14), false},
+
+		// A step from * leaves its field unrestricted, so both must match.
+		{"0 0 */2 * fri", day(23), true},
+		{"0 0 */2 * fri", day(16), false},
+		{"0 0 */2 * fri", day(15), false},
+		{"0 0 13 * */2", day(13), true},
+		{"0 0 13 * */2", day(16), false},
+	}
+	for _, tt := range tests {
+		spec, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.expr, err)
+		}
+		if got := spec.dayMatches(tt.date); got != tt.want {
+			t.Errorf("%q: dayMatches(%s) = %v; want %v", tt.expr, tt.date.Format("Mon Jan 2"), got, tt.want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	utc := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2026, month, day, hour, min, 0, 0, time.UTC)
+	}
+	// In New York the clock goes from 02:00 EST to 03:00 EDT on 8 March
+	// 2026 and from 02:00 EDT back to 01:00 EST on 1 November.
+	est := time.FixedZone("EST", -5*3600)
+	edt := time.FixedZone("EDT", -4*3600)
+	ny := func(month time.Month, day, hour, min int, zone *time.Location) time.Time {
+		return time.Date(2026, month, day, hour, min, 0, 0, zone).In(newYork)
+	}
+	tests := []struct {
+		expr  string
+		after time.Time
+		want  time.Time
+	}{
+		{"* * * * *", utc(10, 16, 10, 14).Add(59 * time.Second), utc(10, 16, 10, 15)},
+		{"*/15 * * * *", utc(10, 16, 10, 15), utc(10, 16, 10, 30)},
+		{"@hourly", utc(10, 16, 23, 15), utc(10, 17, 0, 0)},
+		{"30 2 * * 1-5", utc(10, 16, 3, 0), utc(10, 19, 2, 30)},
+		{"0 0 1 jan *", utc(12, 31, 12, 0), time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", utc(4, 1, 0, 0), utc(5, 31, 0, 0)},
+		{"0 0 29 2 *", utc(3, 1, 0, 0), time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * fri", utc(10, 14, 0, 0), utc(10, 16, 0, 0)},
+		{"0 0 13 * fri", utc(10, 23, 0, 0), utc(10, 30, 0, 0)},
+		{"0 0 30 2 *", utc(1, 1, 0, 0), time.Time{}},
+		{"0 0 31 4,6,9,11 *", utc(1, 1, 0, 0), time.Time{}},
+
+		// Spring forward: 02:30 doesn't exist on the 8th, so it runs as the
+		// clock reaches 03:00, and at 02:30 again the next day.
+		{"30 2 * * *", ny(3, 7, 12, 0, est), ny(3, 8, 3, 0, edt)},
+		{"30 2 * * *", ny(3, 8, 3, 0, edt), ny(3, 9, 2, 30, edt)},
+		{"*/30 * * * *", ny(3, 8, 1, 30, est), ny(3, 8, 3, 0, edt)},
+		{"*/30 * * * *", ny(3, 8, 3, 0, edt), ny(3, 8, 3, 30, edt)},
+		{"0 3 * * *", ny(3, 8, 1, 0, est), ny(3, 8, 3, 0, edt)},
+
+		// Fall back: 01:30 comes twice on 1 November and runs only the
+		// first time.
+		{"30 1 * * *", ny(10, 31, 12, 0, edt), ny(11, 1, 1, 30, edt)},
+		{"30 1 * * *", ny(11, 1, 1, 30, edt), ny(11, 2, 1, 30, est)},
+		{"30 1 * * *", ny(11, 1, 1, 10, est), ny(11, 2, 1, 30, est)},
+		{"0 * * * *", ny(11, 1, 0, 30, edt), ny(11, 1, 1, 0, edt)},
+		{"0 * * * *", ny(11, 1, 1, 0, edt), ny(11, 1, 2, 0, est)},
+		{"0 2 * * *", ny(11, 1, 0, 0, edt), ny(11, 1, 2, 0, est)},
+	}
+	for _, tt := range tests {
+		spec, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.expr, err)
+		}
+		got := spec.next(tt.after)
+		if !got.Equal(tt.want) {
+			t.Errorf("%q: next(%s) = %s; want %s", tt.expr, tt.after, got, tt.want)
+			continue
+		}
+		if got.Location() != tt.after.Location() {
+			t.Errorf("%q: next(%s) is in %s; want %s", tt.expr, tt.after, got.Location(), tt.after.Location())
+		}
+	}
+}
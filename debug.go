@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+const (
+	// recentLogLines and recentLogLineBytes bound the log lines kept
+	// for debug snapshots.
+	recentLogLines     = 1000
+	recentLogLineBytes = 2 << 10
+)
+
+var startedAt = time.Now()
+
+// logRing keeps the most recent log lines. It is installed as an extra
+// log output so snapshots can include them.
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+var recentLogs = &logRing{lines: make([]string, recentLogLines)}
+
+func (l *logRing) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if len(line) > recentLogLineBytes {
+			line = line[:recentLogLineBytes] + "... (truncated)"
+		}
+		l.lines[l.next] = line
+		l.next = (l.next + 1) % len(l.lines)
+		l.full = l.full || l.next == 0
+	}
+	return len(p), nil
+}
+
+// snapshot returns the kept lines, oldest first.
+func (l *logRing) snapshot() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]string(nil), l.lines[:l.next]...)
+	}
+	return append(append([]string(nil), l.lines[l.next:]...), l.lines[:l.next]...)
+}
+
+var (
+	// runningTorrents are the torrents being downloaded, by download
+	// ID, for diagnostics.
+	runningTorrents   = make(map[string]*torrent.Torrent)
+	runningTorrentsMu sync.Mutex
+)
+
+// trackTorrent registers the torrent of download key until the returned
+// func is called.
+func trackTorrent(key string, t *torrent.Torrent) func() {
+	runningTorrentsMu.Lock()
+	runningTorrents[key] = t
+	runningTorrentsMu.Unlock()
+	return func() {
+		runningTorrentsMu.Lock()
+		delete(runningTorrents, key)
+		runningTorrentsMu.Unlock()
+	}
+}
+
+type torrentDiagnostics struct {
+	DownloadID       string `json:"downloadId"`
+	InfoHash         string `json:"infoHash"`
+	Name             string `json:"name,omitempty"`
+	HasInfo          bool   `json:"hasInfo"`
+	BytesCompleted   int64  `json:"bytesCompleted"`
+	Length           int64  `json:"length,omitempty"`
+	TotalPeers       int    `json:"totalPeers"`
+	ActivePeers      int    `json:"activePeers"`
+	HalfOpenPeers    int    `json:"halfOpenPeers"`
+	ConnectedSeeders int    `json:"connectedSeeders"`
+	PiecesComplete   int    `json:"piecesComplete"`
+}
+
+func torrentStats() []torrentDiagnostics {
+	runningTorrentsMu.Lock()
+	defer runningTorrentsMu.Unlock()
+	list := make([]torrentDiagnostics, 0, len(runningTorrents))
+	for key, t := range runningTorrents {
+		stats := t.Stats()
+		d := torrentDiagnostics{
+			DownloadID:       key,
+			InfoHash:         t.InfoHash().HexString(),
+			BytesCompleted:   t.BytesCompleted(),
+			TotalPeers:       stats.TotalPeers,
+			ActivePeers:      stats.ActivePeers,
+			HalfOpenPeers:    stats.HalfOpenPeers,
+			ConnectedSeeders: stats.ConnectedSeeders,
+			PiecesComplete:   stats.PiecesComplete,
+		}
+		if t.Info() != nil {
+			d.HasInfo = true
+			d.Name = t.Name()
+			d.Length = t.Length()
+		}
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DownloadID < list[j].DownloadID })
+	return list
+}
+
+// secretFlag reports whether a flag's value must not appear in a
+// snapshot.
+func secretFlag(name string) bool {
+	for _, word := range []string{"token", "secret", "password", "credential", "webhook"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// effectiveConfig lists every flag's current value, with secrets
+// redacted.
+func effectiveConfig() map[string]string {
+	config := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlag(f.Name) && value != "" {
+			value = "(redacted)"
+		}
+		config[f.Name] = value
+	})
+	return config
+}
+
+// handleDebugSnapshot returns everything useful for a bug report as one
+// JSON attachment. The downloads, queue and workers are captured
+// together, holding the dispatcher no longer than a status broadcast
+// holds the downloads.
+func handleDebugSnapshot(w http.ResponseWriter, r *http.Request) {
+	var downloads json.RawMessage
+	var queue []string
+	var workers []workerInfo
+	pool.frozen(func(queued []job, running map[int]*workerInfo) {
+		downloadsMutex.Lock()
+		downloads, _ = json.Marshal(activeDownloads)
+		downloadsMutex.Unlock()
+		for _, j := range queued {
+			queue = append(queue, j.id)
+		}
+		for _, w := range running {
+			workers = append(workers, *w)
+		}
+	})
+	sort.Slice(workers, func(i, j int) bool { return workers[i].ID < workers[j].ID })
+
+	pausedJobsMu.Lock()
+	paused := make([]string, 0, len(pausedJobs))
+	for id := range pausedJobs {
+		paused = append(paused, id)
+	}
+	pausedJobsMu.Unlock()
+	sort.Strings(paused)
+	scheduled := make([]string, 0)
+	for _, j := range scheduledHandoffJobs() {
+		scheduled = append(scheduled, j.id)
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	now := time.Now()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(map[string]interface{}{
+		"generatedAt":      now,
+		"version":          version,
+		"uptime":           now.Sub(startedAt).Round(time.Second).String(),
+		"config":           effectiveConfig(),
+		"downloads":        downloads,
+		"queue":            queue,
+		"paused":           paused,
+		"scheduled":        scheduled,
+		"workers":          workers,
+		"torrents":         torrentStats(),
+		"websocketClients": wsHub.stats(),
+		"hostBreakers":     breakerStats(),
+		"bandwidth":        shaper.stats(),
+		"dnsCache":         resolverCache.stats(),
+		"bind":             bindStats(),
+		"recoveredPanics": map[string]int64{
+			"handlers": handlerPanics.Load(),
+			"workers":  workerPanics.Load(),
+		},
+		"runtime": map[string]interface{}{
+			"goVersion":    runtime.Version(),
+			"heapAlloc":    ms.HeapAlloc,
+			"heapInuse":    ms.HeapInuse,
+			"sys":          ms.Sys,
+			"numGC":        ms.NumGC,
+			"numGoroutine": runtime.NumGoroutine(),
+		},
+		"logs": recentLogs.snapshot(),
+	})
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="yad-snapshot-%s.json"`, now.UTC().Format("20060102-150405")))
+	w.Write(buf.Bytes())
+}
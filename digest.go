@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// digestChallenge is one parsed "WWW-Authenticate: Digest ..." header.
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       []string
+	userhash  bool
+}
+
+// parseDigestChallenge parses the auth-params of a Digest challenge.
+// ok is false if header is not a Digest challenge.
+func parseDigestChallenge(header string) (ch *digestChallenge, ok bool) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return nil, false
+	}
+
+	ch = &digestChallenge{algorithm: "MD5"}
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if strings.HasPrefix(rest, `"`) {
+			// Quoted string, possibly with backslash escapes
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value = b.String()
+			rest = rest[min(i+1, len(rest)):]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+
+		switch key {
+		case "realm":
+			ch.realm = value
+		case "nonce":
+			ch.nonce = value
+		case "opaque":
+			ch.opaque = value
+		case "algorithm":
+			ch.algorithm = value
+		case "qop":
+			for _, q := range strings.Split(value, ",") {
+				ch.qop = append(ch.qop, strings.TrimSpace(q))
+			}
+		case "userhash":
+			ch.userhash = strings.EqualFold(value, "true")
+		}
+	}
+	return ch, true
+}
+
+// hashFunc returns the hash for the challenge's algorithm and whether it
+// is a -sess variant.
+func (ch *digestChallenge) hashFunc() (func() hash.Hash, bool, error) {
+	alg := strings.ToUpper(ch.algorithm)
+	sess := strings.HasSuffix(alg, "-SESS")
+	switch strings.TrimSuffix(alg, "-SESS") {
+	case "MD5":
+		return md5.New, sess, nil
+	case "SHA-256":
+		return sha256.New, sess, nil
+	}
+	return nil, false, fmt.Errorf("unsupported digest algorithm %q", ch.algorithm)
+}
+
+// strength orders challenges so the strongest supported one is used when
+// a server offers several.
+func (ch *digestChallenge) strength() int {
+	if _, _, err := ch.hashFunc(); err != nil {
+		return -1
+	}
+	if strings.HasPrefix(strings.ToUpper(ch.algorithm), "SHA-256") {
+		return 2
+	}
+	return 1
+}
+
+// digestAuth answers a Digest challenge for every request of one
+// download, tracking the nonce count across them.
+type digestAuth struct {
+	username string
+	password string
+	ch       *digestChallenge
+
+	mu sync.Mutex
+	nc int
+}
+
+func newDigestAuth(resp *http.Response, creds *url.Userinfo) (*digestAuth, error) {
+	var best *digestChallenge
+	for _, header := range resp.Header.Values("WWW-Authenticate") {
+		if ch, ok := parseDigestChallenge(header); ok && (best == nil || ch.strength() > best.strength()) {
+			best = ch
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	if _, _, err := best.hashFunc(); err != nil {
+		return nil, &downloadError{code: "auth_unsupported", err: err}
+	}
+	if len(best.qop) > 0 && !containsFold(best.qop, "auth") {
+		return nil, &downloadError{code: "auth_unsupported", err: fmt.Errorf("unsupported digest qop %q", strings.Join(best.qop, ","))}
+	}
+
+	password, _ := creds.Password()
+	return &digestAuth{username: creds.Username(), password: password, ch: best}, nil
+}
+
+// authorize sets the Authorization header for req.
+func (d *digestAuth) authorize(req *http.Request) {
+	d.mu.Lock()
+	d.nc++
+	nc := fmt.Sprintf("%08x", d.nc)
+	d.mu.Unlock()
+
+	newHash, sess, _ := d.ch.hashFunc()
+	h := func(s string) string {
+		hh := newHash()
+		hh.Write([]byte(s))
+		return hex.EncodeToString(hh.Sum(nil))
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	cnonce := hex.EncodeToString(b)
+
+	uri := req.URL.RequestURI()
+	ha1 := h(d.username + ":" + d.ch.realm + ":" + d.password)
+	if sess {
+		ha1 = h(ha1 + ":" + d.ch.nonce + ":" + cnonce)
+	}
+	ha2 := h(req.Method + ":" + uri)
+
+	username := d.username
+	if d.ch.userhash {
+		username = h(d.username + ":" + d.ch.realm)
+	}
+
+	var response string
+	params := []string{
+		fmt.Sprintf("username=%q", username),
+		fmt.Sprintf("realm=%q", d.ch.realm),
+		fmt.Sprintf("nonce=%q", d.ch.nonce),
+		fmt.Sprintf("uri=%q", uri),
+		"algorithm=" + d.ch.algorithm,
+	}
+	if len(d.ch.qop) > 0 {
+		response = h(strings.Join([]string{ha1, d.ch.nonce, nc, cnonce, "auth", ha2}, ":"))
+		params = append(params, "qop=auth", "nc="+nc, fmt.Sprintf("cnonce=%q", cnonce))
+	} else {
+		// RFC 2069 compatibility
+		response = h(ha1 + ":" + d.ch.nonce + ":" + ha2)
+	}
+	params = append(params, fmt.Sprintf("response=%q", response))
+	if d.ch.opaque != "" {
+		params = append(params, fmt.Sprintf("opaque=%q", d.ch.opaque))
+	}
+	if d.ch.userhash {
+		params = append(params, "userhash=true")
+	}
+	req.Header.Set("Authorization", "Digest "+strings.Join(params, ", "))
+}
+
+// doWithDigest sends req and, if the server answers 401 with a Digest
+// challenge and creds are available, retries it once with a Digest
+// Authorization header. Without creds, the client's own Basic
+// credentials are used. req must not have a body.
+func doWithDigest(client *http.Client, req *http.Request, creds *url.Userinfo) (*http.Response, error) {
+	if t, ok := client.Transport.(headerTransport); ok && creds == nil {
+		creds = t.auth
+	}
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || creds == nil {
+		return resp, err
+	}
+
+	auth, err := newDigestAuth(resp, creds)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if auth == nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	retry := req.Clone(req.Context())
+	auth.authorize(retry)
+	resp, err = client.Do(retry)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		return nil, &downloadError{code: "auth_failed", err: fmt.Errorf("digest authentication failed: wrong credentials")}
+	}
+	return resp, nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	// defaultIndexDepth is how many directory levels a recursive URL
+	// descends when its depth isn't given, and maxIndexDepth the most
+	// it may be given.
+	defaultIndexDepth = 5
+	maxIndexDepth     = 20
+
+	// maxIndexFiles and maxIndexPages cap how many files one recursive
+	// URL expands to and how many index pages are read finding them.
+	maxIndexFiles = 10000
+	maxIndexPages = 1000
+
+	maxIndexPageSize = 8 << 20
+)
+
+// errEmptyIndex is returned for a directory index with no files to
+// download, after the include and exclude patterns.
+var errEmptyIndex = errors.New("no files in the directory index")
+
+// errNotIndex is returned for a recursive URL that doesn't serve an HTML
+// page.
+var errNotIndex = errors.New("not an HTML directory index")
+
+// hrefPattern finds the links of an index page. Autoindex pages from
+// nginx, Apache and lighttpd are plain enough not to need an HTML parser.
+var hrefPattern = regexp.MustCompile(`(?i)<a\s[^>]*?href\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+
+// RecursiveIndex asks for a URL serving a directory index, such as an
+// nginx or Apache "Index of /" page, to be downloaded with every file
+// under it. Depth is how many directory levels to descend, 1 being the
+// page's own files; Include and Exclude are glob patterns, such as
+// "*.iso", matched against each file's name, or its path below the
+// index if the pattern has a "/".
+type RecursiveIndex struct {
+	Depth   int      `json:"depth,omitempty"`
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// checkRecursive validates a request's recursive settings.
+func checkRecursive(req DownloadRequest) error {
+	for u, index := range req.Recursive {
+		if !slices.Contains(req.URLs, u) {
+			return fmt.Errorf("recursive given for %s, which is not in urls", u)
+		}
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return fmt.Errorf("recursive only applies to HTTP(S) directory indexes: %s", u)
+		}
+		if index.Depth < 0 || index.Depth > maxIndexDepth {
+			return fmt.Errorf("recursive depth for %s must be between 1 and %d", u, maxIndexDepth)
+		}
+		for _, pattern := range append(append([]string(nil), index.Include...), index.Exclude...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid recursive pattern %q for %s", pattern, u)
+			}
+		}
+	}
+	return nil
+}
+
+// matches reports whether the file at rel, its path below the index,
+// passes the include and exclude patterns.
+func (index RecursiveIndex) matches(rel string) bool {
+	match := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			name := path.Base(rel)
+			if strings.Contains(pattern, "/") {
+				name = rel
+			}
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if len(index.Include) > 0 && !match(index.Include) {
+		return false
+	}
+	return !match(index.Exclude)
+}
+
+// expandIndexes replaces every URL of urls that recursive names with the
+// URLs of the files under its directory index. It returns the new list
+// and the directory, relative to the output directory, that mirrors each
+// file's place below its index. The files are sent the index's headers
+// and credentials.
+func expandIndexes(ctx context.Context, urls []string, recursive map[string]RecursiveIndex, opts downloadOptions) ([]string, map[string]string, error) {
+	var expanded []string
+	dirs := make(map[string]string)
+	for _, raw := range urls {
+		index, ok := recursive[raw]
+		if !ok {
+			expanded = append(expanded, raw)
+			continue
+		}
+		files, err := crawlIndex(ctx, raw, index, opts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read the directory index %s: %w", raw, err)
+		}
+		for _, f := range files {
+			expanded = append(expanded, f.url)
+			dirs[f.url] = relativeDir(f.rel)
+			if h, ok := opts.headers[raw]; ok {
+				opts.headers[f.url] = h
+			}
+			if auth, ok := opts.basicAuth[raw]; ok {
+				opts.basicAuth[f.url] = auth
+			}
+		}
+	}
+	return expanded, dirs, nil
+}
+
+// indexFile is a file found under a directory index: its URL and its
+// path below the index, unescaped.
+type indexFile struct {
+	url string
+	rel string
+}
+
+// crawlIndex walks the directory index at rawURL breadth first. Only
+// links below the index's own directory on the same host are followed,
+// so parent links, absolute links elsewhere and cycles lead nowhere;
+// links with a query, such as the column-sorting ones, are skipped.
+func crawlIndex(ctx context.Context, rawURL string, index RecursiveIndex, opts downloadOptions) ([]indexFile, error) {
+	client, err := downloadClient(rawURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	depth := index.Depth
+	if depth == 0 {
+		depth = defaultIndexDepth
+	}
+
+	type page struct {
+		url   *url.URL
+		level int
+	}
+	start, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var root *url.URL
+	queue := []page{{start, 1}}
+	seen := map[string]bool{}
+	var files []indexFile
+	for pages := 0; len(queue) > 0; pages++ {
+		if pages == maxIndexPages {
+			return nil, fmt.Errorf("more than %d index pages; submit a narrower directory", maxIndexPages)
+		}
+		p := queue[0]
+		queue = queue[1:]
+		base, links, err := fetchIndexPage(ctx, client, p.url.String())
+		if err != nil {
+			if root == nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%s: %w", p.url, err)
+		}
+		if root == nil {
+			// A redirect, such as /pub to /pub/, moves the index.
+			root = base.ResolveReference(&url.URL{Path: "./"})
+			seen[root.String()] = true
+		}
+		for _, href := range links {
+			ref, err := url.Parse(href)
+			if err != nil || ref.RawQuery != "" {
+				continue
+			}
+			target := base.ResolveReference(ref)
+			target.Fragment = ""
+			if target.Scheme != root.Scheme || target.Host != root.Host || !strings.HasPrefix(target.Path, root.Path) || target.Path == root.Path {
+				continue
+			}
+			if seen[target.String()] {
+				continue
+			}
+			seen[target.String()] = true
+			rel := strings.TrimPrefix(target.Path, root.Path)
+			if strings.HasSuffix(target.Path, "/") {
+				if p.level < depth {
+					queue = append(queue, page{target, p.level + 1})
+				}
+				continue
+			}
+			if !index.matches(rel) {
+				continue
+			}
+			files = append(files, indexFile{url: target.String(), rel: rel})
+			if len(files) > maxIndexFiles {
+				return nil, fmt.Errorf("more than %d files under the index; submit a narrower directory", maxIndexFiles)
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, errEmptyIndex
+	}
+	return files, nil
+}
+
+// fetchIndexPage fetches one index page and returns the URL it was
+// served from, after redirects, and the targets of its links.
+func fetchIndexPage(ctx context.Context, client *http.Client, rawURL string) (*url.URL, []string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := doWithDigest(client, req, req.URL.User)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, statusError(resp)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, nil, errNotIndex
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxIndexPageSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	var links []string
+	for _, m := range hrefPattern.FindAllStringSubmatch(string(body), -1) {
+		links = append(links, html.UnescapeString(m[1]+m[2]+m[3]))
+	}
+	return resp.Request.URL, links, nil
+}
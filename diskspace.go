@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var diskMargin = flag.Int64("disk-margin", 256<<20, "bytes of free space downloads must leave on the disk they write to (0 = none)")
+
+// diskWatchInterval is how often a download of unknown size checks that
+// the disk isn't running out.
+const diskWatchInterval = 5 * time.Second
+
+// formatSize renders a byte count the way the web UI does, such as
+// "4.2 GB".
+func formatSize(bytes int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	size, i := float64(bytes), 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	return fmt.Sprintf("%.1f %s", size, units[i])
+}
+
+// checkDiskSpace fails with error code insufficient_space if writing
+// need more bytes into dir would leave less than -disk-margin free. Where
+// free space can't be read, it lets the download go ahead.
+func checkDiskSpace(dir string, need int64) error {
+	free, err := diskFree(existingParent(dir))
+	if err != nil || need <= 0 {
+		return nil
+	}
+	if want := need + *diskMargin; uint64(want) > free {
+		return &downloadError{code: "insufficient_space", err: fmt.Errorf("insufficient disk space: need %s, have %s", formatSize(want), formatSize(int64(free)))}
+	}
+	return nil
+}
+
+// watchDiskSpace checks dir's free space every diskWatchInterval until
+// stop is closed, calling abort once if it drops below -disk-margin. It
+// guards downloads whose size isn't known up front.
+func watchDiskSpace(key, dir string, stop <-chan struct{}, abort func(error)) {
+	if *diskMargin <= 0 {
+		return
+	}
+	ticker := time.NewTicker(diskWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		free, err := diskFree(dir)
+		if err != nil || free >= uint64(*diskMargin) {
+			continue
+		}
+		err = &downloadError{code: "insufficient_space", err: fmt.Errorf("insufficient disk space: %s left, below the %s margin", formatSize(int64(free)), formatSize(*diskMargin))}
+		addDownloadEvent(key, "low_disk_space", err.Error())
+		abort(err)
+		return
+	}
+}
+
+// handleDiskInfo reports the free space where ?outputDir= (or the default
+// root) is, so clients can warn before submitting large downloads.
+func handleDiskInfo(w http.ResponseWriter, r *http.Request) {
+	dir, ok := resolveOutputDir(r.URL.Query().Get("outputDir"))
+	if !ok {
+		httpErrorWith(w, r, fmt.Sprintf("Output directory %s is not inside an allowed root", dir), http.StatusBadRequest, map[string]interface{}{
+			"code":         "output_dir_not_allowed",
+			"allowedRoots": allowedRootPaths(),
+		})
+		return
+	}
+	free, err := diskFree(existingParent(dir))
+	if err != nil {
+		httpError(w, r, fmt.Sprintf("Free space is unknown: %v", err), http.StatusNotImplemented)
+		return
+	}
+	available := int64(free) - *diskMargin
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"outputDir":      displayPath(dir),
+		"freeBytes":      free,
+		"marginBytes":    *diskMargin,
+		"availableBytes": max(available, 0),
+	})
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	dnsCacheEnabled = flag.Bool("dns-cache", true, "cache DNS answers for downloads, honouring record TTLs")
+	dnsMinTTL       = flag.Duration("dns-min-ttl", 30*time.Second, "shortest time a DNS answer is cached")
+	dnsMaxTTL       = flag.Duration("dns-max-ttl", time.Hour, "longest time a DNS answer is cached")
+	dnsStaleTTL     = flag.Duration("dns-stale-ttl", 5*time.Minute, "how long past expiry a cached answer is still used while the resolver is unreachable")
+	dnsMaxQPS       = flag.Int("dns-max-qps", 0, "maximum DNS queries per second sent to the resolver (0 = unlimited)")
+)
+
+const dnsQueryTimeout = 3 * time.Second
+
+// dnsEntry is one cached answer.
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// dnsFlight lets concurrent lookups of the same host share one query.
+type dnsFlight struct {
+	done  chan struct{}
+	addrs []string
+	stale bool
+	err   error
+}
+
+// dnsCache resolves host names for the download engine's dialer. Answers
+// come from the hosts file or straight from the system's name servers,
+// so the records' TTLs are known.
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+	flights map[string]*dnsFlight
+	next    time.Time // earliest time the next upstream query may go out
+
+	hits, misses, stale atomic.Int64
+}
+
+var resolverCache = &dnsCache{
+	entries: make(map[string]*dnsEntry),
+	flights: make(map[string]*dnsFlight),
+}
+
+type downloadKeyCtx struct{}
+
+// withDownloadKey tags ctx with the download it belongs to so the dialer
+// can record DNS events against it.
+func withDownloadKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, downloadKeyCtx{}, key)
+}
+
+func downloadKeyFrom(ctx context.Context) string {
+	key, _ := ctx.Value(downloadKeyCtx{}).(string)
+	return key
+}
+
+// lookup returns the addresses of host. stale is true when an expired
+// entry was used because the resolver couldn't be reached.
+func (c *dnsCache) lookup(ctx context.Context, host string) (addrs []string, stale bool, err error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{host}, false, nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	c.mu.Lock()
+	if e, ok := c.entries[host]; ok && time.Now().Before(e.expires) {
+		c.mu.Unlock()
+		c.hits.Add(1)
+		return e.addrs, false, nil
+	}
+	c.misses.Add(1)
+	if f, ok := c.flights[host]; ok {
+		c.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.addrs, f.stale, f.err
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+	f := &dnsFlight{done: make(chan struct{})}
+	c.flights[host] = f
+	c.mu.Unlock()
+
+	f.addrs, f.stale, f.err = c.resolve(ctx, host)
+
+	c.mu.Lock()
+	delete(c.flights, host)
+	c.mu.Unlock()
+	close(f.done)
+	return f.addrs, f.stale, f.err
+}
+
+func (c *dnsCache) resolve(ctx context.Context, host string) ([]string, bool, error) {
+	if addrs := hostsFileLookup(host); len(addrs) > 0 {
+		c.store(host, addrs, *dnsMaxTTL)
+		return addrs, false, nil
+	}
+
+	c.throttle()
+	addrs, ttl, err := queryNameservers(ctx, host)
+	if err == nil {
+		c.store(host, addrs, ttl)
+		return addrs, false, nil
+	}
+
+	var dnsErr *net.DNSError
+	unreachable := !errors.As(err, &dnsErr) || !dnsErr.IsNotFound
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	c.mu.Unlock()
+	if unreachable && ok && time.Since(e.expires) < *dnsStaleTTL {
+		c.stale.Add(1)
+		return e.addrs, true, nil
+	}
+	return nil, false, err
+}
+
+func (c *dnsCache) store(host string, addrs []string, ttl time.Duration) {
+	ttl = min(max(ttl, *dnsMinTTL), *dnsMaxTTL)
+	c.mu.Lock()
+	c.entries[host] = &dnsEntry{addrs: addrs, expires: time.Now().Add(ttl)}
+	c.mu.Unlock()
+}
+
+// throttle spaces upstream queries to at most -dns-max-qps.
+func (c *dnsCache) throttle() {
+	if *dnsMaxQPS <= 0 {
+		return
+	}
+	c.mu.Lock()
+	now := time.Now()
+	at := c.next
+	if at.Before(now) {
+		at = now
+	}
+	c.next = at.Add(time.Second / time.Duration(*dnsMaxQPS))
+	c.mu.Unlock()
+	time.Sleep(at.Sub(now))
+}
+
+// flush drops the cached answer for host, or every answer if host is
+// empty, and returns how many were dropped.
+func (c *dnsCache) flush(host string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if host == "" {
+		n := len(c.entries)
+		c.entries = make(map[string]*dnsEntry)
+		return n
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if _, ok := c.entries[host]; ok {
+		delete(c.entries, host)
+		return 1
+	}
+	return 0
+}
+
+func (c *dnsCache) stats() map[string]interface{} {
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+	return map[string]interface{}{
+		"enabled": *dnsCacheEnabled,
+		"entries": entries,
+		"hits":    c.hits.Load(),
+		"misses":  c.misses.Load(),
+		"stale":   c.stale.Load(),
+	}
+}
+
+// lookupHost resolves host through the cache, or directly when the cache
+// is disabled.
+func lookupHost(ctx context.Context, host string) ([]string, error) {
+	if !*dnsCacheEnabled {
+		return net.DefaultResolver.LookupHost(ctx, host)
+	}
+	addrs, _, err := resolverCache.lookup(ctx, host)
+	return addrs, err
+}
+
+// hostsFileLookup returns host's addresses from /etc/hosts.
+func hostsFileLookup(host string) []string {
+	f, err := os.Open("/etc/hosts")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var addrs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			if strings.EqualFold(strings.TrimSuffix(name, "."), host) {
+				addrs = append(addrs, fields[0])
+				break
+			}
+		}
+	}
+	return addrs
+}
+
+// nameservers returns the name servers from /etc/resolv.conf.
+func nameservers() []string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	return servers
+}
+
+// queryNameservers looks up the A and AAAA records of host and returns
+// them with the smallest TTL among them. Without a resolv.conf (or if an
+// answer doesn't fit in a UDP response) it falls back to the system
+// resolver, whose answers come without TTLs.
+func queryNameservers(ctx context.Context, host string) ([]string, time.Duration, error) {
+	servers := nameservers()
+	if len(servers) == 0 {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		return addrs, 0, err
+	}
+
+	var lastErr error
+	for _, server := range servers {
+		var addrs []string
+		ttl := time.Duration(-1)
+		notFound := 0
+		var err error
+		for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+			var found []string
+			var foundTTL time.Duration
+			found, foundTTL, err = dnsQuery(ctx, server, host, qtype)
+			if errors.Is(err, errDNSTruncated) {
+				addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+				return addrs, 0, err
+			}
+			if errors.Is(err, errDNSNotFound) {
+				notFound++
+				err = nil
+				continue
+			}
+			if err != nil {
+				break
+			}
+			addrs = append(addrs, found...)
+			if len(found) > 0 && (ttl < 0 || foundTTL < ttl) {
+				ttl = foundTTL
+			}
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(addrs) == 0 {
+			return nil, 0, &net.DNSError{Err: "no such host", Name: host, Server: server, IsNotFound: true}
+		}
+		return addrs, ttl, nil
+	}
+	return nil, 0, &net.DNSError{Err: lastErr.Error(), Name: host, IsTemporary: true}
+}
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+)
+
+var (
+	errDNSNotFound  = errors.New("no such host")
+	errDNSTruncated = errors.New("truncated response")
+)
+
+// dnsQuery sends one recursive query over UDP and parses the addresses
+// and TTLs in the answer section.
+func dnsQuery(ctx context.Context, server, host string, qtype uint16) ([]string, time.Duration, error) {
+	msg := make([]byte, 12, 512)
+	var id [2]byte
+	rand.Read(id[:])
+	copy(msg, id[:])
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(msg[4:], 1)      // one question
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, fmt.Errorf("invalid host name %q", host)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, 1)
+
+	ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, 0, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		resp := buf[:n]
+		if n < 12 || resp[0] != id[0] || resp[1] != id[1] {
+			continue // not our answer
+		}
+		return parseDNSAnswer(resp, qtype)
+	}
+}
+
+func parseDNSAnswer(resp []byte, qtype uint16) ([]string, time.Duration, error) {
+	flags := binary.BigEndian.Uint16(resp[2:])
+	if flags&0x0200 != 0 {
+		return nil, 0, errDNSTruncated
+	}
+	switch flags & 0x000f {
+	case 0:
+	case 3:
+		return nil, 0, errDNSNotFound
+	default:
+		return nil, 0, fmt.Errorf("server returned rcode %d", flags&0x000f)
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(resp[4:]))
+	ancount := int(binary.BigEndian.Uint16(resp[6:]))
+	off := 12
+	var err error
+	for i := 0; i < qdcount; i++ {
+		if off, err = skipDNSName(resp, off); err != nil {
+			return nil, 0, err
+		}
+		off += 4
+	}
+
+	var addrs []string
+	ttl := time.Duration(-1)
+	for i := 0; i < ancount; i++ {
+		if off, err = skipDNSName(resp, off); err != nil {
+			return nil, 0, err
+		}
+		if off+10 > len(resp) {
+			return nil, 0, errors.New("short DNS answer")
+		}
+		rtype := binary.BigEndian.Uint16(resp[off:])
+		rttl := time.Duration(binary.BigEndian.Uint32(resp[off+4:])) * time.Second
+		rdlen := int(binary.BigEndian.Uint16(resp[off+8:]))
+		off += 10
+		if off+rdlen > len(resp) {
+			return nil, 0, errors.New("short DNS answer")
+		}
+		if rtype == qtype && (rdlen == net.IPv4len || rdlen == net.IPv6len) {
+			addrs = append(addrs, net.IP(resp[off:off+rdlen]).String())
+			if ttl < 0 || rttl < ttl {
+				ttl = rttl
+			}
+		}
+		off += rdlen
+	}
+	if len(addrs) == 0 {
+		return nil, 0, errDNSNotFound
+	}
+	return addrs, ttl, nil
+}
+
+func skipDNSName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			return off + 2, nil // compression pointer ends the name
+		default:
+			off += 1 + l
+		}
+	}
+	return 0, errors.New("malformed DNS name")
+}
+
+// handleFlushDNS drops cached DNS answers for ?host=, or all of them.
+func handleFlushDNS(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Query().Get("host")
+	n := resolverCache.flush(host)
+	logf(r.Context(), "Flushed %d DNS cache entries", n)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"flushed": n})
+}
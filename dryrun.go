@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// SubmissionResult describes what happens to one submitted URL. The
+// same shape is returned for dry runs, where it is a prediction.
+type SubmissionResult struct {
+	ID           string `json:"id,omitempty"`
+	URL          string `json:"url"`
+	Accepted     bool   `json:"accepted"`
+	Reason       string `json:"reason,omitempty"`
+	Kind         string `json:"kind"`
+	FileName     string `json:"fileName"`
+	Path         string `json:"path"`
+	Size         *int64 `json:"size,omitempty"`
+	Deduplicated bool   `json:"deduplicated,omitempty"`
+	Duplicate    bool   `json:"duplicate,omitempty"`
+	Existing     string `json:"existing,omitempty"`
+	BlockedHost  string `json:"blockedHost,omitempty"`
+
+	// What normalization changed in the submitted URL, if anything.
+	Normalized []string `json:"normalized,omitempty"`
+
+	// existingID is the queued or running download of the same URL
+	// into the same directory, if there is one, and reused whether the
+	// URL was answered with it or an earlier listing's download instead
+	// of a new one.
+	existingID string
+	reused     bool
+}
+
+// inFlight reports whether a download in status is queued or running.
+func inFlight(status string) bool {
+	return status == "queued" || status == "downloading" || status == "retrying"
+}
+
+// submissionResults describes urls as they are queued: file name, path
+// and kind, plus the status of any unfinished download of the same URL
+// into the same directory.
+func submissionResults(urls []string, outputDir string, opts downloadOptions) []SubmissionResult {
+	results := make([]SubmissionResult, 0, len(urls))
+
+	downloadsMutex.Lock()
+	defer downloadsMutex.Unlock()
+	for _, u := range urls {
+		fileName := defaultFileName(u)
+		dir, destination := objectLocation(u, outputDir, opts.destination, opts.objectDirs)
+		result := SubmissionResult{
+			URL:      u,
+			Accepted: true,
+			Kind:     "http",
+			FileName: fileName,
+			Path:     filepath.Join(dir, fileName),
+		}
+		switch {
+		case strings.HasPrefix(u, "magnet:") || strings.HasSuffix(u, ".torrent"):
+			result.Kind = "torrent"
+			result.Path = dir // the torrent's name isn't known until its metadata arrives
+		case isFTPLink(u):
+			result.Kind = "ftp"
+		case isSFTPLink(u):
+			result.Kind = "sftp"
+		case isHLSLink(u) && !opts.hlsPlaylistOnly:
+			result.Kind = "hls"
+			result.FileName = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".ts"
+			result.Path = filepath.Join(dir, result.FileName)
+		case isS3Link(u):
+			result.Kind = "s3"
+		case isMetalinkLink(u):
+			result.Kind = "metalink"
+			result.Path = dir // the names are in the Metalink file
+		case opts.followLinkNext:
+			result.Kind = "pages"
+		}
+		if destination != "" {
+			result.Path = strings.TrimSuffix(destination, "/") + "/" + result.FileName
+		}
+		for id, existing := range activeDownloads {
+			if existing.URL == u && existing.OutputDir == dir && !existing.Completed && (result.existingID == "" || !inFlight(result.Existing)) {
+				result.Existing = existing.Status
+				if inFlight(existing.Status) {
+					result.existingID = id
+				}
+			}
+		}
+		applyHostPolicy(&result, opts)
+		results = append(results, result)
+	}
+	return results
+}
+
+// markDuplicates flags every repeat of a URL listed earlier in results.
+func markDuplicates(results []SubmissionResult) {
+	seen := make(map[string]bool, len(results))
+	for i := range results {
+		results[i].Duplicate = seen[results[i].URL]
+		seen[results[i].URL] = true
+	}
+}
+
+// assignIDs gives every result the ID of a new download, or, unless
+// allowDuplicate is set, that of the download it duplicates: the one of
+// an earlier listing of the same URL, or a queued or running download
+// of it into the same directory. It returns the IDs in order and the
+// reused ones.
+func assignIDs(results []SubmissionResult, allowDuplicate bool) ([]string, []string) {
+	ids := make([]string, len(results))
+	var reused []string
+	first := make(map[string]string, len(results))
+	for i := range results {
+		result := &results[i]
+		switch {
+		case allowDuplicate || result.BlockedHost != "":
+			result.ID = newDownloadID()
+		case first[result.URL] != "":
+			result.ID, result.reused = first[result.URL], true
+		case result.existingID != "":
+			result.ID, result.reused = result.existingID, true
+		default:
+			result.ID = newDownloadID()
+		}
+		if first[result.URL] == "" {
+			first[result.URL] = result.ID
+		}
+		if result.reused && !slices.Contains(reused, result.ID) {
+			reused = append(reused, result.ID)
+		}
+		ids[i] = result.ID
+	}
+	return ids, reused
+}
+
+// rejectInvalid applies the per-URL checks an atomic batch must pass:
+// the URL must be one the engine can fetch and, with allowDuplicate,
+// must not be listed twice or duplicate a download into the same
+// directory that is still queued or running, which would otherwise be
+// reused. It reports whether every URL passed.
+func rejectInvalid(results []SubmissionResult, allowDuplicate bool) bool {
+	ok := true
+	for i := range results {
+		result := &results[i]
+		u, err := url.Parse(result.URL)
+		switch {
+		case !result.Accepted:
+		case result.Kind != "torrent" && (err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "ftp" && u.Scheme != "sftp" && u.Scheme != "s3") || u.Host == ""):
+			result.Accepted = false
+			result.Reason = "not an http(s), ftp, sftp or s3 URL, magnet link or torrent file"
+		case !allowDuplicate:
+		case result.Duplicate:
+			result.Accepted = false
+			result.Reason = "listed more than once in the batch"
+		case inFlight(result.Existing):
+			result.Accepted = false
+			result.Reason = fmt.Sprintf("already %s", result.Existing)
+		}
+		if !result.Accepted {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// previewSubmission predicts what submitting urls would do without
+// creating any download records or files. HTTP and S3 URLs are probed
+// with a HEAD request for their size and whether the server would serve them;
+// hosts whose circuit breaker is tripped are reported as rejected, as
+// are downloads over the size limit or that would not fit in the free
+// space of outputDir.
+func previewSubmission(urls []string, outputDir string, opts downloadOptions) []SubmissionResult {
+	results := submissionResults(urls, outputDir, opts)
+	markDuplicates(results)
+	sem := make(chan struct{}, preflightConcurrency)
+	var wg sync.WaitGroup
+	for i := range results {
+		result := &results[i]
+		if result.Kind == "torrent" || result.Kind == "ftp" || result.Kind == "sftp" || result.Kind == "hls" || result.Kind == "metalink" || result.Duplicate || !result.Accepted {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			client, err := downloadClient(result.URL, opts)
+			if err != nil {
+				client = httpClient
+			}
+			previewHTTP(client, result)
+		}()
+	}
+	wg.Wait()
+
+	if limit := opts.sizeLimit(); limit > 0 {
+		for i := range results {
+			if result := &results[i]; result.Accepted && result.Size != nil && *result.Size > limit {
+				result.Accepted = false
+				result.Reason = fmt.Sprintf("exceeded size limit: %d bytes is more than the %d allowed", *result.Size, limit)
+			}
+		}
+	}
+
+	// Walk the batch in order, rejecting whatever no longer fits.
+	if free, err := diskFree(existingParent(outputDir)); err == nil {
+		needed := uint64(max(*diskMargin, 0))
+		for i := range results {
+			result := &results[i]
+			if !result.Accepted || result.Size == nil || result.Deduplicated || result.Duplicate {
+				continue
+			}
+			needed += uint64(*result.Size)
+			if needed > free {
+				result.Accepted = false
+				result.Reason = fmt.Sprintf("not enough disk space: the batch needs %d bytes up to this download, including the -disk-margin, %d bytes free", needed, free)
+			}
+		}
+	}
+	return results
+}
+
+func previewHTTP(client *http.Client, result *SubmissionResult) {
+	u, err := url.Parse(result.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "s3") || u.Host == "" {
+		result.Accepted = false
+		result.Reason = "not an http(s) or s3 URL, magnet link or torrent file"
+		return
+	}
+	if reason, down := breakerDown(u.Host); down {
+		result.Accepted = false
+		result.Reason = reason
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, result.URL, nil)
+	if err != nil {
+		result.Accepted = false
+		result.Reason = err.Error()
+		return
+	}
+	resp, err := doWithDigest(client, req, u.User)
+	if err != nil {
+		result.Accepted = false
+		result.Reason = fmt.Sprintf("probe failed: %v", err)
+		var hostErr *hostNotAllowedError
+		if errors.As(err, &hostErr) {
+			result.BlockedHost = hostErr.host
+		}
+		return
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented:
+		result.Reason = "server doesn't answer HEAD requests; size unknown"
+		return
+	case resp.StatusCode != http.StatusOK:
+		result.Accepted = false
+		result.Reason = fmt.Sprintf("server answered %s", resp.Status)
+		return
+	}
+	if resp.ContentLength >= 0 {
+		size := resp.ContentLength
+		result.Size = &size
+	}
+	if name := responseFileName(resp); name != "" && name != result.FileName {
+		result.Path = strings.TrimSuffix(result.Path, result.FileName) + name
+		result.FileName = name
+	}
+	if _, ok := casLookup(result.URL, resp.ContentLength); ok {
+		result.Deduplicated = true
+	}
+}
+
+// existingParent returns dir or its nearest ancestor that exists, so free
+// space can be checked before the directory is created.
+func existingParent(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
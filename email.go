@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"html"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	smtpHost     = flag.String("smtp-host", os.Getenv("YAD_SMTP_HOST"), "SMTP server finished requests are emailed through, also YAD_SMTP_HOST")
+	smtpPort     = flag.String("smtp-port", os.Getenv("YAD_SMTP_PORT"), "SMTP server port (default 587, or 465 with -smtp-tls=tls), also YAD_SMTP_PORT")
+	smtpUser     = flag.String("smtp-user", os.Getenv("YAD_SMTP_USER"), "SMTP username, also YAD_SMTP_USER")
+	smtpPassword = flag.String("smtp-password", os.Getenv("YAD_SMTP_PASSWORD"), "SMTP password; prefer YAD_SMTP_PASSWORD, which doesn't show up in ps")
+	smtpFrom     = flag.String("smtp-from", os.Getenv("YAD_SMTP_FROM"), "sender address of the emails, also YAD_SMTP_FROM")
+	smtpTo       = flag.String("smtp-to", os.Getenv("YAD_SMTP_TO"), "comma-separated addresses every finished request is emailed to unless it names its own notifyEmail, also YAD_SMTP_TO")
+	smtpTLS      = flag.String("smtp-tls", "starttls", `how the SMTP connection is encrypted: "starttls", "tls" from the start, or "none"`)
+)
+
+const (
+	// mailTimeout bounds one attempt at delivering an email, from
+	// connecting to the server to it accepting the message.
+	mailTimeout = time.Minute
+
+	// mailListed is how many downloads an email lists.
+	mailListed = 500
+)
+
+// mailRetryDelays is how long a failed email waits before each retry.
+var mailRetryDelays = []time.Duration{30 * time.Second, 2 * time.Minute, 10 * time.Minute}
+
+// email is a message about a finished request, with how many times it
+// has been tried.
+type email struct {
+	to       []string
+	subject  string
+	text     string
+	html     string
+	attempts int
+}
+
+var (
+	emailEnabled bool
+	defaultTo    []string
+	emails       = make(chan *email, 64)
+)
+
+// initEmail checks the SMTP settings and, if a server is set, starts
+// the goroutine that sends the emails.
+func initEmail() error {
+	if *smtpHost == "" {
+		if *smtpTo != "" || *smtpFrom != "" {
+			return fmt.Errorf("-smtp-to and -smtp-from need -smtp-host")
+		}
+		return nil
+	}
+	switch *smtpTLS {
+	case "starttls", "none":
+		if *smtpPort == "" {
+			*smtpPort = "587"
+		}
+	case "tls":
+		if *smtpPort == "" {
+			*smtpPort = "465"
+		}
+	default:
+		return fmt.Errorf("unknown -smtp-tls %q (want starttls, tls or none)", *smtpTLS)
+	}
+	if port, err := strconv.Atoi(*smtpPort); err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid -smtp-port %q", *smtpPort)
+	}
+	if _, err := mail.ParseAddress(*smtpFrom); err != nil {
+		return fmt.Errorf("-smtp-host needs a valid -smtp-from address: %v", err)
+	}
+	if *smtpTo != "" {
+		to, err := parseRecipients(*smtpTo)
+		if err != nil {
+			return fmt.Errorf("invalid -smtp-to: %v", err)
+		}
+		defaultTo = to
+	}
+	if *smtpPassword != "" && *smtpUser == "" {
+		return fmt.Errorf("-smtp-password given without -smtp-user")
+	}
+	emailEnabled = true
+	go sendEmails()
+	return nil
+}
+
+// parseRecipients splits a comma-separated list of email addresses into
+// the bare addresses.
+func parseRecipients(list string) ([]string, error) {
+	addrs, err := mail.ParseAddressList(list)
+	if err != nil {
+		return nil, err
+	}
+	to := make([]string, len(addrs))
+	for i, addr := range addrs {
+		to[i] = addr.Address
+	}
+	return to, nil
+}
+
+// checkNotifyEmail validates a request's notifyEmail and returns its
+// addresses.
+func checkNotifyEmail(req DownloadRequest) (string, error) {
+	if req.NotifyEmail == "" {
+		return "", nil
+	}
+	if !emailEnabled {
+		return "", fmt.Errorf("notifyEmail given, but this server has no -smtp-host")
+	}
+	to, err := parseRecipients(req.NotifyEmail)
+	if err != nil {
+		return "", fmt.Errorf("invalid notifyEmail: %v", err)
+	}
+	return strings.Join(to, ", "), nil
+}
+
+// mailFinished queues the email for download id's submission once
+// every download of it has finished. The downloads are marked as
+// mailed, so one finishing again after a retry sends none. Call it
+// without downloadsMutex held.
+func mailFinished(id string) {
+	if !emailEnabled {
+		return
+	}
+	downloadsMutex.Lock()
+	download, exists := activeDownloads[id]
+	if !exists || !download.Completed || download.SubmissionID == "" || download.mailed {
+		downloadsMutex.Unlock()
+		return
+	}
+	to := defaultTo
+	if download.notifyEmail != "" {
+		to = strings.Split(download.notifyEmail, ", ")
+	}
+	if len(to) == 0 {
+		downloadsMutex.Unlock()
+		return
+	}
+	batch, done := finishedBatch(download.SubmissionID)
+	if !done {
+		downloadsMutex.Unlock()
+		return
+	}
+	finished := make([]notification, len(batch))
+	for i, d := range batch {
+		finished[i] = newNotification(d)
+		d.mailed = true
+	}
+	downloadsMutex.Unlock()
+
+	m := newEmail(to, download.RequestID, finished)
+	select {
+	case emails <- m:
+	default:
+		log.Printf("Email queue full; not sending %q", m.subject)
+	}
+}
+
+// newEmail describes the finished downloads of request requestID in a
+// table, as plain text and as HTML, failures first.
+func newEmail(to []string, requestID string, finished []notification) *email {
+	var failed, others []notification
+	for _, n := range finished {
+		if n.status == "failed" {
+			failed = append(failed, n)
+		} else {
+			others = append(others, n)
+		}
+	}
+	subject := fmt.Sprintf("yad: %d downloads finished", len(finished))
+	if len(finished) == 1 {
+		subject = "yad: " + finished[0].fileName + " " + strings.ReplaceAll(finished[0].status, "_", " ")
+	}
+	if len(failed) > 0 && len(finished) > 1 {
+		subject += fmt.Sprintf(", %d failed", len(failed))
+	}
+
+	listed := append(failed, others...)
+	more := 0
+	if len(listed) > mailListed {
+		listed, more = listed[:mailListed], len(listed)-mailListed
+	}
+	var text, page strings.Builder
+	fmt.Fprintf(&text, "Request %s finished.\n\n", requestID)
+	fmt.Fprintf(&page, "<p>Request <code>%s</code> finished.</p>\n<table border=\"1\" cellpadding=\"4\" cellspacing=\"0\">\n", html.EscapeString(requestID))
+	page.WriteString("<tr><th>File</th><th>Size</th><th>Status</th><th>Error</th></tr>\n")
+	for _, n := range listed {
+		status := strings.ReplaceAll(n.status, "_", " ")
+		fmt.Fprintf(&text, "%s\t%s\t%s", n.fileName, formatSize(n.size), status)
+		if n.err != "" {
+			fmt.Fprintf(&text, "\t%s", n.err)
+		}
+		text.WriteString("\n")
+		fmt.Fprintf(&page, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(n.fileName), formatSize(n.size), html.EscapeString(status), html.EscapeString(n.err))
+	}
+	page.WriteString("</table>\n")
+	if more > 0 {
+		fmt.Fprintf(&text, "…and %d more\n", more)
+		fmt.Fprintf(&page, "<p>…and %d more</p>\n", more)
+	}
+	return &email{to: to, subject: subject, text: text.String(), html: page.String()}
+}
+
+// sendEmails sends queued emails one at a time. One that fails is
+// queued again after the next of mailRetryDelays, and dropped when they
+// run out.
+func sendEmails() {
+	for m := range emails {
+		err := deliverEmail(m)
+		if err == nil {
+			continue
+		}
+		if m.attempts == len(mailRetryDelays) {
+			log.Printf("Failed to email %q to %s, giving up: %v", m.subject, strings.Join(m.to, ", "), err)
+			continue
+		}
+		delay := mailRetryDelays[m.attempts]
+		m.attempts++
+		log.Printf("Failed to email %q, retrying in %s: %v", m.subject, delay, err)
+		time.AfterFunc(delay, func() {
+			select {
+			case emails <- m:
+			default:
+				log.Printf("Email queue full; not sending %q", m.subject)
+			}
+		})
+	}
+}
+
+// deliverEmail sends m through the SMTP server.
+func deliverEmail(m *email) error {
+	msg, err := m.message()
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(*smtpHost, *smtpPort)
+	tlsConfig := &tls.Config{ServerName: *smtpHost}
+	dialer := &net.Dialer{Timeout: mailTimeout}
+	var conn net.Conn
+	if *smtpTLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(mailTimeout))
+	c, err := smtp.NewClient(conn, *smtpHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if *smtpTLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s doesn't offer STARTTLS", addr)
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if *smtpUser != "" {
+		if err := c.Auth(smtp.PlainAuth("", *smtpUser, *smtpPassword, *smtpHost)); err != nil {
+			return err
+		}
+	}
+	from, _ := mail.ParseAddress(*smtpFrom)
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, to := range m.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// message is m as a MIME message with a plain text and an HTML part.
+func (m *email) message() ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", m.text},
+		{"text/html; charset=utf-8", m.html},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	header := func(name, value string) { fmt.Fprintf(&msg, "%s: %s\r\n", name, value) }
+	header("From", *smtpFrom)
+	header("To", strings.Join(m.to, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", m.subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
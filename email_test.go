@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMailFinishedBySubmission checks that completion emails are grouped
+// by the server's submission ID, so two submissions that reuse a client
+// request ID get an email each, and that a download finishing again
+// sends none.
+func TestMailFinishedBySubmission(t *testing.T) {
+	emailEnabled, defaultTo = true, []string{"ops@example.com"}
+	t.Cleanup(func() { emailEnabled, defaultTo = false, nil })
+
+	records := []*DownloadStatus{
+		{ID: "mail-a1", URL: "https://example.com/a1", FileName: "a1", SubmissionID: "sub-a"},
+		{ID: "mail-a2", URL: "https://example.com/a2", FileName: "a2", SubmissionID: "sub-a"},
+		{ID: "mail-b1", URL: "https://example.com/b1", FileName: "b1", SubmissionID: "sub-b"},
+	}
+	downloadsMutex.Lock()
+	for _, d := range records {
+		d.RequestID, d.Status, d.Completed = "same-client-id", "completed", true
+		activeDownloads[d.ID] = d
+	}
+	downloadsMutex.Unlock()
+	t.Cleanup(func() {
+		downloadsMutex.Lock()
+		for _, d := range records {
+			delete(activeDownloads, d.ID)
+		}
+		downloadsMutex.Unlock()
+	})
+
+	for _, d := range records {
+		mailFinished(d.ID)
+	}
+	var subjects []string
+	for range 2 {
+		select {
+		case m := <-emails:
+			subjects = append(subjects, m.subject)
+		case <-time.After(time.Second):
+			t.Fatalf("got emails %q; want one per submission", subjects)
+		}
+	}
+	if got := strings.Join(subjects, "|"); !strings.Contains(got, "2 downloads finished") || !strings.Contains(got, "b1 completed") {
+		t.Errorf("subjects = %q; want the two of a together and b1 alone", subjects)
+	}
+
+	// A retried download finishing again.
+	mailFinished("mail-a1")
+	select {
+	case m := <-emails:
+		t.Errorf("sent %q again", m.subject)
+	default:
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+)
+
+// maxExtractErrors caps how many failed entries an extraction reports.
+const maxExtractErrors = 20
+
+// archiveFormat returns the format of the archive at path by its
+// extension: "zip", "tar", "tar.gz" or "tar.xz", or "" if it is none
+// yad extracts.
+func archiveFormat(path string) string {
+	name := strings.ToLower(filepath.Base(path))
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(name, ".tar.xz"), strings.HasSuffix(name, ".txz"):
+		return "tar.xz"
+	}
+	return ""
+}
+
+// checkExtract validates a request's extract, urlExtract and
+// deleteArchive.
+func checkExtract(req DownloadRequest) error {
+	urls := append([]string(nil), req.URLs...)
+	for _, entry := range req.Entries {
+		urls = append(urls, entry.url())
+	}
+	extract := req.Extract
+	for url, on := range req.URLExtract {
+		if !slices.Contains(urls, url) {
+			return fmt.Errorf("urlExtract given for %s, which is not in urls", url)
+		}
+		if _, ok := req.Recursive[url]; ok || isS3Prefix(url) {
+			return fmt.Errorf("urlExtract given for %s, which stands for many downloads; use extract", url)
+		}
+		extract = extract || on
+	}
+	if req.DeleteArchive && !extract {
+		return fmt.Errorf("deleteArchive needs extract")
+	}
+	return nil
+}
+
+// extractError is an extraction that failed, listing the entries that
+// couldn't be written and why.
+type extractError struct {
+	entries []string
+}
+
+func (e *extractError) Error() string {
+	return "failed to extract " + strings.Join(e.entries, "; ")
+}
+
+// extractDownload unpacks the archive download id saved at archivePath
+// into a directory named after it next to it, and returns the
+// directory's path. Entries are written to a hidden staging directory
+// first, which only takes the final name if every entry was written, so
+// a failed extraction leaves nothing behind. With deleteArchive, the
+// archive is removed afterwards.
+func extractDownload(id, rawURL, archivePath string, deleteArchive bool) (string, error) {
+	format := archiveFormat(archivePath)
+	dir := filepath.Dir(archivePath)
+	base, _ := splitExt(filepath.Base(archivePath))
+
+	staging, err := os.MkdirTemp(dir, "."+base+".extracting-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	root, err := os.OpenRoot(staging)
+	if err != nil {
+		os.RemoveAll(staging)
+		return "", fmt.Errorf("failed to open staging directory: %v", err)
+	}
+	var failed []string
+	if format == "zip" {
+		failed, err = extractZip(archivePath, root)
+	} else {
+		failed, err = extractTar(archivePath, format, root)
+	}
+	root.Close()
+	if err == nil && len(failed) > 0 {
+		err = &extractError{entries: failed}
+	}
+	if err != nil {
+		os.RemoveAll(staging)
+		return "", err
+	}
+
+	name, err := claimFileName(id, rawURL, dir, base, conflictRename)
+	defer releaseClaims(id)
+	if err != nil {
+		os.RemoveAll(staging)
+		return "", err
+	}
+	target := filepath.Join(dir, name)
+	if err := os.Rename(staging, target); err != nil {
+		os.RemoveAll(staging)
+		return "", fmt.Errorf("failed to move to %s: %v", displayPath(target), err)
+	}
+	if err := os.Chmod(target, 0o755); err != nil {
+		return "", err
+	}
+	if deleteArchive {
+		if err := os.Remove(archivePath); err != nil {
+			return target, fmt.Errorf("extracted, but failed to delete the archive: %v", err)
+		}
+	}
+	return target, nil
+}
+
+// extractZip writes the entries of the zip archive at path under root
+// and returns the ones that failed.
+func extractZip(path string, root *os.Root) ([]string, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("unreadable zip archive: %v", err)
+	}
+	defer r.Close()
+	var failed []string
+	for _, f := range r.File {
+		if err := extractZipEntry(f, root); err != nil {
+			failed = appendExtractError(failed, f.Name, err)
+		}
+	}
+	return failed, nil
+}
+
+func extractZipEntry(f *zip.File, root *os.Root) error {
+	name, err := entryPath(f.Name)
+	if err != nil {
+		return err
+	}
+	mode := f.Mode()
+	switch {
+	case mode.IsDir():
+		return mkdirAll(root, name)
+	case mode&os.ModeSymlink != 0:
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		link, err := io.ReadAll(io.LimitReader(rc, 4096))
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		return writeSymlink(root, name, string(link))
+	case !mode.IsRegular():
+		return fmt.Errorf("unsupported entry type")
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return writeEntry(root, name, rc, mode)
+}
+
+// extractTar writes the entries of the tar archive at path, compressed
+// according to format, under root and returns the ones that failed. A
+// stream that breaks off fails the extraction, since nothing after it
+// can be read.
+func extractTar(path, format string, root *os.Root) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	switch format {
+	case "tar.gz":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("unreadable gzip stream: %v", err)
+		}
+		defer gz.Close()
+		r = gz
+	case "tar.xz":
+		if r, err = xz.NewReader(f); err != nil {
+			return nil, fmt.Errorf("unreadable xz stream: %v", err)
+		}
+	}
+
+	tr := tar.NewReader(r)
+	var failed []string
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return failed, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unreadable tar archive: %v", err)
+		}
+		if err := extractTarEntry(tr, hdr, root); err != nil {
+			failed = appendExtractError(failed, hdr.Name, err)
+		}
+	}
+}
+
+func extractTarEntry(tr *tar.Reader, hdr *tar.Header, root *os.Root) error {
+	name, err := entryPath(hdr.Name)
+	if err != nil {
+		return err
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return mkdirAll(root, name)
+	case tar.TypeReg:
+		return writeEntry(root, name, tr, hdr.FileInfo().Mode())
+	case tar.TypeSymlink:
+		return writeSymlink(root, name, hdr.Linkname)
+	case tar.TypeLink:
+		return writeHardlink(root, name, hdr.Linkname)
+	case tar.TypeXGlobalHeader:
+		return nil
+	}
+	return fmt.Errorf("unsupported entry type %q", hdr.Typeflag)
+}
+
+// entryPath is where the archive entry name goes, relative to the
+// staging directory. Names that would lead outside it, absolute or
+// through "..", are refused.
+func entryPath(name string) (string, error) {
+	name = strings.TrimSuffix(filepath.FromSlash(name), string(filepath.Separator))
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("path escapes the target directory")
+	}
+	return filepath.Clean(name), nil
+}
+
+// mkdirAll creates directory name under root along with its parents.
+// Going through root, a symlink extracted earlier can't lead it outside
+// the staging directory.
+func mkdirAll(root *os.Root, name string) error {
+	if name == "." {
+		return nil
+	}
+	if err := mkdirAll(root, filepath.Dir(name)); err != nil {
+		return err
+	}
+	err := root.Mkdir(name, 0o755)
+	if errors.Is(err, fs.ErrExist) {
+		if info, statErr := root.Stat(name); statErr == nil && info.IsDir() {
+			return nil
+		}
+	}
+	return err
+}
+
+// checkParents refuses to create name if a directory on its way is a
+// symlink. os.Root has no way to create links in Go 1.24, so they are
+// made by path, which must then mean the same as it reads.
+func checkParents(root *os.Root, name string) error {
+	dir := filepath.Dir(name)
+	if dir == "." {
+		return nil
+	}
+	parts := strings.Split(dir, string(filepath.Separator))
+	for i := range parts {
+		parent := filepath.Join(parts[:i+1]...)
+		info, err := root.Lstat(parent)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", filepath.ToSlash(parent))
+		}
+	}
+	return nil
+}
+
+// writeSymlink creates the symlink entry name pointing at link. link
+// must be relative, with any ".." leading it, and stay inside the
+// staging directory, so that neither it nor a chain of links through it
+// can lead outside.
+func writeSymlink(root *os.Root, name, link string) error {
+	link = filepath.FromSlash(link)
+	escapes := filepath.IsAbs(link) || filepath.VolumeName(link) != "" ||
+		!filepath.IsLocal(filepath.Join(filepath.Dir(name), link))
+	descended := false
+	for _, part := range strings.Split(link, string(filepath.Separator)) {
+		switch part {
+		case "..":
+			escapes = escapes || descended
+		case "", ".":
+		default:
+			descended = true
+		}
+	}
+	if escapes {
+		return fmt.Errorf("link to %s escapes the target directory", filepath.ToSlash(link))
+	}
+	if err := mkdirAll(root, filepath.Dir(name)); err != nil {
+		return err
+	}
+	if err := checkParents(root, name); err != nil {
+		return err
+	}
+	return os.Symlink(link, filepath.Join(root.Name(), name))
+}
+
+// writeHardlink creates the hardlink entry name to the regular file
+// extracted earlier as source.
+func writeHardlink(root *os.Root, name, source string) error {
+	source, err := entryPath(source)
+	if err != nil {
+		return err
+	}
+	if err := mkdirAll(root, filepath.Dir(name)); err != nil {
+		return err
+	}
+	if err := checkParents(root, name); err != nil {
+		return err
+	}
+	if err := checkParents(root, source); err != nil {
+		return err
+	}
+	info, err := root.Lstat(source)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("link to %s, which is not a regular file", filepath.ToSlash(source))
+	}
+	return os.Link(filepath.Join(root.Name(), source), filepath.Join(root.Name(), name))
+}
+
+// writeEntry writes a regular file entry. An existing path is never
+// written through, so an earlier symlink entry can't redirect it.
+func writeEntry(root *os.Root, name string, r io.Reader, mode os.FileMode) error {
+	if err := mkdirAll(root, filepath.Dir(name)); err != nil {
+		return err
+	}
+	f, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm()|0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func appendExtractError(failed []string, name string, err error) []string {
+	if len(failed) == maxExtractErrors {
+		return append(failed, "…")
+	}
+	if len(failed) > maxExtractErrors {
+		return failed
+	}
+	return append(failed, fmt.Sprintf("%s: %v", name, err))
+}
+
+// markExtracted records where download id's archive was extracted.
+func markExtracted(id, path string) {
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[id]; exists {
+		download.ExtractedPath = displayPath(path)
+		download.ExtractErrors = nil
+	}
+	downloadsMutex.Unlock()
+	addDownloadEvent(id, "extracted", "extracted to "+displayPath(path))
+}
+
+// markExtractFailed records why download id's archive wasn't extracted.
+func markExtractFailed(id string, err error) {
+	var entries []string
+	var eerr *extractError
+	if errors.As(err, &eerr) {
+		entries = eerr.entries
+	}
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[id]; exists {
+		download.ExtractErrors = entries
+	}
+	downloadsMutex.Unlock()
+	addDownloadEvent(id, "extract_failed", err.Error())
+}
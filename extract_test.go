@@ -0,0 +1,254 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tarEntry is an entry of a test archive: a regular file with body, a
+// directory, or with typeflag a symlink or hardlink to link.
+type tarEntry struct {
+	name     string
+	typeflag byte
+	link     string
+	body     string
+}
+
+func writeTestTar(t *testing.T, path string, entries []tarEntry) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.link, Mode: 0o644, Size: int64(len(e.body))}
+		if e.typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0o755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// extractTestTar extracts entries into a staging directory inside a
+// fresh directory and returns both, with the entries that failed.
+func extractTestTar(t *testing.T, entries []tarEntry) (outer, staging string, failed []string) {
+	t.Helper()
+	outer = t.TempDir()
+	archive := filepath.Join(outer, "test.tar")
+	writeTestTar(t, archive, entries)
+	staging = filepath.Join(outer, "a", "b", "staging")
+	if err := os.MkdirAll(staging, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	root, err := os.OpenRoot(staging)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	failed, err = extractTar(archive, "tar", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return outer, staging, failed
+}
+
+// assertContained fails the test if a file named name exists anywhere
+// under outer but outside staging.
+func assertContained(t *testing.T, outer, staging, name string) {
+	t.Helper()
+	filepath.WalkDir(outer, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == staging {
+			return filepath.SkipDir
+		}
+		if d.Name() == name {
+			t.Errorf("%s was written outside the staging directory", path)
+		}
+		return nil
+	})
+}
+
+func failedEntry(failed []string, name string) bool {
+	for _, f := range failed {
+		if strings.HasPrefix(f, name+": ") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestExtractTar(t *testing.T) {
+	_, staging, failed := extractTestTar(t, []tarEntry{
+		{name: "release/", typeflag: tar.TypeDir},
+		{name: "release/bin/tool", body: "binary"},
+		{name: "release/README", body: "read me"},
+		{name: "release/docs", typeflag: tar.TypeSymlink, link: "README"},
+		{name: "release/bin/readme", typeflag: tar.TypeSymlink, link: "../README"},
+		{name: "release/bin/tool2", typeflag: tar.TypeLink, link: "release/bin/tool"},
+	})
+	if len(failed) > 0 {
+		t.Fatalf("failed entries: %v", failed)
+	}
+	for name, want := range map[string]string{
+		"release/bin/tool":   "binary",
+		"release/docs":       "read me",
+		"release/bin/readme": "read me",
+		"release/bin/tool2":  "binary",
+	} {
+		got, err := os.ReadFile(filepath.Join(staging, name))
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v; want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestExtractTarRefusesEscapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		refused []string
+	}{
+		{
+			name:    "dot dot",
+			entries: []tarEntry{{name: "../evil", body: "x"}},
+			refused: []string{"../evil"},
+		},
+		{
+			name:    "absolute",
+			entries: []tarEntry{{name: "/tmp/evil", body: "x"}},
+			refused: []string{"/tmp/evil"},
+		},
+		{
+			name: "symlink out",
+			entries: []tarEntry{
+				{name: "out", typeflag: tar.TypeSymlink, link: ".."},
+				{name: "out/evil", body: "x"},
+			},
+			refused: []string{"out"},
+		},
+		{
+			name: "symlink chain",
+			entries: []tarEntry{
+				{name: "x/y", typeflag: tar.TypeSymlink, link: ".."},
+				{name: "x/y/z", typeflag: tar.TypeSymlink, link: ".."},
+				{name: "x/y/z/evil", body: "x"},
+			},
+			refused: []string{"x/y/z"},
+		},
+		{
+			name: "dot dot through a symlink",
+			entries: []tarEntry{
+				{name: "b", typeflag: tar.TypeSymlink, link: "."},
+				{name: "a", typeflag: tar.TypeSymlink, link: "b/b/.."},
+				{name: "a/evil", body: "x"},
+			},
+			refused: []string{"a"},
+		},
+		{
+			name: "hardlink through a symlink",
+			entries: []tarEntry{
+				{name: "x/y", typeflag: tar.TypeSymlink, link: ".."},
+				{name: "evil", typeflag: tar.TypeLink, link: "x/y/evil"},
+				{name: "x/y/evil2", typeflag: tar.TypeLink, link: "x/secret"},
+			},
+			refused: []string{"evil", "x/y/evil2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outer, staging, failed := extractTestTar(t, tt.entries)
+			for _, name := range tt.refused {
+				if !failedEntry(failed, name) {
+					t.Errorf("entry %s not refused; failed: %v", name, failed)
+				}
+			}
+			assertContained(t, outer, staging, "evil")
+			assertContained(t, outer, staging, "evil2")
+		})
+	}
+}
+
+func TestExtractZipRefusesEscapes(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "test.zip")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, name := range []string{"ok.txt", "../evil", "sub/../../evil"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("x"))
+	}
+	link := &zip.FileHeader{Name: "link"}
+	link.SetMode(os.ModeSymlink | 0o777)
+	w, err := zw.CreateHeader(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("../.."))
+	zw.Close()
+	f.Close()
+
+	staging := filepath.Join(dir, "staging")
+	os.Mkdir(staging, 0o755)
+	root, err := os.OpenRoot(staging)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	failed, err := extractZip(archive, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"../evil", "sub/../../evil", "link"} {
+		if !failedEntry(failed, name) {
+			t.Errorf("entry %s not refused; failed: %v", name, failed)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(staging, "ok.txt")); err != nil {
+		t.Error(err)
+	}
+	assertContained(t, dir, staging, "evil")
+}
+
+func TestCheckExtract(t *testing.T) {
+	tests := []struct {
+		req     DownloadRequest
+		wantErr string
+	}{
+		{req: DownloadRequest{URLs: []string{"https://e.com/a.zip"}, URLExtract: map[string]bool{"https://e.com/a.zip": true}, DeleteArchive: true}},
+		{req: DownloadRequest{URLs: []string{"https://e.com/a.zip"}, DeleteArchive: true}, wantErr: "deleteArchive needs extract"},
+		{req: DownloadRequest{URLs: []string{"https://e.com/a.zip"}, URLExtract: map[string]bool{"https://e.com/a.zip": false}, DeleteArchive: true}, wantErr: "deleteArchive needs extract"},
+		{req: DownloadRequest{URLs: []string{"https://e.com/a.zip"}, URLExtract: map[string]bool{"https://e.com/b.zip": true}}, wantErr: "not in urls"},
+		{req: DownloadRequest{URLs: []string{"s3://bucket/dir/"}, URLExtract: map[string]bool{"s3://bucket/dir/": true}}, wantErr: "many downloads"},
+	}
+	for _, tt := range tests {
+		err := checkExtract(tt.req)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("checkExtract(%+v) = %v; want %q", tt.req, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	torrentFallbackAfter       = flag.Duration("torrent-fallback-after", 10*time.Minute, "how long a torrent with an httpFallback gets before switching to HTTP")
+	torrentFallbackMinProgress = flag.Float64("torrent-fallback-min-progress", 1, "percent a torrent with an httpFallback must reach within -torrent-fallback-after to keep going")
+)
+
+// DownloadEntry is a release published both as a torrent and as a direct
+// HTTP link, the torrent being tried first, or with URLs instead, one
+// file served by several mirrors, tried in order.
+type DownloadEntry struct {
+	Magnet       string   `json:"magnet,omitempty"`
+	HTTPFallback string   `json:"httpFallback,omitempty"`
+	URLs         []string `json:"urls,omitempty"`
+
+	// Optional overrides of the server's fallback threshold, in seconds
+	// and percent.
+	FallbackAfter       int     `json:"fallbackAfter,omitempty"`
+	FallbackMinProgress float64 `json:"fallbackMinProgress,omitempty"`
+}
+
+func (e DownloadEntry) validate() error {
+	if len(e.URLs) > 0 {
+		return e.validateMirrors()
+	}
+	if !strings.HasPrefix(e.Magnet, "magnet:") && !strings.HasSuffix(e.Magnet, ".torrent") {
+		return fmt.Errorf("entry magnet %q is not a magnet link or .torrent URL", e.Magnet)
+	}
+	if !strings.HasPrefix(e.HTTPFallback, "http://") && !strings.HasPrefix(e.HTTPFallback, "https://") {
+		return fmt.Errorf("entry httpFallback %q is not an HTTP(S) URL", e.HTTPFallback)
+	}
+	if e.FallbackAfter < 0 || e.FallbackMinProgress < 0 || e.FallbackMinProgress > 100 {
+		return fmt.Errorf("entry fallback threshold is out of range")
+	}
+	return nil
+}
+
+// url is the URL the entry's download is recorded under.
+func (e DownloadEntry) url() string {
+	if len(e.URLs) > 0 {
+		return e.URLs[0]
+	}
+	return e.Magnet
+}
+
+// options returns opts with the entry's fallback settings or mirrors
+// applied.
+func (e DownloadEntry) options(opts downloadOptions) downloadOptions {
+	if len(e.URLs) > 0 {
+		opts.mirrors = e.URLs
+		return opts
+	}
+	opts.httpFallback = e.HTTPFallback
+	opts.fallbackAfter = *torrentFallbackAfter
+	if e.FallbackAfter > 0 {
+		opts.fallbackAfter = time.Duration(e.FallbackAfter) * time.Second
+	}
+	opts.fallbackMinProgress = *torrentFallbackMinProgress
+	if e.FallbackMinProgress > 0 {
+		opts.fallbackMinProgress = e.FallbackMinProgress
+	}
+	return opts
+}
+
+// fallbackError is returned by downloadTorrent when a torrent with an
+// HTTP fallback hasn't made enough progress in time.
+type fallbackError struct {
+	reason string
+}
+
+func (e *fallbackError) Error() string { return e.reason }
+
+// fallbackDue returns a fallbackError once a torrent started at start
+// should give way to its HTTP fallback. progress is in percent.
+func fallbackDue(opts downloadOptions, start, now time.Time, progress float64) error {
+	if opts.httpFallback == "" || now.Sub(start) < opts.fallbackAfter {
+		return nil
+	}
+	if progress < opts.fallbackMinProgress {
+		return &fallbackError{reason: fmt.Sprintf("torrent at %.1f%% after %s, below %.1f%%", progress, opts.fallbackAfter, opts.fallbackMinProgress)}
+	}
+	return nil
+}
+
+// markFallback records on the download's status that it continued over
+// HTTP.
+func markFallback(key, reason, fallbackURL string) {
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[key]; exists {
+		download.FallbackUsed = true
+		download.FileName = defaultFileName(fallbackURL)
+	}
+	downloadsMutex.Unlock()
+	addDownloadEvent(key, "fallback", fmt.Sprintf("%s; continuing via %s", reason, fallbackURL))
+}
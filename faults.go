@@ -0,0 +1,188 @@
+//go:build faults
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault injection for integration tests, compiled in only with
+// -tags faults and then only active with -fault-injection. A request
+// opts in with an X-Yad-Fault header such as
+//
+//	X-Yad-Fault: abort-after=1048576, delay=20ms, flip-byte, fail-first=503
+//
+// which applies to every HTTP download it submits.
+
+var faultInjection = flag.Bool("fault-injection", false, "honour X-Yad-Fault headers on download requests (test builds only)")
+
+func faultsEnabled() bool { return *faultInjection }
+
+type faultSpec struct {
+	abortAfter int64         // fail the transfer after this many bytes
+	delay      time.Duration // sleep before every read
+	flipByte   bool          // corrupt the saved file before it is hashed
+	failFirst  int           // answer the first request with this status
+}
+
+var (
+	// faultAttempts counts the requests made for each download, so
+	// fail-first only hits the first.
+	faultAttempts   = make(map[string]int)
+	faultAttemptsMu sync.Mutex
+)
+
+func parseFault(spec string) (*faultSpec, error) {
+	f := &faultSpec{}
+	for _, part := range strings.Split(spec, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		var err error
+		switch name {
+		case "":
+		case "abort-after":
+			f.abortAfter, err = strconv.ParseInt(value, 10, 64)
+			if err == nil && f.abortAfter < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "delay":
+			f.delay, err = time.ParseDuration(value)
+		case "flip-byte":
+			f.flipByte = true
+		case "fail-first":
+			f.failFirst, err = strconv.Atoi(value)
+			if err == nil && (f.failFirst < 400 || f.failFirst > 599) {
+				err = fmt.Errorf("must be a 4xx or 5xx status")
+			}
+		default:
+			return nil, fmt.Errorf("unknown fault %q (want abort-after, delay, flip-byte or fail-first)", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault %s: %v", name, err)
+		}
+	}
+	return f, nil
+}
+
+// checkFault validates an X-Yad-Fault header.
+func checkFault(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	if !*faultInjection {
+		return fmt.Errorf("fault injection is disabled; start yad with -fault-injection")
+	}
+	_, err := parseFault(spec)
+	return err
+}
+
+// faultResponse replaces resp with a fake error response if spec asks
+// for one on this attempt.
+func faultResponse(key, spec string, resp *http.Response) *http.Response {
+	f, err := parseFault(spec)
+	if spec == "" || err != nil || f.failFirst == 0 {
+		return resp
+	}
+	faultAttemptsMu.Lock()
+	faultAttempts[key]++
+	attempt := faultAttempts[key]
+	faultAttemptsMu.Unlock()
+	if attempt > 1 {
+		return resp
+	}
+	resp.Body.Close()
+	addDownloadEvent(key, "fault", fmt.Sprintf("injected %d on attempt %d", f.failFirst, attempt))
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", f.failFirst, http.StatusText(f.failFirst)),
+		StatusCode: f.failFirst,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    resp.Request,
+	}
+}
+
+// faultReader wraps a response body with the delay and abort faults.
+func faultReader(ctx context.Context, key, spec string, r io.Reader) io.Reader {
+	f, err := parseFault(spec)
+	if spec == "" || err != nil || (f.delay == 0 && f.abortAfter == 0) {
+		return r
+	}
+	if f.delay > 0 {
+		addDownloadEvent(key, "fault", fmt.Sprintf("delaying every read by %s", f.delay))
+	}
+	return &faultyReader{ctx: ctx, key: key, f: f, r: r}
+}
+
+type faultyReader struct {
+	ctx  context.Context
+	key  string
+	f    *faultSpec
+	r    io.Reader
+	read int64
+}
+
+func (fr *faultyReader) Read(p []byte) (int, error) {
+	if fr.f.delay > 0 {
+		select {
+		case <-time.After(fr.f.delay):
+		case <-fr.ctx.Done():
+			return 0, fr.ctx.Err()
+		}
+	}
+	if fr.f.abortAfter > 0 {
+		left := fr.f.abortAfter - fr.read
+		if left <= 0 {
+			err := fmt.Errorf("injected fault: connection aborted after %d bytes", fr.read)
+			addDownloadEvent(fr.key, "fault", err.Error())
+			return 0, err
+		}
+		p = p[:min(int64(len(p)), left)]
+	}
+	n, err := fr.r.Read(p)
+	fr.read += int64(n)
+	return n, err
+}
+
+// faultCorrupt flips a byte in the middle of a saved file, before it is
+// hashed or checked, if spec asks for it.
+func faultCorrupt(key, spec, path string) error {
+	f, err := parseFault(spec)
+	if spec == "" || err != nil || !f.flipByte {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	at := info.Size() / 2
+	b := make([]byte, 1)
+	if _, err := file.ReadAt(b, at); err != nil {
+		return err
+	}
+	b[0] ^= 0xff
+	if _, err := file.WriteAt(b, at); err != nil {
+		return err
+	}
+	addDownloadEvent(key, "fault", fmt.Sprintf("flipped byte %d of the saved file", at))
+	return nil
+}
+
+// forgetFaults drops the attempt count of a download.
+func forgetFaults(key string) {
+	faultAttemptsMu.Lock()
+	delete(faultAttempts, key)
+	faultAttemptsMu.Unlock()
+}
@@ -0,0 +1,30 @@
+//go:build !faults
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Fault injection is compiled out of normal builds; see faults.go. These
+// stubs leave every download untouched.
+
+func faultsEnabled() bool { return false }
+
+func checkFault(spec string) error {
+	if spec != "" {
+		return fmt.Errorf("fault injection is not available in this build")
+	}
+	return nil
+}
+
+func faultResponse(key, spec string, resp *http.Response) *http.Response { return resp }
+
+func faultReader(ctx context.Context, key, spec string, r io.Reader) io.Reader { return r }
+
+func faultCorrupt(key, spec, path string) error { return nil }
+
+func forgetFaults(key string) {}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxFileNameBytes is the longest name most filesystems accept.
+const maxFileNameBytes = 255
+
+// defaultFileName is the name a download of rawURL is saved under unless
+// the response names the file: the last element of its path, decoded
+// (an encoded slash becomes "_"), without query string or fragment. A
+// URL whose path has no usable name gets its host name and a short hash
+// of the whole URL, so that several such URLs don't share one. Magnet
+// links keep their full text.
+func defaultFileName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Opaque != "" || u.Scheme == "magnet" {
+		if name := sanitizeFileName(rawURL); name != "" {
+			return name
+		}
+		return "downloaded_file"
+	}
+	if name := urlPathName(u); name != "" {
+		return name
+	}
+	host := sanitizeFileName(u.Hostname())
+	if host == "" {
+		host = "downloaded_file"
+	}
+	sum := sha256.Sum256([]byte(rawURL))
+	return fmt.Sprintf("%s-%s", host, hex.EncodeToString(sum[:4]))
+}
+
+// urlPathName is the decoded last element of u's path, or "" if it has
+// none.
+func urlPathName(u *url.URL) string {
+	name := ""
+	if escaped := strings.Trim(u.EscapedPath(), "/"); escaped != "" {
+		name = path.Base(escaped)
+	}
+	if decoded, err := url.PathUnescape(name); err == nil {
+		name = strings.ReplaceAll(decoded, "/", "_")
+	}
+	return sanitizeFileName(name)
+}
+
+// responseFileName is the name the server gave the file: the
+// Content-Disposition filename if there is one, otherwise the last path
+// element of the URL the request was redirected to. It returns "" if
+// neither yields a usable name.
+func responseFileName(resp *http.Response) string {
+	if disposition := resp.Header.Get("Content-Disposition"); disposition != "" {
+		// ParseMediaType decodes RFC 2231 filename* into filename.
+		if _, params, err := mime.ParseMediaType(disposition); err == nil {
+			if name := sanitizeFileName(params["filename"]); name != "" {
+				return name
+			}
+		}
+	}
+	if resp.Request == nil || resp.Request.URL == nil {
+		return ""
+	}
+	return urlPathName(resp.Request.URL)
+}
+
+// sanitizeFileName makes a name from a server safe to join to the output
+// directory: only its last path element is kept, control characters are
+// dropped and overlong names are shortened, keeping the extension. It
+// returns "" for names that are empty or refer to a directory.
+func sanitizeFileName(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = name[strings.LastIndex(name, "/")+1:]
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "." || name == ".." {
+		return ""
+	}
+	if len(name) > maxFileNameBytes {
+		ext := filepath.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		name = strings.ToValidUTF8(name[:maxFileNameBytes-len(ext)], "") + ext
+	}
+	return name
+}
+
+// downloadFileName is the name download key is saved under: the one
+// recorded on its status, which a previous attempt may have taken from
+// the server, or the default for url.
+func downloadFileName(key, url string) string {
+	downloadsMutex.Lock()
+	defer downloadsMutex.Unlock()
+	if download, exists := activeDownloads[key]; exists && download.FileName != "" {
+		return download.FileName
+	}
+	return defaultFileName(url)
+}
+
+// settleFileName picks the name download key of url is finally saved
+// under once the server has named the file: want, or what the request's
+// onConflict makes of it if a local file or another download has it. A
+// changed name is recorded on the status.
+func settleFileName(key, url, dir, want string, opts downloadOptions) (string, error) {
+	name := want
+	if opts.destination == "" {
+		var err error
+		if name, err = claimFileName(key, url, dir, want, opts.onConflict); err != nil {
+			return "", err
+		}
+	}
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[key]; exists {
+		download.wantedName = want
+	}
+	downloadsMutex.Unlock()
+	if name == downloadFileName(key, url) {
+		return name, nil
+	}
+	message := fmt.Sprintf("saving as %s", name)
+	if name != want {
+		message = fmt.Sprintf("%s is taken; saving as %s", want, name)
+	}
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[key]; exists {
+		download.FileName = name
+	}
+	downloadsMutex.Unlock()
+	addDownloadEvent(key, "file_name", message)
+	return name, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestDefaultFileName(t *testing.T) {
+	hashed := func(host, rawURL string) string {
+		sum := sha256.Sum256([]byte(rawURL))
+		return host + "-" + hex.EncodeToString(sum[:4])
+	}
+	tests := []struct {
+		url, want string
+	}{
+		{"https://example.com/files/report.pdf", "report.pdf"},
+
+		// Query strings and fragments
+		{"https://example.com/get?file=report.pdf&token=xyz", "get"},
+		{"https://example.com/report.pdf?token=xyz", "report.pdf"},
+		{"https://example.com/report.pdf#page=2", "report.pdf"},
+		{"https://example.com/report.pdf?a=1#top", "report.pdf"},
+
+		// Trailing slashes
+		{"https://example.com/releases/", "releases"},
+		{"https://example.com/releases//", "releases"},
+
+		// Percent-encoded names
+		{"https://example.com/My%20Report%20%282024%29.pdf", "My Report (2024).pdf"},
+		{"https://example.com/caf%C3%A9.txt", "café.txt"},
+		{"https://example.com/a%2Fb.txt", "a_b.txt"},
+		{"https://example.com/100%25.txt", "100%.txt"},
+		{"https://example.com/%2E%2E", hashed("example.com", "https://example.com/%2E%2E")},
+		{"https://example.com/bad%ZZname.txt", "bad%ZZname.txt"},
+
+		// Bare domains
+		{"https://example.com", hashed("example.com", "https://example.com")},
+		{"https://example.com/", hashed("example.com", "https://example.com/")},
+		{"https://example.com:8443/?q=1", hashed("example.com", "https://example.com:8443/?q=1")},
+
+		// Magnet links keep their text
+		{"magnet:?xt=urn:btih:abc", "magnet:?xt=urn:btih:abc"},
+	}
+	for _, tt := range tests {
+		if got := defaultFileName(tt.url); got != tt.want {
+			t.Errorf("defaultFileName(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+
+	// Names for bare URLs differ from each other.
+	if defaultFileName("https://example.com/?a=1") == defaultFileName("https://example.com/?a=2") {
+		t.Error("two bare URLs got the same name")
+	}
+	long := "https://example.com/" + strings.Repeat("a", 300) + ".tar.gz"
+	if got := defaultFileName(long); len(got) > maxFileNameBytes || !strings.HasSuffix(got, ".gz") {
+		t.Errorf("defaultFileName of a %d-byte name = %q", 300, got)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ftpDefaultPort is where an ftp:// URL without a port is served.
+const ftpDefaultPort = "21"
+
+// isFTPLink reports whether url is downloaded over FTP.
+func isFTPLink(url string) bool {
+	return strings.HasPrefix(url, "ftp://")
+}
+
+// ftpReplyError is an FTP reply other than the one a command expected.
+// 4xx replies are transient and 5xx ones permanent, as with HTTP.
+type ftpReplyError struct {
+	command string
+	code    int
+	message string
+}
+
+func (e *ftpReplyError) Error() string {
+	return fmt.Sprintf("FTP %s failed: %d %s", e.command, e.code, e.message)
+}
+
+// ftpConn is the control connection of an FTP session.
+type ftpConn struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// dialFTP connects to the server of u and logs in with auth, or
+// anonymously without it. Files are transferred as binary.
+func dialFTP(ctx context.Context, u *url.URL, auth *BasicAuth) (*ftpConn, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), ftpDefaultPort)
+	}
+	conn, err := dialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &ftpConn{conn: conn, text: textproto.NewConn(conn)}
+	if err := c.login(auth); err != nil {
+		c.close()
+		return nil, err
+	}
+	if _, err := c.expect(200, "TYPE I"); err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *ftpConn) login(auth *BasicAuth) error {
+	code, message, err := c.text.ReadResponse(0)
+	if err != nil {
+		return err
+	}
+	if code != 220 {
+		return &ftpReplyError{command: "greeting", code: code, message: message}
+	}
+	user, password := "anonymous", "anonymous@"
+	if auth != nil {
+		user, password = auth.Username, auth.Password
+	}
+	if code, message, err = c.cmd("USER %s", user); err == nil && code == 331 {
+		code, message, err = c.cmd("PASS %s", password)
+	}
+	switch {
+	case err != nil:
+		return err
+	case code == 230 || code == 202:
+		return nil
+	case code == 530:
+		return &downloadError{code: "auth_failed", err: fmt.Errorf("FTP login as %s was refused: %s", user, message)}
+	}
+	return &ftpReplyError{command: "login", code: code, message: message}
+}
+
+// cmd sends a command and returns the server's reply to it.
+func (c *ftpConn) cmd(format string, args ...any) (int, string, error) {
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.text.ReadResponse(0)
+}
+
+// expect sends a command and returns the reply's message, failing
+// unless its code is want. The error names only the command's verb, so
+// a password never ends up in it.
+func (c *ftpConn) expect(want int, format string, args ...any) (string, error) {
+	code, message, err := c.cmd(format, args...)
+	if err != nil {
+		return "", err
+	}
+	if code != want {
+		verb, _, _ := strings.Cut(format, " ")
+		return "", &ftpReplyError{command: verb, code: code, message: message}
+	}
+	return message, nil
+}
+
+func (c *ftpConn) close() {
+	c.conn.Close()
+}
+
+var (
+	epsvReply = regexp.MustCompile(`\((.)(.)(.)(\d+)(.)\)`)
+	pasvReply = regexp.MustCompile(`(\d+),(\d+),(\d+),(\d+),(\d+),(\d+)`)
+)
+
+// passive opens a data connection in passive mode, asking with EPSV and
+// falling back to PASV for servers that don't know it. The connection
+// always goes to the server's own address, whatever PASV names, so a
+// server behind NAT works and one can't point yad at a third host.
+func (c *ftpConn) passive(ctx context.Context) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	port := 0
+	code, message, err := c.cmd("EPSV")
+	switch {
+	case err != nil:
+		return nil, err
+	case code == 229:
+		m := epsvReply.FindStringSubmatch(message)
+		if m == nil {
+			return nil, fmt.Errorf("unexpected FTP EPSV reply: %s", message)
+		}
+		port, _ = strconv.Atoi(m[4])
+	default:
+		message, err := c.expect(227, "PASV")
+		if err != nil {
+			return nil, err
+		}
+		m := pasvReply.FindStringSubmatch(message)
+		if m == nil {
+			return nil, fmt.Errorf("unexpected FTP PASV reply: %s", message)
+		}
+		hi, _ := strconv.Atoi(m[5])
+		lo, _ := strconv.Atoi(m[6])
+		port = hi<<8 | lo
+	}
+	if port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("FTP server offered data port %d", port)
+	}
+	dialer, err := boundDialer("http")
+	if err != nil {
+		return nil, err
+	}
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// size returns the size of the file at path, or -1 if the server won't
+// say.
+func (c *ftpConn) size(path string) (int64, error) {
+	code, message, err := c.cmd("SIZE %s", path)
+	if err != nil {
+		return -1, err
+	}
+	if code != 213 {
+		return -1, &ftpReplyError{command: "SIZE", code: code, message: message}
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(message), 10, 64)
+	if err != nil || size < 0 {
+		return -1, nil
+	}
+	return size, nil
+}
+
+// isDir reports whether path is a directory the session can change into.
+func (c *ftpConn) isDir(path string) bool {
+	code, _, err := c.cmd("CWD %s", path)
+	return err == nil && code == 250
+}
+
+// modTime is the MDTM timestamp of the file at path, or "" if the server
+// doesn't support it. It stands in for an HTTP Last-Modified when a
+// partial file is continued.
+func (c *ftpConn) modTime(path string) string {
+	message, err := c.expect(213, "MDTM %s", path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(message)
+}
+
+// ftpPath is the path of the file an ftp:// URL names, as sent in
+// commands. Neither it nor the credentials may contain a line break,
+// which would end the command early and start another.
+func ftpPath(u *url.URL, auth *BasicAuth) (string, error) {
+	if strings.ContainsAny(u.Path, "\r\n") || (auth != nil && strings.ContainsAny(auth.Username+auth.Password, "\r\n")) {
+		return "", fmt.Errorf("FTP URLs and credentials can't contain line breaks")
+	}
+	if u.Path == "" {
+		return "/", nil
+	}
+	return u.Path, nil
+}
+
+// downloadFTP fetches a file over FTP into outputDir, or the request's
+// destination, and returns where it was saved. Progress is reported on
+// the download tracked under key. A partial file left by an earlier
+// attempt is continued with REST if the file's MDTM timestamp hasn't
+// changed since. Directories aren't downloaded: their URL fails with
+// ftp_directory.
+func downloadFTP(parent context.Context, key, rawURL, outputDir string, opts downloadOptions) (string, error) {
+	if err := checkURLAllowed(rawURL); err != nil {
+		return "", err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to start download: %w", err)
+	}
+	var auth *BasicAuth
+	if a, ok := opts.basicAuth[rawURL]; ok {
+		auth = &a
+	}
+	remotePath, err := ftpPath(u, auth)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithCancel(withDownloadKey(withPreflight(parent, opts.preflight), key))
+	defer cancel()
+	c, err := dialFTP(ctx, u, auth)
+	if err != nil {
+		var derr *downloadError
+		if errors.As(err, &derr) {
+			return "", err
+		}
+		return "", fmt.Errorf("failed to start download: %w", err)
+	}
+	defer c.close()
+	// Cancelling breaks off whatever the session is waiting for.
+	defer context.AfterFunc(ctx, c.close)()
+
+	size, sizeErr := c.size(remotePath)
+	var reply *ftpReplyError
+	if strings.HasSuffix(remotePath, "/") || (errors.As(sizeErr, &reply) && reply.code == 550 && c.isDir(remotePath)) {
+		return "", &downloadError{code: "ftp_directory", err: fmt.Errorf("%s is an FTP directory; yad only downloads files over FTP, so submit the URLs of the files in it", rawURL)}
+	}
+	if sizeErr != nil && !errors.As(sizeErr, &reply) {
+		return "", fmt.Errorf("failed to start download: %w", sizeErr)
+	}
+	var data net.Conn
+	defer func() {
+		if data != nil {
+			data.Close()
+		}
+	}()
+	return downloadRemote(ctx, key, rawURL, outputDir, opts, remoteFile{
+		size:     size,
+		modified: c.modTime(remotePath),
+		open: func(offset int64) (io.Reader, int64, error) {
+			var err error
+			if data, err = c.passive(ctx); err != nil {
+				return nil, 0, fmt.Errorf("failed to open FTP data connection: %w", err)
+			}
+			context.AfterFunc(ctx, func() { data.Close() })
+			if offset > 0 {
+				if _, err := c.expect(350, "REST %d", offset); err != nil {
+					var reply *ftpReplyError
+					if !errors.As(err, &reply) {
+						return nil, 0, err
+					}
+					offset = 0
+				}
+			}
+			if code, message, err := c.cmd("RETR %s", remotePath); err != nil {
+				return nil, 0, err
+			} else if code != 125 && code != 150 {
+				return nil, 0, &ftpReplyError{command: "RETR", code: code, message: message}
+			}
+			return data, offset, nil
+		},
+		finish: func() error {
+			// The server confirms the transfer once the data
+			// connection is closed.
+			data.Close()
+			code, message, err := c.text.ReadResponse(0)
+			if err != nil {
+				return fmt.Errorf("failed to save file: %w", err)
+			}
+			if code != 226 && code != 250 {
+				return &ftpReplyError{command: "RETR", code: code, message: message}
+			}
+			c.cmd("QUIT")
+			return nil
+		},
+	})
+}
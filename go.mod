@@ -6,6 +6,12 @@ require (
 	github.com/anacrolix/torrent v1.58.1
 	github.com/gorilla/mux v1.6.2
 	github.com/gorilla/websocket v1.5.0
+	github.com/ulikunitz/xz v0.5.15
+	github.com/zeebo/xxh3 v1.0.2
+	golang.org/x/crypto v0.28.0
+	golang.org/x/image v0.25.0
+	lukechampine.com/blake3 v1.1.6
+	modernc.org/sqlite v1.21.1
 )
 
 require (
@@ -76,16 +82,13 @@ require (
 	go.etcd.io/bbolt v1.3.6 // indirect
 	go.opentelemetry.io/otel v1.11.1 // indirect
 	go.opentelemetry.io/otel/trace v1.11.1 // indirect
-	golang.org/x/crypto v0.28.0 // indirect
 	golang.org/x/exp v0.0.0-20240823005443-9b4947da3948 // indirect
 	golang.org/x/net v0.29.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/sys v0.26.0 // indirect
 	golang.org/x/time v0.0.0-20220609170525-579cf78fd858 // indirect
-	lukechampine.com/blake3 v1.1.6 // indirect
 	modernc.org/libc v1.22.3 // indirect
 	modernc.org/mathutil v1.5.0 // indirect
 	modernc.org/memory v1.5.0 // indirect
-	modernc.org/sqlite v1.21.1 // indirect
 	zombiezen.com/go/sqlite v0.13.1 // indirect
 )
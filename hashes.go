@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/zeebo/xxh3"
+	"lukechampine.com/blake3"
+)
+
+var hashAlgorithm = flag.String("hash-algorithm", "sha256", "digest algorithm for recording downloaded content: sha256, sha1, md5, blake3 or xxh3")
+
+// hashAlgorithms are the supported digest algorithms. blake3 and xxh3 are
+// much faster on large files; xxh3 is not cryptographic and only suits
+// integrity recording.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha1":   sha1.New,
+	"md5":    md5.New,
+	"blake3": func() hash.Hash { return blake3.New(32, nil) },
+	"xxh3":   func() hash.Hash { return xxh3.New() },
+}
+
+// checkHashAlgorithm normalizes an algorithm name, returning the global
+// default for an empty one.
+func checkHashAlgorithm(name string) (string, error) {
+	if name == "" {
+		return *hashAlgorithm, nil
+	}
+	name = strings.ToLower(name)
+	if _, ok := hashAlgorithms[name]; !ok {
+		return "", fmt.Errorf("unsupported hash algorithm %q (want sha256, sha1, md5, blake3 or xxh3)", name)
+	}
+	return name, nil
+}
+
+func newHash(name string) hash.Hash {
+	return hashAlgorithms[name]()
+}
+
+// digestAlgorithm is the algorithm a job records digests with.
+func (o downloadOptions) digestAlgorithm() string {
+	if o.hashAlgorithm == "" {
+		return *hashAlgorithm
+	}
+	return o.hashAlgorithm
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// reservedHeaders are set by yad itself and can't be given in a
+// request's headers.
+var reservedHeaders = []string{
+	"Host", "Content-Length", "Transfer-Encoding", "Connection", "Keep-Alive",
+	"Proxy-Connection", "Upgrade", "Te", "Trailer", "Range", "If-Range",
+}
+
+// checkHeaders validates a request's extra headers and returns each HTTP
+// URL's own set: the request-wide headers with that URL's urlHeaders
+// laid over them. URLs without any are left out.
+func checkHeaders(req DownloadRequest) (map[string]http.Header, error) {
+	if err := checkHeaderSet(req.Headers); err != nil {
+		return nil, err
+	}
+	for url, set := range req.URLHeaders {
+		if !slices.Contains(req.URLs, url) && !slices.Contains(mirrorURLs(req), url) {
+			return nil, fmt.Errorf("urlHeaders given for %s, which is not in urls", url)
+		}
+		if isTorrentLink(url) {
+			return nil, fmt.Errorf("headers can only be sent with HTTP downloads: %s", url)
+		}
+		if err := checkHeaderSet(set); err != nil {
+			return nil, fmt.Errorf("%v (for %s)", err, url)
+		}
+	}
+	if strings.ContainsAny(req.Cookies, "\r\n") {
+		return nil, fmt.Errorf("cookies must be a single line such as \"session=abc; theme=dark\"")
+	}
+
+	byURL := make(map[string]http.Header)
+	for _, url := range append(append([]string(nil), req.URLs...), mirrorURLs(req)...) {
+		if isTorrentLink(url) || len(req.Headers)+len(req.URLHeaders[url]) == 0 {
+			continue
+		}
+		h := make(http.Header)
+		for name, value := range req.Headers {
+			h.Set(name, value)
+		}
+		for name, value := range req.URLHeaders[url] {
+			h.Set(name, value)
+		}
+		byURL[url] = h
+	}
+	return byURL, nil
+}
+
+func checkHeaderSet(set map[string]string) error {
+	for name, value := range set {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return fmt.Errorf("value of header %s must be a single line", name)
+		}
+		canonical := http.CanonicalHeaderKey(name)
+		if canonical == "Cookie" {
+			return fmt.Errorf("send cookies with the cookies field, not as a header")
+		}
+		if slices.Contains(reservedHeaders, canonical) {
+			return fmt.Errorf("header %s is set by yad and can't be overridden", canonical)
+		}
+	}
+	return nil
+}
+
+// validHeaderName reports whether name is an RFC 7230 token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range []byte(name) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// sensitiveHeader reports whether a header's value is a secret that
+// must not be logged: credentials, cookies, and anything named like a
+// token or key.
+func sensitiveHeader(name string) bool {
+	name = strings.ToLower(name)
+	switch name {
+	case "authorization", "proxy-authorization", "cookie":
+		return true
+	}
+	for _, word := range []string{"token", "secret", "key", "auth", "session", "password", "signature"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactHeaders lists headers for a log line, with sensitive values
+// replaced by "[redacted]".
+func redactHeaders(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		value := h.Get(name)
+		if sensitiveHeader(name) {
+			value = "[redacted]"
+		}
+		parts = append(parts, name+": "+value)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// headerTransport adds a download's extra headers, cookies and Basic
+// credentials to every request it makes. Redirects to another origin get
+// neither the cookies nor Authorization unless forwardAuth is set; other
+// headers follow them.
+type headerTransport struct {
+	next        http.RoundTripper
+	headers     http.Header
+	cookies     string
+	auth        *url.Userinfo
+	forwardAuth bool
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	same := sameOrigin(chainStart(req).URL, req.URL)
+	out := req.Clone(req.Context())
+	for name, values := range t.headers {
+		if name == "Authorization" && !same && !t.forwardAuth {
+			continue
+		}
+		// Headers the request already carries, such as digest
+		// authentication, win.
+		if out.Header.Get(name) == "" {
+			out.Header[name] = values
+		}
+	}
+	if t.auth != nil && (same || t.forwardAuth) && out.Header.Get("Authorization") == "" {
+		password, _ := t.auth.Password()
+		out.SetBasicAuth(t.auth.Username(), password)
+	}
+	if t.cookies != "" && same {
+		if jar := out.Header.Get("Cookie"); jar != "" {
+			out.Header.Set("Cookie", jar+"; "+t.cookies)
+		} else {
+			out.Header.Set("Cookie", t.cookies)
+		}
+	}
+	return t.next.RoundTrip(out)
+}
+
+// chainStart returns the request a chain of redirects leading to req
+// began with.
+func chainStart(req *http.Request) *http.Request {
+	for req.Response != nil && req.Response.Request != nil {
+		req = req.Response.Request
+	}
+	return req
+}
+
+func sameOrigin(a, b *url.URL) bool {
+	return strings.EqualFold(a.Scheme, b.Scheme) && strings.EqualFold(a.Host, b.Host)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 1000
+)
+
+var (
+	dataDir        = flag.String("data-dir", "./data", "directory for yad's own state, such as the download history database")
+	historyEnabled = flag.Bool("history", true, "record every finished download in <data-dir>/history.db")
+)
+
+// historyDB is the durable log of finished downloads. activeDownloads
+// stays the source of truth for anything still running; a download is
+// written here each time it reaches a terminal state, so a retried one
+// keeps only its latest outcome.
+var (
+	historyDB     *sql.DB
+	historyWrites = make(chan historyEntry, 256)
+)
+
+const historySchema = `CREATE TABLE IF NOT EXISTS downloads (
+	id           TEXT PRIMARY KEY,
+	url          TEXT NOT NULL,
+	file_name    TEXT NOT NULL,
+	output_dir   TEXT NOT NULL,
+	saved_path   TEXT NOT NULL,
+	location     TEXT NOT NULL,
+	request_id   TEXT NOT NULL,
+	tags         TEXT NOT NULL,
+	submitted_at TIMESTAMP NOT NULL,
+	started_at   TIMESTAMP,
+	finished_at  TIMESTAMP NOT NULL,
+	status       TEXT NOT NULL,
+	bytes        INTEGER NOT NULL,
+	total_bytes  INTEGER,
+	error        TEXT NOT NULL,
+	error_code   TEXT NOT NULL,
+	checksum     TEXT NOT NULL DEFAULT '',
+	file_checksums TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS downloads_finished_at ON downloads (finished_at);
+CREATE INDEX IF NOT EXISTS downloads_status ON downloads (status);`
+
+// historyColumns are columns added after the first release of the
+// schema, for databases created before them.
+var historyColumns = []string{
+	"total_bytes INTEGER",
+	"checksum TEXT NOT NULL DEFAULT ''",
+	"file_checksums TEXT NOT NULL DEFAULT ''",
+}
+
+// historyEntry is one finished download as GET /history reports it.
+type historyEntry struct {
+	ID          string     `json:"id"`
+	URL         string     `json:"url"`
+	FileName    string     `json:"fileName"`
+	OutputDir   string     `json:"outputDir,omitempty"`
+	SavedPath   string     `json:"savedPath,omitempty"`
+	Location    string     `json:"location,omitempty"`
+	RequestID   string     `json:"requestId,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	SubmittedAt time.Time  `json:"submittedAt"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	FinishedAt  time.Time  `json:"finishedAt"`
+	Status      string     `json:"status"`
+	Bytes       int64      `json:"bytes"`
+	TotalBytes  int64      `json:"totalBytes,omitempty"`
+	SizeKnown   bool       `json:"sizeKnown"`
+	Error       string     `json:"error,omitempty"`
+	ErrorCode   string     `json:"errorCode,omitempty"`
+
+	// SHA-256 of an HTTP download, or the digests of a torrent's files.
+	Checksum          string            `json:"checksum,omitempty"`
+	FileChecksums     map[string]string `json:"fileChecksums,omitempty"`
+	ChecksumAlgorithm string            `json:"checksumAlgorithm,omitempty"`
+}
+
+// initHistory opens (creating if needed) the history database and starts
+// the goroutine that writes to it.
+func initHistory() error {
+	if !*historyEnabled {
+		return nil
+	}
+	if err := os.MkdirAll(*dataDir, os.ModePerm); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite", filepath.Join(*dataDir, "history.db")+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return err
+	}
+	// One connection serializes writers without SQLITE_BUSY retries.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(historySchema); err != nil {
+		db.Close()
+		return fmt.Errorf("failed to create schema: %v", err)
+	}
+	for _, column := range historyColumns {
+		if _, err := db.Exec("ALTER TABLE downloads ADD COLUMN " + column); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			db.Close()
+			return fmt.Errorf("failed to add column %s: %v", column, err)
+		}
+	}
+	historyDB = db
+	go writeHistory()
+	return nil
+}
+
+// recordHistory queues download id for the history database, the
+// notifiers, the request's email and its recurring download's runs as it
+// is now. Call it after a terminal state change, without
+// downloadsMutex held.
+func recordHistory(id string) {
+	notifyFinished(id)
+	mailFinished(id)
+	finishRecurringRun(id)
+	if historyDB == nil {
+		return
+	}
+	downloadsMutex.Lock()
+	download, exists := activeDownloads[id]
+	if !exists || !download.Completed {
+		downloadsMutex.Unlock()
+		return
+	}
+	entry := historyEntry{
+		ID:          download.ID,
+		URL:         download.URL,
+		FileName:    download.FileName,
+		OutputDir:   download.OutputDir,
+		SavedPath:   download.SavedPath,
+		Location:    download.Location,
+		RequestID:   download.RequestID,
+		Tags:        append([]string(nil), download.Tags...),
+		SubmittedAt: download.SubmittedAt,
+		StartedAt:   download.StartedAt,
+		FinishedAt:  time.Now(),
+		Status:      download.Status,
+		Bytes:       max(download.BytesDownloaded, download.SizeOnDisk),
+		TotalBytes:  download.TotalBytes,
+		SizeKnown:   download.SizeKnown,
+		Error:       download.Error,
+		ErrorCode:   download.ErrorCode,
+
+		Checksum:          download.Checksum,
+		FileChecksums:     download.FileChecksums,
+		ChecksumAlgorithm: download.ChecksumAlgorithm,
+	}
+	downloadsMutex.Unlock()
+	historyWrites <- entry
+}
+
+func writeHistory() {
+	for entry := range historyWrites {
+		tags, _ := json.Marshal(entry.Tags)
+		var started, total interface{}
+		if entry.StartedAt != nil {
+			started = entry.StartedAt.UTC()
+		}
+		if entry.SizeKnown {
+			total = entry.TotalBytes
+		}
+		// Torrent digests are stored with their algorithm, as
+		// {"algorithm": …, "files": {…}}.
+		fileChecksums := ""
+		if len(entry.FileChecksums) > 0 {
+			b, _ := json.Marshal(map[string]interface{}{"algorithm": entry.ChecksumAlgorithm, "files": entry.FileChecksums})
+			fileChecksums = string(b)
+		}
+		_, err := historyDB.Exec(`INSERT OR REPLACE INTO downloads
+			(id, url, file_name, output_dir, saved_path, location, request_id, tags,
+			 submitted_at, started_at, finished_at, status, bytes, total_bytes, error, error_code,
+			 checksum, file_checksums)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			entry.ID, entry.URL, entry.FileName, entry.OutputDir, entry.SavedPath, entry.Location, entry.RequestID, string(tags),
+			entry.SubmittedAt.UTC(), started, entry.FinishedAt.UTC(), entry.Status, entry.Bytes, total, entry.Error, entry.ErrorCode,
+			entry.Checksum, fileChecksums)
+		if err != nil {
+			log.Printf("Failed to record %s in history: %v", entry.ID, err)
+		}
+	}
+}
+
+// handleGetHistory lists finished downloads from the history database,
+// most recently finished first. ?limit= (default 50, at most 1000) and
+// ?offset= page through them; ?status= keeps one terminal status.
+func handleGetHistory(w http.ResponseWriter, r *http.Request) {
+	if historyDB == nil {
+		httpError(w, r, "History is disabled", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	limit, offset := defaultHistoryLimit, 0
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxHistoryLimit {
+			httpError(w, r, fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			httpError(w, r, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	where, args := "", []interface{}{}
+	if status := query.Get("status"); status != "" {
+		where, args = "WHERE status = ?", append(args, status)
+	}
+
+	var total int
+	if err := historyDB.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM downloads "+where, args...).Scan(&total); err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rows, err := historyDB.QueryContext(r.Context(), `SELECT id, url, file_name, output_dir, saved_path, location, request_id, tags,
+		submitted_at, started_at, finished_at, status, bytes, total_bytes, error, error_code,
+		checksum, file_checksums
+		FROM downloads `+where+` ORDER BY finished_at DESC, id LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []historyEntry{}
+	for rows.Next() {
+		var entry historyEntry
+		var tags string
+		var started sql.NullTime
+		var totalBytes sql.NullInt64
+		var fileChecksums string
+		if err := rows.Scan(&entry.ID, &entry.URL, &entry.FileName, &entry.OutputDir, &entry.SavedPath, &entry.Location, &entry.RequestID, &tags,
+			&entry.SubmittedAt, &started, &entry.FinishedAt, &entry.Status, &entry.Bytes, &totalBytes, &entry.Error, &entry.ErrorCode,
+			&entry.Checksum, &fileChecksums); err != nil {
+			httpError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.Unmarshal([]byte(tags), &entry.Tags)
+		if started.Valid {
+			entry.StartedAt = &started.Time
+		}
+		entry.TotalBytes, entry.SizeKnown = totalBytes.Int64, totalBytes.Valid
+		if fileChecksums != "" {
+			var stored struct {
+				Algorithm string            `json:"algorithm"`
+				Files     map[string]string `json:"files"`
+			}
+			json.Unmarshal([]byte(fileChecksums), &stored)
+			entry.ChecksumAlgorithm, entry.FileChecksums = stored.Algorithm, stored.Files
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"total": total, "downloads": entries})
+}
@@ -0,0 +1,683 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// hlsSegmentWorkers is how many segments of a stream are fetched at
+	// once, unless the request's connections asks for more.
+	hlsSegmentWorkers = 4
+
+	maxPlaylistSize   = 4 << 20
+	maxHLSSegmentSize = 1 << 30
+)
+
+// hlsContentTypes are the media types servers send HLS playlists with.
+var hlsContentTypes = map[string]bool{
+	"application/vnd.apple.mpegurl": true,
+	"application/x-mpegurl":         true,
+	"audio/mpegurl":                 true,
+	"audio/x-mpegurl":               true,
+}
+
+var hlsVariantPattern = regexp.MustCompile(`^(highest|lowest|[0-9]+p)$`)
+
+// isHLSLink reports whether rawURL names an HLS playlist by its .m3u8
+// extension.
+func isHLSLink(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && strings.EqualFold(path.Ext(u.Path), ".m3u8")
+}
+
+// isHLSContentType reports whether a Content-Type header value is that
+// of an HLS playlist.
+func isHLSContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && hlsContentTypes[mediaType]
+}
+
+// checkHLSVariant validates a request's hlsVariant: "highest" (the
+// default), "lowest" or a picture height such as "720p".
+func checkHLSVariant(variant string) error {
+	if variant != "" && !hlsVariantPattern.MatchString(variant) {
+		return fmt.Errorf(`hlsVariant must be "highest", "lowest" or a height such as "720p"`)
+	}
+	return nil
+}
+
+// hlsPlaylistError is what downloadFile returns when the server answers
+// with an HLS playlist, which runJob then downloads as a stream.
+type hlsPlaylistError struct {
+	contentType string
+}
+
+func (e *hlsPlaylistError) Error() string {
+	return fmt.Sprintf("the server sent an HLS playlist (%s)", e.contentType)
+}
+
+// hlsVariant is one rendition a master playlist offers.
+type hlsVariant struct {
+	uri           string
+	bandwidth     int64
+	width, height int
+	audio         string // AUDIO group, if any
+}
+
+func (v hlsVariant) String() string {
+	if v.height > 0 {
+		return fmt.Sprintf("%dx%d at %d bit/s", v.width, v.height, v.bandwidth)
+	}
+	return fmt.Sprintf("%d bit/s", v.bandwidth)
+}
+
+// hlsKey is the decryption key an #EXT-X-KEY tag names.
+type hlsKey struct {
+	uri string
+	iv  []byte // nil to derive it from the media sequence number
+}
+
+// hlsPart is one file of a stream, in the order it is played: a media
+// segment or an #EXT-X-MAP initialization section.
+type hlsPart struct {
+	uri    string
+	offset int64
+	length int64 // -1 for the whole file
+	key    *hlsKey
+	seq    int64
+}
+
+// name identifies the part for the file it is saved in, so a changed
+// playlist doesn't pick up another segment saved under its position.
+func (p hlsPart) name(i int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s %d %d", p.uri, p.offset, p.length)))
+	return fmt.Sprintf("%05d-%s.seg", i, hex.EncodeToString(sum[:4]))
+}
+
+// hlsMedia is a parsed media playlist.
+type hlsMedia struct {
+	parts    []hlsPart
+	duration float64 // seconds
+	fmp4     bool
+}
+
+// parseHLSAttributes splits an attribute list such as
+// `BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2"`.
+func parseHLSAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for s != "" {
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+			rest = strings.TrimPrefix(rest, ",")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		attrs[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		s = strings.TrimSpace(rest)
+	}
+	return attrs
+}
+
+// playlistLines returns the playlist's non-empty lines.
+func playlistLines(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func resolveURI(base *url.URL, uri string) (string, error) {
+	ref, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("invalid URI %q in playlist: %v", uri, err)
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// parseMasterPlaylist returns the variants a master playlist offers, and
+// the AUDIO groups whose renditions are separate files. It returns no
+// variants for a media playlist.
+func parseMasterPlaylist(base *url.URL, text string) ([]hlsVariant, map[string]bool, error) {
+	var variants []hlsVariant
+	separateAudio := make(map[string]bool)
+	var pending *hlsVariant
+	for _, line := range playlistLines(text) {
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			attrs := parseHLSAttributes(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:"))
+			v := hlsVariant{audio: attrs["AUDIO"]}
+			v.bandwidth, _ = strconv.ParseInt(attrs["BANDWIDTH"], 10, 64)
+			if w, h, ok := strings.Cut(attrs["RESOLUTION"], "x"); ok {
+				v.width, _ = strconv.Atoi(w)
+				v.height, _ = strconv.Atoi(h)
+			}
+			pending = &v
+		case strings.HasPrefix(line, "#EXT-X-MEDIA:"):
+			attrs := parseHLSAttributes(strings.TrimPrefix(line, "#EXT-X-MEDIA:"))
+			if attrs["TYPE"] == "AUDIO" && attrs["URI"] != "" {
+				separateAudio[attrs["GROUP-ID"]] = true
+			}
+		case strings.HasPrefix(line, "#"):
+		case pending != nil:
+			uri, err := resolveURI(base, line)
+			if err != nil {
+				return nil, nil, err
+			}
+			pending.uri = uri
+			variants = append(variants, *pending)
+			pending = nil
+		}
+	}
+	return variants, separateAudio, nil
+}
+
+// chooseVariant picks the variant want asks for: the highest or lowest
+// bandwidth, or the highest bandwidth with a picture want pixels high.
+func chooseVariant(variants []hlsVariant, want string) (hlsVariant, error) {
+	sorted := append([]hlsVariant(nil), variants...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].bandwidth > sorted[j].bandwidth })
+	switch want {
+	case "", "highest":
+		return sorted[0], nil
+	case "lowest":
+		return sorted[len(sorted)-1], nil
+	}
+	height, _ := strconv.Atoi(strings.TrimSuffix(want, "p"))
+	var offered []string
+	for _, v := range sorted {
+		if v.height == height {
+			return v, nil
+		}
+		if v.height > 0 {
+			offered = append(offered, fmt.Sprintf("%dp", v.height))
+		}
+	}
+	return hlsVariant{}, &downloadError{code: "hls_variant_not_found", err: fmt.Errorf("no %s variant in the playlist; it offers %s", want, strings.Join(offered, ", "))}
+}
+
+// parseMediaPlaylist returns the parts of a media playlist with their
+// URIs resolved against base. Live playlists, which don't end with
+// #EXT-X-ENDLIST, and encryption other than AES-128 are refused.
+func parseMediaPlaylist(base *url.URL, text string) (*hlsMedia, error) {
+	media := &hlsMedia{}
+	var seq int64
+	var key *hlsKey
+	var nextOffset int64
+	pendingRange := false
+	var rangeOffset, rangeLength int64
+	ended := false
+	var lastMap string
+	for _, line := range playlistLines(text) {
+		tag, value, _ := strings.Cut(line, ":")
+		switch tag {
+		case "#EXT-X-MEDIA-SEQUENCE":
+			seq, _ = strconv.ParseInt(value, 10, 64)
+		case "#EXT-X-ENDLIST":
+			ended = true
+		case "#EXT-X-PLAYLIST-TYPE":
+			ended = ended || value == "VOD"
+		case "#EXTINF":
+			d, _, _ := strings.Cut(value, ",")
+			seconds, _ := strconv.ParseFloat(d, 64)
+			media.duration += seconds
+		case "#EXT-X-BYTERANGE":
+			var err error
+			if rangeOffset, rangeLength, err = parseByteRange(value, nextOffset); err != nil {
+				return nil, err
+			}
+			pendingRange = true
+		case "#EXT-X-KEY":
+			attrs := parseHLSAttributes(value)
+			switch attrs["METHOD"] {
+			case "NONE":
+				key = nil
+			case "AES-128":
+				if format := attrs["KEYFORMAT"]; format != "" && format != "identity" {
+					return nil, &downloadError{code: "hls_unsupported_encryption", err: fmt.Errorf("the stream is protected with %s DRM, which yad can't decrypt", format)}
+				}
+				uri, err := resolveURI(base, attrs["URI"])
+				if err != nil || attrs["URI"] == "" {
+					return nil, fmt.Errorf("AES-128 key without a usable URI")
+				}
+				key = &hlsKey{uri: uri}
+				if iv := attrs["IV"]; iv != "" {
+					b, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X"))
+					if err != nil || len(b) != aes.BlockSize {
+						return nil, fmt.Errorf("invalid IV %q in playlist", iv)
+					}
+					key.iv = b
+				}
+			default:
+				return nil, &downloadError{code: "hls_unsupported_encryption", err: fmt.Errorf("the stream is encrypted with %s, which yad doesn't support; only AES-128 streams can be downloaded", attrs["METHOD"])}
+			}
+		case "#EXT-X-MAP":
+			attrs := parseHLSAttributes(value)
+			uri, err := resolveURI(base, attrs["URI"])
+			if err != nil {
+				return nil, err
+			}
+			if uri+attrs["BYTERANGE"] == lastMap {
+				continue
+			}
+			lastMap = uri + attrs["BYTERANGE"]
+			part := hlsPart{uri: uri, length: -1, key: key, seq: seq}
+			if r := attrs["BYTERANGE"]; r != "" {
+				if part.offset, part.length, err = parseByteRange(r, 0); err != nil {
+					return nil, err
+				}
+			}
+			media.parts = append(media.parts, part)
+			media.fmp4 = true
+		default:
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			uri, err := resolveURI(base, line)
+			if err != nil {
+				return nil, err
+			}
+			part := hlsPart{uri: uri, length: -1, key: key, seq: seq}
+			if pendingRange {
+				part.offset, part.length = rangeOffset, rangeLength
+				nextOffset = rangeOffset + rangeLength
+				pendingRange = false
+			}
+			media.parts = append(media.parts, part)
+			seq++
+		}
+	}
+	if !ended {
+		return nil, &downloadError{code: "hls_live", err: fmt.Errorf("the playlist is a live stream; only complete (VOD) playlists can be downloaded")}
+	}
+	if len(media.parts) == 0 {
+		return nil, &downloadError{code: "hls_invalid", err: fmt.Errorf("the playlist has no segments")}
+	}
+	return media, nil
+}
+
+// parseByteRange parses an #EXT-X-BYTERANGE value, "<length>[@<offset>]",
+// whose offset defaults to next.
+func parseByteRange(value string, next int64) (int64, int64, error) {
+	n, o, hasOffset := strings.Cut(value, "@")
+	length, err := strconv.ParseInt(n, 10, 64)
+	offset := next
+	if err == nil && hasOffset {
+		offset, err = strconv.ParseInt(o, 10, 64)
+	}
+	if err != nil || length <= 0 || offset < 0 {
+		return 0, 0, fmt.Errorf("invalid byte range %q in playlist", value)
+	}
+	return offset, length, nil
+}
+
+// fetchPlaylist returns the text of the playlist at rawURL and the URL
+// it was finally served from, which its URIs are relative to.
+func fetchPlaylist(ctx context.Context, client *http.Client, rawURL string) (string, *url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	resp, err := doWithDigest(client, req, req.URL.User)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, statusError(resp)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPlaylistSize+1))
+	if err != nil {
+		return "", nil, err
+	}
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	if len(data) > maxPlaylistSize || !strings.HasPrefix(text, "#EXTM3U") {
+		return "", nil, &downloadError{code: "hls_invalid", err: fmt.Errorf("%s is not an HLS playlist", rawURL)}
+	}
+	return text, resp.Request.URL, nil
+}
+
+// fetchPart returns the bytes of one part, retrying connection errors
+// and 5xx/429 responses with backoff like fetchPage.
+func fetchPart(ctx context.Context, client *http.Client, part hlsPart) ([]byte, error) {
+	var lastErr error
+	for attempt := 0; attempt <= pageRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(1<<(attempt-1)) * time.Second):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, part.uri, nil)
+		if err != nil {
+			return nil, err
+		}
+		if part.length >= 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", part.offset, part.offset+part.length-1))
+		}
+		resp, err := doWithDigest(client, req, req.URL.User)
+		if err != nil {
+			var derr *downloadError
+			if errors.As(err, &derr) || ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("server returned %s", resp.Status)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			err := statusError(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(shapeReader(ctx, resp.Body), maxHLSSegmentSize+1))
+		resp.Body.Close()
+		bytesTransferred.Add(int64(len(data)))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(data) > maxHLSSegmentSize {
+			return nil, fmt.Errorf("segment is larger than %d bytes", maxHLSSegmentSize)
+		}
+		if part.length >= 0 && resp.StatusCode == http.StatusOK {
+			// The server ignored the Range header.
+			if part.offset+part.length > int64(len(data)) {
+				return nil, fmt.Errorf("byte range %d@%d is past the end of %s", part.length, part.offset, part.uri)
+			}
+			data = data[part.offset : part.offset+part.length]
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("giving up after %d attempts: %v", pageRetries+1, lastErr)
+}
+
+// decryptPart undoes AES-128 CBC encryption with PKCS#7 padding. Without
+// an IV in the playlist, the part's media sequence number is used.
+func decryptPart(data, key []byte, part hlsPart) ([]byte, error) {
+	iv := part.key.iv
+	if iv == nil {
+		iv = make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(iv[8:], uint64(part.seq))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("encrypted segment of %d bytes isn't a whole number of AES blocks", len(data))
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > aes.BlockSize || !bytes.Equal(out[len(out)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, fmt.Errorf("segment didn't decrypt; the key is probably wrong")
+	}
+	return out[:len(out)-pad], nil
+}
+
+// setSegmentProgress reports a stream's progress as the share of its
+// parts saved so far, alongside the bytes they hold.
+func setSegmentProgress(key string, done, total int, written int64) {
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[key]; exists {
+		setProgress(download, written, -1)
+		percent := float64(done) / float64(total) * 100
+		download.Progress = &percent
+		download.Segments, download.SegmentsDone = total, done
+		sampleSpeed(download, time.Now())
+	}
+	downloadsMutex.Unlock()
+}
+
+// downloadHLS downloads the stream an HLS playlist describes into one
+// file in outputDir, or the request's destination, and returns where it
+// ended up. A master playlist's variant is picked by opts.hlsVariant.
+// Segments are fetched several at a time into a "<name>.segments"
+// directory next to the output, which a retried or resumed download
+// picks up again, and joined in playlist order once all of them are
+// there: a .ts file, or .mp4 for fragmented MP4 streams.
+func downloadHLS(parent context.Context, key, rawURL, outputDir string, opts downloadOptions) (string, error) {
+	ctx, cancel := context.WithCancelCause(withDownloadKey(withPreflight(parent, opts.preflight), key))
+	defer cancel(nil)
+	client, err := downloadClient(rawURL, opts)
+	if err != nil {
+		return "", err
+	}
+
+	text, base, err := fetchPlaylist(ctx, client, rawURL)
+	if err != nil {
+		return "", err
+	}
+	variants, separateAudio, err := parseMasterPlaylist(base, text)
+	if err != nil {
+		return "", err
+	}
+	if len(variants) > 0 {
+		variant, err := chooseVariant(variants, opts.hlsVariant)
+		if err != nil {
+			return "", err
+		}
+		addDownloadEvent(key, "hls_variant", fmt.Sprintf("downloading the %s variant of %d", variant, len(variants)))
+		if separateAudio[variant.audio] {
+			addDownloadEvent(key, "hls_separate_audio", "the variant's audio is a separate rendition, which isn't included in the file")
+		}
+		if text, base, err = fetchPlaylist(ctx, client, variant.uri); err != nil {
+			return "", err
+		}
+	}
+	media, err := parseMediaPlaylist(base, text)
+	if err != nil {
+		return "", err
+	}
+	total := len(media.parts)
+	addDownloadEvent(key, "hls_stream", fmt.Sprintf("%d segments, %s", total, time.Duration(media.duration*float64(time.Second)).Round(time.Second)))
+
+	ext := ".ts"
+	if media.fmp4 {
+		ext = ".mp4"
+	}
+	recorded := downloadFileName(key, rawURL)
+	fileName, err := settleFileName(key, rawURL, outputDir, strings.TrimSuffix(recorded, filepath.Ext(recorded))+ext, opts)
+	if err != nil {
+		return "", err
+	}
+	if opts.destination == "" {
+		defer releaseClaims(key)
+	}
+	segmentDir := filepath.Join(outputDir, fileName+".segments")
+	if err := os.MkdirAll(segmentDir, os.ModePerm); err != nil {
+		return "", fmt.Errorf("failed to create segment directory: %v", err)
+	}
+	setPartialPath(key, segmentDir)
+
+	keys := make(map[string][]byte)
+	for _, part := range media.parts {
+		if part.key == nil || keys[part.key.uri] != nil {
+			continue
+		}
+		data, err := fetchPart(ctx, client, hlsPart{uri: part.key.uri, length: -1})
+		if err != nil {
+			return "", fmt.Errorf("failed to fetch the stream's key: %w", err)
+		}
+		if len(data) != aes.BlockSize {
+			return "", fmt.Errorf("the stream's key is %d bytes, not %d", len(data), aes.BlockSize)
+		}
+		keys[part.key.uri] = data
+	}
+
+	// Parts saved by an earlier attempt are kept.
+	var mu sync.Mutex
+	done := 0
+	var written int64
+	var missing []int
+	for i, part := range media.parts {
+		if info, err := os.Stat(filepath.Join(segmentDir, part.name(i))); err == nil {
+			done++
+			written += info.Size()
+		} else {
+			missing = append(missing, i)
+		}
+	}
+	if done > 0 {
+		addDownloadEvent(key, "resumed", fmt.Sprintf("%d of %d segments were already saved", done, total))
+	}
+	limit := opts.sizeLimit()
+	if limit > 0 && written > limit {
+		os.RemoveAll(segmentDir)
+		return "", sizeLimitError(-1, limit)
+	}
+	setSegmentProgress(key, done, total, written)
+
+	defer shaper.start(key, downloadClass(key), opts.maxSpeed)()
+	workers := hlsSegmentWorkers
+	if opts.connections > workers {
+		workers = opts.connections
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				part := media.parts[i]
+				data, err := fetchPart(ctx, client, part)
+				if err == nil && part.key != nil {
+					data, err = decryptPart(data, keys[part.key.uri], part)
+				}
+				if err == nil {
+					err = writeSegment(filepath.Join(segmentDir, part.name(i)), data)
+				}
+				if err != nil {
+					cancel(fmt.Errorf("segment %d of %d: %w", i+1, total, err))
+					return
+				}
+				mu.Lock()
+				done++
+				written += int64(len(data))
+				d, w := done, written
+				mu.Unlock()
+				if limit > 0 && w > limit {
+					cancel(sizeLimitError(-1, limit))
+					return
+				}
+				setSegmentProgress(key, d, total, w)
+				updateDownloadStatus(key, "downloading", false, "")
+			}
+		}()
+	}
+feed:
+	for _, i := range missing {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	if err := context.Cause(ctx); err != nil {
+		var derr *downloadError
+		if errors.As(err, &derr) && derr.code == "size_limit" {
+			os.RemoveAll(segmentDir)
+		}
+		return "", err
+	}
+
+	path, err := joinSegments(ctx, key, rawURL, outputDir, fileName, segmentDir, media.parts, opts)
+	if err != nil {
+		return "", err
+	}
+	os.RemoveAll(segmentDir)
+	return path, nil
+}
+
+// writeSegment saves a part under its final name only once it is
+// complete, so a half-written one is never taken as saved.
+func writeSegment(name string, data []byte) error {
+	if err := os.WriteFile(name+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// joinSegments writes the saved parts, in order, to the stream's file and
+// checks it against the expected checksum for rawURL. Parts that make a
+// file with the wrong checksum are thrown away with it.
+func joinSegments(ctx context.Context, key, rawURL, outputDir, fileName, segmentDir string, parts []hlsPart, opts downloadOptions) (string, error) {
+	updateDownloadStatus(key, "assembling", false, "")
+	dest, err := openDestination(opts.destination, outputDir)
+	if err != nil {
+		return "", err
+	}
+	file, err := dest.CreatePart(ctx, fileName, false)
+	if err != nil {
+		return "", err
+	}
+	defer func() { file.Abort() }()
+	if opts.destination == "" {
+		setPartialPath(key, partPath(filepath.Join(outputDir, fileName)))
+	}
+	var w io.Writer = file
+	sums := newChecksummer(opts.checksums[rawURL])
+	if sums != nil {
+		w = io.MultiWriter(file, sums)
+	}
+	for i, part := range parts {
+		f, err := os.Open(filepath.Join(segmentDir, part.name(i)))
+		if err != nil {
+			return "", fmt.Errorf("segment %d of %d is missing: %v", i+1, len(parts), err)
+		}
+		_, err = io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to save file: %w", err)
+		}
+	}
+	if sums != nil {
+		if err := sums.verify(key); err != nil {
+			os.RemoveAll(segmentDir)
+			return "", err
+		}
+	}
+	return file.Commit()
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	onCompleteFlag = flag.String("on-complete", os.Getenv("YAD_ON_COMPLETE"), `command run after every completed download, e.g. "/usr/local/bin/scan --quiet"; split into arguments like a shell would, but without one, also YAD_ON_COMPLETE`)
+	hookShell      = flag.Bool("hook-shell", false, "run -on-complete with sh -c instead of executing it directly")
+	requestHooks   = flag.Bool("request-hooks", false, "let requests name an onComplete command of their own")
+	hookTimeout    = flag.Duration("hook-timeout", 5*time.Minute, "how long a hook command may run before it is killed")
+)
+
+// maxHookOutput caps how much of a hook's output is kept.
+const maxHookOutput = 4096
+
+// onCompleteCommand is -on-complete split into its arguments.
+var onCompleteCommand []string
+
+// initHooks parses -on-complete.
+func initHooks() error {
+	if *onCompleteFlag == "" {
+		return nil
+	}
+	if *hookShell {
+		onCompleteCommand = []string{"sh", "-c", *onCompleteFlag}
+		return nil
+	}
+	argv, err := splitCommand(*onCompleteFlag)
+	if err != nil {
+		return err
+	}
+	onCompleteCommand = argv
+	return nil
+}
+
+// splitCommand splits a command line into arguments at unquoted spaces.
+// Single quotes keep everything up to the next one, and double quotes
+// everything but a backslash-escaped '"' or '\'; nothing is expanded.
+func splitCommand(line string) ([]string, error) {
+	var argv []string
+	var arg strings.Builder
+	inArg := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			if inArg {
+				argv = append(argv, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated ' in %q", line)
+			}
+			arg.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+			inArg = true
+		case c == '"':
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) && (line[i+1] == '"' || line[i+1] == '\\') {
+					i++
+				}
+				arg.WriteByte(line[i])
+			}
+			if i == len(line) {
+				return nil, fmt.Errorf("unterminated \" in %q", line)
+			}
+			inArg = true
+		default:
+			arg.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		argv = append(argv, arg.String())
+	}
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	return argv, nil
+}
+
+// checkOnComplete validates a request's onComplete command.
+func checkOnComplete(req DownloadRequest) error {
+	if len(req.OnComplete) == 0 {
+		if req.StrictHook && len(onCompleteCommand) == 0 {
+			return fmt.Errorf("strictHook given without a hook to run")
+		}
+		return nil
+	}
+	if !*requestHooks {
+		return fmt.Errorf("onComplete commands are disabled on this server (-request-hooks)")
+	}
+	if req.OnComplete[0] == "" {
+		return fmt.Errorf("onComplete needs a command to run")
+	}
+	return nil
+}
+
+// hookError is a hook command that failed or timed out.
+type hookError struct {
+	command string
+	err     error
+	output  string
+}
+
+func (e *hookError) Error() string {
+	msg := fmt.Sprintf("hook %s failed: %v", e.command, e.err)
+	if e.output != "" {
+		msg += ": " + e.output
+	}
+	return msg
+}
+
+// runHooks runs the server's -on-complete command and then the
+// request's own onComplete for completed download id, whose file is at
+// savedPath. Each one's output goes into the download's event log. It
+// returns the first hook's failure, which only fails the download if
+// the request set strictHook.
+func runHooks(id string, j job, savedPath string) error {
+	var first error
+	for _, argv := range [][]string{onCompleteCommand, j.opts.onComplete} {
+		if len(argv) == 0 {
+			continue
+		}
+		if err := runHook(id, j.url, savedPath, argv); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// runHook runs argv without a shell, with the download described in
+// environment variables: YAD_ID, YAD_URL, YAD_FILE and YAD_STATUS.
+func runHook(id, rawURL, savedPath string, argv []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *hookTimeout)
+	defer cancel()
+	if abs, err := filepath.Abs(savedPath); err == nil {
+		savedPath = abs
+	}
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Env = append(os.Environ(),
+		"YAD_ID="+id,
+		"YAD_URL="+rawURL,
+		"YAD_FILE="+savedPath,
+		"YAD_STATUS="+completedStatus(id),
+	)
+	cmd.Dir = filepath.Dir(savedPath)
+	out := &hookOutput{}
+	cmd.Stdout, cmd.Stderr = out, out
+	// Whatever the command left running in the background mustn't hold
+	// up the worker once it exits or times out.
+	cmd.WaitDelay = 5 * time.Second
+
+	addDownloadEvent(id, "hook_started", fmt.Sprintf("%q", argv))
+	err := cmd.Run()
+	output := strings.TrimSpace(out.String())
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s", *hookTimeout)
+	}
+	if err != nil {
+		herr := &hookError{command: argv[0], err: err, output: output}
+		addDownloadEvent(id, "hook_failed", herr.Error())
+		return herr
+	}
+	message := argv[0] + " succeeded"
+	if output != "" {
+		message += ": " + output
+	}
+	addDownloadEvent(id, "hook_succeeded", message)
+	return nil
+}
+
+// hookOutput keeps the first maxHookOutput bytes a hook writes to
+// stdout and stderr and discards the rest.
+type hookOutput struct {
+	mu        sync.Mutex
+	buf       []byte
+	truncated bool
+}
+
+func (o *hookOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if room := maxHookOutput - len(o.buf); room < len(p) {
+		o.buf = append(o.buf, p[:max(room, 0)]...)
+		o.truncated = true
+	} else {
+		o.buf = append(o.buf, p...)
+	}
+	return len(p), nil
+}
+
+func (o *hookOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.truncated {
+		return string(o.buf) + "... (truncated)"
+	}
+	return string(o.buf)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+var maxPerHost = flag.Int("max-per-host", 2, "downloads that may talk to one host at once; further ones wait while workers take downloads for other hosts (0 = no limit)")
+
+// jobHost is the host job j's download starts out talking to, or "" for
+// torrents, which aren't limited per host.
+func jobHost(j job) string {
+	if isTorrentLink(j.url) {
+		return ""
+	}
+	u, err := url.Parse(j.url)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// hostSlots is how busy one host is, as reported in /api/v1/stats.
+type hostSlots struct {
+	Host    string `json:"host"`
+	Running int    `json:"running"`
+	Queued  int    `json:"queued"`
+}
+
+// hostStats lists every host with downloads running or queued, busiest
+// first.
+func (d *dispatcher) hostStats() []hostSlots {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	byHost := make(map[string]*hostSlots)
+	slot := func(host string) *hostSlots {
+		if byHost[host] == nil {
+			byHost[host] = &hostSlots{Host: host}
+		}
+		return byHost[host]
+	}
+	for host, n := range d.hostsBusy() {
+		slot(host).Running = n
+	}
+	for _, j := range d.queue {
+		if host := jobHost(j); host != "" {
+			slot(host).Queued++
+		}
+	}
+	list := make([]hostSlots, 0, len(byHost))
+	for _, s := range byHost {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, k int) bool {
+		if list[i].Running != list[k].Running {
+			return list[i].Running > list[k].Running
+		}
+		return list[i].Host < list[k].Host
+	})
+	return list
+}
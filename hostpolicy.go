@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	allowHostsFlag        = flag.String("allow-hosts", "", `comma-separated hosts downloads may contact, e.g. "mirror.example.org,*.example.net" (empty allows all)`)
+	denyHostsFlag         = flag.String("deny-hosts", "", "comma-separated hosts downloads must never contact; takes precedence over -allow-hosts")
+	maxCrossHostRedirects = flag.Int("max-cross-host-redirects", -1, "redirects to a different host allowed per request (-1 for no limit besides the usual 10 hops)")
+)
+
+// hostPolicy restricts which hosts downloads talk to. Entries are exact
+// host names or "*.example.org", which matches every subdomain of
+// example.org but not example.org itself.
+type hostPolicy struct {
+	Allow                 []string `json:"allow"`
+	Deny                  []string `json:"deny"`
+	MaxCrossHostRedirects int      `json:"maxCrossHostRedirects"`
+}
+
+var (
+	hosts   hostPolicy
+	hostsMu sync.Mutex
+)
+
+// hostNotAllowedError names the host a download was stopped from
+// contacting.
+type hostNotAllowedError struct {
+	host   string
+	reason string
+}
+
+func (e *hostNotAllowedError) Error() string {
+	return fmt.Sprintf("host %s is not allowed: %s", e.host, e.reason)
+}
+
+// initHostPolicy loads -allow-hosts and -deny-hosts. It must run after
+// flag.Parse.
+func initHostPolicy() error {
+	policy := hostPolicy{
+		Allow:                 strings.Split(*allowHostsFlag, ","),
+		Deny:                  strings.Split(*denyHostsFlag, ","),
+		MaxCrossHostRedirects: *maxCrossHostRedirects,
+	}
+	return setHostPolicy(policy)
+}
+
+func setHostPolicy(policy hostPolicy) error {
+	var err error
+	if policy.Allow, err = normalizeHostPatterns(policy.Allow); err != nil {
+		return err
+	}
+	if policy.Deny, err = normalizeHostPatterns(policy.Deny); err != nil {
+		return err
+	}
+	if policy.MaxCrossHostRedirects < -1 {
+		return fmt.Errorf("maxCrossHostRedirects must be -1 or more")
+	}
+
+	hostsMu.Lock()
+	hosts = policy
+	hostsMu.Unlock()
+	return nil
+}
+
+func currentHostPolicy() hostPolicy {
+	hostsMu.Lock()
+	defer hostsMu.Unlock()
+	return hosts
+}
+
+// normalizeHostPatterns lowercases patterns and drops empty ones,
+// rejecting anything that isn't a host name or "*." suffix.
+func normalizeHostPatterns(patterns []string) ([]string, error) {
+	normalized := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		name := strings.TrimPrefix(p, "*.")
+		if name == "" || strings.ContainsAny(name, "*/:@ \t") {
+			return nil, fmt.Errorf("invalid host pattern %q", p)
+		}
+		normalized = append(normalized, p)
+	}
+	return normalized, nil
+}
+
+func matchHost(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+// checkHostAllowed returns a host_not_allowed error if the policy
+// forbids contacting host.
+func checkHostAllowed(host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	policy := currentHostPolicy()
+
+	for _, p := range policy.Deny {
+		if matchHost(p, host) {
+			return &downloadError{code: "host_not_allowed", err: &hostNotAllowedError{host: host, reason: "matches deny entry " + p}}
+		}
+	}
+	if len(policy.Allow) == 0 {
+		return nil
+	}
+	for _, p := range policy.Allow {
+		if matchHost(p, host) {
+			return nil
+		}
+	}
+	return &downloadError{code: "host_not_allowed", err: &hostNotAllowedError{host: host, reason: "not on the allow list"}}
+}
+
+// checkURLAllowed applies checkHostAllowed to the host of rawURL. Magnet
+// links have no host and are always allowed.
+func checkURLAllowed(rawURL string) error {
+	if strings.HasPrefix(rawURL, "magnet:") || isS3Link(rawURL) {
+		// An s3:// URL names a bucket, not a host; the endpoint it is
+		// sent to is checked when the download contacts it.
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil // rejected elsewhere as not fetchable
+	}
+	return checkHostAllowed(u.Hostname())
+}
+
+// applyHostPolicy rejects submitted URLs, and their HTTP fallback or
+// mirrors, that the policy forbids.
+func applyHostPolicy(result *SubmissionResult, opts downloadOptions) {
+	for _, u := range append([]string{result.URL, opts.httpFallback}, opts.mirrors...) {
+		if u == "" {
+			continue
+		}
+		var hostErr *hostNotAllowedError
+		if err := checkURLAllowed(u); errors.As(err, &hostErr) {
+			result.Accepted = false
+			result.Reason = hostErr.Error()
+			result.BlockedHost = hostErr.host
+			return
+		}
+	}
+}
+
+// hostPolicyTransport refuses requests to forbidden hosts, so the
+// policy holds for every request a download makes: the first one, each
+// redirect hop, later pages and the switch to an HTTP fallback.
+type hostPolicyTransport struct {
+	next http.RoundTripper
+}
+
+func (t hostPolicyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := checkHostAllowed(req.URL.Hostname()); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// checkRedirect enforces the cross-host redirect limit on top of
+// -max-redirects and loop detection.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if err := checkRedirectChain(req, via); err != nil {
+		return err
+	}
+	limit := currentHostPolicy().MaxCrossHostRedirects
+	if limit < 0 {
+		return nil
+	}
+	crossHost := 0
+	chain := append(via, req)
+	for i := 1; i < len(chain); i++ {
+		if !strings.EqualFold(chain[i].URL.Hostname(), chain[i-1].URL.Hostname()) {
+			crossHost++
+		}
+	}
+	if crossHost > limit {
+		return &downloadError{code: "host_not_allowed", err: &hostNotAllowedError{
+			host:   req.URL.Hostname(),
+			reason: fmt.Sprintf("more than %d redirects to a different host", limit),
+		}}
+	}
+	return nil
+}
+
+// markBlockedHost records on a failed download the host the policy
+// stopped it from contacting.
+func markBlockedHost(id string, err error) {
+	var hostErr *hostNotAllowedError
+	if !errors.As(err, &hostErr) {
+		return
+	}
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[id]; exists {
+		download.BlockedHost = hostErr.host
+	}
+	downloadsMutex.Unlock()
+}
+
+// recordBlocked creates the record of a submitted download the host
+// policy rejected, failed from the start, and keeps its job for a retry
+// once the policy allows it.
+func recordBlocked(result SubmissionResult, outputDir, requestID string, opts downloadOptions) {
+	downloadsMutex.Lock()
+	activeDownloads[result.ID] = &DownloadStatus{
+		ID:           result.ID,
+		URL:          result.URL,
+		SubmittedAt:  time.Now(),
+		Status:       "failed",
+		FileName:     result.FileName,
+		Completed:    true,
+		Error:        result.Reason,
+		ErrorCode:    "host_not_allowed",
+		BlockedHost:  result.BlockedHost,
+		RequestID:    requestID,
+		OutputDir:    outputDir,
+		Tags:         opts.tags,
+		Class:        opts.class,
+		notifyEmail:  opts.notifyEmail,
+		Recurring:    opts.recurring,
+		SubmissionID: opts.submission,
+	}
+	downloadsMutex.Unlock()
+	rememberStopped(newJob(result.ID, result.URL, outputDir, requestID, opts))
+	recordHistory(result.ID)
+}
+
+func handleGetHostPolicy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentHostPolicy())
+}
+
+// handleSetHostPolicy replaces the host policy. It applies to requests
+// made from then on, including those of downloads already running.
+func handleSetHostPolicy(w http.ResponseWriter, r *http.Request) {
+	policy := hostPolicy{MaxCrossHostRedirects: -1}
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := setHostPolicy(policy); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	policy = currentHostPolicy()
+	logf(r.Context(), "Host policy set: allow %v, deny %v, max cross-host redirects %d", policy.Allow, policy.Deny, policy.MaxCrossHostRedirects)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsSendBuffer   = 64
+	wsWriteTimeout = 10 * time.Second
+
+	// wsCloseTooSlow is sent to clients disconnected by the "disconnect"
+	// slow-client policy.
+	wsCloseTooSlow = 4000
+)
+
+// Websocket subscriptions. Clients start on the full per-download status
+// stream and can switch with {"action":"subscribe_summary"} or
+// {"action":"subscribe_status"}, optionally with "tags" to see only
+// downloads carrying all of them. {"action":"subscribe_public"} switches
+// to the filtered public view, which is all /public/ws clients ever get.
+const (
+	subscribeStatus  = "status"
+	subscribeSummary = "summary"
+	subscribePublic  = "public"
+)
+
+var wsSlowPolicy = flag.String("ws-slow-policy", "coalesce", `what to do when a websocket client's send queue overflows: "coalesce" or "disconnect"`)
+
+// wsClient is one websocket connection with its own bounded outbound
+// queue, drained by a dedicated writer goroutine.
+type wsClient struct {
+	id          int
+	conn        *websocket.Conn
+	send        chan []byte
+	connectedAt time.Time
+	dropped     atomic.Int64
+
+	// legacy clients connected through the deprecated /api/ws and get
+	// the legacy status shape.
+	legacy bool
+
+	mu           sync.Mutex
+	closed       bool
+	subscription string
+	tags         []string
+}
+
+// wsClientStats is the per-client view exposed in /api/stats.
+type wsClientStats struct {
+	ID           int       `json:"id"`
+	RemoteAddr   string    `json:"remoteAddr"`
+	ConnectedAt  time.Time `json:"connectedAt"`
+	QueueDepth   int       `json:"queueDepth"`
+	Dropped      int64     `json:"dropped"`
+	Subscription string    `json:"subscription"`
+	Tags         []string  `json:"tags,omitempty"`
+}
+
+// hub fans status messages out to every connected websocket client
+// without letting one slow client hold up the others.
+type hub struct {
+	mu      sync.Mutex
+	nextID  int
+	clients map[*wsClient]bool
+}
+
+func newHub() *hub {
+	return &hub{clients: make(map[*wsClient]bool)}
+}
+
+func (h *hub) add(conn *websocket.Conn, legacy bool) *wsClient {
+	h.mu.Lock()
+	h.nextID++
+	c := &wsClient{
+		id:           h.nextID,
+		conn:         conn,
+		send:         make(chan []byte, wsSendBuffer),
+		connectedAt:  time.Now(),
+		legacy:       legacy,
+		subscription: subscribeStatus,
+	}
+	h.clients[c] = true
+	h.mu.Unlock()
+
+	go c.writeLoop(h)
+	return c
+}
+
+func (h *hub) remove(c *wsClient) {
+	h.mu.Lock()
+	delete(h.clients, c)
+	h.mu.Unlock()
+
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+	c.mu.Unlock()
+}
+
+// broadcast sends every client on the given subscription the message
+// render builds for its tag filter and shape. Clients sharing both share
+// one rendered message, and nothing is rendered if no client is
+// subscribed.
+func (h *hub) broadcast(subscription string, render func(tags []string, legacy bool) []byte) {
+	h.mu.Lock()
+	clients := make([]*wsClient, 0, len(h.clients))
+	for c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.mu.Unlock()
+
+	rendered := make(map[string][]byte)
+	for _, c := range clients {
+		sub, tags := c.subscribedTo()
+		if sub != subscription {
+			continue
+		}
+		key := strings.Join(tags, "\x00")
+		if c.legacy {
+			key = "legacy\x01" + key
+		}
+		msg, ok := rendered[key]
+		if !ok {
+			msg = render(tags, c.legacy)
+			rendered[key] = msg
+		}
+		h.deliver(c, msg)
+	}
+}
+
+// subscribe switches the client to subscription, limited to downloads
+// carrying all of tags.
+func (c *wsClient) subscribe(subscription string, tags []string) {
+	c.mu.Lock()
+	c.subscription = subscription
+	c.tags = tags
+	c.mu.Unlock()
+}
+
+func (c *wsClient) subscribedTo() (string, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.subscription, c.tags
+}
+
+// deliver queues msg for c, applying the slow-client policy if the
+// queue is full.
+func (h *hub) deliver(c *wsClient, msg []byte) {
+	if c.enqueue(msg) {
+		return
+	}
+
+	c.dropped.Add(1)
+	log.Printf("Disconnecting slow websocket client %d (%s)", c.id, c.conn.RemoteAddr())
+	h.remove(c)
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(wsCloseTooSlow, "client too slow"),
+		time.Now().Add(time.Second))
+	c.conn.Close()
+}
+
+// enqueue adds msg to the client's queue. When the queue is full it
+// either coalesces or, under the "disconnect" policy, reports false so
+// the caller can drop the client.
+func (c *wsClient) enqueue(msg []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return true
+	}
+	select {
+	case c.send <- msg:
+		return true
+	default:
+	}
+	if *wsSlowPolicy == "disconnect" {
+		return false
+	}
+
+	// Every message is a full snapshot, so the newest one supersedes
+	// anything still waiting in the queue.
+	for len(c.send) > 0 {
+		select {
+		case <-c.send:
+			c.dropped.Add(1)
+		default:
+		}
+	}
+	c.send <- msg
+	return true
+}
+
+func (c *wsClient) writeLoop(h *hub) {
+	for msg := range c.send {
+		c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			h.remove(c)
+			c.conn.Close()
+			break
+		}
+	}
+}
+
+func (h *hub) stats() []wsClientStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	list := make([]wsClientStats, 0, len(h.clients))
+	for c := range h.clients {
+		sub, tags := c.subscribedTo()
+		list = append(list, wsClientStats{
+			ID:           c.id,
+			RemoteAddr:   c.conn.RemoteAddr().String(),
+			ConnectedAt:  c.connectedAt,
+			QueueDepth:   len(c.send),
+			Dropped:      c.dropped.Load(),
+			Subscription: sub,
+			Tags:         tags,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
@@ -0,0 +1,118 @@
+// Package httpclient builds the tuned HTTP transport yad's downloads
+// share, so that connections and TLS sessions are reused across
+// workers. Proxies, CA certificates, default headers and rate limits
+// are layered on top of it by the caller.
+package httpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Config holds the transport's connection settings.
+type Config struct {
+	// Time allowed to connect to a server.
+	DialTimeout time.Duration
+	// Interval of TCP keep-alive probes; negative disables them.
+	KeepAlive time.Duration
+	// Time allowed for a server's TLS handshake.
+	TLSHandshakeTimeout time.Duration
+	// Time a server has to send response headers once the request is
+	// written; 0 for no limit.
+	ResponseHeaderTimeout time.Duration
+	// Idle connections kept open to each server for reuse, and for
+	// how long.
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	// Use HTTP/2 with servers that offer it.
+	HTTP2 bool
+}
+
+// DefaultConfig returns the settings yad uses unless told otherwise.
+func DefaultConfig() Config {
+	return Config{
+		DialTimeout:           30 * time.Second,
+		KeepAlive:             30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 2 * time.Minute,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+		HTTP2:                 true,
+	}
+}
+
+// Validate reports the first setting that is out of range, named after
+// its flag.
+func (c Config) Validate() error {
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"dial-timeout", c.DialTimeout},
+		{"tls-handshake-timeout", c.TLSHandshakeTimeout},
+		{"response-header-timeout", c.ResponseHeaderTimeout},
+		{"idle-conn-timeout", c.IdleConnTimeout},
+	} {
+		if d.value < 0 {
+			return fmt.Errorf("-%s must not be negative", d.name)
+		}
+	}
+	if c.MaxIdleConnsPerHost < 1 {
+		return fmt.Errorf("-max-idle-conns-per-host must be at least 1")
+	}
+	return nil
+}
+
+// NewDialer returns a dialer with c's timeouts.
+func NewDialer(c Config) *net.Dialer {
+	d := &net.Dialer{}
+	ApplyDialer(d, c)
+	return d
+}
+
+// ApplyDialer sets c's timeouts on d.
+func ApplyDialer(d *net.Dialer, c Config) {
+	d.Timeout = c.DialTimeout
+	d.KeepAlive = c.KeepAlive
+}
+
+// NewTransport returns a transport tuned by c that connects with dial,
+// or a dialer made by NewDialer if dial is nil. It takes proxies from
+// the environment and keeps a TLS session cache.
+func NewTransport(c Config, dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Transport {
+	if dial == nil {
+		dial = NewDialer(c).DialContext
+	}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
+		MaxIdleConns:          100,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig: &tls.Config{
+			ClientSessionCache: tls.NewLRUClientSessionCache(256),
+		},
+	}
+	Apply(t, c)
+	return t
+}
+
+// Apply sets c's settings on t. Transports cloned from t afterwards get
+// them too.
+func Apply(t *http.Transport, c Config) {
+	t.TLSHandshakeTimeout = c.TLSHandshakeTimeout
+	t.ResponseHeaderTimeout = c.ResponseHeaderTimeout
+	t.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	t.MaxIdleConns = max(t.MaxIdleConns, c.MaxIdleConnsPerHost)
+	t.IdleConnTimeout = c.IdleConnTimeout
+	t.ForceAttemptHTTP2 = c.HTTP2
+	if c.HTTP2 {
+		t.TLSNextProto = nil
+	} else {
+		// A non-nil, empty TLSNextProto turns HTTP/2 off.
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+}
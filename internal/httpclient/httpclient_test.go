@@ -0,0 +1,147 @@
+package httpclient
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("DefaultConfig().Validate() = %v", err)
+	}
+	tests := []struct {
+		change  func(*Config)
+		wantErr string
+	}{
+		{func(c *Config) { c.DialTimeout = -1 }, "-dial-timeout must not be negative"},
+		{func(c *Config) { c.TLSHandshakeTimeout = -1 }, "-tls-handshake-timeout must not be negative"},
+		{func(c *Config) { c.ResponseHeaderTimeout = -1 }, "-response-header-timeout must not be negative"},
+		{func(c *Config) { c.IdleConnTimeout = -1 }, "-idle-conn-timeout must not be negative"},
+		{func(c *Config) { c.MaxIdleConnsPerHost = 0 }, "-max-idle-conns-per-host must be at least 1"},
+		// A negative keep-alive disables the probes.
+		{func(c *Config) { c.KeepAlive = -1 }, ""},
+		{func(c *Config) { c.ResponseHeaderTimeout = 0 }, ""},
+	}
+	for _, tt := range tests {
+		c := DefaultConfig()
+		tt.change(&c)
+		err := c.Validate()
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+			t.Errorf("Validate(%+v) = %v; want %q", c, err, tt.wantErr)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	c := Config{
+		DialTimeout:           5 * time.Second,
+		KeepAlive:             -1,
+		TLSHandshakeTimeout:   3 * time.Second,
+		ResponseHeaderTimeout: 7 * time.Second,
+		MaxIdleConnsPerHost:   200,
+		IdleConnTimeout:       time.Minute,
+	}
+	tr := NewTransport(DefaultConfig(), nil)
+	Apply(tr, c)
+	if tr.TLSHandshakeTimeout != c.TLSHandshakeTimeout || tr.ResponseHeaderTimeout != c.ResponseHeaderTimeout ||
+		tr.MaxIdleConnsPerHost != c.MaxIdleConnsPerHost || tr.IdleConnTimeout != c.IdleConnTimeout {
+		t.Errorf("Apply left %+v", tr)
+	}
+	if tr.MaxIdleConns < c.MaxIdleConnsPerHost {
+		t.Errorf("MaxIdleConns = %d; want at least %d", tr.MaxIdleConns, c.MaxIdleConnsPerHost)
+	}
+	if tr.ForceAttemptHTTP2 || tr.TLSNextProto == nil || len(tr.TLSNextProto) != 0 {
+		t.Errorf("HTTP/2 not turned off: ForceAttemptHTTP2 %v, TLSNextProto %v", tr.ForceAttemptHTTP2, tr.TLSNextProto)
+	}
+	if clone := tr.Clone(); clone.ResponseHeaderTimeout != c.ResponseHeaderTimeout || clone.TLSNextProto == nil {
+		t.Error("a clone made after Apply lost its settings")
+	}
+
+	d := NewDialer(DefaultConfig())
+	ApplyDialer(d, c)
+	if d.Timeout != c.DialTimeout || d.KeepAlive != c.KeepAlive {
+		t.Errorf("ApplyDialer left timeout %v, keep-alive %v", d.Timeout, d.KeepAlive)
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	for _, enabled := range []bool{true, false} {
+		c := DefaultConfig()
+		c.HTTP2 = enabled
+		tr := NewTransport(c, nil)
+		tr.TLSClientConfig.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		want := "HTTP/1.1"
+		if enabled {
+			want = "HTTP/2.0"
+		}
+		if string(body) != want {
+			t.Errorf("HTTP2 %v: server saw %s; want %s", enabled, body, want)
+		}
+		tr.CloseIdleConnections()
+	}
+}
+
+func TestReusesConnections(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	var dials atomic.Int32
+	d := NewDialer(DefaultConfig())
+	tr := NewTransport(DefaultConfig(), func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return d.DialContext(ctx, network, addr)
+	})
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+	for range 3 {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if n := dials.Load(); n != 1 {
+		t.Errorf("%d dials for 3 sequential requests; want 1", n)
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c := DefaultConfig()
+	c.ResponseHeaderTimeout = 50 * time.Millisecond
+	tr := NewTransport(c, nil)
+	defer tr.CloseIdleConnections()
+	_, err := (&http.Client{Transport: tr}).Get(srv.URL)
+	if err == nil || !strings.Contains(err.Error(), "timeout awaiting response headers") {
+		t.Errorf("Get = %v; want a response header timeout", err)
+	}
+}
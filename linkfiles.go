@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// maxLinkFileSize bounds one uploaded link file; real ones are a
+	// few hundred bytes.
+	maxLinkFileSize = 64 << 10
+	// maxLinkUploadSize bounds a whole multipart submission.
+	maxLinkUploadSize = 8 << 20
+)
+
+// linkFileError is an uploaded link file that couldn't be used.
+type linkFileError struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
+
+// parseLinkFile extracts the URL from a browser or desktop link file: the
+// raw contents of a .magnet file, or the URL= key of a Windows .url
+// ([InternetShortcut]) or freedesktop .desktop ([Desktop Entry],
+// Type=Link) file.
+func parseLinkFile(name string, data []byte) (string, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".magnet":
+		link := strings.TrimSpace(string(data))
+		if !strings.HasPrefix(link, "magnet:?") || strings.ContainsAny(link, "\r\n") {
+			return "", fmt.Errorf("not a single magnet link")
+		}
+		return link, nil
+	case ".url":
+		return iniLinkURL(data, "InternetShortcut", "")
+	case ".desktop":
+		return iniLinkURL(data, "Desktop Entry", "Link")
+	}
+	return "", fmt.Errorf("unsupported link file type %q (want .magnet, .url or .desktop)", filepath.Ext(name))
+}
+
+// iniLinkURL returns the URL key of section in an INI-style file. If
+// wantType is set, the section's Type key must match it.
+func iniLinkURL(data []byte, section, wantType string) (string, error) {
+	var url, typ string
+	inSection, found := false, false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inSection = line[1:len(line)-1] == section
+			found = found || inSection
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !inSection || !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "URL":
+			url = strings.TrimSpace(value)
+		case "Type":
+			typ = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	switch {
+	case !found:
+		return "", fmt.Errorf("no [%s] section", section)
+	case wantType != "" && typ != wantType:
+		return "", fmt.Errorf("[%s] has Type=%s, want %s", section, typ, wantType)
+	case url == "":
+		return "", fmt.Errorf("[%s] has no URL", section)
+	}
+	return url, nil
+}
+
+// decodeLinkFileRequest reads a multipart submission: an optional
+// "request" field holding DownloadRequest JSON and any number of "file"
+// fields holding link files, whose URLs are appended to req.URLs. It
+// returns the file each URL came from ("" for ones in the JSON) and the
+// files that couldn't be parsed.
+func decodeLinkFileRequest(w http.ResponseWriter, r *http.Request, req *DownloadRequest) ([]string, []linkFileError, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxLinkUploadSize)
+	if err := r.ParseMultipartForm(maxLinkUploadSize); err != nil {
+		return nil, nil, err
+	}
+	if field := r.FormValue("request"); field != "" {
+		if err := json.Unmarshal([]byte(field), req); err != nil {
+			return nil, nil, fmt.Errorf("invalid request field: %v", err)
+		}
+	}
+	sources := make([]string, len(req.URLs))
+	var rejected []linkFileError
+	for _, header := range r.MultipartForm.File["file"] {
+		url, err := readLinkFile(header)
+		if err != nil {
+			log.Printf("Rejected link file %s: %v", header.Filename, err)
+			rejected = append(rejected, linkFileError{File: header.Filename, Error: err.Error()})
+			continue
+		}
+		req.URLs = append(req.URLs, url)
+		sources = append(sources, header.Filename)
+	}
+	return sources, rejected, nil
+}
+
+func readLinkFile(header *multipart.FileHeader) (string, error) {
+	file, err := header.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxLinkFileSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxLinkFileSize {
+		return "", fmt.Errorf("larger than %d bytes", maxLinkFileSize)
+	}
+	return parseLinkFile(header.Filename, data)
+}
+
+// recordSourceFiles notes on each download which uploaded link file it
+// came from. A download a later file lists again keeps its first source.
+func recordSourceFiles(ids, sources []string) {
+	downloadsMutex.Lock()
+	defer downloadsMutex.Unlock()
+	for i, source := range sources {
+		if download, exists := activeDownloads[ids[i]]; exists && source != "" && download.SourceFile == "" {
+			download.SourceFile = source
+		}
+	}
+}
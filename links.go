@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// LinkResult records what happened for one alsoLinkTo target.
+type LinkResult struct {
+	Target string `json:"target"`
+	Method string `json:"method,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// linkIntoTargets places a completed download into each extra target
+// directory, hardlinking when possible and copying otherwise. Directories
+// (torrent content) are linked file by file so the original stays intact
+// for seeding. Failures are recorded per target and never fail the
+// download itself.
+func linkIntoTargets(id, savedPath string, targets []string) {
+	results := make([]LinkResult, 0, len(targets))
+	for _, target := range targets {
+		var method string
+		var err error
+		// Checked again here: the roots may have changed since the
+		// download was submitted, or it was restored from an older queue.
+		if _, ok := resolveOutputDir(target); !ok || !filepath.IsAbs(target) {
+			err = fmt.Errorf("%s is not inside an allowed root", target)
+		} else {
+			method, err = linkTree(savedPath, filepath.Join(target, filepath.Base(savedPath)))
+		}
+		result := LinkResult{Target: target, Method: method}
+		if err != nil {
+			result.Error = err.Error()
+			addDownloadEvent(id, "link_failed", fmt.Sprintf("%s: %v", target, err))
+		}
+		results = append(results, result)
+	}
+
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[id]; exists {
+		download.Links = results
+	}
+	downloadsMutex.Unlock()
+}
+
+// linkTree links or copies src to dest, recursing into directories. The
+// returned method is "hardlink", "copy", or "mixed".
+func linkTree(src, dest string) (string, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return linkFile(src, dest)
+	}
+
+	method := ""
+	err = filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, os.ModePerm)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		m, err := linkFile(path, target)
+		if err != nil {
+			return err
+		}
+		if method == "" {
+			method = m
+		} else if method != m {
+			method = "mixed"
+		}
+		return nil
+	})
+	return method, err
+}
+
+func linkFile(src, dest string) (string, error) {
+	if _, err := os.Lstat(dest); err == nil {
+		return "", fmt.Errorf("%s already exists", dest)
+	}
+	if err := os.Link(src, dest); err == nil {
+		return "hardlink", nil
+	}
+	// Most likely a different file system; fall back to copying.
+	if err := copyFile(src, dest); err != nil {
+		return "", err
+	}
+	return "copy", nil
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+	return out.Close()
+}
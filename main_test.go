@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	data, err := os.MkdirTemp("", "yad-test-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	*dataDir = data
+	initMemoryProfile()
+	if err := initTransport(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initHostPolicy(); err != nil {
+		log.Fatal(err)
+	}
+	code := m.Run()
+	os.RemoveAll(data)
+	os.Exit(code)
+}
+
+// trackDownload creates the queued record downloadFile reports progress
+// on, and removes it when the test ends.
+func trackDownload(t *testing.T, id, url, outputDir string) {
+	t.Helper()
+	addQueuedRecord(job{id: id, url: url, outputDir: outputDir}, defaultFileName(url), time.Now())
+	t.Cleanup(func() {
+		downloadsMutex.Lock()
+		delete(activeDownloads, id)
+		downloadsMutex.Unlock()
+	})
+}
+
+func TestDownloadFileProgress(t *testing.T) {
+	const size, chunk = 8 << 20, 128 << 10
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+		block := make([]byte, chunk)
+		for sent := 0; sent < size; sent += chunk {
+			if _, err := w.Write(block); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	url := srv.URL + "/big.bin"
+	trackDownload(t, "progress-test", url, dir)
+
+	// Sample the record while the download runs.
+	var samples []int64
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			downloadsMutex.Lock()
+			samples = append(samples, activeDownloads["progress-test"].BytesDownloaded)
+			downloadsMutex.Unlock()
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+	path, err := downloadFile(context.Background(), "progress-test", url, dir, downloadOptions{})
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != size {
+		t.Fatalf("saved %s: %v, %v; want %d bytes", path, info, err, size)
+	}
+
+	var distinct int
+	for i := 1; i < len(samples); i++ {
+		if samples[i] < samples[i-1] {
+			t.Fatalf("progress went back from %d to %d", samples[i-1], samples[i])
+		}
+		if samples[i] != samples[i-1] {
+			distinct++
+		}
+	}
+	if distinct < 2 {
+		t.Errorf("progress was only reported %d times: %v", distinct, samples)
+	}
+}
+
+func TestDownloadFileCreatesNothingOnError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := "http://" + l.Addr().String()
+	l.Close()
+
+	for name, url := range map[string]string{
+		"404":         srv.URL + "/missing.iso",
+		"unreachable": unreachable + "/missing.iso",
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			id := "no-file-" + name
+			trackDownload(t, id, url, dir)
+			if _, err := downloadFile(context.Background(), id, url, dir, downloadOptions{}); err == nil {
+				t.Fatal("download succeeded")
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				t.Errorf("%s was created", e.Name())
+			}
+		})
+	}
+}
+
+func TestDownloadFileKeepsExistingFileOnError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	dir := t.TempDir()
+	existing := dir + "/report.pdf"
+	if err := os.WriteFile(existing, []byte("keep me"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	url := srv.URL + "/report.pdf"
+	trackDownload(t, "keep-existing", url, dir)
+	if _, err := downloadFile(context.Background(), "keep-existing", url, dir, downloadOptions{onConflict: conflictOverwrite}); err == nil {
+		t.Fatal("download succeeded")
+	}
+	if data, err := os.ReadFile(existing); err != nil || string(data) != "keep me" {
+		t.Errorf("existing file = %q, %v; want it untouched", data, err)
+	}
+}
+
+func TestDownloadFileErrorBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/text":
+			http.Error(w, "token expired", http.StatusForbidden)
+		case "/html":
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "<html><body><h1>Access denied</h1><p>Ask an admin.</p></body></html>")
+		case "/long":
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, strings.Repeat("x", 10*maxErrorBody))
+		}
+	}))
+	defer srv.Close()
+
+	for path, want := range map[string]string{
+		"/text": "403 Forbidden: token expired",
+		"/html": "403 Forbidden: Access denied Ask an admin.",
+	} {
+		dir := t.TempDir()
+		id := "error-body" + strings.ReplaceAll(path, "/", "-")
+		trackDownload(t, id, srv.URL+path, dir)
+		_, err := downloadFile(context.Background(), id, srv.URL+path, dir, downloadOptions{})
+		if err == nil || err.Error() != want {
+			t.Errorf("%s: error %v; want %q", path, err, want)
+		}
+	}
+
+	dir := t.TempDir()
+	trackDownload(t, "error-body-long", srv.URL+"/long", dir)
+	_, err := downloadFile(context.Background(), "error-body-long", srv.URL+"/long", dir, downloadOptions{})
+	if err == nil || !strings.HasPrefix(err.Error(), "403 Forbidden: xxx") || len(err.Error()) > maxErrorBody+100 {
+		t.Errorf("long body: error %v; want it cut short", err)
+	}
+}
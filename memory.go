@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/metrics"
+	"sync/atomic"
+
+	"github.com/anacrolix/torrent"
+)
+
+var (
+	lowMemory    = flag.Bool("low-memory", false, "use smaller copy buffers, event logs and torrent connection limits for small machines")
+	memoryBudget = flag.Int64("memory-budget", 0, "heap size in bytes above which queued downloads wait instead of starting (0 disables)")
+)
+
+// copyBufferPool hands out fixed-size buffers for streaming downloads to
+// disk, bounding how much memory in-flight copies can hold at once.
+type copyBufferPool struct {
+	size int
+	free chan []byte
+
+	inUse   atomic.Int64
+	waiting atomic.Int64
+}
+
+var copyBuffers *copyBufferPool
+
+// initMemoryProfile sizes the engine's buffers for the selected profile.
+// It must run after flag.Parse.
+func initMemoryProfile() {
+	if *lowMemory {
+		copyBuffers = newCopyBufferPool(32<<10, 8)
+	} else {
+		copyBuffers = newCopyBufferPool(256<<10, 2*maxWorkers)
+	}
+}
+
+func newCopyBufferPool(size, count int) *copyBufferPool {
+	p := &copyBufferPool{size: size, free: make(chan []byte, count)}
+	for i := 0; i < count; i++ {
+		p.free <- nil // allocated lazily on first use
+	}
+	return p
+}
+
+func (p *copyBufferPool) get() []byte {
+	p.waiting.Add(1)
+	buf := <-p.free
+	p.waiting.Add(-1)
+	p.inUse.Add(1)
+	if buf == nil {
+		buf = make([]byte, p.size)
+	}
+	return buf
+}
+
+func (p *copyBufferPool) put(buf []byte) {
+	p.inUse.Add(-1)
+	p.free <- buf
+}
+
+// copyWithPool is io.Copy using a buffer from the shared pool. dst is
+// wrapped so *os.File's ReaderFrom can't bypass the pooled buffer.
+func copyWithPool(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.get()
+	defer copyBuffers.put(buf)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, src, buf)
+}
+
+// downloadEventLimits returns how many events each download keeps and how
+// long each message may be.
+func downloadEventLimits() (count, messageLen int) {
+	if *lowMemory {
+		return 10, 1 << 10
+	}
+	return maxDownloadEvents, 8 << 10
+}
+
+// applyTorrentMemoryProfile trims the torrent client's connection and
+// buffering limits in low-memory mode.
+func applyTorrentMemoryProfile(cfg *torrent.ClientConfig) {
+	if !*lowMemory {
+		return
+	}
+	cfg.EstablishedConnsPerTorrent = 15
+	cfg.HalfOpenConnsPerTorrent = 5
+	cfg.TotalHalfOpenConns = 20
+	cfg.MaxAllocPeerRequestDataPerConn = 256 << 10
+	cfg.MaxUnverifiedBytes = 8 << 20
+	cfg.DisableWebtorrent = true
+}
+
+// heapBytes reads the live heap size without stopping the world.
+func heapBytes() uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// overMemoryBudget reports whether new downloads should wait.
+func overMemoryBudget() bool {
+	return *memoryBudget > 0 && heapBytes() > uint64(*memoryBudget)
+}
+
+func handleRuntimeStats(w http.ResponseWriter, r *http.Request) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	downloadsMutex.Lock()
+	events := 0
+	for _, download := range activeDownloads {
+		events += len(download.Events)
+	}
+	tracked := len(activeDownloads)
+	downloadsMutex.Unlock()
+
+	eventCount, eventLen := downloadEventLimits()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"go": map[string]interface{}{
+			"heapAlloc":    ms.HeapAlloc,
+			"heapInuse":    ms.HeapInuse,
+			"heapSys":      ms.HeapSys,
+			"sys":          ms.Sys,
+			"numGC":        ms.NumGC,
+			"numGoroutine": runtime.NumGoroutine(),
+		},
+		"engine": map[string]interface{}{
+			"lowMemory":            *lowMemory,
+			"memoryBudget":         *memoryBudget,
+			"overBudget":           overMemoryBudget(),
+			"copyBufferSize":       copyBuffers.size,
+			"copyBuffersMax":       cap(copyBuffers.free),
+			"copyBuffersInUse":     copyBuffers.inUse.Load(),
+			"copyBufferBytesInUse": copyBuffers.inUse.Load() * int64(copyBuffers.size),
+			"copyBufferWaiters":    copyBuffers.waiting.Load(),
+			"trackedDownloads":     tracked,
+			"downloadEvents":       events,
+			"maxEventsPerDownload": eventCount,
+			"maxEventMessageBytes": eventLen,
+			"postProcessQueued":    len(postProcessQueue),
+			"postProcessDropped":   postProcessDropped.Load(),
+		},
+		"dnsCache": resolverCache.stats(),
+		"bind":     bindStats(),
+	})
+}
+
+// handleReadyz reports whether the server is ready to start new
+// downloads.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	var reasons []string
+	if overMemoryBudget() {
+		reasons = append(reasons, fmt.Sprintf("heap %d bytes exceeds memory budget of %d bytes; new downloads are queued", heapBytes(), *memoryBudget))
+	}
+	if bindBlocked() {
+		reasons = append(reasons, "a bound network interface is unavailable; transfers are paused")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(reasons) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"ready": false, "reasons": reasons})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"ready": true})
+}
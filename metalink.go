@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	maxMetalinkSize  = 4 << 20
+	maxMetalinkFiles = 10000
+)
+
+// metalinkContentTypes are the media types of Metalink 4 and 3 files.
+var metalinkContentTypes = map[string]bool{
+	"application/metalink4+xml": true,
+	"application/metalink+xml":  true,
+}
+
+// metalinkHashTypes maps the hash types of Metalink files to the
+// checksum algorithms yad verifies.
+var metalinkHashTypes = map[string]string{
+	"sha-256": "sha256",
+	"sha256":  "sha256",
+	"sha-1":   "sha1",
+	"sha1":    "sha1",
+	"md5":     "md5",
+}
+
+// isMetalinkLink reports whether rawURL names a Metalink file by its
+// .metalink or .meta4 extension.
+func isMetalinkLink(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	ext := strings.ToLower(path.Ext(u.Path))
+	return ext == ".metalink" || ext == ".meta4"
+}
+
+// isMetalinkContentType reports whether a Content-Type header value is
+// that of a Metalink file.
+func isMetalinkContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && metalinkContentTypes[mediaType]
+}
+
+// metalinkError is what downloadFile returns when the server answers
+// with a Metalink file, which runJob then downloads the files of.
+type metalinkError struct {
+	contentType string
+}
+
+func (e *metalinkError) Error() string {
+	return fmt.Sprintf("the server sent a Metalink file (%s)", e.contentType)
+}
+
+// metalinkDocument is a Metalink 4 (RFC 5854) or 3.0 file. Both list
+// file elements, version 3 inside <files>, with their hashes and URLs
+// nested a level deeper.
+type metalinkDocument struct {
+	Files   []metalinkFileElement `xml:"file"`
+	V3Files []metalinkFileElement `xml:"files>file"`
+}
+
+type metalinkFileElement struct {
+	Name     string         `xml:"name,attr"`
+	Hashes   []metalinkHash `xml:"hash"`
+	V3Hashes []metalinkHash `xml:"verification>hash"`
+	URLs     []metalinkURL  `xml:"url"`
+	V3URLs   []metalinkURL  `xml:"resources>url"`
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkURL struct {
+	Priority   int    `xml:"priority,attr"`
+	Preference int    `xml:"preference,attr"`
+	Value      string `xml:",chardata"`
+}
+
+// metalinkFile is one file of a Metalink: where to save it, its HTTP(S)
+// URLs in the order they are tried, and its expected checksums.
+type metalinkFile struct {
+	name      string
+	dir       string
+	urls      []string
+	checksums map[string]string
+}
+
+// parseMetalink returns the files a Metalink document lists. URLs other
+// than HTTP(S) ones, such as FTP or torrents, are left out, and a file
+// without any is an error.
+func parseMetalink(data []byte) ([]metalinkFile, error) {
+	var doc metalinkDocument
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, &downloadError{code: "metalink_invalid", err: fmt.Errorf("unreadable Metalink file: %v", err)}
+	}
+	elements := append(doc.Files, doc.V3Files...)
+	if len(elements) == 0 {
+		return nil, &downloadError{code: "metalink_invalid", err: fmt.Errorf("the Metalink file lists no files")}
+	}
+	files := make([]metalinkFile, 0, len(elements))
+	for _, el := range elements {
+		urls := append(el.URLs, el.V3URLs...)
+		// Metalink 4 tries the lowest priority first and Metalink 3 the
+		// highest preference; unranked URLs go last.
+		rank := func(u metalinkURL) int {
+			switch {
+			case u.Priority > 0:
+				return u.Priority
+			case u.Preference > 0:
+				return 1000 - u.Preference
+			}
+			return 1 << 20
+		}
+		sort.SliceStable(urls, func(i, j int) bool { return rank(urls[i]) < rank(urls[j]) })
+		f := metalinkFile{checksums: make(map[string]string)}
+		for _, u := range urls {
+			target := strings.TrimSpace(u.Value)
+			if (strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://")) && !slices.Contains(f.urls, target) {
+				f.urls = append(f.urls, target)
+			}
+		}
+		if len(f.urls) == 0 {
+			return nil, &downloadError{code: "metalink_invalid", err: fmt.Errorf("the Metalink file has no HTTP(S) URL for %q", el.Name)}
+		}
+		for _, h := range append(el.Hashes, el.V3Hashes...) {
+			alg, ok := metalinkHashTypes[strings.ToLower(h.Type)]
+			sum := strings.ToLower(strings.TrimSpace(h.Value))
+			if b, err := hex.DecodeString(sum); ok && err == nil && len(b) == newHash(alg).Size() {
+				f.checksums[alg] = sum
+			}
+		}
+		name := strings.ReplaceAll(el.Name, "\\", "/")
+		f.name = sanitizeFileName(name)
+		if f.name == "" {
+			f.name = defaultFileName(f.urls[0])
+		}
+		f.dir = relativeDir(name)
+		files = append(files, f)
+	}
+	if len(files) > maxMetalinkFiles {
+		return nil, &downloadError{code: "metalink_invalid", err: fmt.Errorf("the Metalink file lists more than %d files", maxMetalinkFiles)}
+	}
+	return files, nil
+}
+
+// fetchMetalink fetches and parses the Metalink file at rawURL.
+func fetchMetalink(ctx context.Context, rawURL string, opts downloadOptions) ([]metalinkFile, error) {
+	client, err := downloadClient(rawURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doWithDigest(client, req, req.URL.User)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch Metalink file: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxMetalinkSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch Metalink file: %w", err)
+	}
+	if len(data) > maxMetalinkSize {
+		return nil, &downloadError{code: "metalink_invalid", err: fmt.Errorf("the Metalink file is larger than %d bytes", maxMetalinkSize)}
+	}
+	return parseMetalink(data)
+}
+
+// metalinkOptions returns opts for downloading f: its URLs as mirrors,
+// its checksums and its name.
+func metalinkOptions(opts downloadOptions, f metalinkFile) downloadOptions {
+	opts.mirrors = f.urls
+	opts.checksums = nil
+	if len(f.checksums) > 0 {
+		opts.checksums = map[string]map[string]string{f.urls[0]: f.checksums}
+	}
+	opts.fileName = f.name
+	opts.objectDirs = map[string]string{f.urls[0]: f.dir}
+	opts.headers, opts.basicAuth = nil, nil
+	opts.preflight = nil
+	opts.resume = false
+	return opts
+}
+
+// expandMetalink turns job j, whose URL turned out to be a Metalink
+// file, into the download of the file's first entry from its mirrors.
+// Every other file it lists is queued as a download of its own.
+func expandMetalink(ctx context.Context, j *job) error {
+	files, err := fetchMetalink(ctx, j.url, j.opts)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.dir == "" || j.opts.destination != "" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Join(j.outputDir, f.dir), os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create output directory: %v", err)
+		}
+	}
+	for _, f := range files[1:] {
+		processURLs([]string{newDownloadID()}, []string{f.urls[0]}, j.outputDir, j.requestID, metalinkOptions(j.opts, f), 0)
+	}
+	first := files[0]
+	j.opts = metalinkOptions(j.opts, first)
+	j.outputDir, j.opts.destination = objectLocation(first.urls[0], j.outputDir, j.opts.destination, j.opts.objectDirs)
+	j.opts.objectDirs = nil
+
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[j.id]; exists {
+		download.FileName = first.name
+		download.OutputDir = j.outputDir
+		download.Mirrors = first.urls
+	}
+	downloadsMutex.Unlock()
+	message := fmt.Sprintf("downloading %s from %d URLs", first.name, len(first.urls))
+	if len(files) > 1 {
+		message += fmt.Sprintf("; queued the other %d files as downloads of their own", len(files)-1)
+	}
+	addDownloadEvent(j.id, "metalink", message)
+	broadcastStatus()
+	return nil
+}
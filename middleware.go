@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+type contextKey int
+
+const requestInfoKey contextKey = 0
+
+// requestInfo is attached to every request's context by withRequestID.
+// Handlers further down the chain may fill in User.
+type requestInfo struct {
+	ID     string
+	User   string
+	Legacy bool
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether an incoming X-Request-ID is safe to reuse
+// in logs and response headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+func requestIDFrom(ctx context.Context) string {
+	return requestInfoFrom(ctx).ID
+}
+
+// logf logs a line prefixed with the request ID carried by ctx, if any.
+func logf(ctx context.Context, format string, args ...interface{}) {
+	logWithID(requestIDFrom(ctx), format, args...)
+}
+
+func logWithID(requestID, format string, args ...interface{}) {
+	if requestID == "" {
+		log.Printf(format, args...)
+		return
+	}
+	log.Printf("[%s] %s", requestID, fmt.Sprintf(format, args...))
+}
+
+// httpError writes a JSON error envelope carrying the request ID. Legacy
+// API routes keep the original plain-text error bodies.
+func httpError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	httpErrorWith(w, r, msg, code, nil)
+}
+
+// httpErrorWith is httpError with extra machine-readable fields in the
+// JSON body. Legacy routes get the plain message only.
+func httpErrorWith(w http.ResponseWriter, r *http.Request, msg string, code int, fields map[string]interface{}) {
+	if requestInfoFrom(r.Context()).Legacy {
+		http.Error(w, msg, code)
+		return
+	}
+	body := map[string]interface{}{
+		"error":     msg,
+		"requestId": requestIDFrom(r.Context()),
+	}
+	for k, v := range fields {
+		body[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+// responseRecorder captures the status code and body size for the
+// access log while still allowing websocket upgrades.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	if rec.status == 0 {
+		rec.status = http.StatusSwitchingProtocols
+	}
+	return hj.Hijack()
+}
+
+func (rec *responseRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// withRequestID assigns every request an ID (reusing a well-formed
+// incoming X-Request-ID), echoes it back, and writes one access log
+// line per request once it has been served.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		info := &requestInfo{ID: id}
+		w.Header().Set("X-Request-ID", id)
+
+		rec := &responseRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestInfoKey, info)))
+
+		user := info.User
+		if user == "" {
+			user = "-"
+		}
+		clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			clientIP = r.RemoteAddr
+		}
+		log.Printf("access request_id=%s method=%s path=%q status=%d bytes=%d duration=%s client_ip=%s user=%s",
+			id, r.Method, r.URL.Path, rec.status, rec.bytes, time.Since(start).Round(time.Microsecond), clientIP, user)
+	})
+}
+
+// withRecovery turns a handler panic into a 500 JSON error instead of
+// tearing down the connection.
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			handlerPanics.Add(1)
+			logf(r.Context(), "Recovered panic in %s %s: %v\n%s", r.Method, r.URL.Path, p, debug.Stack())
+			httpError(w, r, "Internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deprecatedAPI marks requests to the unversioned /api aliases so they
+// keep legacy response shapes, and points clients at /api/v1.
+func deprecatedAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestInfoFrom(r.Context()).Legacy = true
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("</api/v1%s>; rel=\"successor-version\"", strings.TrimPrefix(r.URL.Path, "/api")))
+		next.ServeHTTP(w, r)
+	})
+}
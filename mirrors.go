@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// mirrorFinalCodes are the failures that would be the same on every
+// mirror, so the next one isn't tried.
+var mirrorFinalCodes = []string{"size_limit", "insufficient_space", "path_in_use", "bind_down", "timed_out"}
+
+func (e DownloadEntry) validateMirrors() error {
+	if e.Magnet != "" || e.HTTPFallback != "" {
+		return fmt.Errorf("entry urls can't be combined with magnet or httpFallback")
+	}
+	for i, u := range e.URLs {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return fmt.Errorf("entry mirror %q is not an HTTP(S) URL", u)
+		}
+		if slices.Contains(e.URLs[:i], u) {
+			return fmt.Errorf("entry mirror %s is listed twice", u)
+		}
+	}
+	return nil
+}
+
+// mirrorURLs lists the mirrors of all of a request's entries.
+func mirrorURLs(req DownloadRequest) []string {
+	var urls []string
+	for _, entry := range req.Entries {
+		urls = append(urls, entry.URLs...)
+	}
+	return urls
+}
+
+// mirrorError is the failure of every mirror of a download, listing
+// why each one failed.
+type mirrorError struct {
+	urls []string
+	errs []error
+}
+
+func (e *mirrorError) Error() string {
+	parts := make([]string, len(e.urls))
+	for i, u := range e.urls {
+		parts[i] = fmt.Sprintf("%s: %v", u, e.errs[i])
+	}
+	return fmt.Sprintf("all %d mirrors failed: %s", len(e.urls), strings.Join(parts, "; "))
+}
+
+func (e *mirrorError) Unwrap() []error { return e.errs }
+
+// downloadMirrors fetches job j's file from each of its mirrors in turn
+// until one serves it. What a failed mirror wrote is kept, so the next
+// one continues from there if it supports ranges.
+func downloadMirrors(ctx context.Context, j job) (string, error) {
+	failed := &mirrorError{}
+	for i, mirror := range j.opts.mirrors {
+		if i > 0 {
+			addDownloadEvent(j.id, "mirror", fmt.Sprintf("trying mirror %d of %d: %s", i+1, len(j.opts.mirrors), mirror))
+		}
+		savedPath, err := downloadFile(ctx, j.id, mirror, j.outputDir, mirrorOptions(j.opts, mirror))
+		if err == nil {
+			setServedBy(j.id, mirror)
+			return savedPath, nil
+		}
+		var derr *downloadError
+		var skipped *skippedError
+		var unchanged *notModifiedError
+		if ctx.Err() != nil || errors.As(err, &skipped) || errors.As(err, &unchanged) || (errors.As(err, &derr) && slices.Contains(mirrorFinalCodes, derr.code)) {
+			return "", err
+		}
+		addDownloadEvent(j.id, "mirror_failed", fmt.Sprintf("%s: %v", mirror, err))
+		failed.urls = append(failed.urls, mirror)
+		failed.errs = append(failed.errs, err)
+	}
+	return "", &downloadError{code: "mirrors_failed", err: failed}
+}
+
+// mirrorOptions returns opts for fetching from mirror: the expected
+// checksums given for any of the mirrors, since they all serve the same
+// file.
+func mirrorOptions(opts downloadOptions, mirror string) downloadOptions {
+	for _, u := range opts.mirrors {
+		if sums, ok := opts.checksums[u]; ok {
+			opts.checksums = map[string]map[string]string{mirror: sums}
+			return opts
+		}
+	}
+	return opts
+}
+
+// setServedBy records which mirror download key's file came from.
+func setServedBy(key, mirror string) {
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[key]; exists {
+		download.ServedBy = mirror
+	}
+	downloadsMutex.Unlock()
+}
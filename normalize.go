@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// maxNormalizeLength bounds the input accepted for normalization; no
+// real URL comes close.
+const maxNormalizeLength = 64 << 10
+
+// junkQuotes are the quotes and brackets pasted text often wraps URLs in.
+var junkQuotes = map[rune]bool{
+	'"': true, '\'': true, '`': true, '<': true, '>': true,
+	'“': true, '”': true, '‘': true, '’': true, '«': true, '»': true,
+}
+
+// normalizeURL cleans up a submitted URL or magnet link and returns it
+// with a description of each change made. Trailing sentence punctuation
+// is only dropped from a URL pasted from text, since a URL given as is
+// may end in "." or ":". It never panics, whatever the input; an error
+// means nothing usable was left.
+func normalizeURL(raw string, pasted bool) (string, []string, error) {
+	if len(raw) > maxNormalizeLength {
+		return "", nil, fmt.Errorf("URL is longer than %d bytes", maxNormalizeLength)
+	}
+	var changes []string
+	s := raw
+
+	if cleaned := strings.Map(func(r rune) rune {
+		if r == '\u200b' || r == '\u200c' || r == '\u200d' || r == '\ufeff' || r == '\u00ad' {
+			return -1
+		}
+		return r
+	}, s); cleaned != s {
+		s = cleaned
+		changes = append(changes, "removed invisible characters")
+	}
+	if trimmed := strings.TrimSpace(s); trimmed != s {
+		s = trimmed
+		changes = append(changes, "trimmed whitespace")
+	}
+	// Quotes and punctuation can nest, as in “https://example.org/”.
+	var quotes, punctuation bool
+	for {
+		if trimmed := strings.TrimFunc(s, func(r rune) bool { return junkQuotes[r] || unicode.IsSpace(r) }); trimmed != s {
+			s = trimmed
+			quotes = true
+			continue
+		}
+		if trimmed := trimTrailingPunctuation(s); pasted && trimmed != s {
+			s = trimmed
+			punctuation = true
+			continue
+		}
+		break
+	}
+	if quotes {
+		changes = append(changes, "removed surrounding quotes")
+	}
+	if punctuation {
+		changes = append(changes, "removed trailing punctuation")
+	}
+	if s == "" {
+		return "", changes, fmt.Errorf("nothing left of %q after cleaning", raw)
+	}
+
+	var err error
+	var more []string
+	if len(s) >= len("magnet:") && strings.EqualFold(s[:len("magnet:")], "magnet:") {
+		if s, more = normalizeMagnet(s); s == "magnet:?" {
+			return "", changes, fmt.Errorf("magnet link %q has no parameters", raw)
+		}
+	} else {
+		s, more, err = normalizeHTTP(s)
+	}
+	return s, append(changes, more...), err
+}
+
+// trimTrailingPunctuation drops sentence punctuation after a URL. A
+// closing parenthesis is kept if the URL opened one.
+func trimTrailingPunctuation(s string) string {
+	for s != "" {
+		last := s[len(s)-1]
+		switch {
+		case strings.IndexByte(".,;:!?", last) >= 0:
+		case last == ')' && strings.Count(s, "(") < strings.Count(s, ")"):
+		default:
+			return s
+		}
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// repairPercents escapes stray "%" signs that don't start a valid
+// escape.
+func repairPercents(s string) (string, bool) {
+	var b strings.Builder
+	changed := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '%' && (i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2])):
+			b.WriteString("%25")
+			changed = true
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), changed
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// normalizeHTTP lowercases the scheme and host of an HTTP(S) URL and
+// drops a default port. The path and query are kept as they are apart
+// from repaired escapes.
+func normalizeHTTP(s string) (string, []string, error) {
+	var changes []string
+	if repaired, changed := repairPercents(s); changed {
+		s = repaired
+		changes = append(changes, "repaired percent-encoding")
+	}
+	if strings.Contains(s, " ") {
+		s = strings.ReplaceAll(s, " ", "%20")
+		changes = append(changes, "encoded spaces")
+	}
+	scheme, rest, ok := strings.Cut(s, "://")
+	if !ok {
+		return s, changes, nil // rejected later as not fetchable
+	}
+	authority, tail := rest, ""
+	if i := strings.IndexAny(rest, "/?#"); i >= 0 {
+		authority, tail = rest[:i], rest[i:]
+	}
+	userinfo, host := "", authority
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		userinfo, host = authority[:i+1], authority[i+1:]
+	}
+
+	if lower := strings.ToLower(scheme); lower != scheme {
+		scheme = lower
+		changes = append(changes, "lowercased scheme")
+	}
+	if lower := strings.ToLower(host); lower != host {
+		host = lower
+		changes = append(changes, "lowercased host")
+	}
+	if (scheme == "http" && strings.HasSuffix(host, ":80")) || (scheme == "https" && strings.HasSuffix(host, ":443")) || (scheme == "ftp" && strings.HasSuffix(host, ":21")) || (scheme == "sftp" && strings.HasSuffix(host, ":22")) {
+		host = host[:strings.LastIndex(host, ":")]
+		changes = append(changes, "removed default port")
+	}
+	out := scheme + "://" + userinfo + host + tail
+	if _, err := url.Parse(out); err != nil {
+		return s, changes, fmt.Errorf("invalid URL: %v", err)
+	}
+	return out, changes, nil
+}
+
+// normalizeMagnet canonicalizes a magnet link: whitespace removed, a
+// lowercase hex infohash, parameters in a fixed order and trackers
+// sorted without duplicates.
+func normalizeMagnet(s string) (string, []string) {
+	var changes []string
+	_, query, _ := strings.Cut(s, "?")
+	if repaired, changed := repairPercents(query); changed {
+		query = repaired
+		changes = append(changes, "repaired percent-encoding")
+	}
+
+	// Line breaks and spaces come from wrapped or OCRed text. Spaces
+	// are only meaningful in the display name.
+	params := make(map[string][]string)
+	strippedSpace := false
+	for _, pair := range strings.Split(query, "&") {
+		key, value, _ := strings.Cut(pair, "=")
+		key = strings.ToLower(strings.Join(strings.Fields(key), ""))
+		if decoded, err := url.QueryUnescape(value); err == nil {
+			value = decoded
+		}
+		var stripped string
+		if key == "dn" {
+			stripped = strings.Join(strings.Fields(value), " ")
+		} else {
+			stripped = strings.Join(strings.Fields(value), "")
+		}
+		if stripped != value || strings.ContainsAny(pair, " \t\r\n") {
+			strippedSpace = true
+		}
+		if key == "" {
+			continue
+		}
+		params[key] = append(params[key], stripped)
+	}
+	if strippedSpace {
+		changes = append(changes, "removed whitespace inside magnet")
+	}
+
+	for i, xt := range params["xt"] {
+		if canonical := canonicalInfohash(xt); canonical != xt {
+			params["xt"][i] = canonical
+			changes = append(changes, "canonicalized infohash")
+		}
+	}
+	if trackers := params["tr"]; len(trackers) > 0 {
+		unique := make([]string, 0, len(trackers))
+		seen := make(map[string]bool, len(trackers))
+		for _, tr := range trackers {
+			if !seen[tr] {
+				seen[tr] = true
+				unique = append(unique, tr)
+			}
+		}
+		sorted := sort.StringsAreSorted(unique)
+		sort.Strings(unique)
+		if len(unique) != len(trackers) {
+			changes = append(changes, "removed duplicate trackers")
+		}
+		if !sorted {
+			changes = append(changes, "sorted trackers")
+		}
+		params["tr"] = unique
+	}
+
+	// xt and dn first, then everything else by key, trackers last.
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		if key != "xt" && key != "dn" && key != "tr" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	keys = append(append([]string{"xt", "dn"}, keys...), "tr")
+
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range params[key] {
+			pairs = append(pairs, key+"="+magnetEscape(value))
+		}
+	}
+	out := "magnet:?" + strings.Join(pairs, "&")
+	if !strings.HasPrefix(s, "magnet:") {
+		changes = append(changes, "lowercased scheme")
+	}
+	if len(changes) == 0 && out != s {
+		changes = append(changes, "rewrote parameters in canonical form")
+	}
+	return out, changes
+}
+
+// canonicalInfohash lowercases a hex BitTorrent infohash and converts a
+// base32 one to hex.
+func canonicalInfohash(xt string) string {
+	const prefix = "urn:btih:"
+	if len(xt) < len(prefix) || !strings.EqualFold(xt[:len(prefix)], prefix) {
+		return xt
+	}
+	hash := xt[len(prefix):]
+	switch len(hash) {
+	case 40:
+		if _, err := hex.DecodeString(hash); err == nil {
+			return prefix + strings.ToLower(hash)
+		}
+	case 32:
+		if b, err := base32.StdEncoding.DecodeString(strings.ToUpper(hash)); err == nil {
+			return prefix + hex.EncodeToString(b)
+		}
+	}
+	return prefix + hash
+}
+
+// magnetEscape escapes a magnet parameter value, keeping the characters
+// infohashes and tracker URLs commonly carry readable.
+func magnetEscape(value string) string {
+	escaped := url.QueryEscape(value)
+	return strings.NewReplacer("%3A", ":", "%2F", "/").Replace(escaped)
+}
+
+// normalizeSubmission normalizes a request's URLs in place and returns
+// the changes made to each, keyed by the cleaned URL. A URL that can't
+// be normalized is left for validation to reject. Credentials embedded
+// in a URL move to the request's basicAuth, unless it has its own for
+// that URL, so they are never stored or shown with it.
+func normalizeSubmission(req *DownloadRequest) map[string][]string {
+	changes := make(map[string][]string)
+	normalize := func(u *string) {
+		cleaned, applied, err := normalizeURL(*u, req.Pasted)
+		if *u == "" || err != nil {
+			return
+		}
+		cleaned, auth := takeUserinfo(cleaned)
+		if auth != nil {
+			if req.BasicAuth == nil {
+				req.BasicAuth = make(map[string]BasicAuth)
+			}
+			if _, ok := req.BasicAuth[cleaned]; !ok {
+				req.BasicAuth[cleaned] = *auth
+			}
+			applied = append(applied, "moved credentials out of the URL")
+		}
+		*u = cleaned
+		if len(applied) > 0 {
+			changes[cleaned] = applied
+		}
+	}
+	for i := range req.URLs {
+		normalize(&req.URLs[i])
+	}
+	for i := range req.Entries {
+		normalize(&req.Entries[i].Magnet)
+		normalize(&req.Entries[i].HTTPFallback)
+		for k := range req.Entries[i].URLs {
+			normalize(&req.Entries[i].URLs[k])
+		}
+	}
+	// Expected checksums, per-URL headers, extraction and credentials
+	// follow their URL.
+	for url, sums := range req.Checksums {
+		cleaned := url
+		normalize(&cleaned)
+		if cleaned != url {
+			delete(req.Checksums, url)
+			req.Checksums[cleaned] = sums
+		}
+	}
+	for url, headers := range req.URLHeaders {
+		cleaned := url
+		normalize(&cleaned)
+		if cleaned != url {
+			delete(req.URLHeaders, url)
+			req.URLHeaders[cleaned] = headers
+		}
+	}
+	for url, extract := range req.URLExtract {
+		cleaned := url
+		normalize(&cleaned)
+		if cleaned != url {
+			delete(req.URLExtract, url)
+			req.URLExtract[cleaned] = extract
+		}
+	}
+	for url, auth := range req.BasicAuth {
+		cleaned := url
+		normalize(&cleaned)
+		if cleaned != url {
+			delete(req.BasicAuth, url)
+			req.BasicAuth[cleaned] = auth
+		}
+	}
+	return changes
+}
+
+// markNormalized lists on each result what normalization changed.
+func markNormalized(results []SubmissionResult, changes map[string][]string) {
+	for i := range results {
+		results[i].Normalized = changes[results[i].URL]
+	}
+}
+
+// handleNormalize returns the cleaned form of a URL without submitting
+// it.
+func handleNormalize(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL    string `json:"url"`
+		Pasted bool   `json:"pasted"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cleaned, changes, err := normalizeURL(req.URL, req.Pasted)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if changes == nil {
+		changes = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"input": req.URL, "url": cleaned, "changes": changes})
+}
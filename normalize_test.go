@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		raw    string
+		pasted bool
+		want   string
+	}{
+		{"https://example.com/file.iso", false, "https://example.com/file.iso"},
+		{"  HTTPS://Example.COM:443/File.iso  ", false, "https://example.com/File.iso"},
+		{"“https://example.com/a b.iso”", false, "https://example.com/a%20b.iso"},
+		{"\u200bhttps://example.com/100%.txt", false, "https://example.com/100%25.txt"},
+		{"<https://example.com/x>", false, "https://example.com/x"},
+
+		// Trailing punctuation is part of a URL given as is.
+		{"https://en.wikipedia.org/wiki/Washington,_D.C.", false, "https://en.wikipedia.org/wiki/Washington,_D.C."},
+		{"https://example.com/notes:", false, "https://example.com/notes:"},
+		{"https://example.com/file.iso.", true, "https://example.com/file.iso"},
+		{"https://example.com/file.iso).", true, "https://example.com/file.iso"},
+		{"https://example.com/Foo_(bar)", true, "https://example.com/Foo_(bar)"},
+		{"https://example.com/file.iso\",", true, "https://example.com/file.iso"},
+
+		// Magnets
+		{"magnet:?xt=urn:btih:ABCDEF0123456789ABCDEF0123456789ABCDEF01&tr=udp://b&tr=udp://a&tr=udp://b", false,
+			"magnet:?xt=urn:btih:abcdef0123456789abcdef0123456789abcdef01&tr=udp://a&tr=udp://b"},
+		{"MAGNET:?dn=My File&xt=urn:btih:ab cdef0123456789abcdef0123456789abcdef01", false,
+			"magnet:?xt=urn:btih:abcdef0123456789abcdef0123456789abcdef01&dn=My+File"},
+		{"magnet:?xt=urn:btih:VPJYMZK5G4QWPZOCEXDJ2E5HIZ7C6NN4", false,
+			"magnet:?xt=urn:btih:abd386655d372167e5c225c69d13a7467e2f35bc"},
+	}
+	for _, tt := range tests {
+		got, _, err := normalizeURL(tt.raw, tt.pasted)
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeURL(%q, %v) = %q, %v; want %q", tt.raw, tt.pasted, got, err, tt.want)
+		}
+	}
+
+	for _, raw := range []string{"", "   ", "“”", strings.Repeat("a", maxNormalizeLength+1)} {
+		if got, _, err := normalizeURL(raw, true); err == nil {
+			t.Errorf("normalizeURL(%q) = %q; want an error", raw, got)
+		}
+	}
+}
+
+// FuzzNormalizeURL checks that no input panics normalizeURL and that
+// normalizing its output again changes nothing. The output is a URL
+// given as is, no longer pasted text, so the second pass keeps trailing
+// punctuation: "magnet:?dn=a.&" rightly becomes "magnet:?dn=a.".
+func FuzzNormalizeURL(f *testing.F) {
+	for _, seed := range []string{
+		"https://example.com/file.iso",
+		" “HTTP://Example.com:80/a b/100%.txt?x=1#y” ",
+		"https://user:pass@[::1]:8080/path",
+		"https://en.wikipedia.org/wiki/Washington,_D.C.",
+		"(https://example.com/Foo_(bar)).",
+		"magnet:?xt=urn:btih:ABCDEF0123456789ABCDEF0123456789ABCDEF01&dn=a b&tr=udp://x&tr=udp://x",
+		"magnet:?xt=urn:btih:VPJYMZK5G4QWPZOCEXDJ2E5HIZ7C6NN4&tr=%zz",
+		"magnet:",
+		"mAgnet:0",
+		"mAgnet:?0=.&",
+		"ftp://ftp.example.com:21/pub/",
+		"s3://bucket/key",
+		"%",
+		"\u200b\ufeff",
+	} {
+		f.Add(seed, false)
+		f.Add(seed, true)
+	}
+	f.Fuzz(func(t *testing.T, raw string, pasted bool) {
+		once, _, err := normalizeURL(raw, pasted)
+		if err != nil {
+			return
+		}
+		twice, changes, err := normalizeURL(once, false)
+		if err != nil {
+			t.Fatalf("normalizing %q again: %v", once, err)
+		}
+		if twice != once {
+			t.Fatalf("normalizing %q gave %q, then %q (%v)", raw, once, twice, changes)
+		}
+	})
+}
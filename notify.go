@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	slackWebhook   = flag.String("slack-webhook", os.Getenv("YAD_SLACK_WEBHOOK"), "Slack incoming-webhook URL finished downloads are reported to, also YAD_SLACK_WEBHOOK")
+	telegramToken  = flag.String("telegram-token", os.Getenv("YAD_TELEGRAM_TOKEN"), "Telegram bot token finished downloads are reported with, also YAD_TELEGRAM_TOKEN")
+	telegramChat   = flag.String("telegram-chat", os.Getenv("YAD_TELEGRAM_CHAT"), "Telegram chat ID the bot reports to, also YAD_TELEGRAM_CHAT")
+	notifyInterval = flag.Duration("notify-interval", 30*time.Second, "shortest time between two notifications; downloads finishing in between are summed up in one")
+	notifyBatches  = flag.Bool("notify-batches", false, "report the downloads of a request with several URLs together once the last one finishes")
+)
+
+const (
+	// notifySettle is how long a notification waits for more downloads
+	// to finish, so a batch finishing together is reported at once.
+	notifySettle = 5 * time.Second
+
+	// notifyListed is how many downloads a summary lists by name.
+	notifyListed = 10
+
+	notifyTimeout = 15 * time.Second
+)
+
+// notifier sends a short text message to people, such as a chat.
+type notifier interface {
+	// Name identifies the backend in logs.
+	Name() string
+	Notify(ctx context.Context, text string) error
+}
+
+// notification is one finished download as it is reported.
+type notification struct {
+	fileName string
+	status   string
+	size     int64
+	took     time.Duration
+	err      string
+}
+
+var (
+	notifiers     []notifier
+	notifications = make(chan []notification, 256)
+
+	// reportedBatches holds the submissions whose downloads were
+	// reported together; a download of one that finishes again, after a
+	// retry, is reported on its own. Guarded by downloadsMutex.
+	reportedBatches = make(map[string]bool)
+
+	// submitting holds the submissions whose downloads are still being
+	// recorded, so none of them is taken for a finished batch before the
+	// last is added. Guarded by downloadsMutex.
+	submitting = make(map[string]bool)
+)
+
+// initNotifiers sets up the configured backends and, if there are any,
+// the goroutine that sends their messages.
+func initNotifiers() error {
+	if *slackWebhook != "" {
+		if !strings.HasPrefix(*slackWebhook, "https://") && !strings.HasPrefix(*slackWebhook, "http://") {
+			return fmt.Errorf("-slack-webhook must be an http(s) URL")
+		}
+		notifiers = append(notifiers, slackNotifier{webhookURL: *slackWebhook})
+	}
+	if (*telegramToken == "") != (*telegramChat == "") {
+		return fmt.Errorf("-telegram-token and -telegram-chat must be given together")
+	}
+	if *telegramToken != "" {
+		notifiers = append(notifiers, telegramNotifier{apiURL: "https://api.telegram.org", token: *telegramToken, chatID: *telegramChat})
+	}
+	if *notifyInterval < 0 {
+		return fmt.Errorf("-notify-interval must not be negative")
+	}
+	if len(notifiers) > 0 {
+		go sendNotifications()
+	}
+	return nil
+}
+
+// notifyFinished queues a notification for download id, which just
+// reached a terminal state. With -notify-batches, a download of a
+// request with several URLs waits for the last of them. Call it without
+// downloadsMutex held.
+func notifyFinished(id string) {
+	if len(notifiers) == 0 {
+		return
+	}
+	downloadsMutex.Lock()
+	download, exists := activeDownloads[id]
+	if !exists || !download.Completed || download.notified {
+		downloadsMutex.Unlock()
+		return
+	}
+	batch := []*DownloadStatus{download}
+	if *notifyBatches && download.SubmissionID != "" && !reportedBatches[download.SubmissionID] {
+		var done bool
+		if batch, done = finishedBatch(download.SubmissionID); !done {
+			// Reported with the last one
+			downloadsMutex.Unlock()
+			return
+		}
+		if len(batch) > 1 {
+			reportedBatches[download.SubmissionID] = true
+		}
+	}
+	group := make([]notification, len(batch))
+	for i, d := range batch {
+		group[i] = newNotification(d)
+		d.notified = true
+	}
+	downloadsMutex.Unlock()
+	select {
+	case notifications <- group:
+	default:
+		log.Printf("Notification queue full; not reporting %s", id)
+	}
+}
+
+// finishedBatch returns the downloads of submission, and whether they
+// have all finished and were all recorded. downloadsMutex must be held.
+func finishedBatch(submission string) ([]*DownloadStatus, bool) {
+	if submitting[submission] {
+		return nil, false
+	}
+	var batch []*DownloadStatus
+	for _, download := range activeDownloads {
+		if download.SubmissionID != submission {
+			continue
+		}
+		if !download.Completed {
+			return nil, false
+		}
+		batch = append(batch, download)
+	}
+	return batch, len(batch) > 0
+}
+
+// beginSubmission holds back batch reports for submission until
+// endSubmission, while its downloads are recorded and queued.
+func beginSubmission(submission string) {
+	downloadsMutex.Lock()
+	submitting[submission] = true
+	downloadsMutex.Unlock()
+}
+
+// endSubmission lets the batch of submission, whose downloads are ids,
+// be reported, and reports it if every download already finished.
+func endSubmission(submission string, ids []string) {
+	downloadsMutex.Lock()
+	delete(submitting, submission)
+	downloadsMutex.Unlock()
+	for _, id := range ids {
+		notifyFinished(id)
+		mailFinished(id)
+	}
+}
+
+// newNotification describes download. downloadsMutex must be held.
+func newNotification(download *DownloadStatus) notification {
+	n := notification{
+		fileName: download.FileName,
+		status:   download.Status,
+		size:     max(download.BytesDownloaded, download.SizeOnDisk),
+		err:      download.Error,
+	}
+	if n.fileName == "" {
+		n.fileName = download.URL
+	}
+	start := download.SubmittedAt
+	if download.StartedAt != nil {
+		start = *download.StartedAt
+	}
+	n.took = time.Since(start).Round(time.Second)
+	return n
+}
+
+// sendNotifications collects finished downloads and sends them to every
+// notifier, at most one message per -notify-interval, each summing up
+// whatever finished since the last.
+func sendNotifications() {
+	var pending []notification
+	var last, first time.Time
+	for {
+		var due <-chan time.Time
+		if len(pending) > 0 {
+			at := first.Add(notifySettle)
+			if next := last.Add(*notifyInterval); next.After(at) {
+				at = next
+			}
+			due = time.After(time.Until(at))
+		}
+		select {
+		case group := <-notifications:
+			if len(pending) == 0 {
+				first = time.Now()
+			}
+			pending = append(pending, group...)
+		case <-due:
+			text := notificationText(pending)
+			pending, last = nil, time.Now()
+			for _, n := range notifiers {
+				ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+				if err := n.Notify(ctx, text); err != nil {
+					log.Printf("Failed to notify %s: %v", n.Name(), err)
+				}
+				cancel()
+			}
+		}
+	}
+}
+
+// notificationText is the message for finished downloads: a line for
+// one, or a summary with the first few listed, failures first.
+func notificationText(finished []notification) string {
+	if len(finished) == 1 {
+		return "yad: " + finished[0].line()
+	}
+	counts := make(map[string]int)
+	var total int64
+	var failed, others []notification
+	for _, n := range finished {
+		counts[n.status]++
+		total += n.size
+		if n.status == "failed" {
+			failed = append(failed, n)
+		} else {
+			others = append(others, n)
+		}
+	}
+	var parts []string
+	for _, status := range []string{"completed", "deduplicated", "not_modified", "skipped", "suspicious", "failed", "cancelled"} {
+		if counts[status] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[status], strings.ReplaceAll(status, "_", " ")))
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "yad: %d downloads finished: %s (%s)", len(finished), strings.Join(parts, ", "), formatSize(total))
+	listed := append(failed, others...)
+	for i, n := range listed {
+		if i == notifyListed {
+			fmt.Fprintf(&b, "\n…and %d more", len(listed)-i)
+			break
+		}
+		b.WriteString("\n" + n.line())
+	}
+	return b.String()
+}
+
+// line describes one finished download, such as "✅ os.iso completed
+// (4.2 GB in 3m12s)".
+func (n notification) line() string {
+	switch n.status {
+	case "failed":
+		return fmt.Sprintf("❌ %s failed after %s: %s", n.fileName, n.took, n.err)
+	case "cancelled":
+		return fmt.Sprintf("⏹ %s cancelled after %s", n.fileName, n.took)
+	case "suspicious":
+		return fmt.Sprintf("⚠️ %s is suspicious (%s in %s)", n.fileName, formatSize(n.size), n.took)
+	}
+	return fmt.Sprintf("✅ %s %s (%s in %s)", n.fileName, strings.ReplaceAll(n.status, "_", " "), formatSize(n.size), n.took)
+}
+
+// notifyClient sends notifications over the shared transport, so they
+// go out the way downloads do (-bind, -ca-file, the proxy and the
+// connection flags), but without the download servers' default headers
+// and host policy.
+var notifyClient = &http.Client{Transport: proxyErrorTransport{httpTransport}, Timeout: notifyTimeout}
+
+// postJSON sends body as JSON to endpoint and fails unless it is
+// answered with a 2xx status.
+func postJSON(ctx context.Context, endpoint string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		// Not err, which quotes the URL.
+		return fmt.Errorf("invalid notification URL")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		// The URL net/http quotes in its errors holds the webhook's or
+		// the bot's secret.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// slackNotifier posts to a Slack incoming webhook.
+type slackNotifier struct {
+	webhookURL string
+}
+
+func (slackNotifier) Name() string { return "Slack" }
+
+func (s slackNotifier) Notify(ctx context.Context, text string) error {
+	return postJSON(ctx, s.webhookURL, map[string]string{"text": text})
+}
+
+// telegramNotifier sends messages to a chat as a Telegram bot.
+type telegramNotifier struct {
+	apiURL string
+	token  string
+	chatID string
+}
+
+func (telegramNotifier) Name() string { return "Telegram" }
+
+func (t telegramNotifier) Notify(ctx context.Context, text string) error {
+	return postJSON(ctx, t.apiURL+"/bot"+t.token+"/sendMessage", map[string]string{"chat_id": t.chatID, "text": text})
+}
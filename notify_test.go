@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPostJSONErrorHidesURL(t *testing.T) {
+	// A port nothing listens on, so the request fails in transport.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	n := telegramNotifier{apiURL: "http://" + addr, token: "123456:SECRET-TOKEN", chatID: "1"}
+	err = n.Notify(context.Background(), "hello")
+	if err == nil {
+		t.Fatal("Notify succeeded without a server")
+	}
+	if strings.Contains(err.Error(), "SECRET-TOKEN") || strings.Contains(err.Error(), "/bot") {
+		t.Errorf("error quotes the URL: %v", err)
+	}
+}
+
+func TestSecretFlag(t *testing.T) {
+	for name, want := range map[string]bool{
+		"slack-webhook":  true,
+		"telegram-token": true,
+		"smtp-password":  true,
+		"telegram-chat":  false,
+		"smtp-host":      false,
+	} {
+		if got := secretFlag(name); got != want {
+			t.Errorf("secretFlag(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
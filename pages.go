@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxPages = 1000
+	pageRetries     = 3
+)
+
+// downloadPages fetches url and every page reachable through rel="next"
+// Link headers. Pages are appended to one output file, or saved as
+// numbered files in a "<name>-pages" directory when opts.linkNextParts is
+// set. It returns the file or directory written.
+func downloadPages(ctx context.Context, key, url, outputDir string, opts downloadOptions) (string, error) {
+	ctx = withDownloadKey(ctx, key)
+	defer shaper.start(key, downloadClass(key), opts.maxSpeed)()
+	client, err := downloadClient(url, opts)
+	if err != nil {
+		return "", err
+	}
+	maxPages := opts.maxPages
+	if maxPages <= 0 {
+		maxPages = defaultMaxPages
+	}
+
+	fileName, err := settleFileName(key, url, outputDir, downloadFileName(key, url), opts)
+	if err != nil {
+		return "", err
+	}
+	defer releaseClaims(key)
+	outputPath := filepath.Join(outputDir, fileName)
+	var out *os.File
+	if opts.linkNextParts {
+		outputPath = filepath.Join(outputDir, fileName+"-pages")
+		if err := os.MkdirAll(outputPath, os.ModePerm); err != nil {
+			return "", fmt.Errorf("failed to create page directory: %v", err)
+		}
+	} else {
+		out, err = os.Create(outputPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to create file: %v", err)
+		}
+		defer out.Close()
+	}
+	setPartialPath(key, outputPath)
+
+	seen := make(map[string]bool)
+	next := url
+	var received int64
+	for page := 1; next != ""; page++ {
+		if seen[next] {
+			return "", fmt.Errorf("page %d links back to already fetched %s", page, next)
+		}
+		if page > maxPages {
+			return "", fmt.Errorf("stopped after %d pages; raise maxPages to fetch more", maxPages)
+		}
+		seen[next] = true
+
+		dest := out
+		if opts.linkNextParts {
+			dest, err = os.Create(filepath.Join(outputPath, fmt.Sprintf("page-%04d%s", page, filepath.Ext(fileName))))
+			if err != nil {
+				return "", fmt.Errorf("failed to create page file: %v", err)
+			}
+		}
+		var n int64
+		next, n, err = fetchPage(ctx, client, next, dest)
+		if opts.linkNextParts {
+			dest.Close()
+		}
+		if err != nil {
+			return "", fmt.Errorf("page %d: %v", page, err)
+		}
+
+		downloadsMutex.Lock()
+		if download, exists := activeDownloads[key]; exists {
+			download.Pages = page
+		}
+		downloadsMutex.Unlock()
+		// The number of pages isn't known up front.
+		received += n
+		setDownloadProgress(key, received, -1)
+		updateDownloadStatus(key, "downloading", false, "")
+	}
+	return outputPath, nil
+}
+
+// fetchPage writes one page's body to dest, retrying connection errors
+// and 5xx/429 responses with backoff, and returns the absolute rel="next"
+// URL, if any, and the size of the body. A failed attempt's partial body
+// is discarded.
+func fetchPage(ctx context.Context, client *http.Client, url string, dest *os.File) (string, int64, error) {
+	start, err := dest.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= pageRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(1<<(attempt-1)) * time.Second):
+			case <-ctx.Done():
+				return "", 0, ctx.Err()
+			}
+			if err := dest.Truncate(start); err != nil {
+				return "", 0, err
+			}
+			if _, err := dest.Seek(start, io.SeekStart); err != nil {
+				return "", 0, err
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return "", 0, err
+		}
+		resp, err := doWithDigest(client, req, req.URL.User)
+		if err != nil {
+			var derr *downloadError
+			if errors.As(err, &derr) {
+				return "", 0, err
+			}
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("server returned %s", resp.Status)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := statusError(resp)
+			resp.Body.Close()
+			return "", 0, err
+		}
+
+		n, err := copyWithPool(dest, shapeReader(ctx, resp.Body))
+		resp.Body.Close()
+		bytesTransferred.Add(n)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return linkNext(resp.Request.URL, resp.Header.Values("Link")), n, nil
+	}
+	return "", 0, fmt.Errorf("giving up after %d attempts: %v", pageRetries+1, lastErr)
+}
+
+// linkNext returns the target of the first rel="next" link in RFC 8288
+// (formerly RFC 5988) Link header values, resolved against base.
+func linkNext(base *neturl.URL, headers []string) string {
+	for _, header := range headers {
+		rest := header
+		for {
+			open := strings.IndexByte(rest, '<')
+			if open < 0 {
+				break
+			}
+			end := strings.IndexByte(rest[open:], '>')
+			if end < 0 {
+				break
+			}
+			target := rest[open+1 : open+end]
+			rest = rest[open+end+1:]
+
+			// Parameters run up to the next link, which starts after a
+			// comma outside quotes.
+			params := rest
+			more := false
+			inQuotes := false
+			for i := 0; i < len(rest); i++ {
+				if rest[i] == '"' {
+					inQuotes = !inQuotes
+				} else if rest[i] == ',' && !inQuotes {
+					params, rest, more = rest[:i], rest[i+1:], true
+					break
+				}
+			}
+
+			if hasRelNext(params) {
+				ref, err := neturl.Parse(target)
+				if err != nil {
+					return ""
+				}
+				return base.ResolveReference(ref).String()
+			}
+			if !more {
+				break
+			}
+		}
+	}
+	return ""
+}
+
+func hasRelNext(params string) bool {
+	for _, param := range strings.Split(params, ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "rel") {
+			continue
+		}
+		for _, rel := range strings.Fields(strings.Trim(strings.TrimSpace(value), `"`)) {
+			if strings.EqualFold(rel, "next") {
+				return true
+			}
+		}
+	}
+	return false
+}
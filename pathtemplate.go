@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// pathTemplateVars are the placeholders a pathTemplate may use, besides
+// {tag:name}.
+var pathTemplateVars = []string{"requestId", "host", "filename", "yyyy", "mm", "dd", "yyyy-mm-dd"}
+
+// pathTemplateError points at what is wrong with a pathTemplate.
+type pathTemplateError struct {
+	placeholder string
+	offset      int
+	reason      string
+}
+
+func (e *pathTemplateError) Error() string {
+	if e.placeholder == "" {
+		return "invalid pathTemplate: " + e.reason
+	}
+	return fmt.Sprintf("invalid pathTemplate: %s at offset %d: %s", e.placeholder, e.offset, e.reason)
+}
+
+func (e *pathTemplateError) fields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"code":    "invalid_path_template",
+		"allowed": append(append([]string(nil), pathTemplateVars...), "tag:<name>"),
+	}
+	if e.placeholder != "" {
+		fields["placeholder"] = e.placeholder
+		fields["offset"] = e.offset
+	}
+	return fields
+}
+
+// checkPathTemplate validates a pathTemplate such as
+// "{tag:project}/{yyyy-mm-dd}/{host}/{filename}": a relative path whose
+// placeholders are all known.
+func checkPathTemplate(template string) error {
+	if template == "" {
+		return nil
+	}
+	if filepath.IsAbs(template) || strings.HasPrefix(template, "/") {
+		return &pathTemplateError{reason: "must be relative to outputDir"}
+	}
+	for _, segment := range strings.Split(template, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return &pathTemplateError{reason: fmt.Sprintf("path element %q is not allowed", segment)}
+		}
+	}
+	_, err := expandPathTemplate(template, func(string) string { return "x" })
+	return err
+}
+
+// expandPathTemplate replaces each {name} in template with value(name).
+func expandPathTemplate(template string, value func(name string) string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(template); {
+		open := strings.IndexByte(template[i:], '{')
+		if close := strings.IndexByte(template[i:], '}'); close >= 0 && (open < 0 || close < open) {
+			return "", &pathTemplateError{placeholder: "}", offset: i + close, reason: "unmatched }"}
+		}
+		if open < 0 {
+			b.WriteString(template[i:])
+			break
+		}
+		b.WriteString(template[i : i+open])
+		start := i + open
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return "", &pathTemplateError{placeholder: template[start:], offset: start, reason: "unterminated placeholder"}
+		}
+		placeholder := template[start : start+end+1]
+		name := placeholder[1 : len(placeholder)-1]
+		if !knownTemplateVar(name) {
+			return "", &pathTemplateError{placeholder: placeholder, offset: start, reason: "unknown variable"}
+		}
+		b.WriteString(value(name))
+		i = start + end + 1
+	}
+	return b.String(), nil
+}
+
+func knownTemplateVar(name string) bool {
+	if tag, ok := strings.CutPrefix(name, "tag:"); ok {
+		return tag != "" && !strings.ContainsAny(tag, "{}/")
+	}
+	for _, v := range pathTemplateVars {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// templateValue makes a variable's value usable as (part of) one path
+// element.
+func templateValue(s string) string {
+	s = sanitizeFileName(strings.NewReplacer("/", "_", "\\", "_").Replace(s))
+	if s == "" {
+		return "_"
+	}
+	return s
+}
+
+// resolvePathTemplate works out where download j of rawURL, saved at
+// savedPath, belongs under its outputDir at completion time.
+func resolvePathTemplate(j job, rawURL, savedPath string, now time.Time) (string, error) {
+	host := ""
+	if u, err := url.Parse(rawURL); err == nil {
+		host = u.Hostname()
+	}
+	// A name changed only because another file had it in outputDir
+	// gets its original back.
+	fileName := filepath.Base(savedPath)
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[j.id]; exists && download.wantedName != "" {
+		fileName = download.wantedName
+	}
+	downloadsMutex.Unlock()
+	rel, err := expandPathTemplate(j.opts.pathTemplate, func(name string) string {
+		switch name {
+		case "requestId":
+			return templateValue(j.requestID)
+		case "host":
+			return templateValue(host)
+		case "filename":
+			return templateValue(fileName)
+		case "yyyy":
+			return now.Format("2006")
+		case "mm":
+			return now.Format("01")
+		case "dd":
+			return now.Format("02")
+		case "yyyy-mm-dd":
+			return now.Format("2006-01-02")
+		}
+		prefix := strings.TrimPrefix(name, "tag:") + ":"
+		for _, tag := range j.opts.tags {
+			if value, ok := strings.CutPrefix(tag, prefix); ok {
+				return templateValue(value)
+			}
+		}
+		return "untagged"
+	})
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(j.outputDir, rel)
+	if !withinDir(filepath.Clean(j.outputDir), target) {
+		return "", fmt.Errorf("pathTemplate resolved outside %s", displayPath(j.outputDir))
+	}
+	if _, ok := resolveOutputDir(filepath.Dir(target)); !ok {
+		return "", &downloadError{code: "output_dir_not_allowed", err: fmt.Errorf("pathTemplate resolved to %s, outside the allowed roots", displayPath(target))}
+	}
+	return target, nil
+}
+
+// applyPathTemplate moves a completed download to where its request's
+// pathTemplate puts it, subject to the request's onConflict, and returns
+// the new path.
+func applyPathTemplate(id string, j job, rawURL, savedPath string) (string, error) {
+	target, err := resolvePathTemplate(j, rawURL, savedPath, time.Now())
+	if err != nil || target == savedPath {
+		return savedPath, err
+	}
+	dir := filepath.Dir(target)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return savedPath, fmt.Errorf("failed to create %s: %v", displayPath(dir), err)
+	}
+	name, err := claimFileName(id, rawURL, dir, filepath.Base(target), j.opts.onConflict)
+	defer releaseClaims(id)
+	if err != nil {
+		var skipped *skippedError
+		if errors.As(err, &skipped) {
+			os.RemoveAll(savedPath)
+		}
+		return savedPath, err
+	}
+	target = filepath.Join(dir, name)
+	if err := os.Rename(savedPath, target); err != nil {
+		return savedPath, fmt.Errorf("failed to move to %s: %v", displayPath(target), err)
+	}
+
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[id]; exists {
+		download.FileName = name
+	}
+	downloadsMutex.Unlock()
+	addDownloadEvent(id, "moved", fmt.Sprintf("moved to %s by pathTemplate", displayPath(target)))
+	return target, nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// pauseRequest is the cause a running download's context is cancelled
+// with when it is paused rather than cancelled.
+type pauseRequest struct{}
+
+func (p *pauseRequest) Error() string { return "download paused" }
+
+var (
+	// pausedJobs holds paused downloads out of the queue, so they don't
+	// occupy a worker, until they are resumed.
+	pausedJobs   = make(map[string]job)
+	pausedJobsMu sync.Mutex
+)
+
+// pauseWait bounds how long a pause request waits for the transfer to
+// stop.
+const pauseWait = 5 * time.Second
+
+func waitPaused(id string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		pausedJobsMu.Lock()
+		_, ok := pausedJobs[id]
+		pausedJobsMu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func takePausedJob(id string) (job, bool) {
+	pausedJobsMu.Lock()
+	defer pausedJobsMu.Unlock()
+	j, ok := pausedJobs[id]
+	delete(pausedJobs, id)
+	return j, ok
+}
+
+// finishPaused parks a job whose transfer was stopped by a pause. The
+// partial file stays on disk for the resume to continue from.
+func finishPaused(j job) {
+	j.ctx, j.cancel = nil, nil
+	pausedJobsMu.Lock()
+	pausedJobs[j.id] = j
+	pausedJobsMu.Unlock()
+
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[j.id]; exists {
+		download.Status = "paused"
+		clearSpeed(download)
+		download.QueuePosition = 0
+		download.EstimatedStart = nil
+	}
+	downloadsMutex.Unlock()
+	addDownloadEvent(j.id, "paused", "download paused")
+	broadcastStatus()
+}
+
+// pausable reports why url can't be paused, if it can't. Only plain HTTP
+// transfers can be continued with a Range request.
+func pausable(url string, opts downloadOptions) error {
+	if strings.HasPrefix(url, "magnet:") || strings.HasSuffix(url, ".torrent") {
+		return fmt.Errorf("torrents can't be paused")
+	}
+	if opts.followLinkNext {
+		return fmt.Errorf("paginated downloads can't be paused")
+	}
+	return nil
+}
+
+// downloadTargets resolves the download ID in the path, or ?url= or
+// ?tag= for a group, to the IDs of the downloads an action applies to.
+// A single download that doesn't match is a conflict; group members
+// that don't match are skipped. It writes the error response itself and
+// returns false if the query is invalid or names nothing known.
+func downloadTargets(w http.ResponseWriter, r *http.Request, match func(*DownloadStatus) bool) ([]string, bool) {
+	id := mux.Vars(r)["id"]
+	query := r.URL.Query()
+	url := query.Get("url")
+	tags, err := normalizeTags(query["tag"])
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	given := 0
+	for _, set := range []bool{id != "", url != "", len(tags) > 0} {
+		if set {
+			given++
+		}
+	}
+	if given != 1 {
+		httpError(w, r, "Exactly one of a download ID, url or tag is required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	downloadsMutex.Lock()
+	defer downloadsMutex.Unlock()
+	if id != "" {
+		download, exists := activeDownloads[id]
+		if !exists {
+			httpError(w, r, "Download not found", http.StatusNotFound)
+			return nil, false
+		}
+		if !match(download) {
+			httpErrorWith(w, r, fmt.Sprintf("Download is %s", download.Status), http.StatusConflict, map[string]interface{}{
+				"status": download.Status,
+			})
+			return nil, false
+		}
+		return []string{id}, true
+	}
+	found := false
+	var targets []string
+	for key, download := range filterDownloads(tags) {
+		if url != "" && download.URL != url {
+			continue
+		}
+		found = true
+		if match(download) {
+			targets = append(targets, key)
+		}
+	}
+	if url != "" && !found {
+		httpError(w, r, "Download not found", http.StatusNotFound)
+		return nil, false
+	}
+	return targets, true
+}
+
+// handlePauseDownload pauses the queued, running or retrying HTTP download {id},
+// or every pausable one matching ?url= or ?tag=.
+func handlePauseDownload(w http.ResponseWriter, r *http.Request) {
+	targets, ok := downloadTargets(w, r, func(d *DownloadStatus) bool {
+		return inFlight(d.Status)
+	})
+	if !ok {
+		return
+	}
+	single := mux.Vars(r)["id"] != ""
+
+	paused := make([]string, 0, len(targets))
+	for _, target := range targets {
+		j, state := pool.find(target)
+		if state == "" {
+			continue
+		}
+		if err := pausable(j.url, j.opts); err != nil {
+			if single {
+				httpError(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+			continue
+		}
+		switch j, state = pool.cancel(target, &pauseRequest{}); state {
+		case "":
+			continue
+		case "queued":
+			finishPaused(j)
+		case "running":
+			// Answer once the worker has let go of it, so the status
+			// already reads paused.
+			waitPaused(target, pauseWait)
+		}
+		paused = append(paused, target)
+	}
+	logf(r.Context(), "Paused %d downloads", len(paused))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"paused": paused})
+}
+
+// handleResumeDownload queues the paused download {id}, or every paused
+// one matching ?url= or ?tag=, to continue where it stopped.
+func handleResumeDownload(w http.ResponseWriter, r *http.Request) {
+	targets, ok := downloadTargets(w, r, func(d *DownloadStatus) bool {
+		return d.Status == "paused"
+	})
+	if !ok {
+		return
+	}
+
+	resumed := make([]string, 0, len(targets))
+	for _, target := range targets {
+		if resumePaused(target, "download resumed") {
+			resumed = append(resumed, target)
+		}
+	}
+	logf(r.Context(), "Resumed %d downloads", len(resumed))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"resumed": resumed})
+}
+
+// resumePaused queues the paused download id to continue from its
+// partial file, recording message as the reason. It reports false if id
+// isn't paused.
+func resumePaused(id, message string) bool {
+	j, ok := takePausedJob(id)
+	if !ok {
+		return false
+	}
+	j.opts.resume = true
+	updateDownloadStatus(id, "queued", false, "")
+	addDownloadEvent(id, "resumed", message)
+	pool.enqueue(j)
+	return true
+}
+
+// contentRangeStart returns the first byte position of a 206 response's
+// Content-Range, or -1.
+func contentRangeStart(resp *http.Response) int64 {
+	unit, rest, ok := strings.Cut(resp.Header.Get("Content-Range"), " ")
+	if !ok || unit != "bytes" {
+		return -1
+	}
+	first, _, ok := strings.Cut(rest, "-")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// contentRangeTotal returns the complete length from a Content-Range
+// header ("bytes */1234" on a 416), or -1.
+func contentRangeTotal(resp *http.Response) int64 {
+	_, total, ok := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// resumable reports whether a download should continue from the file a
+// previous attempt left at path: only if it is shorter than what the
+// server would send and the server advertises byte ranges. Anything
+// else, including a failed probe, means a fresh download.
+func resumable(ctx context.Context, client *http.Client, url, path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := doWithDigest(client, req, req.URL.User)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK && resp.Header.Get("Accept-Ranges") == "bytes" && info.Size() < resp.ContentLength
+}
+
+// markResumed records that download key continued from offset.
+func markResumed(key string, offset int64) {
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[key]; exists {
+		download.ResumedFrom = offset
+	}
+	downloadsMutex.Unlock()
+	addDownloadEvent(key, "range_resume", fmt.Sprintf("continuing from byte %d", offset))
+}
+
+func markRangeUnsupported(key string) {
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[key]; exists {
+		download.RangeUnsupported = true
+	}
+	downloadsMutex.Unlock()
+	addDownloadEvent(key, "range_unsupported", "server doesn't support Range requests; restarting from zero")
+}
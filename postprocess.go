@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// postProcessQueueSize bounds how many tasks can wait; further tasks are
+// dropped rather than holding up the worker that finished a download.
+const postProcessQueueSize = 256
+
+// postProcessTask is low-priority work on a finished download, such as
+// generating its thumbnail.
+type postProcessTask struct {
+	id   string
+	name string
+	run  func() error
+}
+
+var (
+	postProcessQueue   = make(chan postProcessTask, postProcessQueueSize)
+	postProcessDropped atomic.Int64
+)
+
+// enqueuePostProcess queues task behind any others. Tasks run one at a
+// time so they never compete with downloads for more than one core.
+func enqueuePostProcess(task postProcessTask) {
+	select {
+	case postProcessQueue <- task:
+	default:
+		postProcessDropped.Add(1)
+		log.Printf("Post-processing queue full; skipping %s for %s", task.name, task.id)
+	}
+}
+
+// startPostProcessing starts the goroutine that drains the queue. A
+// failed task is recorded as an event on its download and never changes
+// the download's status.
+func startPostProcessing() {
+	go func() {
+		for task := range postProcessQueue {
+			if err := runPostProcessTask(task); err != nil {
+				addDownloadEvent(task.id, task.name+"_failed", err.Error())
+				broadcastStatus()
+			}
+		}
+	}()
+}
+
+func runPostProcessTask(task postProcessTask) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			workerPanics.Add(1)
+			log.Printf("Recovered panic in %s for %s: %v", task.name, task.id, p)
+			err = fmt.Errorf("internal error: %v", p)
+		}
+	}()
+	return task.run()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	preflightConcurrency = 16
+	preflightTimeout     = 15 * time.Second
+)
+
+// preflightBatch holds the host addresses resolved for one submitted
+// batch. It travels with the batch's jobs and is consulted by the dialer
+// through the request context, so it lives exactly as long as they do.
+type preflightBatch struct {
+	mu    sync.Mutex
+	hosts map[string][]string
+}
+
+type preflightKey struct{}
+
+func withPreflight(ctx context.Context, batch *preflightBatch) context.Context {
+	if batch == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, preflightKey{}, batch)
+}
+
+func preflightFrom(ctx context.Context) *preflightBatch {
+	batch, _ := ctx.Value(preflightKey{}).(*preflightBatch)
+	return batch
+}
+
+func (b *preflightBatch) lookup(host string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.hosts[host]
+}
+
+// runPreflight resolves every distinct host among the jobs' URLs
+// concurrently and then warms up TLS connections to the warmup most
+// frequent HTTPS hosts. Failures only annotate the affected downloads
+// with a hint; DNS may well succeed by the time a worker gets to them.
+func runPreflight(batch *preflightBatch, jobs []job, warmup int) {
+	byHost := make(map[string][]string) // host -> download IDs
+	schemes := make(map[string]string)
+	for _, j := range jobs {
+		u, err := url.Parse(j.url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+			continue
+		}
+		byHost[u.Hostname()] = append(byHost[u.Hostname()], j.id)
+		schemes[u.Hostname()] = u.Scheme
+	}
+	batch.hosts = make(map[string][]string, len(byHost))
+
+	sem := make(chan struct{}, preflightConcurrency)
+	var wg sync.WaitGroup
+	for host, ids := range byHost {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(host string, ids []string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+			defer cancel()
+			ips, err := lookupHost(ctx, host)
+			if err != nil {
+				annotateLikelyFailure(ids, fmt.Sprintf("DNS lookup for %s failed during pre-flight: %v", host, err))
+				return
+			}
+			batch.mu.Lock()
+			batch.hosts[host] = ips
+			batch.mu.Unlock()
+		}(host, ids)
+	}
+	wg.Wait()
+
+	if warmup <= 0 {
+		return
+	}
+	var hosts []string
+	for host := range byHost {
+		if schemes[host] == "https" && len(batch.lookup(host)) > 0 {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool { return len(byHost[hosts[i]]) > len(byHost[hosts[j]]) })
+	if len(hosts) > warmup {
+		hosts = hosts[:warmup]
+	}
+
+	for _, host := range hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(host string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := warmUpHost(batch, host); err != nil {
+				annotateLikelyFailure(byHost[host], fmt.Sprintf("TLS warmup to %s failed during pre-flight: %v", host, err))
+			}
+		}(host)
+	}
+	wg.Wait()
+}
+
+// warmUpHost opens a pooled TLS connection to host by sending a HEAD for
+// its root. The response status doesn't matter; the idle connection and
+// TLS session are what later requests reuse.
+func warmUpHost(batch *preflightBatch, host string) error {
+	ctx, cancel := context.WithTimeout(withPreflight(context.Background(), batch), preflightTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, "https://"+host+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return nil
+}
+
+func annotateLikelyFailure(ids []string, hint string) {
+	downloadsMutex.Lock()
+	for _, id := range ids {
+		if download, exists := activeDownloads[id]; exists {
+			download.Hint = "likely to fail: " + hint
+		}
+	}
+	downloadsMutex.Unlock()
+	for _, id := range ids {
+		addDownloadEvent(id, "preflight", hint)
+	}
+}
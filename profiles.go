@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	profilesFlag        = flag.String("profiles", "", `named concurrency profiles as name=workers/torrents, e.g. "day=5/2,evening=2/1" (torrents 0 or omitted means no separate limit)`)
+	profileScheduleFlag = flag.String("profile-schedule", "", `local times of day to switch concurrency profile at, e.g. "08:00=day,18:00=evening"`)
+)
+
+// concurrencyProfile is a worker count and torrent limit applied
+// together, by schedule or by hand.
+type concurrencyProfile struct {
+	Workers  int `json:"workers"`
+	Torrents int `json:"torrents,omitempty"`
+}
+
+// profileSwitch makes profile active every day at minute past local
+// midnight.
+type profileSwitch struct {
+	minute  int
+	profile string
+}
+
+// profileManager holds the configured profiles and which one is in
+// effect: the manual override if set, otherwise the scheduled one.
+type profileManager struct {
+	mu       sync.Mutex
+	profiles map[string]concurrencyProfile
+	schedule []profileSwitch // by minute
+	override string
+	active   string
+	applied  bool
+	// held stops switches while a warm restart drains the pool.
+	held bool
+}
+
+var profiles = &profileManager{}
+
+// initProfiles loads -profiles and -profile-schedule. It must run after
+// flag.Parse.
+func initProfiles() error {
+	list, err := parseProfiles(*profilesFlag)
+	if err != nil {
+		return err
+	}
+	schedule, err := parseProfileSchedule(*profileScheduleFlag, list)
+	if err != nil {
+		return err
+	}
+	profiles.profiles, profiles.schedule = list, schedule
+	return nil
+}
+
+func parseProfiles(s string) (map[string]concurrencyProfile, error) {
+	list := make(map[string]concurrencyProfile)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, limits, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("profile %q: want name=workers/torrents", entry)
+		}
+		workers, torrents, _ := strings.Cut(limits, "/")
+		var p concurrencyProfile
+		var err error
+		if p.Workers, err = strconv.Atoi(strings.TrimSpace(workers)); err != nil || p.Workers < 1 || p.Workers > maxWorkers {
+			return nil, fmt.Errorf("profile %s: workers must be between 1 and %d", name, maxWorkers)
+		}
+		if torrents != "" {
+			if p.Torrents, err = strconv.Atoi(strings.TrimSpace(torrents)); err != nil || p.Torrents < 0 {
+				return nil, fmt.Errorf("profile %s: torrents must be a non-negative number", name)
+			}
+		}
+		if _, dup := list[name]; dup {
+			return nil, fmt.Errorf("profile %s is defined twice", name)
+		}
+		list[name] = p
+	}
+	return list, nil
+}
+
+func parseProfileSchedule(s string, list map[string]concurrencyProfile) ([]profileSwitch, error) {
+	var schedule []profileSwitch
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		at, name, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok {
+			return nil, fmt.Errorf("schedule entry %q: want HH:MM=profile", entry)
+		}
+		t, err := time.Parse("15:04", strings.TrimSpace(at))
+		if err != nil {
+			return nil, fmt.Errorf("schedule entry %q: time must be HH:MM", entry)
+		}
+		if _, ok := list[name]; !ok {
+			return nil, fmt.Errorf("schedule entry %q: unknown profile %s", entry, name)
+		}
+		minute := t.Hour()*60 + t.Minute()
+		for _, sw := range schedule {
+			if sw.minute == minute {
+				return nil, fmt.Errorf("schedule has two switches at %s", at)
+			}
+		}
+		schedule = append(schedule, profileSwitch{minute: minute, profile: name})
+	}
+	sort.Slice(schedule, func(i, j int) bool { return schedule[i].minute < schedule[j].minute })
+	return schedule, nil
+}
+
+// scheduled returns the profile the schedule has in effect at now: the
+// last switch before it, wrapping around to yesterday's final one.
+func (m *profileManager) scheduled(now time.Time) string {
+	if len(m.schedule) == 0 {
+		return ""
+	}
+	minute := now.Hour()*60 + now.Minute()
+	current := m.schedule[len(m.schedule)-1].profile
+	for _, sw := range m.schedule {
+		if sw.minute > minute {
+			break
+		}
+		current = sw.profile
+	}
+	return current
+}
+
+// nextSwitch returns the schedule's next switch after now.
+func (m *profileManager) nextSwitch(now time.Time) (string, time.Time, bool) {
+	if len(m.schedule) == 0 {
+		return "", time.Time{}, false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	sw, day := m.schedule[0], 1
+	for _, s := range m.schedule {
+		if s.minute > minute {
+			sw, day = s, 0
+			break
+		}
+	}
+	at := time.Date(now.Year(), now.Month(), now.Day()+day, sw.minute/60, sw.minute%60, 0, 0, now.Location())
+	return sw.profile, at, true
+}
+
+// apply resizes the worker pool and sets the torrent limit for the
+// profile that should be in effect at now, if that changed. Without one,
+// the pool runs -workers with no torrent limit. A worker count set
+// through /admin/workers lasts until the next switch.
+func (m *profileManager) apply(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	want := m.override
+	if want == "" {
+		want = m.scheduled(now)
+	}
+	if m.held || (m.applied && want == m.active) {
+		return
+	}
+	m.applied, m.active = true, want
+	workers, torrents := *workerCount, 0
+	if p, ok := m.profiles[want]; ok {
+		workers, torrents = p.Workers, p.Torrents
+		log.Printf("Concurrency profile %s: %d workers, torrent limit %d", want, workers, torrents)
+	}
+	pool.setWorkers(workers)
+	pool.setTorrentLimit(torrents)
+}
+
+func (m *profileManager) hold(held bool) {
+	m.mu.Lock()
+	m.held = held
+	m.mu.Unlock()
+}
+
+// startPool starts the workers for the profile in effect, or -workers
+// without one, and switches profiles on schedule from then on.
+func startPool() {
+	profiles.apply(time.Now())
+	if len(profiles.schedule) == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			profiles.apply(now)
+		}
+	}()
+}
+
+// profileStatus is what /stats and /config/profile report about
+// concurrency profiles.
+type profileStatus struct {
+	Active      string                        `json:"active,omitempty"`
+	Override    string                        `json:"override,omitempty"`
+	Scheduled   string                        `json:"scheduled,omitempty"`
+	NextProfile string                        `json:"nextProfile,omitempty"`
+	NextSwitch  *time.Time                    `json:"nextSwitch,omitempty"`
+	Profiles    map[string]concurrencyProfile `json:"profiles"`
+}
+
+// status returns nil when no profiles are configured.
+func (m *profileManager) status(now time.Time) *profileStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.profiles) == 0 {
+		return nil
+	}
+	s := &profileStatus{Active: m.active, Override: m.override, Scheduled: m.scheduled(now), Profiles: m.profiles}
+	// The schedule doesn't take over again until the override is
+	// cleared.
+	if name, at, ok := m.nextSwitch(now); ok && m.override == "" {
+		s.NextProfile, s.NextSwitch = name, &at
+	}
+	return s
+}
+
+func handleGetProfile(w http.ResponseWriter, r *http.Request) {
+	status := profiles.status(time.Now())
+	if status == nil {
+		httpError(w, r, "no concurrency profiles configured (see -profiles)", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleSetProfile switches to a profile by hand until the override is
+// cleared with an empty name or DELETE.
+func handleSetProfile(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Profile string `json:"profile"`
+	}
+	if r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	profiles.mu.Lock()
+	if len(profiles.profiles) == 0 {
+		profiles.mu.Unlock()
+		httpError(w, r, "no concurrency profiles configured (see -profiles)", http.StatusNotFound)
+		return
+	}
+	if _, ok := profiles.profiles[req.Profile]; req.Profile != "" && !ok {
+		profiles.mu.Unlock()
+		httpError(w, r, fmt.Sprintf("unknown profile %q", req.Profile), http.StatusBadRequest)
+		return
+	}
+	profiles.override = req.Profile
+	profiles.mu.Unlock()
+	profiles.apply(time.Now())
+
+	if req.Profile != "" {
+		logf(r.Context(), "Concurrency profile overridden to %s", req.Profile)
+	} else {
+		logf(r.Context(), "Concurrency profile override cleared")
+	}
+	handleGetProfile(w, r)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// finishedStates maps each ?state= accepted by DELETE /status to the
+// statuses it removes. Only terminal statuses appear here, so queued,
+// running and paused downloads are never pruned.
+var finishedStates = map[string][]string{
+	"completed":    {"completed", "deduplicated", "suspicious", "not_modified"},
+	"failed":       {"failed"},
+	"cancelled":    {"cancelled"},
+	"all-finished": {"completed", "deduplicated", "suspicious", "not_modified", "failed", "cancelled"},
+}
+
+// handleClearStatus removes finished downloads' records, optionally only
+// those carrying all the given ?tag= values. Files on disk are kept.
+func handleClearStatus(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+	statuses, ok := finishedStates[state]
+	if !ok {
+		httpError(w, r, fmt.Sprintf("state must be completed, failed, cancelled or all-finished, not %q", state), http.StatusBadRequest)
+		return
+	}
+	tags, err := normalizeTags(r.URL.Query()["tag"])
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var removed []string
+	downloadsMutex.Lock()
+	for id, download := range filterDownloads(tags) {
+		if !download.Completed || !contains(statuses, download.Status) {
+			continue
+		}
+		delete(activeDownloads, id)
+		removed = append(removed, id)
+	}
+	downloadsMutex.Unlock()
+	for _, id := range removed {
+		forgetDownload(id)
+	}
+	logf(r.Context(), "Cleared %d %s downloads", len(removed), state)
+	broadcastStatus()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"removed": len(removed)})
+}
+
+// forgetDownload drops what is kept about download id outside its
+// record once the record is gone.
+func forgetDownload(id string) {
+	stoppedJobsMu.Lock()
+	delete(stoppedJobs, id)
+	stoppedJobsMu.Unlock()
+	os.Remove(thumbnailPath(id))
+	forgetFaults(id)
+	go discardUpload(id)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const publicTag = "public"
+
+var (
+	publicStatus = flag.Bool("public-status", false, "serve an unauthenticated, read-only status page at /public")
+	publicScope  = flag.String("public-scope", "tagged", `downloads shown on the public status page: "tagged" (only those tagged "public") or "all"`)
+)
+
+// publicDownload is everything the public status page may show about a
+// download. URLs, paths, errors and events are deliberately absent: this
+// type, not the UI, decides what leaves the server.
+type publicDownload struct {
+	FileName string   `json:"fileName"`
+	Progress *float64 `json:"progress,omitempty"`
+	Speed    int64    `json:"speed"`
+	ETA      *int64   `json:"etaSeconds,omitempty"`
+	State    string   `json:"state"`
+}
+
+// publicView builds the public listing. The caller must hold
+// downloadsMutex.
+func publicView() []publicDownload {
+	list := make([]publicDownload, 0)
+	for _, download := range activeDownloads {
+		if *publicScope != "all" && !hasTags(download, []string{publicTag}) {
+			continue
+		}
+		list = append(list, publicDownload{
+			FileName: publicFileName(download.FileName),
+			Progress: download.Progress,
+			Speed:    download.Speed,
+			ETA:      download.ETASeconds,
+			State:    download.Status,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].FileName < list[j].FileName })
+	return list
+}
+
+// publicFileName drops any query string or fragment that ended up in a
+// file name taken from the URL, since that is where tokens live.
+func publicFileName(name string) string {
+	if i := strings.IndexAny(name, "?#"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// renderPublic marshals the public view. tags and legacy are ignored;
+// they exist so the function can be used with hub.broadcast.
+func renderPublic(tags []string, legacy bool) []byte {
+	downloadsMutex.Lock()
+	defer downloadsMutex.Unlock()
+	publicJSON, _ := json.Marshal(publicView())
+	return publicJSON
+}
+
+// requirePublic hides the public endpoints unless -public-status is set.
+func requirePublic(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !*publicStatus {
+			http.NotFound(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func handlePublicStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(renderPublic(nil, false))
+}
+
+// handlePublicWebSocket streams the public view. Unlike /ws, the client
+// can't change its subscription; anything it sends is ignored.
+func handlePublicWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logf(r.Context(), "Failed to upgrade to WebSocket: %v", err)
+		return
+	}
+
+	client := wsHub.add(conn, false)
+	client.subscribe(subscribePublic, nil)
+	wsHub.deliver(client, renderPublic(nil, false))
+
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			wsHub.remove(client)
+			conn.Close()
+			break
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// queueSaveInterval is how often the pending queue is checked for
+// changes and saved.
+const queueSaveInterval = time.Second
+
+var restoreQueue = flag.Bool("restore-queue", true, "save unfinished downloads to <data-dir>/queue.json and queue them again after a restart")
+
+// queueSavingHeld stops the saver while a warm restart hands the queue
+// to the new process, which saves it from then on.
+var queueSavingHeld atomic.Bool
+
+// savedQueue is what queue.json holds: every download that hadn't
+// reached a terminal state, in dispatch order.
+type savedQueue struct {
+	Jobs []savedJob `json:"jobs"`
+}
+
+type savedJob struct {
+	handoffJob
+	// "queued", "running", "paused" or "scheduled".
+	State       string    `json:"state"`
+	FileName    string    `json:"fileName"`
+	SubmittedAt time.Time `json:"submittedAt"`
+}
+
+func queueFile() string {
+	return filepath.Join(*dataDir, "queue.json")
+}
+
+// pendingQueue captures the downloads that would be lost if the process
+// died now.
+func pendingQueue() savedQueue {
+	queued, running := pool.pending()
+	pausedJobsMu.Lock()
+	paused := make([]job, 0, len(pausedJobs))
+	for _, j := range pausedJobs {
+		paused = append(paused, j)
+	}
+	pausedJobsMu.Unlock()
+	sort.Slice(paused, func(i, k int) bool { return paused[i].id < paused[k].id })
+
+	saved := savedQueue{Jobs: []savedJob{}}
+	downloadsMutex.Lock()
+	defer downloadsMutex.Unlock()
+	add := func(jobs []job, state string) {
+		for _, j := range jobs {
+			download, exists := activeDownloads[j.id]
+			if !exists {
+				continue
+			}
+			saved.Jobs = append(saved.Jobs, savedJob{
+				handoffJob:  newHandoffJob(j),
+				State:       state,
+				FileName:    download.FileName,
+				SubmittedAt: download.SubmittedAt,
+			})
+		}
+	}
+	// Interrupted downloads go back to the front of the queue.
+	add(running, "running")
+	add(queued, "queued")
+	add(paused, "paused")
+	add(scheduledHandoffJobs(), "scheduled")
+	return saved
+}
+
+// startQueueSaver keeps queue.json up to date with the pending queue.
+func startQueueSaver() {
+	if !*restoreQueue {
+		return
+	}
+	go func() {
+		var last []byte
+		for range time.Tick(queueSaveInterval) {
+			if queueSavingHeld.Load() {
+				continue
+			}
+			data, _ := json.MarshalIndent(pendingQueue(), "", "  ")
+			if bytes.Equal(data, last) {
+				continue
+			}
+			if err := writeQueueFile(data); err != nil {
+				log.Printf("Failed to save the download queue: %v", err)
+				continue
+			}
+			last = data
+		}
+	}()
+}
+
+func writeQueueFile(data []byte) error {
+	if err := os.MkdirAll(*dataDir, os.ModePerm); err != nil {
+		return err
+	}
+	tmp := queueFile() + ".tmp"
+	// Jobs may carry credentials in their headers.
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, queueFile())
+}
+
+// loadQueue queues again the downloads saved by the previous process.
+// Ones that were mid-download are marked interrupted and continue from
+// their partial file where they can, otherwise start over. It runs
+// before the workers start.
+func loadQueue() error {
+	if !*restoreQueue {
+		return nil
+	}
+	data, err := os.ReadFile(queueFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved savedQueue
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", queueFile(), err)
+	}
+
+	var jobs []job
+	for _, s := range saved.Jobs {
+		j := s.job()
+		addQueuedRecord(j, s.FileName, s.SubmittedAt)
+		switch s.State {
+		case "running":
+			j.opts.resume = pausable(j.url, j.opts) == nil
+			downloadsMutex.Lock()
+			activeDownloads[j.id].Interrupted = true
+			downloadsMutex.Unlock()
+			message := "interrupted by a server restart; queued again"
+			if j.opts.resume {
+				message = "interrupted by a server restart; continuing from the partial file"
+			}
+			addDownloadEvent(j.id, "interrupted", message)
+		case "paused":
+			downloadsMutex.Lock()
+			activeDownloads[j.id].Status = "paused"
+			downloadsMutex.Unlock()
+			pausedJobsMu.Lock()
+			pausedJobs[j.id] = j
+			pausedJobsMu.Unlock()
+			continue
+		case "scheduled":
+			// The scheduler queues it, right away if its time has
+			// passed.
+			downloadsMutex.Lock()
+			activeDownloads[j.id].Status = "scheduled"
+			activeDownloads[j.id].StartAt = &j.opts.startAt
+			downloadsMutex.Unlock()
+			scheduledJobsMu.Lock()
+			scheduledJobs[j.id] = scheduledJob{job: j}
+			scheduledJobsMu.Unlock()
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	pool.enqueue(jobs...)
+	if len(saved.Jobs) > 0 {
+		log.Printf("Restored %d unfinished downloads from %s", len(saved.Jobs), queueFile())
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var reconcileInterval = flag.Duration("reconcile-interval", 0, "how often to check finished downloads' files for external deletion or modification (0 disables)")
+
+// reconcileItem is one finished download whose file no longer matches
+// its record.
+type reconcileItem struct {
+	ID           string     `json:"id"`
+	URL          string     `json:"url"`
+	Path         string     `json:"path"`
+	ExpectedSize int64      `json:"expectedSize"`
+	ActualSize   int64      `json:"actualSize,omitempty"`
+	ExpectedTime *time.Time `json:"expectedModTime,omitempty"`
+	ActualTime   *time.Time `json:"actualModTime,omitempty"`
+}
+
+// reconcileReport summarises one reconciliation pass.
+type reconcileReport struct {
+	Time     time.Time       `json:"time"`
+	Checked  int             `json:"checked"`
+	Missing  []reconcileItem `json:"missing"`
+	Modified []reconcileItem `json:"modified"`
+	Requeued []string        `json:"requeued,omitempty"`
+}
+
+var (
+	lastReconcile   *reconcileReport
+	lastReconcileMu sync.Mutex
+)
+
+// startReconciler runs a reconciliation pass every -reconcile-interval.
+func startReconciler() {
+	if *reconcileInterval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(*reconcileInterval) {
+			report := reconcile(false)
+			if len(report.Missing) > 0 || len(report.Modified) > 0 {
+				log.Printf("Reconciliation found %d missing and %d modified files", len(report.Missing), len(report.Modified))
+			}
+		}
+	}()
+}
+
+// reconcile stats the saved file of every finished download and flags
+// the ones that were deleted or changed since yad wrote them. With
+// requeue, missing downloads are queued again into their original
+// directory.
+func reconcile(requeue bool) *reconcileReport {
+	type candidate struct {
+		id, url, path string
+		size          int64
+		modTime       *time.Time
+	}
+	var candidates []candidate
+	downloadsMutex.Lock()
+	for id, download := range activeDownloads {
+		if download.Completed && download.Status != "failed" && download.SavedPath != "" {
+			candidates = append(candidates, candidate{id, download.URL, download.SavedPath, download.SizeOnDisk, download.ModTime})
+		}
+	}
+	downloadsMutex.Unlock()
+
+	report := &reconcileReport{Time: time.Now(), Checked: len(candidates), Missing: []reconcileItem{}, Modified: []reconcileItem{}}
+	for _, c := range candidates {
+		item := reconcileItem{ID: c.id, URL: c.url, Path: c.path, ExpectedSize: c.size, ExpectedTime: c.modTime}
+		size, modTime, err := measureSaved(savedPathOnDisk(c.path))
+		missing := err != nil
+		modified := !missing && (size != c.size || (c.modTime != nil && !modTime.Equal(*c.modTime)))
+		if modified {
+			item.ActualSize = size
+			item.ActualTime = &modTime
+		}
+
+		downloadsMutex.Lock()
+		download, exists := activeDownloads[c.id]
+		if !exists || download.SavedPath != c.path {
+			downloadsMutex.Unlock()
+			continue // replaced while we were looking
+		}
+		newlyMissing := missing && !download.FileMissing
+		newlyModified := modified && !download.FileModified
+		download.FileMissing = missing
+		download.FileModified = modified
+		requestID, outputDir, tags := download.RequestID, download.OutputDir, download.Tags
+		downloadsMutex.Unlock()
+
+		switch {
+		case missing:
+			report.Missing = append(report.Missing, item)
+			if newlyMissing {
+				addDownloadEvent(c.id, "file_missing", fmt.Sprintf("%s no longer exists", c.path))
+			}
+			if requeue && outputDir != "" {
+				processURLs([]string{c.id}, []string{c.url}, outputDir, requestID, downloadOptions{tags: tags, class: classBackground}, 0)
+				addDownloadEvent(c.id, "requeued", "re-downloading after the saved file went missing")
+				report.Requeued = append(report.Requeued, c.id)
+			}
+		case modified:
+			report.Modified = append(report.Modified, item)
+			if newlyModified {
+				addDownloadEvent(c.id, "file_modified", fmt.Sprintf("%s changed outside yad: %d bytes, modified %s (recorded %d bytes)",
+					c.path, size, modTime.Format(time.RFC3339), c.size))
+			}
+		}
+	}
+
+	lastReconcileMu.Lock()
+	lastReconcile = report
+	lastReconcileMu.Unlock()
+	broadcastStatus()
+	return report
+}
+
+// savedPathOnDisk turns a record's SavedPath, which is relative to the
+// default download folder when it lives there, back into a usable path.
+func savedPathOnDisk(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(downloadFolder, path)
+}
+
+// handleReconcile runs a reconciliation pass now. ?requeue=true queues
+// missing downloads again.
+func handleReconcile(w http.ResponseWriter, r *http.Request) {
+	report := reconcile(r.URL.Query().Get("requeue") == "true")
+	logf(r.Context(), "Reconciliation checked %d files: %d missing, %d modified, %d requeued",
+		report.Checked, len(report.Missing), len(report.Modified), len(report.Requeued))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleGetReconcile returns the report of the last reconciliation pass.
+func handleGetReconcile(w http.ResponseWriter, r *http.Request) {
+	lastReconcileMu.Lock()
+	report := lastReconcile
+	lastReconcileMu.Unlock()
+	if report == nil {
+		httpError(w, r, "No reconciliation has run yet", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
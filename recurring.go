@@ -0,0 +1,517 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxRecurringRuns is how many runs of a recurring download are kept.
+const maxRecurringRuns = 100
+
+// recurringURLVars are the placeholders a recurring download's URL may
+// use, filled in from the local time it was due at.
+var recurringURLVars = map[string]string{
+	"{date}": "2006-01-02",
+	"{yyyy}": "2006",
+	"{mm}":   "01",
+	"{dd}":   "02",
+}
+
+// recurringJob downloads URL into OutputDir every time its Cron
+// expression matches, in the server's local time.
+type recurringJob struct {
+	ID            string         `json:"id"`
+	URL           string         `json:"url"`
+	OutputDir     string         `json:"outputDir,omitempty"`
+	Cron          string         `json:"cron"`
+	SkipUnchanged bool           `json:"skipUnchanged,omitempty"`
+	OnConflict    string         `json:"onConflict,omitempty"`
+	Tags          []string       `json:"tags,omitempty"`
+	Class         string         `json:"class,omitempty"`
+	MaxAttempts   int            `json:"maxAttempts,omitempty"`
+	Paused        bool           `json:"paused"`
+	CreatedAt     time.Time      `json:"createdAt"`
+	Runs          []recurringRun `json:"runs,omitempty"`
+
+	spec cronSpec
+	next time.Time
+}
+
+// recurringRun is one time a recurring download was due: the download
+// it queued, with how that ended once it has, or why none was queued.
+type recurringRun struct {
+	At         time.Time `json:"at"`
+	URL        string    `json:"url"`
+	DownloadID string    `json:"downloadId,omitempty"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+}
+
+var (
+	// recurringJobs holds the recurring downloads by ID, kept in
+	// <data-dir>/recurring.json.
+	recurringJobs = make(map[string]*recurringJob)
+	recurringMu   sync.Mutex
+
+	// recurringChanged wakes the scheduler when a job is added or
+	// changed.
+	recurringChanged = make(chan struct{}, 1)
+)
+
+func recurringFile() string {
+	return filepath.Join(*dataDir, "recurring.json")
+}
+
+// loadRecurring reads the recurring downloads saved by earlier runs.
+// Times they were due while the server was down are skipped.
+func loadRecurring() error {
+	data, err := os.ReadFile(recurringFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var jobs []*recurringJob
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", recurringFile(), err)
+	}
+	recurringMu.Lock()
+	defer recurringMu.Unlock()
+	now := time.Now()
+	for _, job := range jobs {
+		spec, err := parseCron(job.Cron)
+		if err != nil {
+			return fmt.Errorf("recurring download %s: %v", job.ID, err)
+		}
+		job.spec, job.next = spec, spec.next(now)
+		recurringJobs[job.ID] = job
+	}
+	return nil
+}
+
+// saveRecurring writes the recurring downloads out. Call it with
+// recurringMu held.
+func saveRecurring() {
+	jobs := make([]*recurringJob, 0, len(recurringJobs))
+	for _, job := range recurringJobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].CreatedAt.Before(jobs[k].CreatedAt) })
+	data, err := json.MarshalIndent(jobs, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(*dataDir, os.ModePerm)
+	}
+	if err == nil {
+		// URLs may carry tokens.
+		tmp := recurringFile() + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, recurringFile())
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to save recurring downloads: %v", err)
+	}
+}
+
+// expandRecurringURL fills in the date placeholders of rawURL for at.
+func expandRecurringURL(rawURL string, at time.Time) string {
+	for placeholder, layout := range recurringURLVars {
+		rawURL = strings.ReplaceAll(rawURL, placeholder, at.Format(layout))
+	}
+	return rawURL
+}
+
+// check validates a recurring download as submitted and parses its cron
+// expression.
+func (job *recurringJob) check() error {
+	if job.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	u, err := url.Parse(expandRecurringURL(job.URL, time.Now()))
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid url %q", job.URL)
+	}
+	switch u.Scheme {
+	case "http", "https", "ftp", "sftp", "s3":
+	default:
+		return fmt.Errorf("url must be an http(s), ftp, sftp or s3 URL")
+	}
+	if job.spec, err = parseCron(job.Cron); err != nil {
+		return err
+	}
+	if job.spec.next(time.Now()).IsZero() {
+		return fmt.Errorf("cron expression %q never matches", job.Cron)
+	}
+	if _, ok := resolveOutputDir(job.OutputDir); !ok {
+		return fmt.Errorf("output directory %s is not inside an allowed root", job.OutputDir)
+	}
+	if job.OnConflict, err = checkOnConflict(job.OnConflict); err != nil {
+		return err
+	}
+	if job.Tags, err = normalizeTags(job.Tags); err != nil {
+		return err
+	}
+	if job.Class, err = checkClass(job.Class); err != nil {
+		return err
+	}
+	if job.MaxAttempts < 0 {
+		return fmt.Errorf("maxAttempts must not be negative")
+	}
+	return nil
+}
+
+// startRecurring starts the goroutine that queues recurring downloads
+// when they are due.
+func startRecurring() {
+	go func() {
+		timer := time.NewTimer(0)
+		for {
+			select {
+			case <-timer.C:
+			case <-recurringChanged:
+				timer.Stop()
+			}
+			next := runDueRecurring(time.Now())
+			if next.IsZero() {
+				timer.Reset(24 * time.Hour)
+			} else {
+				timer.Reset(time.Until(next))
+			}
+		}
+	}()
+}
+
+func wakeRecurring() {
+	select {
+	case recurringChanged <- struct{}{}:
+	default:
+	}
+}
+
+// runDueRecurring queues a download for every job due by now and
+// returns when the next one is due.
+func runDueRecurring(now time.Time) time.Time {
+	type dueJob struct {
+		job recurringJob
+		at  time.Time
+	}
+	var due []dueJob
+	var next time.Time
+	recurringMu.Lock()
+	for _, job := range recurringJobs {
+		if job.Paused || job.next.IsZero() {
+			continue
+		}
+		if !job.next.After(now) {
+			due = append(due, dueJob{*job, job.next})
+			job.next = job.spec.next(now)
+		}
+		if !job.next.IsZero() && (next.IsZero() || job.next.Before(next)) {
+			next = job.next
+		}
+	}
+	recurringMu.Unlock()
+	for _, d := range due {
+		addRecurringRun(d.job.ID, runRecurring(d.job, d.at))
+	}
+	return next
+}
+
+// runRecurring queues the download job is due for at. It queues none
+// while the download of its previous run is still unfinished.
+func runRecurring(job recurringJob, at time.Time) recurringRun {
+	run := recurringRun{At: at, URL: expandRecurringURL(job.URL, at)}
+	var previous string
+	for _, r := range job.Runs {
+		if r.DownloadID != "" {
+			previous = r.DownloadID
+		}
+	}
+	downloadsMutex.Lock()
+	var status string
+	if download, exists := activeDownloads[previous]; exists && !download.Completed {
+		status = download.Status
+	}
+	downloadsMutex.Unlock()
+	if status != "" {
+		log.Printf("WARNING: recurring download %s is due, but its previous run %s is still %s; skipping this run", job.ID, previous, status)
+		run.Status, run.Error = "skipped", fmt.Sprintf("previous run %s still %s", previous, status)
+		return run
+	}
+
+	outputDir, ok := resolveOutputDir(job.OutputDir)
+	if !ok {
+		run.Status, run.Error = "failed", fmt.Sprintf("output directory %s is not inside an allowed root", outputDir)
+		return run
+	}
+	if err := os.MkdirAll(outputDir, os.ModePerm); err != nil {
+		run.Status, run.Error = "failed", fmt.Sprintf("failed to create output directory: %v", err)
+		return run
+	}
+	opts := downloadOptions{
+		skipUnchanged: job.SkipUnchanged,
+		onConflict:    job.OnConflict,
+		tags:          job.Tags,
+		class:         job.Class,
+		maxAttempts:   job.MaxAttempts,
+		recurring:     job.ID,
+		submission:    newDownloadID(),
+	}
+	run.DownloadID, run.Status = newDownloadID(), "queued"
+	requestID := newRequestID()
+
+	submitMu.Lock()
+	result := submissionResults([]string{run.URL}, outputDir, opts)[0]
+	result.ID = run.DownloadID
+	if result.BlockedHost != "" {
+		recordBlocked(result, outputDir, requestID, opts)
+	} else {
+		processURLs([]string{run.DownloadID}, []string{run.URL}, outputDir, requestID, opts, 0)
+	}
+	submitMu.Unlock()
+	addDownloadEvent(run.DownloadID, "recurring", fmt.Sprintf("run of recurring download %s due at %s", job.ID, at.Format(time.RFC3339)))
+	log.Printf("[%s] Recurring download %s queued %s as %s", requestID, job.ID, run.URL, run.DownloadID)
+	return run
+}
+
+// addRecurringRun appends run to job id's runs, dropping the oldest past
+// maxRecurringRuns. The download may have finished already, such as one
+// blocked by the host policy.
+func addRecurringRun(id string, run recurringRun) {
+	if run.DownloadID != "" {
+		downloadsMutex.Lock()
+		if download, exists := activeDownloads[run.DownloadID]; exists && download.Completed {
+			run.Status, run.Error = download.Status, download.Error
+		}
+		downloadsMutex.Unlock()
+	}
+	recurringMu.Lock()
+	defer recurringMu.Unlock()
+	job, exists := recurringJobs[id]
+	if !exists {
+		return
+	}
+	job.Runs = append(job.Runs, run)
+	if len(job.Runs) > maxRecurringRuns {
+		job.Runs = job.Runs[len(job.Runs)-maxRecurringRuns:]
+	}
+	saveRecurring()
+}
+
+// finishRecurringRun records how download id ended on the run of the
+// recurring download that queued it, if one did. Call it without
+// downloadsMutex held.
+func finishRecurringRun(id string) {
+	downloadsMutex.Lock()
+	download, exists := activeDownloads[id]
+	if !exists || download.Recurring == "" || !download.Completed {
+		downloadsMutex.Unlock()
+		return
+	}
+	jobID, status, errorMsg := download.Recurring, download.Status, download.Error
+	downloadsMutex.Unlock()
+
+	recurringMu.Lock()
+	defer recurringMu.Unlock()
+	job, exists := recurringJobs[jobID]
+	if !exists {
+		return
+	}
+	for i := range job.Runs {
+		if job.Runs[i].DownloadID == id {
+			job.Runs[i].Status, job.Runs[i].Error = status, errorMsg
+			saveRecurring()
+			return
+		}
+	}
+}
+
+// recurringView is a recurring download as the API shows it: without
+// its runs, which have an endpoint of their own, and with when it is
+// next due.
+type recurringView struct {
+	recurringJob
+	Runs    []recurringRun `json:"runs,omitempty"`
+	NextRun *time.Time     `json:"nextRun,omitempty"`
+}
+
+// view returns job for the API. Call it with recurringMu held.
+func (job *recurringJob) view() recurringView {
+	v := recurringView{recurringJob: *job}
+	if !job.Paused && !job.next.IsZero() {
+		next := job.next
+		v.NextRun = &next
+	}
+	return v
+}
+
+func handleListRecurring(w http.ResponseWriter, r *http.Request) {
+	recurringMu.Lock()
+	list := make([]recurringView, 0, len(recurringJobs))
+	for _, job := range recurringJobs {
+		list = append(list, job.view())
+	}
+	recurringMu.Unlock()
+	sort.Slice(list, func(i, k int) bool { return list[i].CreatedAt.Before(list[k].CreatedAt) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleCreateRecurring adds a recurring download from a JSON body such
+// as {"url": "https://example.com/nightly-{date}.tar.gz", "cron": "0 3 * * *"}.
+func handleCreateRecurring(w http.ResponseWriter, r *http.Request) {
+	var job recurringJob
+	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := job.check(); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	job.ID, job.CreatedAt, job.Runs = newDownloadID(), time.Now(), nil
+	job.next = job.spec.next(time.Now())
+
+	recurringMu.Lock()
+	recurringJobs[job.ID] = &job
+	saveRecurring()
+	v := job.view()
+	recurringMu.Unlock()
+	wakeRecurring()
+	logf(r.Context(), "Added recurring download %s of %s (%s)", job.ID, job.URL, job.Cron)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(v)
+}
+
+func handleGetRecurring(w http.ResponseWriter, r *http.Request) {
+	recurringMu.Lock()
+	job, exists := recurringJobs[mux.Vars(r)["id"]]
+	var v recurringView
+	if exists {
+		v = job.view()
+	}
+	recurringMu.Unlock()
+	if !exists {
+		httpError(w, r, "Recurring download not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleUpdateRecurring replaces the settings of recurring download
+// {id}. Its runs and whether it is paused are kept.
+func handleUpdateRecurring(w http.ResponseWriter, r *http.Request) {
+	var update recurringJob
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := update.check(); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	recurringMu.Lock()
+	job, exists := recurringJobs[mux.Vars(r)["id"]]
+	if !exists {
+		recurringMu.Unlock()
+		httpError(w, r, "Recurring download not found", http.StatusNotFound)
+		return
+	}
+	update.ID, update.CreatedAt, update.Runs, update.Paused = job.ID, job.CreatedAt, job.Runs, job.Paused
+	update.next = update.spec.next(time.Now())
+	*job = update
+	saveRecurring()
+	v := job.view()
+	recurringMu.Unlock()
+	wakeRecurring()
+	logf(r.Context(), "Updated recurring download %s", job.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleDeleteRecurring removes recurring download {id}. Downloads its
+// runs queued are left alone.
+func handleDeleteRecurring(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	recurringMu.Lock()
+	_, exists := recurringJobs[id]
+	delete(recurringJobs, id)
+	if exists {
+		saveRecurring()
+	}
+	recurringMu.Unlock()
+	if !exists {
+		httpError(w, r, "Recurring download not found", http.StatusNotFound)
+		return
+	}
+	logf(r.Context(), "Deleted recurring download %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePauseRecurring stops recurring download {id} from running until
+// it is resumed, or resumes it, depending on the route.
+func handlePauseRecurring(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recurringMu.Lock()
+		job, exists := recurringJobs[mux.Vars(r)["id"]]
+		if !exists {
+			recurringMu.Unlock()
+			httpError(w, r, "Recurring download not found", http.StatusNotFound)
+			return
+		}
+		if job.Paused != paused {
+			job.Paused = paused
+			// A resumed job runs from now on; times it was due while
+			// paused are skipped.
+			job.next = job.spec.next(time.Now())
+			saveRecurring()
+		}
+		v := job.view()
+		recurringMu.Unlock()
+		wakeRecurring()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+// handleRecurringRuns lists the runs of recurring download {id}, oldest
+// first, with the current status of those still unfinished.
+func handleRecurringRuns(w http.ResponseWriter, r *http.Request) {
+	recurringMu.Lock()
+	job, exists := recurringJobs[mux.Vars(r)["id"]]
+	var runs []recurringRun
+	if exists {
+		runs = append([]recurringRun{}, job.Runs...)
+	}
+	recurringMu.Unlock()
+	if !exists {
+		httpError(w, r, "Recurring download not found", http.StatusNotFound)
+		return
+	}
+	downloadsMutex.Lock()
+	for i, run := range runs {
+		if download, ok := activeDownloads[run.DownloadID]; ok && run.DownloadID != "" {
+			runs[i].Status, runs[i].Error = download.Status, download.Error
+		}
+	}
+	downloadsMutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var maxRedirects = flag.Int("max-redirects", 10, "redirects a download request may follow before it fails with error code too_many_redirects")
+
+// checkRedirectChain fails a request that revisits a URL of its redirect
+// chain, or would take the chain past -max-redirects, with an error
+// listing the hops.
+func checkRedirectChain(req *http.Request, via []*http.Request) error {
+	hops := make([]string, 0, len(via)+1)
+	for _, r := range via {
+		hops = append(hops, r.URL.Redacted())
+	}
+	hops = append(hops, req.URL.Redacted())
+	for _, r := range via {
+		if r.URL.String() == req.URL.String() {
+			return &downloadError{code: "redirect_loop", err: fmt.Errorf("redirect loop: %s", strings.Join(hops, " -> "))}
+		}
+	}
+	if len(via) > *maxRedirects {
+		return &downloadError{code: "too_many_redirects", err: fmt.Errorf("stopped after %d redirects: %s", *maxRedirects, strings.Join(hops, " -> "))}
+	}
+	return nil
+}
+
+// recordRedirects stores on download key the URL resp came from and, if
+// it was redirected there, the URLs it went through, adding a
+// "redirected" event the first time the chain is seen.
+func recordRedirects(key string, resp *http.Response) {
+	if key == "" || resp.Request == nil {
+		return
+	}
+	var chain []string
+	for r := resp.Request; r != nil; {
+		chain = append([]string{r.URL.Redacted()}, chain...)
+		if r.Response == nil {
+			break
+		}
+		r = r.Response.Request
+	}
+	final := chain[len(chain)-1]
+	redirects := chain[:len(chain)-1]
+
+	downloadsMutex.Lock()
+	download, exists := activeDownloads[key]
+	changed := exists && download.FinalURL != final
+	if exists {
+		download.FinalURL = final
+		download.Redirects = redirects
+	}
+	downloadsMutex.Unlock()
+	pool.setHost(key, strings.ToLower(resp.Request.URL.Hostname()))
+	if changed && len(redirects) > 0 {
+		addDownloadEvent(key, "redirected", strings.Join(chain, " -> "))
+	}
+}
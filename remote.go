@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// remoteFile is a file fetched over a protocol other than HTTP, such as
+// FTP or SFTP, whose server can start sending it at an offset.
+type remoteFile struct {
+	// size is the file's length, or -1 if the server doesn't say.
+	size int64
+	// modified is the file's modification time as the server reports
+	// it, or "". It is stored with a partial file and has to match
+	// before that is continued, as Last-Modified does for HTTP.
+	modified string
+	// open starts sending the file from offset. It returns the offset
+	// the server really starts at, which is 0 if it can't skip ahead.
+	open func(offset int64) (io.Reader, int64, error)
+	// finish is called once the body has been read to its end, to
+	// confirm the server sent all of it.
+	finish func() error
+}
+
+// saveResumeStamp records that download key is writing the file at path
+// from url, with the modification time it started from as its
+// Last-Modified.
+func saveResumeStamp(path, key, url, modified string) error {
+	data, err := json.Marshal(resumeMeta{ID: key, URL: url, LastModified: modified})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(resumeMetaPath(path), data, 0o644)
+}
+
+// downloadRemote saves src, the file at rawURL, into outputDir or the
+// request's destination and returns where it ended up. It is the part of
+// a download that doesn't depend on the protocol: claiming the name,
+// continuing a partial file that is still current, checksums, the size
+// limit, bandwidth shaping and progress on the download tracked under
+// key.
+func downloadRemote(ctx context.Context, key, rawURL, outputDir string, opts downloadOptions, src remoteFile) (string, error) {
+	local := opts.destination == ""
+	if limit := opts.sizeLimit(); limit > 0 && src.size > limit {
+		return "", sizeLimitError(src.size, limit)
+	}
+
+	recorded := downloadFileName(key, rawURL)
+	fileName, err := settleFileName(key, rawURL, outputDir, recorded, opts)
+	if err != nil {
+		return "", err
+	}
+	if local {
+		defer releaseClaims(key)
+	}
+	outputPath := filepath.Join(outputDir, fileName)
+	dest, err := openDestination(opts.destination, outputDir)
+	if err != nil {
+		return "", err
+	}
+	// A local file the claimed name left behind is this download's own,
+	// so it is continued as it would be over HTTP.
+	file, err := dest.CreatePart(ctx, fileName, opts.resume || local)
+	if err != nil {
+		return "", err
+	}
+	defer func() { file.Abort() }()
+	discard := func() {
+		file.Abort()
+		if local {
+			os.Remove(partPath(outputPath))
+			removeResumeMeta(outputPath)
+		}
+	}
+	var sums *checksummer
+	commit := func() (string, error) {
+		if sums != nil {
+			if err := sums.verify(key); err != nil {
+				discard()
+				return "", err
+			}
+		}
+		path, err := file.Commit()
+		if err == nil && local {
+			removeResumeMeta(outputPath)
+		}
+		return path, err
+	}
+	restart := func(event, message string) error {
+		addDownloadEvent(key, event, message)
+		return file.Reset()
+	}
+	offset := file.Offset()
+	if local {
+		setPartialPath(key, partPath(outputPath))
+	}
+	if offset > 0 && local {
+		stored := ifRangeValidator(outputPath, rawURL)
+		switch {
+		case stored != "" && stored != src.modified:
+			err = restart("resource_changed", "the file changed on the server since the partial download; restarting from zero")
+			offset = 0
+		case stored == "" && *strictResume:
+			err = restart("resume_unvalidated", "no modification time stored for the partial file; starting over")
+			offset = 0
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if offset > 0 && src.size >= 0 && offset > src.size {
+		if err := restart("resource_changed", "the partial file is longer than the file on the server; restarting from zero"); err != nil {
+			return "", err
+		}
+		offset = 0
+	}
+	// An expected checksum covers the whole file, and what an earlier
+	// attempt uploaded can't be read back to hash.
+	if offset > 0 && !local && len(opts.checksums[rawURL]) > 0 {
+		if err := restart("checksum_restart", "the expected checksum needs the whole file; uploading it again from the start"); err != nil {
+			return "", err
+		}
+		offset = 0
+	}
+	if local && src.size >= 0 {
+		if err := checkDiskSpace(outputDir, src.size-offset); err != nil {
+			return "", err
+		}
+	}
+	if sums = newChecksummer(opts.checksums[rawURL]); sums != nil && offset > 0 {
+		if !local {
+			sums = nil
+		} else if err := sums.hashPrefix(partPath(outputPath), offset); err != nil {
+			return "", err
+		}
+	}
+	if offset > 0 && offset == src.size {
+		// Everything was already written before the pause.
+		return commit()
+	}
+
+	body, start, err := src.open(offset)
+	if err != nil {
+		return "", err
+	}
+	if start != offset {
+		markRangeUnsupported(key)
+		if err := file.Reset(); err != nil {
+			return "", err
+		}
+		offset = 0
+		sums = newChecksummer(opts.checksums[rawURL])
+	}
+	if offset > 0 {
+		markResumed(key, offset)
+	} else if local {
+		if err := saveResumeStamp(outputPath, key, rawURL, src.modified); err != nil {
+			return "", err
+		}
+	}
+	size := src.size
+	setDownloadProgress(key, offset, size)
+
+	body = shapeReader(ctx, body)
+	if sums != nil {
+		body = io.TeeReader(body, sums)
+	}
+	defer shaper.start(key, downloadClass(key), opts.maxSpeed)()
+	reader := &progressReader{Reader: body}
+
+	stop := make(chan struct{})
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				setDownloadProgress(key, offset+reader.bytesRead(), size)
+				return
+			}
+			setDownloadProgress(key, offset+reader.bytesRead(), size)
+			updateDownloadStatus(key, "downloading", false, "")
+		}
+	}()
+
+	var dst io.Writer = file
+	limit := opts.sizeLimit()
+	if limit > 0 {
+		dst = &limitWriter{w: file, limit: limit, offset: offset}
+	}
+	written, err := copyWithPool(dst, reader)
+	close(stop)
+	<-progressDone
+	if errors.Is(err, errSizeLimit) {
+		discard()
+		return "", sizeLimitError(-1, limit)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to save file: %w", err)
+	}
+	if err := src.finish(); err != nil {
+		return "", err
+	}
+	if size >= 0 && offset+written != size {
+		return "", fmt.Errorf("failed to save file: got %d of %d bytes: %w", offset+written, size, io.ErrUnexpectedEOF)
+	}
+	return commit()
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+var restartDrainTimeout = flag.Duration("restart-drain-timeout", 5*time.Minute, "how long a warm restart waits for active downloads to finish before pausing them for the new process to continue")
+
+// envHandoffFile names the state file a warm restart hands to the new
+// process.
+const envHandoffFile = "YAD_HANDOFF_FILE"
+
+// handoffState is everything a warm restart carries over to the new
+// process besides the listening socket.
+type handoffState struct {
+	Downloads   map[string]*DownloadStatus `json:"downloads"`
+	Queue       []handoffJob               `json:"queue"`
+	Credentials []handoffCredential        `json:"credentials,omitempty"`
+	Roots       []outputRoot               `json:"roots"`
+	Paused      []handoffJob               `json:"paused,omitempty"`
+	Scheduled   []handoffJob               `json:"scheduled,omitempty"`
+
+	// Jobs of failed and cancelled downloads, for a retry.
+	Stopped []handoffJob `json:"stopped,omitempty"`
+
+	// Transfers still running when the drain timed out, paused for the
+	// new process to continue from their partial files.
+	Resume []handoffTransfer `json:"resume,omitempty"`
+}
+
+// handoffTransfer is a paused transfer with the partial file it is to
+// continue from and how much of it was written.
+type handoffTransfer struct {
+	handoffJob
+	PartialPath string `json:"partialPath,omitempty"`
+	Offset      int64  `json:"offset"`
+}
+
+type handoffJob struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	OutputDir string `json:"outputDir"`
+	RequestID string `json:"requestId,omitempty"`
+
+	StallTimeout        time.Duration `json:"stallTimeout,omitempty"`
+	MinSpeed            int64         `json:"minSpeed,omitempty"`
+	MinSpeedWindow      time.Duration `json:"minSpeedWindow,omitempty"`
+	Timeout             time.Duration `json:"timeout,omitempty"`
+	MaxAttempts         int           `json:"maxAttempts,omitempty"`
+	SkipUnchanged       bool          `json:"skipUnchanged,omitempty"`
+	InsecureTLS         bool          `json:"insecureTLS,omitempty"`
+	CookieFile          string        `json:"cookieFile,omitempty"`
+	AlsoLinkTo          []string      `json:"alsoLinkTo,omitempty"`
+	Cookies             string        `json:"cookies,omitempty"`
+	Tags                []string      `json:"tags,omitempty"`
+	Class               string        `json:"class,omitempty"`
+	HTTPFallback        string        `json:"httpFallback,omitempty"`
+	Mirrors             []string      `json:"mirrors,omitempty"`
+	FallbackAfter       time.Duration `json:"fallbackAfter,omitempty"`
+	FallbackMinProgress float64       `json:"fallbackMinProgress,omitempty"`
+	FollowLinkNext      bool          `json:"followLinkNext,omitempty"`
+	LinkNextParts       bool          `json:"linkNextParts,omitempty"`
+	MaxPages            int           `json:"maxPages,omitempty"`
+	HashAlgorithm       string        `json:"hashAlgorithm,omitempty"`
+	Destination         string        `json:"destination,omitempty"`
+	Resume              bool          `json:"resume,omitempty"`
+	Fault               string        `json:"fault,omitempty"`
+	Connections         int           `json:"connections,omitempty"`
+	MaxSpeed            int64         `json:"maxSpeed,omitempty"`
+	OnConflict          string        `json:"onConflict,omitempty"`
+	PathTemplate        string        `json:"pathTemplate,omitempty"`
+	MaxFileSize         int64         `json:"maxFileSize,omitempty"`
+
+	Checksums map[string]map[string]string `json:"checksums,omitempty"`
+
+	Headers      map[string]http.Header `json:"headers,omitempty"`
+	CookieHeader string                 `json:"cookieHeader,omitempty"`
+	ForwardAuth  bool                   `json:"forwardAuth,omitempty"`
+	BasicAuth    map[string]BasicAuth   `json:"basicAuth,omitempty"`
+	Proxy        string                 `json:"proxy,omitempty"`
+	S3Endpoint   string                 `json:"s3Endpoint,omitempty"`
+	S3Region     string                 `json:"s3Region,omitempty"`
+
+	FileName        string `json:"fileName,omitempty"`
+	HLSVariant      string `json:"hlsVariant,omitempty"`
+	HLSPlaylistOnly bool   `json:"hlsPlaylistOnly,omitempty"`
+	Extract         bool   `json:"extract,omitempty"`
+	DeleteArchive   bool   `json:"deleteArchive,omitempty"`
+
+	OnComplete []string `json:"onComplete,omitempty"`
+	StrictHook bool     `json:"strictHook,omitempty"`
+
+	NotifyEmail string     `json:"notifyEmail,omitempty"`
+	StartAt     *time.Time `json:"startAt,omitempty"`
+	Recurring   string     `json:"recurring,omitempty"`
+	Submission  string     `json:"submission,omitempty"`
+}
+
+type handoffCredential struct {
+	Name       string    `json:"name"`
+	Imported   time.Time `json:"imported"`
+	CookiesTxt string    `json:"cookiesTxt"`
+}
+
+func newHandoffJob(j job) handoffJob {
+	h := handoffJob{
+		ID:                  j.id,
+		URL:                 j.url,
+		OutputDir:           j.outputDir,
+		RequestID:           j.requestID,
+		StallTimeout:        j.opts.stallTimeout,
+		MinSpeed:            j.opts.minSpeed,
+		MinSpeedWindow:      j.opts.minSpeedWindow,
+		Timeout:             j.opts.timeout,
+		MaxAttempts:         j.opts.maxAttempts,
+		SkipUnchanged:       j.opts.skipUnchanged,
+		InsecureTLS:         j.opts.insecureTLS,
+		CookieFile:          j.opts.cookieFile,
+		AlsoLinkTo:          j.opts.alsoLinkTo,
+		Cookies:             j.opts.cookies,
+		Tags:                j.opts.tags,
+		Class:               j.opts.class,
+		HTTPFallback:        j.opts.httpFallback,
+		Mirrors:             j.opts.mirrors,
+		FallbackAfter:       j.opts.fallbackAfter,
+		FallbackMinProgress: j.opts.fallbackMinProgress,
+		FollowLinkNext:      j.opts.followLinkNext,
+		LinkNextParts:       j.opts.linkNextParts,
+		MaxPages:            j.opts.maxPages,
+		HashAlgorithm:       j.opts.hashAlgorithm,
+		Destination:         j.opts.destination,
+		Resume:              j.opts.resume,
+		Fault:               j.opts.fault,
+		Connections:         j.opts.connections,
+		MaxSpeed:            j.opts.maxSpeed,
+		OnConflict:          j.opts.onConflict,
+		PathTemplate:        j.opts.pathTemplate,
+		MaxFileSize:         j.opts.maxFileSize,
+		Checksums:           j.opts.checksums,
+		Headers:             j.opts.headers,
+		CookieHeader:        j.opts.cookieHeader,
+		ForwardAuth:         j.opts.forwardAuth,
+		BasicAuth:           j.opts.basicAuth,
+		Proxy:               j.opts.proxy,
+		S3Endpoint:          j.opts.s3Endpoint,
+		S3Region:            j.opts.s3Region,
+		FileName:            j.opts.fileName,
+		HLSVariant:          j.opts.hlsVariant,
+		HLSPlaylistOnly:     j.opts.hlsPlaylistOnly,
+		Extract:             j.opts.extract,
+		DeleteArchive:       j.opts.deleteArchive,
+		OnComplete:          j.opts.onComplete,
+		StrictHook:          j.opts.strictHook,
+		NotifyEmail:         j.opts.notifyEmail,
+		Recurring:           j.opts.recurring,
+		Submission:          j.opts.submission,
+	}
+	if !j.opts.startAt.IsZero() {
+		h.StartAt = &j.opts.startAt
+	}
+	return h
+}
+
+func (h handoffJob) job() job {
+	if h.ID == "" {
+		h.ID = h.URL
+	}
+	// Queues saved before credentials were kept apart have them in the
+	// URL.
+	if url, auth := takeUserinfo(h.URL); auth != nil {
+		h.URL = url
+		if h.BasicAuth == nil {
+			h.BasicAuth = make(map[string]BasicAuth)
+		}
+		if _, ok := h.BasicAuth[url]; !ok {
+			h.BasicAuth[url] = *auth
+		}
+	}
+	j := job{
+		id:        h.ID,
+		url:       h.URL,
+		outputDir: h.OutputDir,
+		requestID: h.RequestID,
+		opts: downloadOptions{
+			stallTimeout:        h.StallTimeout,
+			minSpeed:            h.MinSpeed,
+			minSpeedWindow:      h.MinSpeedWindow,
+			timeout:             h.Timeout,
+			maxAttempts:         h.MaxAttempts,
+			skipUnchanged:       h.SkipUnchanged,
+			insecureTLS:         h.InsecureTLS,
+			cookieFile:          h.CookieFile,
+			alsoLinkTo:          h.AlsoLinkTo,
+			cookies:             h.Cookies,
+			tags:                h.Tags,
+			class:               h.Class,
+			httpFallback:        h.HTTPFallback,
+			mirrors:             h.Mirrors,
+			fallbackAfter:       h.FallbackAfter,
+			fallbackMinProgress: h.FallbackMinProgress,
+			followLinkNext:      h.FollowLinkNext,
+			linkNextParts:       h.LinkNextParts,
+			maxPages:            h.MaxPages,
+			hashAlgorithm:       h.HashAlgorithm,
+			destination:         h.Destination,
+			resume:              h.Resume,
+			fault:               h.Fault,
+			connections:         h.Connections,
+			maxSpeed:            h.MaxSpeed,
+			onConflict:          h.OnConflict,
+			pathTemplate:        h.PathTemplate,
+			maxFileSize:         h.MaxFileSize,
+			checksums:           h.Checksums,
+			headers:             h.Headers,
+			cookieHeader:        h.CookieHeader,
+			forwardAuth:         h.ForwardAuth,
+			basicAuth:           h.BasicAuth,
+			proxy:               h.Proxy,
+			s3Endpoint:          h.S3Endpoint,
+			s3Region:            h.S3Region,
+			fileName:            h.FileName,
+			hlsVariant:          h.HLSVariant,
+			hlsPlaylistOnly:     h.HLSPlaylistOnly,
+			extract:             h.Extract,
+			deleteArchive:       h.DeleteArchive,
+			onComplete:          h.OnComplete,
+			strictHook:          h.StrictHook,
+			notifyEmail:         h.NotifyEmail,
+			recurring:           h.Recurring,
+			submission:          h.Submission,
+		},
+	}
+	if h.StartAt != nil {
+		j.opts.startAt = *h.StartAt
+	}
+	return j
+}
+
+// pauseForHandoff pauses the transfers still running when a warm
+// restart's drain times out, so the new process can continue them from
+// their partial files. Torrents and paginated downloads can't be paused
+// and are left running. It returns the IDs it paused, for buildHandoff,
+// and for resumeAfterAbort if the restart fails.
+func pauseForHandoff() []string {
+	_, running := pool.pending()
+	var ids []string
+	for _, j := range running {
+		if pausable(j.url, j.opts) != nil {
+			continue
+		}
+		if _, state := pool.cancel(j.id, &pauseRequest{}); state == "running" {
+			ids = append(ids, j.id)
+		}
+	}
+	for _, id := range ids {
+		waitPaused(id, pauseWait)
+	}
+	return ids
+}
+
+// resumeAfterAbort continues, in this process, the transfers
+// pauseForHandoff paused for a restart that didn't happen.
+func resumeAfterAbort(ids []string) {
+	for _, id := range ids {
+		waitPaused(id, pauseWait)
+		resumePaused(id, "warm restart aborted; continuing")
+	}
+}
+
+// buildHandoff captures the engine's state for a warm restart. The
+// transfers pauseForHandoff paused, listed in paused, are handed over
+// to be resumed. Jobs still running are put at the front of the queue
+// and start over in the new process. The returned queued jobs can be
+// re-enqueued if the restart fails.
+func buildHandoff(paused []string) (handoffState, []job) {
+	queued, running := pool.takeQueue()
+
+	state := handoffState{}
+	pausedJobsMu.Lock()
+	resume := make(map[string]job)
+	for _, id := range paused {
+		if j, ok := pausedJobs[id]; ok {
+			resume[id] = j
+		}
+	}
+	pausedJobsMu.Unlock()
+	// A worker that has just paused its job may not have let go of it
+	// yet.
+	running = slices.DeleteFunc(running, func(j job) bool {
+		_, ok := resume[j.id]
+		return ok
+	})
+	for _, j := range running {
+		state.Queue = append(state.Queue, newHandoffJob(j))
+	}
+	for _, j := range queued {
+		state.Queue = append(state.Queue, newHandoffJob(j))
+	}
+	downloadsMutex.Lock()
+	data, _ := json.Marshal(activeDownloads)
+	downloadsMutex.Unlock()
+	// Work on a copy detached from the live map, so later updates in
+	// this process don't race with encoding the state, and the records
+	// of running downloads stay as they are if the restart is aborted
+	// and this process carries on.
+	json.Unmarshal(data, &state.Downloads)
+	for _, j := range running {
+		if download, exists := state.Downloads[j.id]; exists {
+			download.Status = "queued"
+			setProgress(download, 0, -1)
+			download.Events = append(download.Events, DownloadEvent{
+				Time:    time.Now(),
+				Type:    "restarted",
+				Message: "interrupted by a warm restart; starting over",
+			})
+		}
+	}
+	for _, id := range paused {
+		j, ok := resume[id]
+		if !ok {
+			continue
+		}
+		t := handoffTransfer{handoffJob: newHandoffJob(j), PartialPath: partialPath(id)}
+		if info, err := os.Stat(t.PartialPath); err == nil {
+			t.Offset = info.Size()
+		}
+		state.Resume = append(state.Resume, t)
+		if download, exists := state.Downloads[id]; exists {
+			download.Events = append(download.Events, DownloadEvent{
+				Time:    time.Now(),
+				Type:    "restarted",
+				Message: fmt.Sprintf("paused at byte %d by a warm restart; continuing in the new process", t.Offset),
+			})
+		}
+	}
+
+	cookieCredentialsMu.Lock()
+	for _, cred := range cookieCredentials {
+		state.Credentials = append(state.Credentials, handoffCredential{
+			Name:       cred.name,
+			Imported:   cred.imported,
+			CookiesTxt: formatCookiesTxt(cred.cookies),
+		})
+	}
+	cookieCredentialsMu.Unlock()
+
+	outputRootsMu.Lock()
+	state.Roots = append([]outputRoot(nil), outputRoots...)
+	outputRootsMu.Unlock()
+
+	pausedJobsMu.Lock()
+	for _, j := range pausedJobs {
+		if _, ok := resume[j.id]; !ok {
+			state.Paused = append(state.Paused, newHandoffJob(j))
+		}
+	}
+	pausedJobsMu.Unlock()
+	for _, j := range scheduledHandoffJobs() {
+		state.Scheduled = append(state.Scheduled, newHandoffJob(j))
+	}
+	for _, j := range stoppedHandoffJobs() {
+		state.Stopped = append(state.Stopped, newHandoffJob(j))
+	}
+	return state, queued
+}
+
+// writeHandoff saves state to a private temporary file and returns its
+// path.
+func writeHandoff(state handoffState) (string, error) {
+	f, err := os.CreateTemp("", "yad-handoff-*.json")
+	if err != nil {
+		return "", err
+	}
+	if err := json.NewEncoder(f).Encode(state); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// loadHandoff restores the state left by the process this one replaced
+// in a warm restart. It reports false if this is a normal start.
+func loadHandoff() (bool, error) {
+	path := os.Getenv(envHandoffFile)
+	if path == "" {
+		return false, nil
+	}
+	os.Unsetenv(envHandoffFile)
+	defer os.Remove(path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read handoff state: %v", err)
+	}
+	var state handoffState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return false, fmt.Errorf("failed to parse handoff state: %v", err)
+	}
+
+	for _, c := range state.Credentials {
+		cookies, err := parseCookiesTxt(strings.NewReader(c.CookiesTxt))
+		if err != nil {
+			return false, fmt.Errorf("failed to restore credential %q: %v", c.Name, err)
+		}
+		cookieCredentials[c.Name] = &cookieCredential{name: c.Name, cookies: cookies, imported: c.Imported}
+	}
+	if len(state.Roots) > 0 {
+		outputRoots = state.Roots
+	}
+	for key, download := range state.Downloads {
+		if download.ID == "" {
+			// Handed over by a version that keyed downloads by URL
+			download.ID = key
+		}
+		activeDownloads[key] = download
+	}
+	jobs := make([]job, len(state.Queue))
+	for i, h := range state.Queue {
+		jobs[i] = h.job()
+	}
+	pool.enqueue(jobs...)
+	for _, h := range state.Paused {
+		j := h.job()
+		pausedJobs[j.id] = j
+	}
+	for _, h := range state.Scheduled {
+		j := h.job()
+		scheduledJobs[j.id] = scheduledJob{job: j}
+	}
+	for _, h := range state.Stopped {
+		j := h.job()
+		stoppedJobs[j.id] = j
+	}
+	for _, t := range state.Resume {
+		j := t.job()
+		pausedJobs[j.id] = j
+		if t.PartialPath != "" {
+			setPartialPath(j.id, t.PartialPath)
+		}
+		handedOffTransfers = append(handedOffTransfers, j.id)
+	}
+	return true, nil
+}
+
+// handedOffTransfers are the transfers the previous process paused for
+// a warm restart, for resumeHandedOff.
+var handedOffTransfers []string
+
+// resumeHandedOff continues the transfers the previous process paused.
+// It must run once that process has exited, so nothing else is writing
+// their partial files.
+func resumeHandedOff() {
+	for _, id := range handedOffTransfers {
+		resumePaused(id, "continuing after a warm restart")
+	}
+	handedOffTransfers = nil
+}
+
+// formatCookiesTxt writes cookies back out in Netscape format.
+func formatCookiesTxt(cookies []netscapeCookie) string {
+	var b strings.Builder
+	for _, c := range cookies {
+		if c.httpOnly {
+			b.WriteString("#HttpOnly_")
+		}
+		var expires int64
+		if !c.expires.IsZero() {
+			expires = c.expires.Unix()
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			c.domain, boolField(c.includeSubdomains), c.path, boolField(c.secure), expires, c.name, c.value)
+	}
+	return b.String()
+}
+
+func boolField(v bool) string {
+	if v {
+		return "TRUE"
+	}
+	return "FALSE"
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+// Warm restarts rely on SIGUSR2 and passing file descriptors to a child
+// process, so they are only available on Unix.
+
+func inheritedListener() (net.Listener, error) { return nil, nil }
+
+func signalReady() {}
+
+func waitForPreviousProcess() {}
+
+func watchRestartSignal(srv *http.Server, ln net.Listener) {}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestBuildHandoffLeavesLiveRecords checks that a warm restart only
+// rewrites running downloads in the state it hands over, so an aborted
+// restart leaves this process's records as they were.
+func TestBuildHandoffLeavesLiveRecords(t *testing.T) {
+	const id = "handoff-running"
+	j := job{id: id, url: "https://example.com/big.iso", outputDir: t.TempDir()}
+	downloadsMutex.Lock()
+	download := &DownloadStatus{ID: id, URL: j.url, Status: "downloading"}
+	setProgress(download, 500, 1000)
+	activeDownloads[id] = download
+	downloadsMutex.Unlock()
+	pool.mu.Lock()
+	pool.workers[99] = &workerInfo{ID: 99, current: &j}
+	pool.mu.Unlock()
+	t.Cleanup(func() {
+		pool.mu.Lock()
+		delete(pool.workers, 99)
+		pool.mu.Unlock()
+		downloadsMutex.Lock()
+		delete(activeDownloads, id)
+		downloadsMutex.Unlock()
+	})
+
+	state, _ := buildHandoff(nil)
+
+	downloadsMutex.Lock()
+	status, downloaded := download.Status, download.BytesDownloaded
+	downloadsMutex.Unlock()
+	if status != "downloading" || downloaded != 500 {
+		t.Errorf("live record = %s at %d bytes; want it untouched", status, downloaded)
+	}
+	handed := state.Downloads[id]
+	if handed == nil || handed.Status != "queued" || handed.BytesDownloaded != 0 {
+		t.Errorf("handed-over record = %+v; want queued from 0 bytes", handed)
+	}
+	if len(state.Queue) == 0 || state.Queue[0].ID != id {
+		t.Errorf("handed-over queue = %+v; want %s first", state.Queue, id)
+	}
+}
+
+// TestWarmRestartResumesRunningTransfer pauses a transfer the drain
+// timed out on, hands it over, and checks that the "new process"
+// continues it from the partial file with a Range request.
+func TestWarmRestartResumesRunningTransfer(t *testing.T) {
+	const size, chunk = 4 << 20, 64 << 10
+	body := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+	var rangeStart atomic.Int64
+	rangeStart.Store(-1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := 0
+		if v, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+			start, _ = strconv.Atoi(strings.TrimSuffix(v, "-"))
+			rangeStart.Store(int64(start))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, size-1, size))
+		}
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", fmt.Sprint(size-start))
+		if start > 0 {
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		for sent := start; sent < size; sent += chunk {
+			if _, err := w.Write(body[sent:min(sent+chunk, size)]); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			if start == 0 {
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	const id = "handoff-resume"
+	dir := t.TempDir()
+	j := job{id: id, url: srv.URL + "/big.bin", outputDir: dir}
+	trackDownload(t, id, j.url, dir)
+	t.Cleanup(func() { pool.setWorkers(0); pool.waitIdle(5 * time.Second) })
+	pool.setWorkers(1)
+	pool.enqueue(j)
+	waitFor(t, func(d *DownloadStatus) bool { return d.BytesDownloaded > chunk }, id)
+
+	// The old process: the drain has timed out.
+	pool.setWorkers(0)
+	paused := pauseForHandoff()
+	if len(paused) != 1 || paused[0] != id {
+		t.Fatalf("paused %v; want [%s]", paused, id)
+	}
+	state, _ := buildHandoff(paused)
+	if len(state.Resume) != 1 || state.Resume[0].ID != id || state.Resume[0].Offset == 0 || state.Resume[0].PartialPath == "" {
+		t.Fatalf("handed-over transfers = %+v; want %s with its partial file", state.Resume, id)
+	}
+	if len(state.Queue) != 0 || len(state.Paused) != 0 {
+		t.Errorf("%s also handed over as queued %v or paused %v", id, state.Queue, state.Paused)
+	}
+	if d := state.Downloads[id]; d == nil || d.Status != "paused" {
+		t.Errorf("handed-over record = %+v; want paused", d)
+	}
+	pool.waitIdle(5 * time.Second)
+
+	// The new process starts from the handed-over state alone.
+	takePausedJob(id)
+	takePartialPath(id)
+	path, err := writeHandoff(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envHandoffFile, path)
+	if ok, err := loadHandoff(); !ok || err != nil {
+		t.Fatalf("loadHandoff() = %v, %v", ok, err)
+	}
+	resumeHandedOff()
+	pool.setWorkers(1)
+	waitFor(t, func(d *DownloadStatus) bool { return d.Completed }, id)
+
+	downloadsMutex.Lock()
+	status, resumedFrom := activeDownloads[id].Status, activeDownloads[id].ResumedFrom
+	downloadsMutex.Unlock()
+	if status != "completed" || resumedFrom == 0 || rangeStart.Load() != resumedFrom {
+		t.Errorf("status %s, resumed from %d, server saw range from %d; want completed from the partial file", status, resumedFrom, rangeStart.Load())
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "big.bin"))
+	if err != nil || !bytes.Equal(got, body) {
+		t.Errorf("file is %d bytes, %v; want the %d byte body", len(got), err, size)
+	}
+}
+
+// waitFor polls download id until cond holds, failing the test after 10
+// seconds.
+func waitFor(t *testing.T, cond func(*DownloadStatus) bool, id string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		downloadsMutex.Lock()
+		d, ok := activeDownloads[id]
+		done := ok && cond(d)
+		downloadsMutex.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("download %s never reached the expected state", id)
+}
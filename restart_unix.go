@@ -0,0 +1,178 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// File descriptors passed to the new process in a warm restart.
+const (
+	envListenFD    = "YAD_LISTEN_FD"
+	envReadyFD     = "YAD_READY_FD"
+	envPreviousPID = "YAD_PREVIOUS_PID"
+)
+
+// inheritedListener returns the listening socket handed down by a warm
+// restart, or nil on a normal start.
+func inheritedListener() (net.Listener, error) {
+	fd, err := inheritedFD(envListenFD)
+	if fd == nil || err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return net.FileListener(fd)
+}
+
+// signalReady tells the process being replaced that this one has loaded
+// the handed-off state and is about to serve.
+func signalReady() {
+	fd, err := inheritedFD(envReadyFD)
+	if fd == nil || err != nil {
+		return
+	}
+	fd.Write([]byte{1})
+	fd.Close()
+}
+
+func inheritedFD(env string) (*os.File, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(env)
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", env, value)
+	}
+	return os.NewFile(uintptr(n), env), nil
+}
+
+// waitForPreviousProcess blocks until the process that started this one
+// in a warm restart has exited, so downloads it was still running are
+// not written to by both.
+func waitForPreviousProcess() {
+	previous, err := strconv.Atoi(os.Getenv(envPreviousPID))
+	if err != nil {
+		return
+	}
+	os.Unsetenv(envPreviousPID)
+	for os.Getppid() == previous {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// watchRestartSignal performs a warm restart each time SIGUSR2 arrives.
+func watchRestartSignal(srv *http.Server, ln net.Listener) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+	for range sigs {
+		if err := warmRestart(srv, ln); err != nil {
+			log.Printf("Warm restart failed, carrying on: %v", err)
+		}
+	}
+}
+
+// warmRestart drains the worker pool, starts the binary at os.Args[0]
+// with the listening socket and the engine's state, and exits once the
+// new process is ready to serve. The API stays up throughout: this
+// process serves until the new one is ready, and connections arriving
+// in between wait in the shared socket's backlog.
+func warmRestart(srv *http.Server, ln net.Listener) error {
+	tcp, ok := ln.(*net.TCPListener)
+	if !ok {
+		return errors.New("listener is not a TCP socket")
+	}
+	binary, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+
+	target, _ := pool.snapshot()
+	log.Printf("Warm restart: waiting up to %s for active downloads to finish", *restartDrainTimeout)
+	profiles.hold(true)
+	pool.setWorkers(0)
+	var paused []string
+	if !pool.waitIdle(*restartDrainTimeout) {
+		log.Printf("Warm restart: drain timed out; pausing unfinished downloads for the new process to continue")
+		paused = pauseForHandoff()
+	}
+
+	// The new process saves the queue from here on.
+	queueSavingHeld.Store(true)
+	state, queued := buildHandoff(paused)
+	// If anything below fails, this process carries on as before.
+	abort := func(err error) error {
+		pool.enqueue(queued...)
+		resumeAfterAbort(paused)
+		pool.setWorkers(target)
+		profiles.hold(false)
+		queueSavingHeld.Store(false)
+		return err
+	}
+
+	handoffFile, err := writeHandoff(state)
+	if err != nil {
+		return abort(fmt.Errorf("failed to write handoff state: %v", err))
+	}
+	lnFile, err := tcp.File()
+	if err != nil {
+		os.Remove(handoffFile)
+		return abort(err)
+	}
+	defer lnFile.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		os.Remove(handoffFile)
+		return abort(err)
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(binary, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{lnFile, readyW}
+	cmd.Env = append(os.Environ(), envListenFD+"=3", envReadyFD+"=4", envHandoffFile+"="+handoffFile,
+		envPreviousPID+"="+strconv.Itoa(os.Getpid()))
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		os.Remove(handoffFile)
+		return abort(err)
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(30 * time.Second):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.Remove(handoffFile)
+		return abort(fmt.Errorf("new process did not become ready: %v", err))
+	}
+
+	log.Printf("Warm restart: process %d is serving; shutting down", cmd.Process.Pid)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+	os.Exit(0)
+	return nil
+}
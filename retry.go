@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+var (
+	// stoppedJobs keeps the jobs of failed and cancelled downloads so a
+	// retry runs with the options they were submitted with.
+	stoppedJobs   = make(map[string]job)
+	stoppedJobsMu sync.Mutex
+)
+
+func rememberStopped(j job) {
+	j.ctx, j.cancel = nil, nil
+	j.opts.preflight = nil
+	stoppedJobsMu.Lock()
+	stoppedJobs[j.id] = j
+	stoppedJobsMu.Unlock()
+}
+
+// takeStoppedJob returns the job download id last ran as. There is none
+// for a download handed over by a warm restart from a version that
+// didn't keep them, or one whose record was restored otherwise; running
+// it without the headers, credentials, checksums and limits it was
+// submitted with would be wrong, so it can't be retried.
+func takeStoppedJob(id string) (job, bool) {
+	stoppedJobsMu.Lock()
+	defer stoppedJobsMu.Unlock()
+	j, ok := stoppedJobs[id]
+	delete(stoppedJobs, id)
+	return j, ok
+}
+
+// stoppedHandoffJobs returns the jobs kept for a retry, for a warm
+// restart.
+func stoppedHandoffJobs() []job {
+	stoppedJobsMu.Lock()
+	defer stoppedJobsMu.Unlock()
+	jobs := make([]job, 0, len(stoppedJobs))
+	for _, j := range stoppedJobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].id < jobs[k].id })
+	return jobs
+}
+
+// resetForRetry clears what the previous attempt left on a failed or
+// cancelled download's record and puts it back in the queued state. It
+// reports false if the download is in any other state, so concurrent
+// retries queue it only once.
+func resetForRetry(id string) bool {
+	downloadsMutex.Lock()
+	defer downloadsMutex.Unlock()
+	download, exists := activeDownloads[id]
+	if !exists || (download.Status != "failed" && download.Status != "cancelled") {
+		return false
+	}
+	download.Status = "queued"
+	download.Completed = false
+	download.Error = ""
+	download.ErrorCode = ""
+	download.Warning = ""
+	download.BlockedHost = ""
+	download.ResumedFrom = 0
+	download.Upload = ""
+	download.Checksum = ""
+	download.Checksums = nil
+	download.FinalURL = ""
+	download.Redirects = nil
+	download.ServedBy = ""
+	download.Attempt, download.MaxAttempts, download.RetryAt = 0, 0, nil
+	clearSpeed(download)
+	setProgress(download, 0, -1)
+	download.StartedAt = nil
+	download.notified = false
+	return true
+}
+
+// handleRetryDownload queues the failed or cancelled download {id}, or
+// every such download matching ?url= or ?tag=, again under the same ID.
+// HTTP downloads continue from their partial file.
+func handleRetryDownload(w http.ResponseWriter, r *http.Request) {
+	targets, ok := downloadTargets(w, r, func(d *DownloadStatus) bool {
+		return d.Status == "failed" || d.Status == "cancelled"
+	})
+	if !ok {
+		return
+	}
+
+	retried := make([]string, 0, len(targets))
+	for _, target := range targets {
+		if !resetForRetry(target) {
+			continue
+		}
+		j, ok := takeStoppedJob(target)
+		if !ok {
+			failDownload(target, "", "nothing to retry: the options the download was submitted with are gone; submit it again")
+			continue
+		}
+		j.opts.resume = pausable(j.url, j.opts) == nil
+		addDownloadEvent(target, "retried", "download queued again")
+		pool.enqueue(j)
+		retried = append(retried, target)
+	}
+	logf(r.Context(), "Retried %d downloads", len(retried))
+	broadcastStatus()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"retried": retried})
+}
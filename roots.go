@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var allowedRootsFlag = flag.String("allowed-roots", "", "comma-separated directories, besides ./downloads, that outputDir may point into")
+
+// outputRoot is a directory downloads may be saved under. outputDir must
+// resolve to the root itself or a directory inside it.
+type outputRoot struct {
+	Path    string `json:"path"`
+	Default bool   `json:"default"`
+}
+
+var errUnknownRoot = errors.New("not an allowed root")
+
+var (
+	outputRoots   []outputRoot
+	outputRootsMu sync.Mutex
+)
+
+// initOutputRoots sets up the download folder as the default root plus
+// any -allowed-roots. It must run after flag.Parse.
+func initOutputRoots() error {
+	root, err := filepath.Abs(downloadFolder)
+	if err != nil {
+		return err
+	}
+	outputRoots = []outputRoot{{Path: root, Default: true}}
+	for _, dir := range strings.Split(*allowedRootsFlag, ",") {
+		if strings.TrimSpace(dir) == "" {
+			continue
+		}
+		if _, err := addOutputRoot(strings.TrimSpace(dir), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addOutputRoot creates dir if needed and adds it to the allowed roots,
+// optionally making it the default.
+func addOutputRoot(dir string, makeDefault bool) (outputRoot, error) {
+	path, err := filepath.Abs(dir)
+	if err != nil {
+		return outputRoot{}, err
+	}
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		return outputRoot{}, fmt.Errorf("failed to create root: %v", err)
+	}
+
+	outputRootsMu.Lock()
+	defer outputRootsMu.Unlock()
+	index := -1
+	for i, root := range outputRoots {
+		if root.Path == path {
+			index = i
+		}
+	}
+	if index < 0 {
+		outputRoots = append(outputRoots, outputRoot{Path: path})
+		index = len(outputRoots) - 1
+	}
+	if makeDefault {
+		for i := range outputRoots {
+			outputRoots[i].Default = i == index
+		}
+	}
+	return outputRoots[index], nil
+}
+
+// removeOutputRoot removes dir from the allowed roots. The default root
+// and roots that unfinished downloads are saving into can't be removed.
+func removeOutputRoot(dir string) error {
+	path, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	outputRootsMu.Lock()
+	defer outputRootsMu.Unlock()
+	index := -1
+	for i, root := range outputRoots {
+		if root.Path == path {
+			index = i
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("%s is %w", path, errUnknownRoot)
+	}
+	if outputRoots[index].Default {
+		return fmt.Errorf("%s is the default root; make another root the default first", path)
+	}
+
+	downloadsMutex.Lock()
+	active := 0
+	for _, download := range activeDownloads {
+		if !download.Completed && withinDir(path, download.OutputDir) {
+			active++
+		}
+	}
+	downloadsMutex.Unlock()
+	if active > 0 {
+		return fmt.Errorf("%d active downloads are saving into %s", active, path)
+	}
+
+	outputRoots = append(outputRoots[:index], outputRoots[index+1:]...)
+	return nil
+}
+
+// resolveOutputDir turns a requested outputDir into an absolute path
+// inside one of the allowed roots. Empty and relative paths are taken
+// relative to the default root.
+func resolveOutputDir(dir string) (string, bool) {
+	outputRootsMu.Lock()
+	defer outputRootsMu.Unlock()
+
+	if !filepath.IsAbs(dir) {
+		for _, root := range outputRoots {
+			if root.Default {
+				dir = filepath.Join(root.Path, dir)
+			}
+		}
+	}
+	dir = filepath.Clean(dir)
+	for _, root := range outputRoots {
+		if withinDir(root.Path, dir) {
+			return dir, true
+		}
+	}
+	return dir, false
+}
+
+func allowedRootPaths() []string {
+	outputRootsMu.Lock()
+	defer outputRootsMu.Unlock()
+	paths := make([]string, len(outputRoots))
+	for i, root := range outputRoots {
+		paths[i] = root.Path
+	}
+	return paths
+}
+
+// withinDir reports whether path is dir or inside it. Both must be
+// absolute and clean.
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// handleGetRoots lists the allowed output roots with their free space.
+func handleGetRoots(w http.ResponseWriter, r *http.Request) {
+	outputRootsMu.Lock()
+	roots := append([]outputRoot(nil), outputRoots...)
+	outputRootsMu.Unlock()
+
+	type rootInfo struct {
+		outputRoot
+		FreeBytes *uint64 `json:"freeBytes,omitempty"`
+	}
+	list := make([]rootInfo, len(roots))
+	for i, root := range roots {
+		list[i].outputRoot = root
+		if free, err := diskFree(root.Path); err == nil {
+			list[i].FreeBytes = &free
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func handleAddRoot(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path    string `json:"path"`
+		Default bool   `json:"default"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Path == "" {
+		httpError(w, r, "A root path is required", http.StatusBadRequest)
+		return
+	}
+
+	root, err := addOutputRoot(req.Path, req.Default)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logf(r.Context(), "Allowed output root %s (default: %v)", root.Path, root.Default)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(root)
+}
+
+func handleRemoveRoot(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		httpError(w, r, "A root path is required", http.StatusBadRequest)
+		return
+	}
+	if err := removeOutputRoot(path); err != nil {
+		code := http.StatusConflict
+		if errors.Is(err, errUnknownRoot) {
+			code = http.StatusNotFound
+		}
+		httpError(w, r, err.Error(), code)
+		return
+	}
+	logf(r.Context(), "Removed output root %s", path)
+	w.WriteHeader(http.StatusNoContent)
+}
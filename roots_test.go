@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withOutputRoot makes a fresh temporary directory the only, default
+// output root for the rest of the test.
+func withOutputRoot(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	outputRootsMu.Lock()
+	saved := outputRoots
+	outputRoots = []outputRoot{{Path: root, Default: true}}
+	outputRootsMu.Unlock()
+	t.Cleanup(func() {
+		outputRootsMu.Lock()
+		outputRoots = saved
+		outputRootsMu.Unlock()
+	})
+	return root
+}
+
+func TestAlsoLinkToConfinedToRoots(t *testing.T) {
+	root := withOutputRoot(t)
+	outside := t.TempDir()
+
+	tests := []struct {
+		name    string
+		linkTo  string
+		dryRun  bool
+		allowed bool
+	}{
+		{name: "absolute outside", linkTo: filepath.Join(outside, "evil"), allowed: false},
+		{name: "absolute outside, dry run", linkTo: filepath.Join(outside, "evil"), dryRun: true, allowed: false},
+		{name: "relative escape", linkTo: "../evil", allowed: false},
+		{name: "relative", linkTo: "mirror", dryRun: true, allowed: true},
+		{name: "absolute inside", linkTo: filepath.Join(root, "mirror"), dryRun: true, allowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(DownloadRequest{
+				URLs:       []string{"https://example.com/file.iso"},
+				AlsoLinkTo: []string{tt.linkTo},
+				DryRun:     tt.dryRun,
+			})
+			rec := httptest.NewRecorder()
+			handleDownloadRequest(rec, httptest.NewRequest(http.MethodPost, "/api/v1/download", strings.NewReader(string(body))))
+
+			if !tt.allowed {
+				var resp struct {
+					Code         string   `json:"code"`
+					AllowedRoots []string `json:"allowedRoots"`
+				}
+				json.NewDecoder(rec.Body).Decode(&resp)
+				if rec.Code != http.StatusBadRequest || resp.Code != "output_dir_not_allowed" || len(resp.AllowedRoots) != 1 || resp.AllowedRoots[0] != root {
+					t.Errorf("got %d, code %q, roots %v; want 400 output_dir_not_allowed with %s", rec.Code, resp.Code, resp.AllowedRoots, root)
+				}
+				if _, err := os.Stat(filepath.Join(outside, "evil")); !os.IsNotExist(err) {
+					t.Errorf("directory outside the roots was created: %v", err)
+				}
+				if _, err := os.Stat(filepath.Join(filepath.Dir(root), "evil")); !os.IsNotExist(err) {
+					t.Errorf("directory outside the roots was created: %v", err)
+				}
+				return
+			}
+			if rec.Code != http.StatusOK {
+				t.Errorf("got %d: %s; want 200", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestLinkIntoTargetsConfinedToRoots(t *testing.T) {
+	root := withOutputRoot(t)
+	saved := filepath.Join(root, "file.iso")
+	if err := os.WriteFile(saved, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	inside := filepath.Join(root, "mirror")
+	outside := t.TempDir()
+	os.Mkdir(inside, 0o755)
+	trackDownload(t, "linkroots", "https://example.com/file.iso", root)
+
+	// A relative target would be resolved against the working directory.
+	linkIntoTargets("linkroots", saved, []string{inside, outside, "mirror"})
+
+	downloadsMutex.Lock()
+	links := activeDownloads["linkroots"].Links
+	downloadsMutex.Unlock()
+	if len(links) != 3 || links[0].Error != "" || links[1].Error == "" || links[2].Error == "" {
+		t.Fatalf("links = %+v; want only %s linked", links, inside)
+	}
+	if _, err := os.Stat(filepath.Join(inside, "file.iso")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "file.iso")); !os.IsNotExist(err) {
+		t.Errorf("file linked outside the roots: %v", err)
+	}
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// s3PartSize is how much of a download is buffered before it is
+	// uploaded as one part. S3 needs every part but the last to be at
+	// least 5 MiB.
+	s3PartSize = 8 << 20
+
+	s3AbortTimeout = 30 * time.Second
+)
+
+var (
+	s3Endpoint = flag.String("s3-endpoint", "", `S3-compatible endpoint for s3:// URLs and destinations, e.g. "http://minio:9000" (default AWS)`)
+	s3Region   = flag.String("s3-region", "", "region for s3:// URLs and destinations (default $AWS_REGION, then us-east-1)")
+)
+
+// s3Client is used for destination uploads. They aren't downloads, so the
+// host policy doesn't apply to them.
+var s3Client = &http.Client{Transport: httpTransport}
+
+// s3Credentials are read from the usual AWS environment variables, or
+// else from the shared credentials file.
+type s3Credentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// loadS3Credentials returns the credentials in AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY or, without them, those of the AWS_PROFILE
+// profile ("default" if unset) in AWS_SHARED_CREDENTIALS_FILE or
+// ~/.aws/credentials. It fails if neither has any.
+func loadS3Credentials() (s3Credentials, error) {
+	creds := s3Credentials{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.accessKey != "" && creds.secretKey != "" {
+		return creds, nil
+	}
+	creds, err := s3CredentialsFromFile()
+	if err != nil {
+		return creds, err
+	}
+	if creds.accessKey == "" || creds.secretKey == "" {
+		return creds, fmt.Errorf("set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or add them to the shared credentials file")
+	}
+	return creds, nil
+}
+
+// s3CredentialsFromFile reads the AWS_PROFILE profile of the shared
+// credentials file. A missing file has no credentials in it.
+func s3CredentialsFromFile() (s3Credentials, error) {
+	var creds s3Credentials
+	file := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return creds, nil
+		}
+		file = filepath.Join(home, ".aws", "credentials")
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return creds, nil
+	}
+	if err != nil {
+		return creds, fmt.Errorf("failed to read S3 credentials: %v", err)
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	section := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "aws_access_key_id":
+			creds.accessKey = value
+		case "aws_secret_access_key":
+			creds.secretKey = value
+		case "aws_session_token":
+			creds.sessionToken = value
+		}
+	}
+	return creds, nil
+}
+
+// s3RegionName is the region requests are signed for when the request
+// doesn't name one.
+func s3RegionName() string {
+	if *s3Region != "" {
+		return *s3Region
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return "us-east-1"
+}
+
+// s3Backend uploads objects under a bucket and key prefix.
+type s3Backend struct {
+	bucket   string
+	prefix   string
+	region   string
+	endpoint string // "" for AWS
+	creds    s3Credentials
+}
+
+func newS3Backend(destination string) (*s3Backend, error) {
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(destination, "s3://"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("destination %q has no bucket", destination)
+	}
+	creds, err := loadS3Credentials()
+	if err != nil {
+		return nil, fmt.Errorf("s3 destinations need credentials: %v", err)
+	}
+	return &s3Backend{bucket: bucket, prefix: prefix, region: s3RegionName(), endpoint: *s3Endpoint, creds: creds}, nil
+}
+
+// CreatePart continues the multipart upload a previous attempt left
+// behind when resuming, and otherwise discards it.
+func (b *s3Backend) CreatePart(ctx context.Context, name string, resume bool) (storagePart, error) {
+	p := &s3Part{backend: b, ctx: ctx, id: downloadKeyFrom(ctx), key: path.Join(b.prefix, name)}
+	if state, ok := loadUploadState(p.id); ok {
+		if resume && state.Bucket == b.bucket && state.Key == p.key {
+			p.uploadID, p.parts = state.UploadID, state.Parts
+		} else {
+			discardUpload(p.id)
+		}
+	}
+	if p.Offset() > 0 {
+		setUploadStatus(p.id, "uploading (resumed)")
+		addDownloadEvent(p.id, "upload_resume", fmt.Sprintf("continuing the upload of %s after %d parts (%d bytes)", p.key, len(p.parts), p.Offset()))
+	} else {
+		setUploadStatus(p.id, "uploading")
+	}
+	return p, nil
+}
+
+// objectURL addresses key, path-style on a custom endpoint and
+// virtual-hosted on AWS.
+func (b *s3Backend) objectURL(key string, query url.Values) (*url.URL, error) {
+	var u *url.URL
+	if b.endpoint != "" {
+		endpoint, err := url.Parse(b.endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3 endpoint: %v", err)
+		}
+		u = &url.URL{Scheme: endpoint.Scheme, Host: endpoint.Host, Path: "/" + b.bucket + "/" + key}
+	} else {
+		u = &url.URL{Scheme: "https", Host: fmt.Sprintf("%s.s3.%s.amazonaws.com", b.bucket, b.region), Path: "/" + key}
+	}
+	u.RawPath = s3Escape(u.Path, true)
+	u.RawQuery = s3CanonicalQuery(query)
+	return u, nil
+}
+
+// do sends a signed request and returns the response body, failing on
+// anything but a 2xx.
+func (b *s3Backend) do(ctx context.Context, method, key string, query url.Values, body []byte) (http.Header, []byte, error) {
+	u, err := b.objectURL(key, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.URL = u
+	req.ContentLength = int64(len(body))
+	if len(body) > 0 {
+		// S3 rejects a body that arrives damaged.
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	signS3Request(req, body, b.creds, b.region, time.Now())
+
+	resp, err := s3Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		var s3Err struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		if xml.Unmarshal(respBody, &s3Err) == nil && s3Err.Code != "" {
+			return nil, nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, s3Err.Code, s3Err.Message)
+		}
+		return nil, nil, fmt.Errorf("s3 %s %s: %s", method, key, resp.Status)
+	}
+	return resp.Header, respBody, nil
+}
+
+// s3Part buffers writes and uploads them as parts of a multipart upload,
+// which stays invisible until it is completed. An object that fits in a
+// single part is uploaded with one PUT on Commit instead. The upload's
+// progress is saved after every part so a later attempt can continue it.
+type s3Part struct {
+	backend  *s3Backend
+	ctx      context.Context
+	id       string // download ID
+	key      string
+	buf      []byte
+	uploadID string
+	parts    []s3UploadedPart
+	done     bool
+}
+
+// Offset is how much of the object earlier attempts already uploaded.
+func (p *s3Part) Offset() int64 {
+	var n int64
+	for _, part := range p.parts {
+		n += part.Size
+	}
+	return n
+}
+
+func (p *s3Part) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for len(p.buf) >= s3PartSize {
+		if err := p.flush(p.buf[:s3PartSize]); err != nil {
+			return 0, err
+		}
+		p.buf = append(p.buf[:0], p.buf[s3PartSize:]...)
+	}
+	return len(b), nil
+}
+
+func (p *s3Part) flush(data []byte) error {
+	if p.uploadID == "" {
+		_, body, err := p.backend.do(p.ctx, http.MethodPost, p.key, url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := xml.Unmarshal(body, &result); err != nil || result.UploadID == "" {
+			return fmt.Errorf("s3 returned no upload ID for %s", p.key)
+		}
+		p.uploadID = result.UploadID
+		p.saveState()
+	}
+	query := url.Values{
+		"partNumber": {fmt.Sprint(len(p.parts) + 1)},
+		"uploadId":   {p.uploadID},
+	}
+	header, _, err := p.backend.do(p.ctx, http.MethodPut, p.key, query, data)
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(data)
+	p.parts = append(p.parts, s3UploadedPart{ETag: header.Get("ETag"), Size: int64(len(data)), MD5: hex.EncodeToString(sum[:])})
+	p.saveState()
+	return nil
+}
+
+func (p *s3Part) saveState() {
+	state := s3UploadState{Bucket: p.backend.bucket, Key: p.key, UploadID: p.uploadID, Parts: p.parts}
+	if err := saveUploadState(p.id, state); err != nil {
+		log.Printf("Failed to save the upload state of %s: %v", p.key, err)
+	}
+}
+
+func (p *s3Part) Reset() error {
+	p.buf = p.buf[:0]
+	setUploadStatus(p.id, "uploading")
+	return p.abortUpload()
+}
+
+func (p *s3Part) Commit() (string, error) {
+	location := fmt.Sprintf("s3://%s/%s", p.backend.bucket, p.key)
+	if p.uploadID == "" {
+		if _, _, err := p.backend.do(p.ctx, http.MethodPut, p.key, nil, p.buf); err != nil {
+			return "", err
+		}
+		p.done = true
+		sum := md5.Sum(p.buf)
+		return location, p.verify(int64(len(p.buf)), hex.EncodeToString(sum[:]))
+	}
+
+	if len(p.buf) > 0 {
+		if err := p.flush(p.buf); err != nil {
+			return "", err
+		}
+	}
+	var complete bytes.Buffer
+	complete.WriteString("<CompleteMultipartUpload>")
+	for i, part := range p.parts {
+		fmt.Fprintf(&complete, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, xmlEscape(part.ETag))
+	}
+	complete.WriteString("</CompleteMultipartUpload>")
+	_, body, err := p.backend.do(p.ctx, http.MethodPost, p.key, url.Values{"uploadId": {p.uploadID}}, complete.Bytes())
+	if err != nil {
+		return "", err
+	}
+	// Completion can fail after a 200, with the error in the body.
+	if bytes.Contains(body, []byte("<Error>")) {
+		return "", fmt.Errorf("s3 failed to complete upload of %s: %s", p.key, body)
+	}
+	p.done = true
+	removeUploadState(p.id)
+
+	// A multipart object's ETag is the MD5 of its parts' MD5s.
+	digests := md5.New()
+	for _, part := range p.parts {
+		sum, _ := hex.DecodeString(part.MD5)
+		digests.Write(sum)
+	}
+	return location, p.verify(p.Offset(), fmt.Sprintf("%x-%d", digests.Sum(nil), len(p.parts)))
+}
+
+// verify checks that the stored object has the size and, unless it is
+// KMS-encrypted (which makes the ETag opaque), the ETag it should.
+func (p *s3Part) verify(size int64, etag string) error {
+	setUploadStatus(p.id, "verifying")
+	ctx, cancel := context.WithTimeout(context.Background(), s3AbortTimeout)
+	defer cancel()
+	header, _, err := p.backend.do(ctx, http.MethodHead, p.key, nil, nil)
+	if err != nil {
+		return &downloadError{code: "upload_unverified", err: fmt.Errorf("failed to verify the upload: %v", err)}
+	}
+	if got := header.Get("Content-Length"); got != fmt.Sprint(size) {
+		return &downloadError{code: "upload_mismatch", err: fmt.Errorf("uploaded object is %s bytes, expected %d", got, size)}
+	}
+	got := strings.Trim(header.Get("ETag"), `"`)
+	if header.Get("X-Amz-Server-Side-Encryption") != "aws:kms" && got != "" && got != etag {
+		return &downloadError{code: "upload_mismatch", err: fmt.Errorf("uploaded object has ETag %s, expected %s", got, etag)}
+	}
+	setUploadStatus(p.id, "verified")
+	addDownloadEvent(p.id, "upload_verified", fmt.Sprintf("s3://%s/%s has the expected size and ETag", p.backend.bucket, p.key))
+	return nil
+}
+
+// Abort keeps what was uploaded so a resume, retry or reupload can
+// continue from it, unless the download was cancelled.
+func (p *s3Part) Abort() error {
+	if p.done {
+		return nil
+	}
+	p.buf = nil
+	var cancelled *cancelRequest
+	if errors.As(context.Cause(p.ctx), &cancelled) || p.uploadID == "" {
+		return p.abortUpload()
+	}
+	addDownloadEvent(p.id, "upload_kept", fmt.Sprintf("kept %d uploaded parts (%d bytes) to continue from", len(p.parts), p.Offset()))
+	return nil
+}
+
+// abortUpload discards the uploaded parts. It runs on a fresh context
+// since the download's own is usually cancelled by then.
+func (p *s3Part) abortUpload() error {
+	if p.uploadID == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3AbortTimeout)
+	defer cancel()
+	_, _, err := p.backend.do(ctx, http.MethodDelete, p.key, url.Values{"uploadId": {p.uploadID}}, nil)
+	p.uploadID, p.parts = "", nil
+	removeUploadState(p.id)
+	return err
+}
+
+// s3UploadState is what is kept of an unfinished multipart upload in
+// <data-dir>/uploads, so a paused, failed or interrupted download
+// continues it instead of uploading everything again.
+type s3UploadState struct {
+	Bucket   string           `json:"bucket"`
+	Key      string           `json:"key"`
+	UploadID string           `json:"uploadId"`
+	Parts    []s3UploadedPart `json:"parts"`
+}
+
+type s3UploadedPart struct {
+	ETag string `json:"etag"`
+	Size int64  `json:"size"`
+	MD5  string `json:"md5"`
+}
+
+// uploadStatePath names the state file after a hash of the download ID,
+// which may be a URL.
+func uploadStatePath(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(*dataDir, "uploads", hex.EncodeToString(sum[:16])+".json")
+}
+
+func loadUploadState(id string) (s3UploadState, bool) {
+	var state s3UploadState
+	data, err := os.ReadFile(uploadStatePath(id))
+	if err != nil || json.Unmarshal(data, &state) != nil || state.UploadID == "" {
+		return state, false
+	}
+	return state, true
+}
+
+func saveUploadState(id string, state s3UploadState) error {
+	if err := os.MkdirAll(filepath.Dir(uploadStatePath(id)), os.ModePerm); err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := uploadStatePath(id) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, uploadStatePath(id))
+}
+
+func removeUploadState(id string) {
+	os.Remove(uploadStatePath(id))
+}
+
+// discardUpload aborts the multipart upload download id left behind,
+// if any.
+func discardUpload(id string) {
+	state, ok := loadUploadState(id)
+	if !ok {
+		return
+	}
+	backend, err := newS3Backend("s3://" + state.Bucket)
+	if err != nil {
+		log.Printf("Failed to abort the upload of %s: %v", state.Key, err)
+		return
+	}
+	p := &s3Part{backend: backend, id: id, key: state.Key, uploadID: state.UploadID}
+	if err := p.abortUpload(); err != nil {
+		log.Printf("Failed to abort the upload of %s: %v", state.Key, err)
+	}
+}
+
+// setUploadStatus records how far pushing download id to its destination
+// has come.
+func setUploadStatus(id, status string) {
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[id]; exists {
+		download.Upload = status
+	}
+	downloadsMutex.Unlock()
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// signS3Request adds AWS Signature Version 4 headers to req, signing
+// every header already set on it.
+func signS3Request(req *http.Request, body []byte, creds s3Credentials, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := day + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but unreserved characters (and
+// slashes, for paths), as SigV4 requires.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', keepSlash && c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxS3PrefixObjects caps how many objects one s3:// prefix expands to.
+const maxS3PrefixObjects = 10000
+
+// errEmptyS3Prefix is returned for a prefix with no objects under it.
+var errEmptyS3Prefix = errors.New("no objects under the S3 prefix")
+
+// isS3Link reports whether url is an object in an S3 bucket.
+func isS3Link(url string) bool {
+	return strings.HasPrefix(url, "s3://")
+}
+
+// isS3Prefix reports whether url is an s3:// prefix, one ending in "/",
+// rather than an object.
+func isS3Prefix(url string) bool {
+	return isS3Link(url) && strings.HasSuffix(url, "/")
+}
+
+// checkS3Endpoint validates a request's s3Endpoint.
+func checkS3Endpoint(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("s3Endpoint must be an http or https URL such as http://minio:9000")
+	}
+	return nil
+}
+
+// s3SourceTransport sends requests for s3:// URLs to the bucket's
+// endpoint, signed with the S3 credentials when there are any and
+// anonymously otherwise, so public buckets work without them. Everything
+// else about them, Range and If-Range included, is plain HTTP, so S3
+// objects are downloaded, resumed and split over connections like any
+// other file. Other requests, such as redirects, pass through unchanged.
+type s3SourceTransport struct {
+	endpoint string
+	region   string
+	creds    *s3Credentials
+	next     http.RoundTripper
+}
+
+// newS3SourceTransport reads the credentials and settles the endpoint
+// and region for a download's s3:// requests.
+func newS3SourceTransport(opts downloadOptions, next http.RoundTripper) s3SourceTransport {
+	t := s3SourceTransport{endpoint: opts.s3Endpoint, region: opts.s3Region, next: next}
+	if t.endpoint == "" {
+		t.endpoint = *s3Endpoint
+	}
+	if t.region == "" {
+		t.region = s3RegionName()
+	}
+	if creds, err := loadS3Credentials(); err == nil {
+		t.creds = &creds
+	}
+	return t
+}
+
+func (t s3SourceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "s3" {
+		return t.next.RoundTrip(req)
+	}
+	backend := &s3Backend{bucket: req.URL.Host, region: t.region, endpoint: t.endpoint}
+	u, err := backend.objectURL(strings.TrimPrefix(req.URL.Path, "/"), req.URL.Query())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	out := req.Clone(req.Context())
+	out.URL, out.Host = u, u.Host
+	if t.creds != nil {
+		// Only the host and the x-amz- headers are signed, so nothing
+		// the transports below add or change breaks the signature.
+		signed := &http.Request{Method: out.Method, URL: u, Header: make(http.Header)}
+		signS3Request(signed, nil, *t.creds, t.region, time.Now())
+		for name, values := range signed.Header {
+			out.Header[name] = values
+		}
+	}
+	return t.next.RoundTrip(out)
+}
+
+// expandS3Prefixes replaces every s3:// prefix in urls with the URLs of
+// the objects under it, listed with the request's endpoint, proxy and
+// TLS settings. It returns the new list and the directory, relative to
+// the output directory, that mirrors each object's key below its prefix.
+func expandS3Prefixes(ctx context.Context, urls []string, opts downloadOptions) ([]string, map[string]string, error) {
+	var expanded []string
+	dirs := make(map[string]string)
+	for _, raw := range urls {
+		if !isS3Prefix(raw) {
+			expanded = append(expanded, raw)
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			return nil, nil, fmt.Errorf("invalid S3 prefix %s", raw)
+		}
+		client, err := downloadClient(raw, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		prefix := strings.TrimPrefix(u.Path, "/")
+		keys, err := listS3Prefix(ctx, client, u.Host, prefix)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to list %s: %w", raw, err)
+		}
+		for _, key := range keys {
+			object := (&url.URL{Scheme: "s3", Host: u.Host, Path: "/" + key}).String()
+			expanded = append(expanded, object)
+			dirs[object] = relativeDir(strings.TrimPrefix(key, prefix))
+		}
+	}
+	return expanded, dirs, nil
+}
+
+// relativeDir is the directory a slash-separated path, such as an S3 key
+// relative to its prefix, is saved in. Segments that can't be a
+// directory name, such as "..", are dropped, so no path leads outside
+// the output directory.
+func relativeDir(rel string) string {
+	segments := strings.Split(rel, "/")
+	var dir []string
+	for _, segment := range segments[:len(segments)-1] {
+		if segment = sanitizeFileName(segment); segment != "" {
+			dir = append(dir, segment)
+		}
+	}
+	return filepath.Join(dir...)
+}
+
+// objectLocation is where a download of url saves its file: the
+// directory dirs names for it under outputDir or the remote
+// destination, or those themselves.
+func objectLocation(url, outputDir, destination string, dirs map[string]string) (string, string) {
+	dir := dirs[url]
+	if dir == "" {
+		return outputDir, destination
+	}
+	if destination != "" {
+		destination = strings.TrimSuffix(destination, "/") + "/" + filepath.ToSlash(dir) + "/"
+	}
+	return filepath.Join(outputDir, dir), destination
+}
+
+// s3ListPage is one page of a ListObjectsV2 response.
+type s3ListPage struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// listS3Prefix returns the keys of the objects under prefix in bucket,
+// leaving out the empty "folder/" markers some tools create.
+func listS3Prefix(ctx context.Context, client *http.Client, bucket, prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u := &url.URL{Scheme: "s3", Host: bucket, Path: "/", RawQuery: query.Encode()}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			var s3Err struct {
+				Code    string `xml:"Code"`
+				Message string `xml:"Message"`
+			}
+			if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+				return nil, fmt.Errorf("%s: %s", s3Err.Code, s3Err.Message)
+			}
+			return nil, fmt.Errorf("%s", resp.Status)
+		}
+		var page s3ListPage
+		if err := xml.Unmarshal(body, &page); err != nil {
+			return nil, fmt.Errorf("unreadable listing: %v", err)
+		}
+		for _, object := range page.Contents {
+			if !strings.HasSuffix(object.Key, "/") {
+				keys = append(keys, object.Key)
+			}
+		}
+		if len(keys) > maxS3PrefixObjects {
+			return nil, fmt.Errorf("more than %d objects under the prefix; submit a narrower one", maxS3PrefixObjects)
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	if len(keys) == 0 {
+		return nil, errEmptyS3Prefix
+	}
+	return keys, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// scheduledJob is a download waiting for its startAt, with the number
+// of hosts its preflight warms up once it starts.
+type scheduledJob struct {
+	job
+	warmupHosts int
+}
+
+var (
+	// scheduledJobs holds downloads submitted with a startAt still to
+	// come, out of the queue, until the scheduler hands them to the
+	// workers.
+	scheduledJobs   = make(map[string]scheduledJob)
+	scheduledJobsMu sync.Mutex
+
+	// scheduleChanged wakes the scheduler when a download is scheduled.
+	scheduleChanged = make(chan struct{}, 1)
+)
+
+// maxStartDelay is how far ahead a download may be scheduled.
+const maxStartDelay = 366 * 24 * time.Hour
+
+// checkStartAt validates a request's startAt.
+func checkStartAt(req DownloadRequest) error {
+	if req.StartAt == nil {
+		return nil
+	}
+	if time.Until(*req.StartAt) > maxStartDelay {
+		return fmt.Errorf("startAt must be within a year")
+	}
+	return nil
+}
+
+// scheduleJobs holds jobs back until their opts.startAt, marking them
+// scheduled.
+func scheduleJobs(jobs []job, warmupHosts int) {
+	downloadsMutex.Lock()
+	for _, j := range jobs {
+		if download, exists := activeDownloads[j.id]; exists {
+			download.Status = "scheduled"
+			startAt := j.opts.startAt
+			download.StartAt = &startAt
+		}
+	}
+	downloadsMutex.Unlock()
+	scheduledJobsMu.Lock()
+	for _, j := range jobs {
+		scheduledJobs[j.id] = scheduledJob{job: j, warmupHosts: warmupHosts}
+	}
+	scheduledJobsMu.Unlock()
+	for _, j := range jobs {
+		addDownloadEvent(j.id, "scheduled", "starts at "+j.opts.startAt.Format(time.RFC3339))
+	}
+	select {
+	case scheduleChanged <- struct{}{}:
+	default:
+	}
+}
+
+func takeScheduledJob(id string) (job, bool) {
+	scheduledJobsMu.Lock()
+	defer scheduledJobsMu.Unlock()
+	s, ok := scheduledJobs[id]
+	delete(scheduledJobs, id)
+	return s.job, ok
+}
+
+// startScheduler starts the goroutine that queues scheduled downloads
+// as their time comes. Ones whose time passed while the server was
+// down are queued right away.
+func startScheduler() {
+	go func() {
+		timer := time.NewTimer(0)
+		for {
+			select {
+			case <-timer.C:
+			case <-scheduleChanged:
+				timer.Stop()
+			}
+			next := releaseScheduled(time.Now())
+			if next.IsZero() {
+				timer.Reset(maxStartDelay)
+			} else {
+				timer.Reset(time.Until(next))
+			}
+		}
+	}()
+}
+
+// releaseScheduled queues the scheduled downloads due by now, in the
+// order they were submitted, and returns when the next one is due, or
+// the zero time if none is left.
+func releaseScheduled(now time.Time) time.Time {
+	var due []scheduledJob
+	var next time.Time
+	scheduledJobsMu.Lock()
+	for id, s := range scheduledJobs {
+		if !s.opts.startAt.After(now) {
+			due = append(due, s)
+			delete(scheduledJobs, id)
+		} else if next.IsZero() || s.opts.startAt.Before(next) {
+			next = s.opts.startAt
+		}
+	}
+	scheduledJobsMu.Unlock()
+	if len(due) == 0 {
+		return next
+	}
+
+	downloadsMutex.Lock()
+	submitted := func(s scheduledJob) time.Time {
+		if download, exists := activeDownloads[s.id]; exists {
+			return download.SubmittedAt
+		}
+		return time.Time{}
+	}
+	sort.SliceStable(due, func(i, k int) bool { return submitted(due[i]).Before(submitted(due[k])) })
+	for _, s := range due {
+		if download, exists := activeDownloads[s.id]; exists {
+			download.Status = "queued"
+		}
+	}
+	downloadsMutex.Unlock()
+
+	// Downloads submitted together are preflighted together.
+	var jobs []job
+	batches := make(map[*preflightBatch][]job)
+	warmup := make(map[*preflightBatch]int)
+	for _, s := range due {
+		addDownloadEvent(s.id, "schedule_reached", "start time reached; queued")
+		if s.opts.preflight == nil {
+			jobs = append(jobs, s.job)
+			continue
+		}
+		batches[s.opts.preflight] = append(batches[s.opts.preflight], s.job)
+		warmup[s.opts.preflight] = s.warmupHosts
+	}
+	pool.enqueue(jobs...)
+	for batch, batchJobs := range batches {
+		go func() {
+			runPreflight(batch, batchJobs, warmup[batch])
+			pool.enqueue(batchJobs...)
+			broadcastStatus()
+		}()
+	}
+	broadcastStatus()
+	return next
+}
+
+// scheduledHandoffJobs returns the scheduled downloads for queue.json or
+// a warm restart.
+func scheduledHandoffJobs() []job {
+	scheduledJobsMu.Lock()
+	defer scheduledJobsMu.Unlock()
+	jobs := make([]job, 0, len(scheduledJobs))
+	for _, s := range scheduledJobs {
+		jobs = append(jobs, s.job)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].id < jobs[k].id })
+	return jobs
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxConnections caps DownloadRequest.Connections.
+	maxConnections = 8
+	// minSegmentSize keeps small files from being split into segments
+	// not worth a connection of their own.
+	minSegmentSize = 1 << 20
+	// segmentRetries is how often a failed segment is tried again before
+	// the download fails.
+	segmentRetries = 3
+)
+
+// errRangesRejected means the server answered a range request with the
+// whole file, so the download falls back to a single connection.
+var errRangesRejected = errors.New("server ignored the Range header")
+
+func checkConnections(n int) (int, error) {
+	if n == 0 {
+		return 1, nil
+	}
+	if n < 1 || n > maxConnections {
+		return 0, fmt.Errorf("connections must be between 1 and %d", maxConnections)
+	}
+	return n, nil
+}
+
+// wantSegments reports whether a download should try several
+// connections: only to local disk, and not when continuing a partial
+// file written over a single one.
+func wantSegments(opts downloadOptions, resume bool, path string) bool {
+	if opts.connections < 2 || opts.destination != "" || opts.followLinkNext {
+		return false
+	}
+	if !resume {
+		return true
+	}
+	info, err := os.Stat(path)
+	return err != nil || info.Size() == 0
+}
+
+// rangeSize returns the length of url if the server advertises byte
+// ranges for it, or -1, along with the file name the server gives it.
+func rangeSize(ctx context.Context, client *http.Client, url string) (int64, string) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return -1, ""
+	}
+	resp, err := doWithDigest(client, req, req.URL.User)
+	if err != nil {
+		return -1, ""
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" {
+		return -1, ""
+	}
+	recordRedirects(downloadKeyFrom(ctx), resp)
+	noteValidators(downloadKeyFrom(ctx), resp)
+	return resp.ContentLength, responseFileName(resp)
+}
+
+// segmentCount is how many connections a file of size is split over.
+func segmentCount(size int64, connections int) int {
+	if size <= 0 {
+		return 1
+	}
+	return int(min(int64(connections), max(size/minSegmentSize, 1)))
+}
+
+// segment is one byte range of a segmented download.
+type segment struct {
+	index      int
+	start, end int64 // inclusive
+	done       int64 // bytes written so far; atomic
+}
+
+// downloadSegments fetches url, size bytes long, over several
+// connections into a preallocated file next to path, renaming it to path
+// once every segment is complete. A failed segment is retried from where
+// it stopped without disturbing the others. The file can't be continued
+// later, so it is removed on failure and a paused download starts over.
+func downloadSegments(parent context.Context, key, url, path string, client *http.Client, size int64, opts downloadOptions) (string, error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	n := segmentCount(size, opts.connections)
+	segments := make([]*segment, n)
+	length := size / int64(n)
+	for i := range segments {
+		segments[i] = &segment{index: i, start: int64(i) * length, end: int64(i+1)*length - 1}
+	}
+	segments[n-1].end = size - 1
+
+	tmp := path + ".segments"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+	if err != nil {
+		return "", fmt.Errorf("failed to create file: %v", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			file.Close()
+			os.Remove(tmp)
+		}
+	}()
+	if err := file.Truncate(size); err != nil {
+		return "", fmt.Errorf("failed to allocate file: %v", err)
+	}
+	setPartialPath(key, tmp)
+	addDownloadEvent(key, "segmented", fmt.Sprintf("downloading %d bytes over %d connections", size, n))
+	setDownloadProgress(key, 0, size)
+
+	var total int64
+	defer shaper.start(key, downloadClass(key), opts.maxSpeed)()
+	guard := newSpeedGuard(opts, false)
+	stop := make(chan struct{})
+	tripped := make(chan error, 1)
+	if guard.enabled() {
+		go guard.watch(key, func() int64 { return atomic.LoadInt64(&total) }, stop, func(err error) {
+			tripped <- err
+			cancel()
+		})
+	}
+
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				setDownloadProgress(key, atomic.LoadInt64(&total), size)
+				return
+			}
+			setDownloadProgress(key, atomic.LoadInt64(&total), size)
+			updateDownloadStatus(key, "downloading", false, "")
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var firstErr error
+	var errOnce sync.Once
+	for _, seg := range segments {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fetchSegmentWithRetries(ctx, key, url, client, file, seg, &total, opts); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-progressDone
+
+	if firstErr != nil {
+		select {
+		case guardErr := <-tripped:
+			return "", guardErr
+		default:
+		}
+		if errors.Is(firstErr, errRangesRejected) {
+			return "", firstErr
+		}
+		if parent.Err() != nil {
+			return "", parent.Err()
+		}
+		return "", fmt.Errorf("failed to download: %w", firstErr)
+	}
+
+	committed = true
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to save file: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to save file: %v", err)
+	}
+	removeResumeMeta(path)
+	setPartialPath(key, path)
+	return path, nil
+}
+
+func fetchSegmentWithRetries(ctx context.Context, key, url string, client *http.Client, file *os.File, seg *segment, total *int64, opts downloadOptions) error {
+	for attempt := 1; ; attempt++ {
+		err := fetchSegment(ctx, key, url, client, file, seg, total, opts)
+		if err == nil || errors.Is(err, errRangesRejected) || ctx.Err() != nil || attempt > segmentRetries {
+			return err
+		}
+		from := seg.start + atomic.LoadInt64(&seg.done)
+		addDownloadEvent(key, "segment_retry", fmt.Sprintf("segment %d failed: %v; retrying from byte %d (attempt %d of %d)", seg.index, err, from, attempt, segmentRetries))
+		select {
+		case <-time.After(time.Duration(attempt) * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// fetchSegment downloads what remains of seg into its place in file.
+func fetchSegment(ctx context.Context, key, url string, client *http.Client, file *os.File, seg *segment, total *int64, opts downloadOptions) error {
+	from := seg.start + atomic.LoadInt64(&seg.done)
+	if from > seg.end {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, seg.end))
+	resp, err := doWithDigest(client, req, req.URL.User)
+	if err != nil {
+		return err
+	}
+	resp = faultResponse(key, opts.fault, resp)
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && contentRangeStart(resp) == from:
+	case resp.StatusCode == http.StatusOK:
+		return errRangesRejected
+	default:
+		return fmt.Errorf("segment %d: %s", seg.index, resp.Status)
+	}
+
+	w := &segmentWriter{file: file, seg: seg, total: total}
+	body := faultReader(ctx, key, opts.fault, shapeReader(ctx, resp.Body))
+	if _, err := copyWithPool(w, io.LimitReader(body, seg.end-from+1)); err != nil {
+		return err
+	}
+	if left := seg.end + 1 - seg.start - atomic.LoadInt64(&seg.done); left > 0 {
+		return fmt.Errorf("segment %d: %v with %d bytes left", seg.index, io.ErrUnexpectedEOF, left)
+	}
+	return nil
+}
+
+// segmentWriter writes a segment's bytes at their offset and counts them.
+type segmentWriter struct {
+	file  *os.File
+	seg   *segment
+	total *int64
+}
+
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.seg.start+atomic.LoadInt64(&w.seg.done))
+	atomic.AddInt64(&w.seg.done, int64(n))
+	atomic.AddInt64(w.total, int64(n))
+	bytesTransferred.Add(int64(n))
+	return n, err
+}
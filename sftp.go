@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	knownHostsFile = flag.String("known-hosts", os.Getenv("YAD_KNOWN_HOSTS"), "known_hosts file SFTP servers' host keys are checked against (default ~/.ssh/known_hosts), also YAD_KNOWN_HOSTS")
+	sshKeyFile     = flag.String("ssh-key-file", os.Getenv("YAD_SSH_KEY_FILE"), "unencrypted private key for SFTP logins, tried after a password in the URL, also YAD_SSH_KEY_FILE")
+)
+
+const (
+	// sshDefaultPort is where an sftp:// URL without a port is served.
+	sshDefaultPort = "22"
+	// sshIdleTimeout is how long an SSH connection is kept open after its
+	// last download, for the next file from the same server.
+	sshIdleTimeout = 30 * time.Second
+)
+
+// sshSigner is the -ssh-key-file key, or nil.
+var sshSigner ssh.Signer
+
+// initSSH loads the -ssh-key-file key.
+func initSSH() error {
+	if *sshKeyFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(*sshKeyFile)
+	if err != nil {
+		return err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return fmt.Errorf("%s is protected by a passphrase; yad needs an unencrypted key", *sshKeyFile)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", *sshKeyFile, err)
+	}
+	sshSigner = signer
+	return nil
+}
+
+// isSFTPLink reports whether url is downloaded over SFTP.
+func isSFTPLink(url string) bool {
+	return strings.HasPrefix(url, "sftp://")
+}
+
+// hostKeyCallback checks servers' host keys against the known_hosts
+// file, which is read again for every connection so keys added to it
+// take effect at once.
+func hostKeyCallback() (ssh.HostKeyCallback, error) {
+	path := *knownHostsFile
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return nil, &downloadError{code: "host_key_unknown", err: fmt.Errorf("can't check SSH host keys: %v", err)}
+	}
+	return callback, nil
+}
+
+// sshClient is an SSH connection shared by the downloads from one
+// server as one user.
+type sshClient struct {
+	*ssh.Client
+	key   string
+	users int
+	idle  *time.Timer
+}
+
+var (
+	// sshClients holds open SSH connections by address, user and
+	// password.
+	sshClients   = make(map[string]*sshClient)
+	sshClientsMu sync.Mutex
+)
+
+// acquireSSH returns a connection to addr logged in with auth, reusing
+// an open one if there is one. It reports whether it did. Call
+// releaseSSH when done with it.
+func acquireSSH(ctx context.Context, addr string, auth BasicAuth) (*sshClient, bool, error) {
+	sum := sha256.Sum256([]byte(addr + "\x00" + auth.Username + "\x00" + auth.Password))
+	key := hex.EncodeToString(sum[:])
+	sshClientsMu.Lock()
+	if c := sshClients[key]; c != nil {
+		c.users++
+		if c.idle != nil {
+			c.idle.Stop()
+			c.idle = nil
+		}
+		sshClientsMu.Unlock()
+		return c, true, nil
+	}
+	sshClientsMu.Unlock()
+
+	client, err := dialSSH(ctx, addr, auth)
+	if err != nil {
+		return nil, false, err
+	}
+	sshClientsMu.Lock()
+	defer sshClientsMu.Unlock()
+	if c := sshClients[key]; c != nil {
+		// Another download connected first.
+		client.Close()
+		c.users++
+		if c.idle != nil {
+			c.idle.Stop()
+			c.idle = nil
+		}
+		return c, true, nil
+	}
+	c := &sshClient{Client: client, key: key, users: 1}
+	sshClients[key] = c
+	go func() {
+		client.Wait()
+		sshClientsMu.Lock()
+		if sshClients[key] == c {
+			delete(sshClients, key)
+		}
+		sshClientsMu.Unlock()
+	}()
+	return c, false, nil
+}
+
+// releaseSSH gives up a download's use of c, which is closed once no
+// download has used it for sshIdleTimeout.
+func releaseSSH(c *sshClient) {
+	sshClientsMu.Lock()
+	defer sshClientsMu.Unlock()
+	c.users--
+	if c.users > 0 {
+		return
+	}
+	c.idle = time.AfterFunc(sshIdleTimeout, func() {
+		sshClientsMu.Lock()
+		defer sshClientsMu.Unlock()
+		if c.users == 0 {
+			if sshClients[c.key] == c {
+				delete(sshClients, c.key)
+			}
+			c.Close()
+		}
+	})
+}
+
+// dialSSH connects to addr and logs in as auth's user with its
+// password, if it has one, and the -ssh-key-file key.
+func dialSSH(ctx context.Context, addr string, auth BasicAuth) (*ssh.Client, error) {
+	callback, err := hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+	var methods []ssh.AuthMethod
+	if auth.Password != "" {
+		methods = append(methods, ssh.Password(auth.Password))
+	}
+	if sshSigner != nil {
+		methods = append(methods, ssh.PublicKeys(sshSigner))
+	}
+	if len(methods) == 0 {
+		return nil, &downloadError{code: "auth_failed", err: fmt.Errorf("no password in the URL and no -ssh-key-file to log in to %s as %s with", addr, auth.Username)}
+	}
+	config := &ssh.ClientConfig{
+		User:            auth.Username,
+		Auth:            methods,
+		HostKeyCallback: callback,
+		ClientVersion:   "SSH-2.0-yad_" + version,
+	}
+
+	conn, err := dialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	stop()
+	if err != nil {
+		conn.Close()
+		var keyErr *knownhosts.KeyError
+		switch {
+		case errors.As(err, &keyErr) && len(keyErr.Want) == 0:
+			return nil, &downloadError{code: "host_key_unknown", err: fmt.Errorf("the host key of %s is not in the known_hosts file; add it with ssh-keyscan", addr)}
+		case errors.As(err, &keyErr):
+			return nil, &downloadError{code: "host_key_mismatch", err: fmt.Errorf("the host key of %s doesn't match the known_hosts file", addr)}
+		case strings.Contains(err.Error(), "unable to authenticate"):
+			return nil, &downloadError{code: "auth_failed", err: fmt.Errorf("SSH login to %s as %s was refused", addr, auth.Username)}
+		}
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// SFTP version 3 packet types and status codes, from
+// draft-ietf-secsh-filexfer-02.
+const (
+	sftpInit    = 1
+	sftpVersion = 2
+	sftpOpen    = 3
+	sftpClose   = 4
+	sftpRead    = 5
+	sftpStat    = 17
+	sftpStatus  = 101
+	sftpHandle  = 102
+	sftpData    = 103
+	sftpAttrs   = 105
+
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+
+	sftpOpenRead = 1
+
+	sftpAttrSize        = 0x1
+	sftpAttrUIDGID      = 0x2
+	sftpAttrPermissions = 0x4
+	sftpAttrTimes       = 0x8
+)
+
+const (
+	// sftpReadSize is how much one read request asks for, which every
+	// server accepts.
+	sftpReadSize = 32 * 1024
+	// sftpMaxPacket bounds the replies yad accepts.
+	sftpMaxPacket = 1 << 20
+)
+
+// sftpStatusError is an SFTP request's failure.
+type sftpStatusError struct {
+	op      string
+	code    uint32
+	message string
+}
+
+func (e *sftpStatusError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("SFTP %s failed with status %d", e.op, e.code)
+	}
+	return fmt.Sprintf("SFTP %s failed: %s", e.op, e.message)
+}
+
+// sftpSession is the SFTP subsystem on one SSH channel. Requests are
+// sent one at a time.
+type sftpSession struct {
+	session *ssh.Session
+	w       io.WriteCloser
+	r       *bufio.Reader
+	id      uint32
+}
+
+func openSFTP(client *ssh.Client) (*sftpSession, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	s := &sftpSession{session: session}
+	w, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	s.w, s.r = w, bufio.NewReader(r)
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("the server has no SFTP subsystem: %w", err)
+	}
+	if err := s.send(sftpInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+		session.Close()
+		return nil, err
+	}
+	typ, _, err := s.recv()
+	if err == nil && typ != sftpVersion {
+		err = fmt.Errorf("unexpected SFTP packet %d instead of the version", typ)
+	}
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sftpSession) close() {
+	s.session.Close()
+}
+
+func (s *sftpSession) send(typ byte, payload []byte) error {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	packet = append(packet, typ)
+	_, err := s.w.Write(append(packet, payload...))
+	return err
+}
+
+func (s *sftpSession) recv() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(s.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > sftpMaxPacket {
+		return 0, nil, fmt.Errorf("SFTP packet of %d bytes", length)
+	}
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(s.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
+
+// request sends a request of type typ with the given payload after its
+// id and returns the type and payload of the reply, after the id. A
+// status reply other than OK is returned as an sftpStatusError.
+func (s *sftpSession) request(op string, typ byte, payload []byte) (byte, sftpBuffer, error) {
+	s.id++
+	if err := s.send(typ, append(binary.BigEndian.AppendUint32(nil, s.id), payload...)); err != nil {
+		return 0, nil, err
+	}
+	replyType, reply, err := s.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+	buf := sftpBuffer(reply)
+	if id := buf.uint32(); id != s.id {
+		return 0, nil, fmt.Errorf("SFTP reply %d to request %d", id, s.id)
+	}
+	if replyType == sftpStatus {
+		code := buf.uint32()
+		message := buf.string()
+		if code != sftpOK {
+			return 0, nil, &sftpStatusError{op: op, code: code, message: message}
+		}
+	}
+	return replyType, buf, nil
+}
+
+// sftpFileAttrs are the parts of a file's attributes yad uses.
+type sftpFileAttrs struct {
+	size  int64 // -1 if not given
+	mode  uint32
+	mtime int64 // 0 if not given
+}
+
+func (a sftpFileAttrs) isDir() bool {
+	return a.mode&0o170000 == 0o040000
+}
+
+func (s *sftpSession) stat(path string) (sftpFileAttrs, error) {
+	typ, buf, err := s.request("stat", sftpStat, appendSFTPString(nil, path))
+	if err != nil {
+		return sftpFileAttrs{}, err
+	}
+	if typ != sftpAttrs {
+		return sftpFileAttrs{}, fmt.Errorf("unexpected SFTP packet %d in reply to stat", typ)
+	}
+	attrs := sftpFileAttrs{size: -1}
+	flags := buf.uint32()
+	if flags&sftpAttrSize != 0 {
+		attrs.size = int64(buf.uint64())
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		buf.uint32()
+		buf.uint32()
+	}
+	if flags&sftpAttrPermissions != 0 {
+		attrs.mode = buf.uint32()
+	}
+	if flags&sftpAttrTimes != 0 {
+		buf.uint32()
+		attrs.mtime = int64(buf.uint32())
+	}
+	return attrs, nil
+}
+
+// open opens the file at path for reading and returns its handle.
+func (s *sftpSession) open(path string) (string, error) {
+	payload := appendSFTPString(nil, path)
+	payload = binary.BigEndian.AppendUint32(payload, sftpOpenRead)
+	payload = binary.BigEndian.AppendUint32(payload, 0) // no attributes
+	typ, buf, err := s.request("open", sftpOpen, payload)
+	if err != nil {
+		return "", err
+	}
+	if typ != sftpHandle {
+		return "", fmt.Errorf("unexpected SFTP packet %d in reply to open", typ)
+	}
+	return buf.string(), nil
+}
+
+func (s *sftpSession) closeHandle(handle string) error {
+	_, _, err := s.request("close", sftpClose, appendSFTPString(nil, handle))
+	return err
+}
+
+// sftpReader reads an open file from offset on.
+type sftpReader struct {
+	s      *sftpSession
+	handle string
+	offset int64
+}
+
+func (r *sftpReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	payload := appendSFTPString(nil, r.handle)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(r.offset))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(min(len(p), sftpReadSize)))
+	typ, buf, err := r.s.request("read", sftpRead, payload)
+	var status *sftpStatusError
+	if errors.As(err, &status) && status.code == sftpEOF {
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	if typ != sftpData {
+		return 0, fmt.Errorf("unexpected SFTP packet %d in reply to read", typ)
+	}
+	data := buf.string()
+	if len(data) > len(p) {
+		return 0, fmt.Errorf("SFTP server sent %d bytes for a read of %d", len(data), len(p))
+	}
+	n := copy(p, data)
+	r.offset += int64(n)
+	return n, nil
+}
+
+func appendSFTPString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// sftpBuffer decodes a packet's fields. Reading past its end yields
+// zero values.
+type sftpBuffer []byte
+
+func (b *sftpBuffer) uint32() uint32 {
+	if len(*b) < 4 {
+		*b = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint32(*b)
+	*b = (*b)[4:]
+	return v
+}
+
+func (b *sftpBuffer) uint64() uint64 {
+	return uint64(b.uint32())<<32 | uint64(b.uint32())
+}
+
+func (b *sftpBuffer) string() string {
+	n := b.uint32()
+	if uint32(len(*b)) < n {
+		*b = nil
+		return ""
+	}
+	s := string((*b)[:n])
+	*b = (*b)[n:]
+	return s
+}
+
+// sftpPath is the remote path an sftp:// URL names. A path starting
+// with /~/ is relative to the user's home directory.
+func sftpPath(u *url.URL) string {
+	if rest, ok := strings.CutPrefix(u.Path, "/~/"); ok {
+		return rest
+	}
+	if u.Path == "" {
+		return "."
+	}
+	return u.Path
+}
+
+// sftpFailure turns the failure of an SFTP request on path into what
+// the download's status shows.
+func sftpFailure(err error, host, path string) error {
+	var status *sftpStatusError
+	if errors.As(err, &status) {
+		switch status.code {
+		case sftpNoSuchFile:
+			return &downloadError{code: "remote_not_found", err: fmt.Errorf("%s does not exist on %s", path, host)}
+		case sftpPermissionDenied:
+			return &downloadError{code: "permission_denied", err: fmt.Errorf("%s on %s can't be read: permission denied", path, host)}
+		}
+	}
+	return err
+}
+
+// downloadSFTP fetches a file over SFTP into outputDir, or the request's
+// destination, and returns where it was saved. Progress is reported on
+// the download tracked under key, against the size the server reports
+// for the file. Downloads from the same server as the same user share
+// an SSH connection.
+func downloadSFTP(parent context.Context, key, rawURL, outputDir string, opts downloadOptions) (string, error) {
+	if err := checkURLAllowed(rawURL); err != nil {
+		return "", err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to start download: %w", err)
+	}
+	auth, ok := opts.basicAuth[rawURL]
+	if !ok || auth.Username == "" {
+		return "", &downloadError{code: "auth_failed", err: fmt.Errorf("no user to log in to %s as; use sftp://user@host/path", u.Host)}
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), sshDefaultPort)
+	}
+	remotePath := sftpPath(u)
+
+	ctx, cancel := context.WithCancel(withDownloadKey(withPreflight(parent, opts.preflight), key))
+	defer cancel()
+	client, reused, err := acquireSSH(ctx, addr, auth)
+	if err != nil {
+		var derr *downloadError
+		if errors.As(err, &derr) {
+			return "", err
+		}
+		return "", fmt.Errorf("failed to start download: %w", err)
+	}
+	defer releaseSSH(client)
+	if reused {
+		addDownloadEvent(key, "ssh_reused", fmt.Sprintf("reusing the SSH connection to %s", addr))
+	}
+	s, err := openSFTP(client.Client)
+	if err != nil {
+		return "", fmt.Errorf("failed to start download: %w", err)
+	}
+	defer s.close()
+	// Cancelling closes the channel, not the shared connection.
+	defer context.AfterFunc(ctx, s.close)()
+
+	attrs, err := s.stat(remotePath)
+	if err != nil {
+		return "", sftpFailure(err, u.Host, remotePath)
+	}
+	if attrs.isDir() {
+		return "", &downloadError{code: "sftp_directory", err: fmt.Errorf("%s is a directory on %s; yad only downloads files over SFTP, so submit the URLs of the files in it", remotePath, u.Host)}
+	}
+	handle, err := s.open(remotePath)
+	if err != nil {
+		return "", sftpFailure(err, u.Host, remotePath)
+	}
+	modified := ""
+	if attrs.mtime > 0 {
+		modified = strconv.FormatInt(attrs.mtime, 10)
+	}
+	return downloadRemote(ctx, key, rawURL, outputDir, opts, remoteFile{
+		size:     attrs.size,
+		modified: modified,
+		open: func(offset int64) (io.Reader, int64, error) {
+			return &sftpReader{s: s, handle: handle, offset: offset}, offset, nil
+		},
+		finish: func() error {
+			return s.closeHandle(handle)
+		},
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+)
+
+var maxFileSize = flag.Int64("max-file-size", 0, "largest download in bytes, HTTP file or whole torrent (0 = unlimited)")
+
+// errSizeLimit stops a copy that ran past the size limit.
+var errSizeLimit = errors.New("exceeded size limit")
+
+// sizeLimit is the most bytes the download may have, or 0 for no limit.
+// A request's own maxFileSize replaces -max-file-size; a negative one
+// lifts it.
+func (o downloadOptions) sizeLimit() int64 {
+	if o.maxFileSize != 0 {
+		return max(o.maxFileSize, 0)
+	}
+	return *maxFileSize
+}
+
+// sizeLimitError reports a download of size bytes, or -1 if its body
+// just ran past limit.
+func sizeLimitError(size, limit int64) error {
+	if size < 0 {
+		return &downloadError{code: "size_limit", err: fmt.Errorf("%v: the body ran past the %d bytes allowed", errSizeLimit, limit)}
+	}
+	return &downloadError{code: "size_limit", err: fmt.Errorf("%v: %d bytes is more than the %d allowed", errSizeLimit, size, limit)}
+}
+
+// limitWriter fails a write that would take what has been written past
+// limit, counting from offset, for bodies whose length isn't known up
+// front.
+type limitWriter struct {
+	w      io.Writer
+	limit  int64
+	offset int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.offset+int64(len(p)) > l.limit {
+		return 0, errSizeLimit
+	}
+	n, err := l.w.Write(p)
+	l.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+var (
+	stallTimeout   = flag.Duration("stall-timeout", 0, "fail HTTP downloads that receive no data for this long (0 disables)")
+	minSpeed       = flag.Int64("min-speed", 0, "fail HTTP downloads averaging fewer bytes/sec than this over -min-speed-window (0 disables)")
+	minSpeedWindow = flag.Duration("min-speed-window", 60*time.Second, "window over which -min-speed is averaged")
+
+	downloadTimeout = flag.Duration("download-timeout", 0, "fail downloads, HTTP or torrent, still transferring after this long (0 disables)")
+)
+
+// timeLimit is how long the download may take, or 0 for no limit. A
+// request's own timeout replaces -download-timeout; a negative one lifts
+// it.
+func (o downloadOptions) timeLimit() time.Duration {
+	if o.timeout != 0 {
+		return max(o.timeout, 0)
+	}
+	return *downloadTimeout
+}
+
+// timedOutError ends a download that ran past its time limit.
+type timedOutError struct {
+	limit time.Duration
+}
+
+func (e *timedOutError) Error() string {
+	return fmt.Sprintf("timed out: still transferring after %s", e.limit)
+}
+
+// awaitResponse cancels a request that gets no response within the
+// download's stall timeout, since the guard only starts watching once
+// the body flows. The returned stop ends the wait, returning a "stalled"
+// download error if the time had already run out.
+func awaitResponse(opts downloadOptions, cancel func()) (stop func() error) {
+	limit := newSpeedGuard(opts, false).stallTimeout
+	if limit <= 0 {
+		return func() error { return nil }
+	}
+	t := time.AfterFunc(limit, cancel)
+	return func() error {
+		if t.Stop() {
+			return nil
+		}
+		return &downloadError{code: "stalled", err: fmt.Errorf("no response for %s", limit)}
+	}
+}
+
+// speedSample is the byte count observed at one sampler tick.
+type speedSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// speedGuard watches the byte counter of one transfer and trips when it
+// stops moving or moves too slowly.
+type speedGuard struct {
+	stallTimeout   time.Duration
+	minSpeed       int64
+	minSpeedWindow time.Duration
+
+	lastBytes  int64
+	lastChange time.Time
+	samples    []speedSample
+}
+
+// newSpeedGuard resolves the guard settings for one download. Server
+// defaults only apply to HTTP downloads; torrents are guarded only when
+// the request asks for it. Negative request values disable a guard.
+func newSpeedGuard(opts downloadOptions, isTorrent bool) *speedGuard {
+	g := &speedGuard{lastChange: time.Now()}
+	if !isTorrent {
+		g.stallTimeout = *stallTimeout
+		g.minSpeed = *minSpeed
+	}
+	g.minSpeedWindow = *minSpeedWindow
+
+	if opts.stallTimeout != 0 {
+		g.stallTimeout = max(opts.stallTimeout, 0)
+	}
+	if opts.minSpeed != 0 {
+		g.minSpeed = max(opts.minSpeed, 0)
+	}
+	if opts.minSpeedWindow > 0 {
+		g.minSpeedWindow = opts.minSpeedWindow
+	}
+	return g
+}
+
+func (g *speedGuard) enabled() bool {
+	return g.stallTimeout > 0 || g.minSpeed > 0
+}
+
+// check records the current byte count and returns a "stalled" download
+// error if either guard has tripped.
+func (g *speedGuard) check(bytes int64, now time.Time) error {
+	if bytes != g.lastBytes {
+		g.lastBytes = bytes
+		g.lastChange = now
+	}
+	if g.stallTimeout > 0 && now.Sub(g.lastChange) >= g.stallTimeout {
+		return &downloadError{
+			code: "stalled",
+			err:  fmt.Errorf("no data received for %s (stopped at byte %d)", g.stallTimeout, bytes),
+		}
+	}
+
+	if g.minSpeed <= 0 {
+		return nil
+	}
+	g.samples = append(g.samples, speedSample{at: now, bytes: bytes})
+	for len(g.samples) > 1 && now.Sub(g.samples[1].at) >= g.minSpeedWindow {
+		g.samples = g.samples[1:]
+	}
+	oldest := g.samples[0]
+	elapsed := now.Sub(oldest.at)
+	if elapsed < g.minSpeedWindow {
+		return nil
+	}
+	speed := float64(bytes-oldest.bytes) / elapsed.Seconds()
+	if speed < float64(g.minSpeed) {
+		return &downloadError{
+			code: "stalled",
+			err:  fmt.Errorf("average speed %.0f B/s over %s is below the minimum of %d B/s (at byte %d)", speed, g.minSpeedWindow, g.minSpeed, bytes),
+		}
+	}
+	return nil
+}
+
+// watch samples counter once a second until stop is closed. The first
+// time the guard trips, the event is recorded against the download and
+// abort is called with the error.
+func (g *speedGuard) watch(key string, counter func() int64, stop <-chan struct{}, abort func(error)) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if err := g.check(counter(), now); err != nil {
+				addDownloadEvent(key, "stalled", err.Error())
+				abort(err)
+				return
+			}
+		}
+	}
+}
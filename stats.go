@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	handlerPanics atomic.Int64
+	workerPanics  atomic.Int64
+
+	// bytesTransferred counts payload bytes received by all downloads;
+	// transferRate is its per-second delta, sampled by trackTransferRate.
+	bytesTransferred atomic.Int64
+	transferRate     atomic.Int64
+)
+
+// statsSummary is the aggregate view of the engine shown on dashboards.
+// It is served by GET /api/stats and pushed to websocket clients that
+// subscribe with {"action":"subscribe_summary"}.
+type statsSummary struct {
+	Counts      map[string]int `json:"counts"`
+	Total       int            `json:"total"`
+	TotalSpeed  int64          `json:"totalSpeed"`
+	QueueLength int            `json:"queueLength"`
+	QueueETA    *time.Time     `json:"queueEta,omitempty"`
+	DiskFree    *uint64        `json:"diskFree,omitempty"`
+}
+
+// trackTransferRate samples bytesTransferred once a second for the
+// totalSpeed figure.
+func trackTransferRate() {
+	last := bytesTransferred.Load()
+	for range time.Tick(time.Second) {
+		current := bytesTransferred.Load()
+		transferRate.Store(current - last)
+		last = current
+	}
+}
+
+// computeSummary builds the stats summary, counting only downloads that
+// carry all of tags. It takes downloadsMutex, so the caller must not
+// hold it.
+func computeSummary(tags []string) statsSummary {
+	queued, workers, avg := pool.queueEstimate()
+
+	summary := statsSummary{
+		Counts:      make(map[string]int),
+		TotalSpeed:  transferRate.Load(),
+		QueueLength: len(queued),
+	}
+	downloadsMutex.Lock()
+	downloads := filterDownloads(tags)
+	for _, download := range downloads {
+		summary.Counts[download.Status]++
+	}
+	summary.Total = len(downloads)
+	downloadsMutex.Unlock()
+
+	if len(queued) > 0 && avg > 0 && workers > 0 {
+		// Same model as the per-download estimates: the last queued job
+		// starts after the ones ahead of it, then runs for avg.
+		last := len(queued) - 1
+		eta := time.Now().Add(avg*time.Duration(last/workers) + avg/2 + avg).Round(time.Second)
+		summary.QueueETA = &eta
+	}
+	if free, err := diskFree(downloadFolder); err == nil {
+		summary.DiskFree = &free
+	}
+	return summary
+}
+
+func handleGetStats(w http.ResponseWriter, r *http.Request) {
+	tags, err := normalizeTags(r.URL.Query()["tag"])
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		statsSummary
+		RecoveredPanics  map[string]int64 `json:"recoveredPanics"`
+		WebsocketClients []wsClientStats  `json:"websocketClients"`
+		HostBreakers     []hostBreaker    `json:"hostBreakers"`
+		Bandwidth        bandwidthStats   `json:"bandwidth"`
+		Profile          *profileStatus   `json:"profile,omitempty"`
+		MaxPerHost       int              `json:"maxPerHost"`
+		Hosts            []hostSlots      `json:"hosts"`
+	}{
+		statsSummary: computeSummary(tags),
+		RecoveredPanics: map[string]int64{
+			"handlers": handlerPanics.Load(),
+			"workers":  workerPanics.Load(),
+		},
+		WebsocketClients: wsHub.stats(),
+		HostBreakers:     breakerStats(),
+		Bandwidth:        shaper.stats(),
+		Profile:          profiles.status(time.Now()),
+		MaxPerHost:       *maxPerHost,
+		Hosts:            pool.hostStats(),
+	})
+}
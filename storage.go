@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// storageBackend is where downloads are written: the local output
+// directory unless the request names a remote destination.
+type storageBackend interface {
+	// CreatePart starts writing the object called name. With resume,
+	// a local part keeps what an earlier attempt already wrote.
+	CreatePart(ctx context.Context, name string, resume bool) (storagePart, error)
+}
+
+// storagePart is one object being written. Writes append. Nothing a
+// remote backend stores is visible until Commit; Abort discards it.
+type storagePart interface {
+	io.Writer
+
+	// Offset is how many bytes the part held when it was created.
+	Offset() int64
+	// Reset discards everything written so far.
+	Reset() error
+	// Commit finishes the object and returns where it ended up.
+	Commit() (string, error)
+	// Abort stops writing. It is a no-op after Commit.
+	Abort() error
+}
+
+// openDestination returns the backend for a request's destination, which
+// is empty for outputDir on local disk or an s3://bucket/prefix/ URI.
+func openDestination(destination, outputDir string) (storageBackend, error) {
+	switch {
+	case destination == "":
+		return localBackend{dir: outputDir}, nil
+	case strings.HasPrefix(destination, "s3://"):
+		return newS3Backend(destination)
+	}
+	return nil, fmt.Errorf("unsupported destination %q (want s3://bucket/prefix/)", destination)
+}
+
+// checkDestination rejects a remote destination the request can't use.
+// Only single-file HTTP downloads can be written to one.
+func checkDestination(req DownloadRequest) error {
+	if _, err := openDestination(req.Destination, ""); err != nil {
+		return err
+	}
+	if req.FollowLinkNext || len(req.Entries) > 0 || len(req.AlsoLinkTo) > 0 || req.PathTemplate != "" || req.SkipUnchanged {
+		return fmt.Errorf("destination supports plain HTTP downloads only, without entries, followLinkNext, alsoLinkTo, pathTemplate or skipUnchanged")
+	}
+	for _, u := range req.URLs {
+		if strings.HasPrefix(u, "magnet:") || strings.HasSuffix(u, ".torrent") {
+			return fmt.Errorf("torrents can't be written to a destination: %s", u)
+		}
+	}
+	return nil
+}
+
+// recordUploaded records where a download sent to a remote destination
+// ended up.
+func recordUploaded(id, location string) {
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[id]; exists {
+		download.Location = location
+	}
+	downloadsMutex.Unlock()
+}
+
+// handleReupload queues a failed download to a remote destination
+// again, continuing the multipart upload it left behind. Only what
+// wasn't uploaded yet is fetched from the source; if everything was,
+// the upload is just completed.
+func handleReupload(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	downloadsMutex.Lock()
+	download, exists := activeDownloads[id]
+	status := ""
+	if exists {
+		status = download.Status
+	}
+	downloadsMutex.Unlock()
+	if !exists {
+		httpError(w, r, "Download not found", http.StatusNotFound)
+		return
+	}
+	if status != "failed" {
+		httpError(w, r, fmt.Sprintf("Download is %s", status), http.StatusConflict)
+		return
+	}
+	state, ok := loadUploadState(id)
+	if !ok {
+		httpError(w, r, "Nothing was uploaded to continue from; retry the download instead", http.StatusConflict)
+		return
+	}
+	if !resetForRetry(id) {
+		httpError(w, r, "Download is no longer failed", http.StatusConflict)
+		return
+	}
+	j, ok := takeStoppedJob(id)
+	if !ok || j.opts.destination == "" {
+		failDownload(id, "", "nothing to reupload: the download's destination is unknown")
+		httpError(w, r, "The download's destination is unknown", http.StatusConflict)
+		return
+	}
+	j.opts.resume = true
+	var uploaded int64
+	for _, part := range state.Parts {
+		uploaded += part.Size
+	}
+	addDownloadEvent(id, "reupload", fmt.Sprintf("continuing the upload to %s from byte %d", j.opts.destination, uploaded))
+	pool.enqueue(j)
+	broadcastStatus()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "uploaded": uploaded})
+}
+
+// partSuffix marks a local file that is still being written. It only
+// gets its real name once complete, so a file under that name is never
+// a truncated one.
+const partSuffix = ".part"
+
+func partPath(path string) string {
+	return path + partSuffix
+}
+
+// rangesSupported reports whether the server of resp could continue an
+// interrupted transfer of it.
+func rangesSupported(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusPartialContent || resp.Header.Get("Accept-Ranges") == "bytes"
+}
+
+// localBackend writes into a directory, each file as "<name>.part"
+// until it is committed, so a paused download can continue from
+// whatever reached the disk. The file is only created on the first
+// write, so a request that fails leaves nothing behind, and an existing
+// file is left alone until the body arrives.
+type localBackend struct {
+	dir string
+}
+
+func (b localBackend) CreatePart(ctx context.Context, name string, resume bool) (storagePart, error) {
+	p := &localPart{path: filepath.Join(b.dir, name)}
+	if resume {
+		if info, err := os.Stat(partPath(p.path)); err == nil && info.Mode().IsRegular() {
+			p.offset = info.Size()
+		}
+	}
+	return p, nil
+}
+
+type localPart struct {
+	file   *os.File // nil until the first write
+	path   string
+	offset int64
+	closed bool
+}
+
+// open opens the part file, keeping the offset bytes already in it.
+func (p *localPart) open() error {
+	if p.file != nil {
+		return nil
+	}
+	if p.closed {
+		return os.ErrClosed
+	}
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if p.offset > 0 {
+		flags = os.O_RDWR | os.O_CREATE
+	}
+	file, err := os.OpenFile(partPath(p.path), flags, 0o666)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+	if _, err := file.Seek(p.offset, io.SeekStart); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to resume file: %v", err)
+	}
+	p.file = file
+	return nil
+}
+
+func (p *localPart) Write(b []byte) (int, error) {
+	if err := p.open(); err != nil {
+		return 0, err
+	}
+	return p.file.Write(b)
+}
+
+func (p *localPart) Offset() int64 { return p.offset }
+
+func (p *localPart) Reset() error {
+	p.offset = 0
+	if p.file == nil {
+		return nil
+	}
+	if err := p.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to restart file: %v", err)
+	}
+	_, err := p.file.Seek(0, io.SeekStart)
+	return err
+}
+
+func (p *localPart) Commit() (string, error) {
+	// An empty body still makes a file.
+	if err := p.open(); err != nil {
+		return "", err
+	}
+	p.closed = true
+	if err := p.file.Close(); err != nil {
+		return "", fmt.Errorf("failed to save file: %v", err)
+	}
+	if err := os.Rename(p.file.Name(), p.path); err != nil {
+		return "", fmt.Errorf("failed to save file: %v", err)
+	}
+	return p.path, nil
+}
+
+// Abort leaves the partial file where it is: pause and resume rely on
+// it, and cancelling removes it only when asked to.
+func (p *localPart) Abort() error {
+	if p.closed || p.file == nil {
+		p.closed = true
+		return nil
+	}
+	p.closed = true
+	return p.file.Close()
+}
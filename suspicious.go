@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mime"
+	"net/http"
+	neturl "net/url"
+	"path"
+	"strings"
+)
+
+const suspiciousCaptureSize = 1 << 10
+
+var suspiciousAsFailure = flag.Bool("suspicious-as-failure", false, "fail downloads that come back empty or as an HTML page instead of marking them suspicious")
+
+// prefixBuffer keeps the first max bytes written to it and discards the
+// rest.
+type prefixBuffer struct {
+	buf []byte
+	max int
+}
+
+func (p *prefixBuffer) Write(b []byte) (int, error) {
+	if room := p.max - len(p.buf); room > 0 {
+		p.buf = append(p.buf, b[:min(room, len(b))]...)
+	}
+	return len(b), nil
+}
+
+// expectsBinary reports whether url's extension names a non-text file
+// type, so an HTML response for it is most likely an error or login page.
+func expectsBinary(rawURL string) bool {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	ext := strings.ToLower(path.Ext(u.Path))
+	if ext == "" {
+		return false
+	}
+	switch ext {
+	case ".html", ".htm", ".xhtml", ".php", ".asp", ".aspx", ".jsp", ".cgi":
+		return false
+	}
+	typ := mime.TypeByExtension(ext)
+	return typ != "" && !strings.HasPrefix(typ, "text/")
+}
+
+// checkSuspicious returns a warning when a finished HTTP download looks
+// like a silent failure: an empty body, or HTML where a binary file was
+// expected.
+func checkSuspicious(rawURL, contentType string, written int64, head []byte) string {
+	if written == 0 {
+		return "suspicious: empty response body"
+	}
+	if !expectsBinary(rawURL) {
+		return ""
+	}
+	sniffed := http.DetectContentType(head)
+	if strings.HasPrefix(sniffed, "text/html") || strings.HasPrefix(strings.ToLower(contentType), "text/html") {
+		return "suspicious: got HTML instead of file"
+	}
+	return ""
+}
+
+// flagSuspicious records the warning and the start of the body in the
+// download's event log. With -suspicious-as-failure it returns an error
+// that fails the download instead.
+func flagSuspicious(key, warning string, head []byte) error {
+	message := warning
+	if len(head) > 0 {
+		message = fmt.Sprintf("%s; first %d bytes of body:\n%s", warning, len(head), head)
+	}
+	addDownloadEvent(key, "suspicious", message)
+	if *suspiciousAsFailure {
+		return &downloadError{code: "suspicious", err: fmt.Errorf("%s", warning)}
+	}
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[key]; exists {
+		download.Warning = warning
+	}
+	downloadsMutex.Unlock()
+	return nil
+}
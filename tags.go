@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxTags      = 16
+	maxTagLength = 64
+)
+
+// normalizeTags trims, de-duplicates and sorts tags, rejecting empty,
+// overlong or whitespace-containing ones and lists over maxTags.
+func normalizeTags(tags []string) ([]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	seen := make(map[string]bool, len(tags))
+	out := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			return nil, fmt.Errorf("tags must not be empty")
+		}
+		if len(tag) > maxTagLength {
+			return nil, fmt.Errorf("tag %q is longer than %d characters", tag, maxTagLength)
+		}
+		if strings.IndexFunc(tag, unicode.IsSpace) >= 0 {
+			return nil, fmt.Errorf("tag %q must not contain whitespace", tag)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			out = append(out, tag)
+		}
+	}
+	if len(out) > maxTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// hasTags reports whether the download carries every one of tags.
+func hasTags(download *DownloadStatus, tags []string) bool {
+	for _, want := range tags {
+		found := false
+		for _, tag := range download.Tags {
+			if tag == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// filterDownloads returns the downloads carrying all of tags. The caller
+// must hold downloadsMutex.
+func filterDownloads(tags []string) map[string]*DownloadStatus {
+	if len(tags) == 0 {
+		return activeDownloads
+	}
+	filtered := make(map[string]*DownloadStatus)
+	for key, download := range activeDownloads {
+		if hasTags(download, tags) {
+			filtered[key] = download
+		}
+	}
+	return filtered
+}
+
+// handlePatchTags replaces a download's tags.
+func handlePatchTags(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID   string   `json:"id"`
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	downloadsMutex.Lock()
+	download, exists := activeDownloads[req.ID]
+	if exists {
+		download.Tags = tags
+	}
+	downloadsMutex.Unlock()
+	if !exists {
+		httpError(w, r, "Download not found", http.StatusNotFound)
+		return
+	}
+	broadcastStatus()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": req.ID, "tags": tags})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// maxThumbnailSourcePixels keeps a huge image from being decoded
+	// into memory just to shrink it.
+	maxThumbnailSourcePixels = 50_000_000
+
+	videoPosterTimeout = 30 * time.Second
+)
+
+var (
+	thumbnailsEnabled = flag.Bool("thumbnails", true, "generate thumbnails for completed image and video downloads")
+	thumbnailSize     = flag.Int("thumbnail-size", 256, "longest side of generated thumbnails, in pixels")
+)
+
+var (
+	imageExtensions = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true}
+	videoExtensions = map[string]bool{".mp4": true, ".mkv": true, ".webm": true, ".mov": true, ".avi": true, ".m4v": true}
+)
+
+// thumbnailPath is where the thumbnail of download id is cached.
+func thumbnailPath(id string) string {
+	return filepath.Join(downloadFolder, ".thumbs", id+".jpg")
+}
+
+// queueThumbnail schedules a thumbnail for a finished download if it is
+// an image, or a video and ffmpeg is available.
+func queueThumbnail(id, savedPath string) {
+	if !*thumbnailsEnabled {
+		return
+	}
+	ext := strings.ToLower(filepath.Ext(savedPath))
+	var generate func(src, dest string) error
+	switch {
+	case imageExtensions[ext]:
+		generate = imageThumbnail
+	case videoExtensions[ext]:
+		if _, err := exec.LookPath("ffmpeg"); err != nil {
+			return
+		}
+		generate = videoPoster
+	default:
+		return
+	}
+
+	enqueuePostProcess(postProcessTask{id: id, name: "thumbnail", run: func() error {
+		dest := thumbnailPath(id)
+		if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+			return err
+		}
+		if err := generate(savedPath, dest); err != nil {
+			os.Remove(dest)
+			return err
+		}
+		markThumbnail(id)
+		return nil
+	}})
+}
+
+// imageThumbnail scales the image at src to fit within -thumbnail-size
+// and writes it to dest as a JPEG.
+func imageThumbnail(src, dest string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("failed to read image: %v", err)
+	}
+	if cfg.Width*cfg.Height > maxThumbnailSourcePixels {
+		return fmt.Errorf("image is too large to thumbnail (%dx%d)", cfg.Width, cfg.Height)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if limit := *thumbnailSize; w > limit || h > limit {
+		if w >= h {
+			w, h = limit, max(h*limit/w, 1)
+		} else {
+			w, h = max(w*limit/h, 1), limit
+		}
+	}
+	thumb := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(thumb, thumb.Bounds(), img, bounds, draw.Src, nil)
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(out, thumb, &jpeg.Options{Quality: 80}); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// videoPoster has ffmpeg grab a frame a second into the video at src.
+func videoPoster(src, dest string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), videoPosterTimeout)
+	defer cancel()
+	scale := fmt.Sprintf("scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease", *thumbnailSize, *thumbnailSize)
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-nostdin", "-loglevel", "error", "-y",
+		"-ss", "1", "-i", src, "-frames:v", "1", "-vf", scale, dest)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	if _, err := os.Stat(dest); err != nil {
+		return fmt.Errorf("ffmpeg produced no frame")
+	}
+	return nil
+}
+
+func markThumbnail(id string) {
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[id]; exists {
+		download.Thumbnail = "/api/v1/download/" + id + "/thumbnail"
+	}
+	downloadsMutex.Unlock()
+	broadcastStatus()
+}
+
+// handleGetThumbnail serves a download's cached thumbnail. Thumbnails
+// never change once written, so clients may cache them for a day and
+// revalidate with the ETag.
+func handleGetThumbnail(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	downloadsMutex.Lock()
+	_, exists := activeDownloads[id]
+	downloadsMutex.Unlock()
+	if !exists {
+		httpError(w, r, "Download not found", http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(thumbnailPath(id))
+	if err != nil {
+		httpError(w, r, "No thumbnail for this download", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%x"`, id, info.ModTime().UnixNano()))
+	http.ServeContent(w, r, "thumbnail.jpg", info.ModTime(), f)
+}
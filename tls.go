@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/anacrolix/torrent"
+)
+
+var caFile = flag.String("ca-file", os.Getenv("YAD_CA_FILE"), "PEM bundle of CA certificates trusted for HTTPS downloads on top of the system ones, also YAD_CA_FILE")
+
+// initTLS adds the -ca-file certificates to the roots the shared
+// transport trusts. It runs before any download, so every transport
+// cloned from it trusts them too.
+func initTLS() error {
+	if *caFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(*caFile)
+	if err != nil {
+		return err
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil || roots == nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no PEM certificates found in %s", *caFile)
+	}
+	httpTransport.TLSClientConfig.RootCAs = roots
+	return nil
+}
+
+// skipVerify stops t, a clone of the shared transport, from verifying
+// server certificates. It gets a session cache of its own so no session
+// it sets up is resumed by a verifying transport.
+func skipVerify(t *http.Transport) {
+	t.TLSClientConfig.InsecureSkipVerify = true
+	t.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(64)
+}
+
+// webSeedTransport is what a torrent fetches web seeds with: the shared
+// transport's TLS settings, the download's proxy and the torrent
+// client's dialer, if it has its own.
+func webSeedTransport(cfg *torrent.ClientConfig, opts downloadOptions) http.RoundTripper {
+	t := httpTransport.Clone()
+	if opts.insecureTLS {
+		skipVerify(t)
+	}
+	t.Proxy = proxyFunc(opts.proxy)
+	if cfg.HTTPDialContext != nil {
+		t.DialContext = cfg.HTTPDialContext
+	}
+	return t
+}
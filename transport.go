@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Adarsh-Liju/yad/internal/httpclient"
+)
+
+var (
+	dialTimeout           = flag.Duration("dial-timeout", 30*time.Second, "time allowed to connect to a download server")
+	keepAlive             = flag.Duration("keep-alive", 30*time.Second, "interval of TCP keep-alive probes on download connections (negative disables them)")
+	tlsHandshakeTimeout   = flag.Duration("tls-handshake-timeout", 10*time.Second, "time allowed for a download server's TLS handshake")
+	responseHeaderTimeout = flag.Duration("response-header-timeout", 2*time.Minute, "time a download server has to send response headers once the request is written (0 = no limit)")
+	maxIdleConnsPerHost   = flag.Int("max-idle-conns-per-host", 4, "idle connections kept open to each download server for reuse")
+	idleConnTimeout       = flag.Duration("idle-conn-timeout", 90*time.Second, "how long an idle connection to a download server is kept")
+	enableHTTP2           = flag.Bool("http2", true, "use HTTP/2 with servers that offer it")
+)
+
+// httpTransport is shared by every HTTP download so connections and TLS
+// sessions are reused across workers. initTransport applies the
+// connection flags to it.
+var httpTransport = httpclient.NewTransport(httpclient.DefaultConfig(), dialContext)
+
+var httpClient = &http.Client{Transport: hostPolicyTransport{transportFor("", false)}, CheckRedirect: checkRedirect}
+
+var baseDialer = httpclient.NewDialer(httpclient.DefaultConfig())
+
+// initTransport applies the connection flags to the shared transport and
+// dialer. It runs before any download, so transports cloned from the
+// shared one get them too.
+func initTransport() error {
+	cfg := httpclient.Config{
+		DialTimeout:           *dialTimeout,
+		KeepAlive:             *keepAlive,
+		TLSHandshakeTimeout:   *tlsHandshakeTimeout,
+		ResponseHeaderTimeout: *responseHeaderTimeout,
+		MaxIdleConnsPerHost:   *maxIdleConnsPerHost,
+		IdleConnTimeout:       *idleConnTimeout,
+		HTTP2:                 *enableHTTP2,
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	httpclient.ApplyDialer(baseDialer, cfg)
+	httpclient.Apply(httpTransport, cfg)
+	return nil
+}
+
+// dialContext dials addr, using the addresses pre-resolved for the
+// request's batch when there are any and the shared DNS cache otherwise.
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	if batch := preflightFrom(ctx); batch != nil {
+		ips = batch.lookup(host)
+	}
+	if len(ips) == 0 && *dnsCacheEnabled {
+		var stale bool
+		ips, stale, err = resolverCache.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if key := downloadKeyFrom(ctx); stale && key != "" {
+			addDownloadEvent(key, "dns_stale", fmt.Sprintf("resolver unreachable; using expired DNS answer for %s", host))
+		}
+	}
+	dialer, err := boundDialer("http")
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
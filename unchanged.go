@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// storedValidators are the ETag and Last-Modified a completed download's
+// file was served with, and the file as it was saved, so a later
+// download of the same URL into the same directory can ask the server
+// whether it changed.
+type storedValidators struct {
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	ModTime      time.Time `json:"modTime"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+}
+
+var (
+	// validators holds storedValidators by URL and then output
+	// directory, kept in <data-dir>/validators.json.
+	validators   = make(map[string]map[string]storedValidators)
+	validatorsMu sync.Mutex
+)
+
+func validatorsFile() string {
+	return filepath.Join(*dataDir, "validators.json")
+}
+
+// loadValidators reads the validators saved by earlier runs.
+func loadValidators() error {
+	data, err := os.ReadFile(validatorsFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	validatorsMu.Lock()
+	defer validatorsMu.Unlock()
+	if err := json.Unmarshal(data, &validators); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", validatorsFile(), err)
+	}
+	return nil
+}
+
+// saveValidators writes validators out. Call it with validatorsMu held.
+func saveValidators() error {
+	data, err := json.MarshalIndent(validators, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*dataDir, os.ModePerm); err != nil {
+		return err
+	}
+	tmp := validatorsFile() + ".tmp"
+	// Keyed by URL, which may carry tokens in its query.
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, validatorsFile())
+}
+
+// noteValidators keeps the validators of resp on download key until it
+// completes.
+func noteValidators(key string, resp *http.Response) {
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[key]; exists {
+		download.etag, download.lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	}
+	downloadsMutex.Unlock()
+}
+
+// rememberValidators stores the validators of completed download id
+// under its URL and output directory, replacing those of any earlier
+// download there. Downloads the server sent neither for are forgotten.
+func rememberValidators(id string) {
+	downloadsMutex.Lock()
+	download, exists := activeDownloads[id]
+	if !exists || download.SavedPath == "" || download.ModTime == nil {
+		downloadsMutex.Unlock()
+		return
+	}
+	url, dir := download.URL, download.OutputDir
+	path, err := filepath.Abs(savedPathOnDisk(download.SavedPath))
+	if err != nil {
+		downloadsMutex.Unlock()
+		return
+	}
+	stored := storedValidators{
+		Path:         path,
+		Size:         download.SizeOnDisk,
+		ModTime:      *download.ModTime,
+		ETag:         download.etag,
+		LastModified: download.lastModified,
+	}
+	downloadsMutex.Unlock()
+
+	validatorsMu.Lock()
+	defer validatorsMu.Unlock()
+	if stored.ETag == "" && stored.LastModified == "" {
+		if _, ok := validators[url][dir]; !ok {
+			return
+		}
+		delete(validators[url], dir)
+		if len(validators[url]) == 0 {
+			delete(validators, url)
+		}
+	} else {
+		if validators[url] == nil {
+			validators[url] = make(map[string]storedValidators)
+		}
+		validators[url][dir] = stored
+	}
+	if err := saveValidators(); err != nil {
+		log.Printf("Failed to save validators for %s: %v", url, err)
+	}
+}
+
+// previousValidators returns what was stored for download key's URL in
+// outputDir, if the file it describes is still there as it was saved.
+// A file that is missing or was changed locally has to be fetched
+// again whatever the server says.
+func previousValidators(key, outputDir string) (storedValidators, bool) {
+	downloadsMutex.Lock()
+	download, exists := activeDownloads[key]
+	url := ""
+	if exists {
+		url = download.URL
+	}
+	downloadsMutex.Unlock()
+
+	validatorsMu.Lock()
+	stored, ok := validators[url][outputDir]
+	validatorsMu.Unlock()
+	if !ok {
+		return storedValidators{}, false
+	}
+	info, err := os.Stat(stored.Path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != stored.Size || !info.ModTime().Equal(stored.ModTime) {
+		return storedValidators{}, false
+	}
+	return stored, true
+}
+
+// setConditional makes req ask for the file only if it differs from
+// stored.
+func setConditional(req *http.Request, stored storedValidators) {
+	if stored.ETag != "" {
+		req.Header.Set("If-None-Match", stored.ETag)
+	}
+	if stored.LastModified != "" {
+		req.Header.Set("If-Modified-Since", stored.LastModified)
+	}
+}
+
+// notModifiedError means the server answered 304: the file saved at path
+// by an earlier download is still current.
+type notModifiedError struct {
+	path string
+}
+
+func (e *notModifiedError) Error() string {
+	return fmt.Sprintf("%s is unchanged on the server", displayPath(e.path))
+}
+
+// markNotModified ends download id without downloading anything because
+// the file it would fetch is already saved.
+func markNotModified(id string, unchanged *notModifiedError) {
+	if err := recordSavedFile(id, unchanged.path); err != nil {
+		log.Printf("Failed to stat %s: %v", unchanged.path, err)
+	}
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[id]; exists {
+		download.Status = "not_modified"
+		download.Completed = true
+		download.Error = ""
+		clearSpeed(download)
+		download.QueuePosition = 0
+		download.EstimatedStart = nil
+	}
+	downloadsMutex.Unlock()
+	addDownloadEvent(id, "not_modified", unchanged.Error()+"; kept the saved file")
+	recordHistory(id)
+	broadcastStatus()
+}
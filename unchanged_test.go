@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSaveValidatorsPrivate(t *testing.T) {
+	const url = "https://example.com/nightly.tar.gz?token=secret"
+	stored := storedValidators{Path: "/srv/nightly.tar.gz", Size: 42, ModTime: time.Unix(1700000000, 0).UTC(), ETag: `"abc"`}
+	validatorsMu.Lock()
+	saved := validators
+	validators = map[string]map[string]storedValidators{url: {"/srv": stored}}
+	err := saveValidators()
+	validators = make(map[string]map[string]storedValidators)
+	validatorsMu.Unlock()
+	t.Cleanup(func() {
+		validatorsMu.Lock()
+		validators = saved
+		validatorsMu.Unlock()
+		os.Remove(validatorsFile())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(validatorsFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("validators.json has mode %v; want 0600", perm)
+	}
+	if err := loadValidators(); err != nil {
+		t.Fatal(err)
+	}
+	validatorsMu.Lock()
+	got := validators[url]["/srv"]
+	validatorsMu.Unlock()
+	if got != stored {
+		t.Errorf("loaded %+v; want %+v", got, stored)
+	}
+}
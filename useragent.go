@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	userAgent      = flag.String("user-agent", envUserAgent(), "User-Agent sent with every download request, also YAD_USER_AGENT")
+	defaultHeaders = make(http.Header)
+)
+
+func init() {
+	flag.Var(headerFlag{defaultHeaders}, "header", `"Name: value" header sent with every download request unless the download sets its own; repeatable`)
+}
+
+// envUserAgent is the default of -user-agent.
+func envUserAgent() string {
+	if value := os.Getenv("YAD_USER_AGENT"); value != "" {
+		return value
+	}
+	return "yad/" + version
+}
+
+// headerFlag collects repeated -header flags. Sensitive values are
+// redacted when the flag is printed.
+type headerFlag struct {
+	h http.Header
+}
+
+func (f headerFlag) String() string {
+	if f.h == nil {
+		return ""
+	}
+	return redactHeaders(f.h)
+}
+
+func (f headerFlag) Set(value string) error {
+	name, v, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("want \"Name: value\"")
+	}
+	name, v = strings.TrimSpace(name), strings.TrimSpace(v)
+	if err := checkHeaderSet(map[string]string{name: v}); err != nil {
+		return err
+	}
+	f.h.Set(name, v)
+	return nil
+}
+
+// defaultHeaderTransport adds -user-agent and the -header defaults to
+// requests that don't carry those headers already, so every request a
+// download makes, probes and resumes included, looks the same.
+type defaultHeaderTransport struct {
+	next http.RoundTripper
+}
+
+func (t defaultHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	missing := req.Header.Get("User-Agent") == "" && *userAgent != ""
+	for name := range defaultHeaders {
+		missing = missing || req.Header.Get(name) == ""
+	}
+	if !missing {
+		return t.next.RoundTrip(req)
+	}
+	out := req.Clone(req.Context())
+	if out.Header.Get("User-Agent") == "" && *userAgent != "" {
+		out.Header.Set("User-Agent", *userAgent)
+	}
+	for name, values := range defaultHeaders {
+		if out.Header.Get(name) == "" {
+			out.Header[name] = values
+		}
+	}
+	return t.next.RoundTrip(out)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var strictResume = flag.Bool("strict-resume", false, "start over instead of resuming a partial file that has no stored ETag or Last-Modified to send as If-Range")
+
+// resumeMeta is kept next to a partial file while it is being written:
+// which download it belongs to and the validators the server sent with
+// the response the file started from. Resuming sends one as If-Range, so
+// a file that changed on the server in the meantime comes back whole
+// rather than spliced onto the old version.
+type resumeMeta struct {
+	ID           string `json:"id,omitempty"`
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+func resumeMetaPath(path string) string {
+	return path + ".resume.json"
+}
+
+// saveResumeMeta records that download key is writing the file at path
+// from url, along with the validators of resp, which starts the file from
+// byte zero. resp is nil while the file is created, before the response
+// arrives.
+func saveResumeMeta(path, key, url string, resp *http.Response) error {
+	meta := resumeMeta{ID: key, URL: url}
+	if resp != nil {
+		meta.ETag, meta.LastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(resumeMetaPath(path), data, 0o644)
+}
+
+func removeResumeMeta(path string) {
+	os.Remove(resumeMetaPath(path))
+}
+
+// ownsPartial reports whether the file at path was left by download key,
+// so it may be continued or replaced. Files written before downloads were
+// recorded in the sidecar are matched by URL.
+func ownsPartial(path, key, url string) bool {
+	data, err := os.ReadFile(resumeMetaPath(path))
+	if err != nil {
+		return false
+	}
+	var meta resumeMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return false
+	}
+	if meta.ID == "" {
+		return meta.URL == url
+	}
+	return meta.ID == key
+}
+
+// ifRangeValidator returns what to send as If-Range when continuing the
+// partial file at path, or "" if nothing usable was stored for url. Weak
+// ETags can't be used for ranges, so Last-Modified is the fallback.
+func ifRangeValidator(path, url string) string {
+	data, err := os.ReadFile(resumeMetaPath(path))
+	if err != nil {
+		return ""
+	}
+	var meta resumeMeta
+	if err := json.Unmarshal(data, &meta); err != nil || meta.URL != url {
+		return ""
+	}
+	if meta.ETag != "" && !strings.HasPrefix(meta.ETag, "W/") {
+		return meta.ETag
+	}
+	return meta.LastModified
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// expectedChecksumAlgorithms are the algorithms a request may give
+// expected digests in.
+var expectedChecksumAlgorithms = []string{"sha256", "sha1", "md5"}
+
+// checkChecksums validates a request's expected checksums, keyed by URL
+// and then algorithm, lowercasing algorithms and digests. Each URL must
+// be one of the request's plain HTTP downloads.
+func checkChecksums(sums map[string]map[string]string, req DownloadRequest) error {
+	for url, byAlg := range sums {
+		if !slices.Contains(req.URLs, url) && !slices.Contains(mirrorURLs(req), url) {
+			return fmt.Errorf("checksums given for %s, which is not in urls", url)
+		}
+		if isTorrentLink(url) || req.FollowLinkNext {
+			return fmt.Errorf("checksums can only be verified for plain HTTP downloads: %s", url)
+		}
+		normalized := make(map[string]string, len(byAlg))
+		for alg, sum := range byAlg {
+			alg, sum = strings.ToLower(alg), strings.ToLower(strings.TrimSpace(sum))
+			if !slices.Contains(expectedChecksumAlgorithms, alg) {
+				return fmt.Errorf("unsupported checksum algorithm %q for %s (want sha256, sha1 or md5)", alg, url)
+			}
+			if b, err := hex.DecodeString(sum); err != nil || len(b) != newHash(alg).Size() {
+				return fmt.Errorf("%s checksum for %s must be %d hex digits", alg, url, newHash(alg).Size()*2)
+			}
+			normalized[alg] = sum
+		}
+		sums[url] = normalized
+	}
+	return nil
+}
+
+var skipChecksum = flag.Bool("skip-checksum", false, "don't compute the SHA-256 of HTTP downloads as they are written (expected checksums are still verified)")
+
+// checksummer hashes a download as the bytes are written: in SHA-256
+// for the record unless -skip-checksum is set, and in every algorithm it
+// has an expected digest in.
+type checksummer struct {
+	expected map[string]string
+	hashes   map[string]hash.Hash
+	w        io.Writer
+}
+
+// newChecksummer returns nil if there is nothing to compute.
+func newChecksummer(expected map[string]string) *checksummer {
+	algs := make(map[string]bool)
+	for alg := range expected {
+		algs[alg] = true
+	}
+	if !*skipChecksum {
+		algs["sha256"] = true
+	}
+	if len(algs) == 0 {
+		return nil
+	}
+	c := &checksummer{expected: expected, hashes: make(map[string]hash.Hash)}
+	var writers []io.Writer
+	for alg := range algs {
+		h := newHash(alg)
+		c.hashes[alg] = h
+		writers = append(writers, h)
+	}
+	c.w = io.MultiWriter(writers...)
+	return c
+}
+
+func (c *checksummer) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+// hashPrefix feeds the first n bytes of path to the hashes, as when a
+// download continues a partial file. n < 0 means the whole file.
+func (c *checksummer) hashPrefix(path string, n int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to hash %s: %v", displayPath(path), err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if n >= 0 {
+		r = io.LimitReader(f, n)
+	}
+	read, err := copyWithPool(c, r)
+	if err == nil && n >= 0 && read != n {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return fmt.Errorf("failed to hash %s: %v", displayPath(path), err)
+	}
+	return nil
+}
+
+// verify records the digests on download key's status and compares them
+// with the expected ones.
+func (c *checksummer) verify(key string) error {
+	sums := make(map[string]string, len(c.expected))
+	for alg := range c.expected {
+		sums[alg] = hex.EncodeToString(c.hashes[alg].Sum(nil))
+	}
+	downloadsMutex.Lock()
+	if download, exists := activeDownloads[key]; exists {
+		if h, ok := c.hashes["sha256"]; ok {
+			download.Checksum = hex.EncodeToString(h.Sum(nil))
+		}
+		if len(sums) > 0 {
+			download.Checksums = sums
+		}
+	}
+	downloadsMutex.Unlock()
+	if len(c.expected) == 0 {
+		return nil
+	}
+
+	algs := make([]string, 0, len(sums))
+	for alg := range sums {
+		algs = append(algs, alg)
+	}
+	sort.Strings(algs)
+	for _, alg := range algs {
+		if sums[alg] != c.expected[alg] {
+			return &downloadError{code: "checksum_mismatch", err: fmt.Errorf("%s checksum mismatch: expected %s, got %s", alg, c.expected[alg], sums[alg])}
+		}
+	}
+	addDownloadEvent(key, "checksum_verified", fmt.Sprintf("%s matched", strings.Join(algs, ", ")))
+	return nil
+}
+
+// verifyFile hashes a file that was written without passing through a
+// checksummer, removing it if it doesn't match what was expected.
+func verifyFile(key, path string, expected map[string]string) error {
+	c := newChecksummer(expected)
+	if c == nil {
+		return nil
+	}
+	status := "hashing"
+	if len(expected) > 0 {
+		status = "verifying"
+	}
+	updateDownloadStatus(key, status, false, "")
+	if err := c.hashPrefix(path, -1); err != nil {
+		return err
+	}
+	if err := c.verify(key); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,655 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxWorkers = 64
+
+	// durationSamples is how many recent job durations feed the
+	// queue wait estimate.
+	durationSamples = 20
+)
+
+// job is a single URL waiting for, or being processed by, a worker. id
+// is the key of its record in activeDownloads.
+type job struct {
+	id        string
+	url       string
+	outputDir string
+	requestID string
+	opts      downloadOptions
+
+	// Set when a worker picks the job up; cancelling it stops the
+	// transfer.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+// workerInfo describes what a single worker is doing right now.
+type workerInfo struct {
+	ID         int    `json:"id"`
+	State      string `json:"state"`
+	Download   string `json:"download,omitempty"`
+	DownloadID string `json:"downloadId,omitempty"`
+	// Host the download is talking to, counted against -max-per-host.
+	Host     string `json:"host,omitempty"`
+	retiring bool
+	current  *job
+}
+
+// dispatcher owns the shared download queue and the pool of workers
+// draining it. The pool can be resized at runtime without dropping
+// queued jobs.
+type dispatcher struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []job
+	target  int
+	nextID  int
+	workers map[int]*workerInfo
+
+	// torrentLimit caps how many workers run torrents at once; 0 means
+	// only the pool size does.
+	torrentLimit int
+
+	durations []time.Duration
+}
+
+func newDispatcher() *dispatcher {
+	d := &dispatcher{workers: make(map[int]*workerInfo)}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+func (d *dispatcher) enqueue(jobs ...job) {
+	d.mu.Lock()
+	d.queue = append(d.queue, jobs...)
+	d.mu.Unlock()
+	d.cond.Broadcast()
+}
+
+// setWorkers changes the target worker count. New workers start
+// immediately; excess workers exit once their current job is done.
+func (d *dispatcher) setWorkers(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.target = n
+
+	var active []*workerInfo
+	for _, w := range d.workers {
+		if !w.retiring {
+			active = append(active, w)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].ID < active[j].ID })
+
+	for i := len(active); i < n; i++ {
+		d.nextID++
+		w := &workerInfo{ID: d.nextID, State: "idle"}
+		d.workers[w.ID] = w
+		go d.run(w)
+	}
+	for _, w := range active[min(n, len(active)):] {
+		w.retiring = true
+	}
+	d.cond.Broadcast()
+}
+
+// setTorrentLimit changes how many torrents may run at once. Torrents
+// already running over a lowered limit carry on.
+func (d *dispatcher) setTorrentLimit(n int) {
+	d.mu.Lock()
+	d.torrentLimit = n
+	d.mu.Unlock()
+	d.cond.Broadcast()
+}
+
+func (d *dispatcher) run(w *workerInfo) {
+	for {
+		j, ok := d.next(w)
+		if !ok {
+			return
+		}
+		start := time.Now()
+		runJob(j)
+		j.cancel(nil)
+		d.mu.Lock()
+		w.State = "idle"
+		w.Download = ""
+		w.DownloadID = ""
+		w.Host = ""
+		w.current = nil
+		d.durations = append(d.durations, time.Since(start))
+		if len(d.durations) > durationSamples {
+			d.durations = d.durations[1:]
+		}
+		d.mu.Unlock()
+		// A queued torrent, or a download for the same host, may have
+		// been waiting for this slot.
+		d.cond.Broadcast()
+	}
+}
+
+// next blocks until a job is available for w, or returns false once w
+// has been retired.
+func (d *dispatcher) next(w *workerInfo) (job, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for {
+		for d.pick() < 0 && !w.retiring {
+			d.cond.Wait()
+		}
+		if w.retiring {
+			delete(d.workers, w.ID)
+			return job{}, false
+		}
+		wait := ""
+		switch {
+		case overMemoryBudget():
+			wait = "waiting (memory)"
+		case bindBlocked():
+			wait = "waiting (interface)"
+		}
+		if wait == "" {
+			break
+		}
+		w.State = wait
+		// Over the memory budget or the bound interface is down: leave
+		// the job queued and check again shortly.
+		d.mu.Unlock()
+		time.Sleep(time.Second)
+		d.mu.Lock()
+	}
+
+	i := d.pick()
+	j := d.queue[i]
+	d.queue = slices.Delete(d.queue, i, i+1)
+	j.ctx, j.cancel = context.WithCancelCause(context.Background())
+	w.State = "busy"
+	w.Download = j.url
+	w.DownloadID = j.id
+	w.Host = jobHost(j)
+	w.current = &j
+	return j, true
+}
+
+// pick returns the index of the first queued job a worker may start, or
+// -1. Torrents are passed over while the torrent limit is reached, and
+// downloads from a host while -max-per-host downloads are talking to
+// it. d.mu must be held.
+func (d *dispatcher) pick() int {
+	running := -1
+	var hosts map[string]int
+	for i, j := range d.queue {
+		if host := jobHost(j); host != "" && *maxPerHost > 0 {
+			if hosts == nil {
+				hosts = d.hostsBusy()
+			}
+			if hosts[host] >= *maxPerHost {
+				continue
+			}
+		}
+		if d.torrentLimit == 0 || !isTorrentLink(j.url) {
+			return i
+		}
+		if running < 0 {
+			running = 0
+			for _, w := range d.workers {
+				if w.current != nil && isTorrentLink(w.current.url) {
+					running++
+				}
+			}
+		}
+		if running < d.torrentLimit {
+			return i
+		}
+	}
+	return -1
+}
+
+// hostsBusy counts the running downloads talking to each host. d.mu
+// must be held.
+func (d *dispatcher) hostsBusy() map[string]int {
+	hosts := make(map[string]int)
+	for _, w := range d.workers {
+		if w.current != nil && w.Host != "" {
+			hosts[w.Host]++
+		}
+	}
+	return hosts
+}
+
+// setHost records that download id, if running, now talks to host, such
+// as after a redirect, freeing its slot on the host it started with.
+func (d *dispatcher) setHost(id, host string) {
+	d.mu.Lock()
+	changed := false
+	for _, w := range d.workers {
+		if w.current != nil && w.current.id == id && w.Host != host {
+			w.Host = host
+			changed = true
+		}
+	}
+	d.mu.Unlock()
+	if changed {
+		d.cond.Broadcast()
+	}
+}
+
+// waitIdle waits up to timeout for every worker to exit after the pool
+// has been scaled to zero. It reports whether they all did.
+func (d *dispatcher) waitIdle(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		d.mu.Lock()
+		n := len(d.workers)
+		d.mu.Unlock()
+		if n == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// find returns the job for download id and whether it is "queued" or
+// "running", or "" if there is no such job.
+func (d *dispatcher) find(id string) (job, string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, j := range d.queue {
+		if j.id == id {
+			return j, "queued"
+		}
+	}
+	for _, w := range d.workers {
+		if w.current != nil && w.current.id == id {
+			return *w.current, "running"
+		}
+	}
+	return job{}, ""
+}
+
+// cancel stops the job for download id, with cause telling the worker
+// why. It returns "queued" and the job if it was removed from the queue,
+// "running" if a worker's transfer was cancelled, or "" if there was no
+// such job.
+func (d *dispatcher) cancel(id string, cause error) (job, string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, j := range d.queue {
+		if j.id == id {
+			d.queue = append(d.queue[:i], d.queue[i+1:]...)
+			return j, "queued"
+		}
+	}
+	for _, w := range d.workers {
+		if w.current != nil && w.current.id == id {
+			w.current.cancel(cause)
+			return *w.current, "running"
+		}
+	}
+	return job{}, ""
+}
+
+// takeQueue removes and returns every queued job, plus copies of the
+// jobs workers are still running.
+func (d *dispatcher) takeQueue() (queued, running []job) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	queued = d.queue
+	d.queue = nil
+	for _, w := range d.workers {
+		if w.current != nil {
+			running = append(running, *w.current)
+		}
+	}
+	return queued, running
+}
+
+// pending returns copies of the queued jobs, in dispatch order, and of
+// the jobs workers are running.
+func (d *dispatcher) pending() (queued, running []job) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	queued = append([]job(nil), d.queue...)
+	for _, w := range d.workers {
+		if w.current != nil {
+			running = append(running, *w.current)
+		}
+	}
+	return queued, running
+}
+
+// frozen calls fn with the queue and workers while holding the
+// dispatcher's lock, so nothing is dispatched until it returns. fn must
+// not modify them.
+func (d *dispatcher) frozen(fn func(queue []job, workers map[int]*workerInfo)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fn(d.queue, d.workers)
+}
+
+// snapshot returns the target and a copy of every running worker,
+// ordered by ID.
+func (d *dispatcher) snapshot() (int, []workerInfo) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	list := make([]workerInfo, 0, len(d.workers))
+	for _, w := range d.workers {
+		info := *w
+		if w.retiring {
+			info.State = "retiring"
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return d.target, list
+}
+
+// queueEstimate returns the keys of queued jobs in dispatch order along
+// with the worker target and the average duration of recent jobs.
+func (d *dispatcher) queueEstimate() ([]string, int, time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	keys := make([]string, len(d.queue))
+	for i, j := range d.queue {
+		keys[i] = j.id
+	}
+
+	var avg time.Duration
+	if len(d.durations) > 0 {
+		var total time.Duration
+		for _, dur := range d.durations {
+			total += dur
+		}
+		avg = total / time.Duration(len(d.durations))
+	}
+	return keys, d.target, avg
+}
+
+// applyQueueEstimates fills in the queue position and estimated start of
+// every queued download. The caller must hold downloadsMutex.
+func applyQueueEstimates(queued []string, workers int, avg time.Duration) {
+	now := time.Now()
+	for i, key := range queued {
+		download, exists := activeDownloads[key]
+		if !exists || download.Status != "queued" {
+			continue
+		}
+		download.QueuePosition = i + 1
+		download.EstimatedStart = nil
+		if avg > 0 && workers > 0 {
+			// Jobs ahead of this one run workers at a time; the running
+			// ones are assumed to be half done on average.
+			wait := avg*time.Duration(i/workers) + avg/2
+			start := now.Add(wait).Round(time.Second)
+			download.EstimatedStart = &start
+		}
+	}
+}
+
+func runJob(j job) {
+	id, url := j.id, j.url
+
+	// A panic while downloading fails this one download; the worker
+	// carries on with the next job.
+	defer func() {
+		if p := recover(); p != nil {
+			workerPanics.Add(1)
+			stack := debug.Stack()
+			logWithID(j.requestID, "Recovered panic while downloading %s: %v\n%s", url, p, stack)
+			addDownloadEvent(id, "panic", fmt.Sprintf("%v\n%s", p, stack))
+			failDownload(id, "internal", fmt.Sprintf("internal error: %v", p))
+		}
+	}()
+
+	updateDownloadStatus(id, "downloading", false, "")
+	if j.opts.insecureTLS {
+		logWithID(j.requestID, "WARNING: not verifying TLS certificates for %s", url)
+		addDownloadEvent(id, "insecure_tls", "TLS certificate verification is disabled for this download")
+	}
+
+	var savedPath string
+	var err error
+	// The time limit covers the transfer, not what is done with the file
+	// afterwards.
+	ctx := j.ctx
+	if limit := j.opts.timeLimit(); limit > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(j.ctx, limit, &timedOutError{limit: limit})
+		defer cancel()
+	}
+	// Check if the URL is a magnet link or torrent file
+	isTorrent := isTorrentLink(url)
+	isHLS := isHLSLink(url) && !j.opts.hlsPlaylistOnly
+	isMetalink := isMetalinkLink(url)
+	fellBack := false
+	// Retryable failures are tried again after a backoff; an HTTP retry
+	// resumes from the bytes already written.
+	limit := j.opts.attemptLimit()
+	for attempt := 1; ; attempt++ {
+		setAttempt(id, attempt, limit)
+		if fellBack {
+			savedPath, err = downloadFile(ctx, id, j.opts.httpFallback, j.outputDir, j.opts)
+		} else if isTorrent {
+			savedPath, err = downloadTorrent(ctx, id, url, j.outputDir, j.opts)
+			var fallback *fallbackError
+			if errors.As(err, &fallback) {
+				// Same download, now over HTTP
+				logWithID(j.requestID, "Falling back to %s for %s: %v", j.opts.httpFallback, url, err)
+				markFallback(id, fallback.reason, j.opts.httpFallback)
+				isTorrent, fellBack = false, true
+				setDownloadProgress(id, 0, -1)
+				updateDownloadStatus(id, "downloading", false, "")
+				savedPath, err = downloadFile(ctx, id, j.opts.httpFallback, j.outputDir, j.opts)
+			}
+		} else if j.opts.followLinkNext {
+			savedPath, err = downloadPages(ctx, id, url, j.outputDir, j.opts)
+		} else if isMetalink {
+			if err = expandMetalink(ctx, &j); err == nil {
+				isMetalink = false
+				savedPath, err = downloadMirrors(ctx, j)
+			}
+		} else if len(j.opts.mirrors) > 0 {
+			savedPath, err = downloadMirrors(ctx, j)
+		} else if isFTPLink(url) {
+			savedPath, err = downloadFTP(ctx, id, url, j.outputDir, j.opts)
+		} else if isSFTPLink(url) {
+			savedPath, err = downloadSFTP(ctx, id, url, j.outputDir, j.opts)
+		} else if isHLS {
+			savedPath, err = downloadHLS(ctx, id, url, j.outputDir, j.opts)
+		} else {
+			savedPath, err = downloadFile(ctx, id, url, j.outputDir, j.opts)
+			var playlist *hlsPlaylistError
+			if errors.As(err, &playlist) {
+				// Same download, now as a stream
+				addDownloadEvent(id, "hls_detected", playlist.Error())
+				isHLS = true
+				savedPath, err = downloadHLS(ctx, id, url, j.outputDir, j.opts)
+			}
+			var metalink *metalinkError
+			if errors.As(err, &metalink) {
+				addDownloadEvent(id, "metalink_detected", metalink.Error())
+				if err = expandMetalink(ctx, &j); err == nil {
+					savedPath, err = downloadMirrors(ctx, j)
+				}
+			}
+		}
+		if err == nil || attempt >= limit || ctx.Err() != nil || !retryableError(err) {
+			break
+		}
+		logWithID(j.requestID, "Attempt %d of %d for %s failed: %v", attempt, limit, url, err)
+		if !awaitRetry(ctx, id, attempt, limit, err) {
+			break
+		}
+		updateDownloadStatus(id, "downloading", false, "")
+	}
+	if timedOut, ok := context.Cause(ctx).(*timedOutError); ok && err != nil && j.ctx.Err() == nil {
+		addDownloadEvent(id, "timed_out", timedOut.Error())
+		err = &downloadError{code: "timed_out", err: timedOut}
+	}
+	if j.ctx.Err() != nil {
+		if _, ok := context.Cause(j.ctx).(*pauseRequest); ok {
+			logWithID(j.requestID, "Paused %s", url)
+			finishPaused(j)
+			return
+		}
+		logWithID(j.requestID, "Cancelled %s", url)
+		req, _ := context.Cause(j.ctx).(*cancelRequest)
+		rememberStopped(j)
+		finishCancelled(id, req)
+		return
+	}
+	takePartialPath(id)
+	// The steps after saving need the file on local disk.
+	local := j.opts.destination == ""
+	if err == nil && local && j.opts.pathTemplate != "" {
+		savedPath, err = applyPathTemplate(id, j, url, savedPath)
+	}
+	var skipped *skippedError
+	if errors.As(err, &skipped) {
+		logWithID(j.requestID, "Skipped %s: %v", url, err)
+		markSkipped(id, skipped)
+		return
+	}
+	var unchanged *notModifiedError
+	if errors.As(err, &unchanged) {
+		logWithID(j.requestID, "Not modified: %s", url)
+		markNotModified(id, unchanged)
+		return
+	}
+	if err == nil && !local {
+		recordUploaded(id, savedPath)
+	}
+	if err == nil && local {
+		err = faultCorrupt(id, j.opts.fault, savedPath)
+	}
+	if err == nil && local {
+		err = recordSavedFile(id, savedPath)
+	}
+	if err == nil && local && isTorrent && !*skipTorrentHash {
+		updateDownloadStatus(id, "hashing", false, "")
+		if hashErr := hashTorrentPayload(id, savedPath, j.opts.digestAlgorithm()); hashErr != nil {
+			addDownloadEvent(id, "hash_failed", hashErr.Error())
+		}
+	}
+	if err == nil && local {
+		storeInCAS(id, url, savedPath, j.opts.digestAlgorithm())
+	}
+	if err == nil && local && len(j.opts.alsoLinkTo) > 0 {
+		linkIntoTargets(id, savedPath, j.opts.alsoLinkTo)
+	}
+	if err == nil && local {
+		queueThumbnail(id, savedPath)
+	}
+	if err == nil && local && j.opts.extract && !isTorrent && archiveFormat(savedPath) != "" {
+		updateDownloadStatus(id, "extracting", false, "")
+		if target, extractErr := extractDownload(id, url, savedPath, j.opts.deleteArchive); extractErr != nil {
+			markExtractFailed(id, extractErr)
+		} else {
+			markExtracted(id, target)
+			if j.opts.deleteArchive {
+				savedPath = target
+				err = recordSavedFile(id, target)
+			}
+		}
+	}
+	if err == nil && local && (len(onCompleteCommand) > 0 || len(j.opts.onComplete) > 0) {
+		updateDownloadStatus(id, "running_hook", false, "")
+		if hookErr := runHooks(id, j, savedPath); hookErr != nil && j.opts.strictHook {
+			err = &downloadError{code: "hook_failed", err: hookErr}
+		}
+	}
+
+	if err != nil {
+		logWithID(j.requestID, "Failed to download %s: %v", url, err)
+		code := ""
+		var derr *downloadError
+		if errors.As(err, &derr) {
+			code = derr.code
+		}
+		markBlockedHost(id, err)
+		rememberStopped(j)
+		failDownload(id, code, err.Error())
+	} else {
+		logWithID(j.requestID, "Downloaded: %s", url)
+		if local && !isTorrent {
+			rememberValidators(id)
+		}
+		updateDownloadStatus(id, completedStatus(id), true, "")
+	}
+}
+
+// isTorrentLink reports whether url is downloaded as a torrent.
+func isTorrentLink(url string) bool {
+	return strings.HasPrefix(url, "magnet:") || strings.HasSuffix(url, ".torrent")
+}
+
+// completedStatus is the terminal status of a download that finished
+// without error.
+func completedStatus(id string) string {
+	downloadsMutex.Lock()
+	defer downloadsMutex.Unlock()
+	download, exists := activeDownloads[id]
+	switch {
+	case !exists:
+		return "completed"
+	case download.Warning != "":
+		return "suspicious"
+	case download.Deduplicated:
+		return "deduplicated"
+	}
+	return "completed"
+}
+
+func handleGetWorkers(w http.ResponseWriter, r *http.Request) {
+	target, list := pool.snapshot()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"target":  target,
+		"actual":  len(list),
+		"workers": list,
+	})
+}
+
+func handleSetWorkers(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Count int `json:"count"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Count < 1 || req.Count > maxWorkers {
+		httpError(w, r, fmt.Sprintf("count must be between 1 and %d", maxWorkers), http.StatusBadRequest)
+		return
+	}
+
+	pool.setWorkers(req.Count)
+	logf(r.Context(), "Worker count set to %d", req.Count)
+	handleGetWorkers(w, r)
+}